@@ -0,0 +1,33 @@
+package account
+
+import (
+	"net/http"
+
+	"github.com/babolivier/ident/common"
+	"github.com/babolivier/ident/common/database"
+
+	"github.com/matrix-org/util"
+)
+
+type AccountResp struct {
+	UserID string `json:"user_id"`
+}
+
+func GetAccount(userID string) util.JSONResponse {
+	return util.JSONResponse{
+		Code: 200,
+		JSON: AccountResp{UserID: userID},
+	}
+}
+
+func Logout(r *http.Request, db database.Database) util.JSONResponse {
+	// The token has already been checked when authenticating the request.
+	if err := db.DeleteAccountToken(common.GetAccessToken(r)); err != nil {
+		return common.InternalServerError(err)
+	}
+
+	return util.JSONResponse{
+		Code: 200,
+		JSON: struct{}{},
+	}
+}
@@ -0,0 +1,114 @@
+package account
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/babolivier/ident/common"
+	"github.com/babolivier/ident/common/crypto"
+	"github.com/babolivier/ident/common/database"
+
+	"github.com/matrix-org/gomatrix"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+	"github.com/sirupsen/logrus"
+)
+
+const accessTokenLength = 64
+
+// RegisterReq is the OpenID token the client obtained from its homeserver.
+// c.f. https://matrix.org/docs/spec/client_server/r0.5.0#post-matrix-client-r0-user-userid-openid-request-token
+type RegisterReq struct {
+	AccessToken      string `json:"access_token"`
+	TokenType        string `json:"token_type"`
+	MatrixServerName string `json:"matrix_server_name"`
+	ExpiresIn        int64  `json:"expires_in"`
+}
+
+type RegisterResp struct {
+	Token string `json:"token"`
+}
+
+func Register(r *http.Request, db database.Database, fedClient *gomatrixserverlib.Client) util.JSONResponse {
+	// Check if we have a request body.
+	if r.Body == nil {
+		return util.JSONResponse{
+			Code: 400,
+			JSON: gomatrix.RespError{
+				ErrCode: "M_MISSING_PARAMS",
+				Err:     "Missing request body",
+			},
+		}
+	}
+
+	defer r.Body.Close()
+
+	// Load the body's JSON into an instance of RegisterReq.
+	var req RegisterReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return common.InternalServerError(err)
+	}
+
+	if resp := checkRegisterReq(&req); resp != nil {
+		return *resp
+	}
+
+	// Ask the homeserver which user the OpenID token belongs to. This also checks that the user ID belongs to this
+	// homeserver.
+	userInfo, err := fedClient.LookupUserInfo(
+		r.Context(), gomatrixserverlib.ServerName(req.MatrixServerName), req.AccessToken,
+	)
+	if err != nil {
+		logrus.WithError(err).WithField("server_name", req.MatrixServerName).Warn("Couldn't validate OpenID token")
+		return util.JSONResponse{
+			Code: 401,
+			JSON: gomatrix.RespError{
+				ErrCode: "M_UNAUTHORIZED",
+				Err:     "Couldn't validate the OpenID token with the homeserver",
+			},
+		}
+	}
+
+	// Issue an access token for this user.
+	token, err := crypto.RandString(accessTokenLength)
+	if err != nil {
+		return common.InternalServerError(err)
+	}
+
+	if err = db.SaveAccountToken(token, userInfo.Sub, common.NowMS()); err != nil {
+		return common.InternalServerError(err)
+	}
+
+	return util.JSONResponse{
+		Code: 200,
+		JSON: RegisterResp{Token: token},
+	}
+}
+
+func checkRegisterReq(req *RegisterReq) *util.JSONResponse {
+	var resp util.JSONResponse
+
+	if len(req.AccessToken) == 0 {
+		resp = common.MissingParamsError("access_token")
+		return &resp
+	}
+
+	if len(req.MatrixServerName) == 0 {
+		resp = common.MissingParamsError("matrix_server_name")
+		return &resp
+	}
+
+	if req.TokenType != "Bearer" {
+		resp = common.InvalidParamError("Unsupported token type: " + req.TokenType)
+		return &resp
+	}
+
+	if _, _, valid := gomatrixserverlib.ParseAndValidateServerName(
+		gomatrixserverlib.ServerName(req.MatrixServerName),
+	); !valid {
+		resp = common.InvalidParamError("Invalid server name")
+		return &resp
+	}
+
+	return nil
+}
@@ -0,0 +1,31 @@
+package account
+
+import (
+	"net/http"
+
+	"github.com/babolivier/ident/common"
+	"github.com/babolivier/ident/common/config"
+	"github.com/babolivier/ident/common/database"
+
+	"github.com/gorilla/mux"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+// SetupRouting registers the account management routes. These routes are only available in the v2 API.
+func SetupRouting(router *mux.Router, cfg *config.Config, db database.Database) {
+	// Client used to check OpenID tokens against the homeservers that issued them.
+	fedClient := gomatrixserverlib.NewClient()
+
+	router.Handle("/account/register", common.MakeAPI(func(r *http.Request) util.JSONResponse {
+		return Register(r, db, fedClient)
+	})).Methods(http.MethodOptions, http.MethodPost)
+
+	router.Handle("/account", common.MakeAuthAPIWithoutTerms(db, func(r *http.Request, userID string) util.JSONResponse {
+		return GetAccount(userID)
+	})).Methods(http.MethodGet)
+
+	router.Handle("/account/logout", common.MakeAuthAPIWithoutTerms(db, func(r *http.Request, userID string) util.JSONResponse {
+		return Logout(r, db)
+	})).Methods(http.MethodOptions, http.MethodPost)
+}
@@ -0,0 +1,156 @@
+package account
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/babolivier/ident/common/config"
+	"github.com/babolivier/ident/common/constants"
+	"github.com/babolivier/ident/common/database"
+	"github.com/babolivier/ident/common/testutils"
+
+	"github.com/matrix-org/gomatrix"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegister(t *testing.T) {
+	testutils.TestWithTestServerV2(t, testRegister, SetupRouting)
+}
+
+func testRegister(t *testing.T, cfg *config.Config, db database.Database, s *httptest.Server) {
+	registerURL := s.URL + path.Join(constants.APIv2Prefix, "account/register")
+	accountURL := s.URL + path.Join(constants.APIv2Prefix, "account")
+	logoutURL := s.URL + path.Join(constants.APIv2Prefix, "account/logout")
+	contentType := "application/json"
+
+	openIDToken := "someopenidtoken"
+
+	// Mock of a homeserver implementing the OpenID userinfo endpoint.
+	hs := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/_matrix/federation/v1/openid/userinfo", r.URL.Path)
+
+		if r.URL.Query().Get("access_token") != openIDToken {
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = w.Write([]byte(`{"errcode":"M_UNKNOWN_TOKEN","error":"Unknown token"}`))
+			return
+		}
+
+		_, _ = w.Write([]byte(`{"sub":"@alice:` + r.Host + `"}`))
+	}))
+	defer hs.Close()
+
+	hsName := strings.TrimPrefix(hs.URL, "https://")
+
+	var respError gomatrix.RespError
+
+	// Test that registering with an OpenID token the homeserver doesn't know results in an error.
+	req := RegisterReq{
+		AccessToken:      "wrongtoken",
+		TokenType:        "Bearer",
+		MatrixServerName: hsName,
+		ExpiresIn:        3600,
+	}
+
+	resp, err := http.Post(registerURL, contentType, structToIOReader(t, &req))
+	require.Nil(t, err, err)
+	require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	httpRespToStruct(t, resp, &respError)
+	require.Equal(t, "M_UNAUTHORIZED", respError.ErrCode)
+
+	// Test that registering with a valid OpenID token results in an access token being issued.
+	req.AccessToken = openIDToken
+
+	var registerResp RegisterResp
+	resp, err = http.Post(registerURL, contentType, structToIOReader(t, &req))
+	require.Nil(t, err, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	httpRespToStruct(t, resp, &registerResp)
+	require.NotEmpty(t, registerResp.Token)
+
+	// Test that the account endpoint can't be used without an access token.
+	resp, err = http.Get(accountURL)
+	require.Nil(t, err, err)
+	require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	httpRespToStruct(t, resp, &respError)
+	require.Equal(t, "M_UNAUTHORIZED", respError.ErrCode)
+
+	// Test that the access token identifies the right user.
+	var accountResp AccountResp
+	resp, err = doWithToken(http.MethodGet, accountURL, registerResp.Token)
+	require.Nil(t, err, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	httpRespToStruct(t, resp, &accountResp)
+	require.Equal(t, "@alice:"+hsName, accountResp.UserID)
+
+	// Test that the access token can't be used anymore after logging out.
+	resp, err = doWithToken(http.MethodPost, logoutURL, registerResp.Token)
+	require.Nil(t, err, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp, err = doWithToken(http.MethodGet, accountURL, registerResp.Token)
+	require.Nil(t, err, err)
+	require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+}
+
+func TestCheckRegisterReq(t *testing.T) {
+	req := &RegisterReq{
+		AccessToken:      "sometoken",
+		TokenType:        "Bearer",
+		MatrixServerName: "example.com",
+	}
+
+	require.Nil(t, checkRegisterReq(req))
+
+	req.TokenType = "Something"
+	resp := checkRegisterReq(req)
+	require.NotNil(t, resp)
+	require.Equal(t, "M_INVALID_PARAM", resp.JSON.(gomatrix.RespError).ErrCode)
+
+	req.MatrixServerName = ""
+	resp = checkRegisterReq(req)
+	require.NotNil(t, resp)
+	require.Equal(t, "M_MISSING_PARAMS", resp.JSON.(gomatrix.RespError).ErrCode)
+	require.Equal(t, "Missing params: matrix_server_name", resp.JSON.(gomatrix.RespError).Err)
+}
+
+func doWithToken(method, url, token string) (*http.Response, error) {
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	return http.DefaultClient.Do(req)
+}
+
+func structToIOReader(t *testing.T, req interface{}) io.Reader {
+	jsonBytes, err := json.Marshal(req)
+	require.Nil(t, err, err)
+
+	return bytes.NewReader(jsonBytes)
+}
+
+func httpRespToStruct(t *testing.T, resp *http.Response, instance interface{}) []byte {
+	require.NotNil(t, resp.Body)
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(resp.Body)
+	require.Nil(t, err, err)
+
+	err = json.Unmarshal(b, instance)
+	require.Nil(t, err, err)
+
+	return b
+}
@@ -0,0 +1,108 @@
+package associations
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/babolivier/ident/common"
+	"github.com/babolivier/ident/common/config"
+	"github.com/babolivier/ident/common/database"
+	"github.com/babolivier/ident/common/types"
+	"github.com/babolivier/ident/validation"
+
+	"github.com/matrix-org/gomatrix"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+// AssociationLifetime is the amount of time during which an association is considered valid after its creation.
+// Sydent uses 100 years, let's do the same.
+const AssociationLifetime = 100 * 365 * 24 * time.Hour
+
+type BindReq struct {
+	SID          string `json:"sid"`
+	ClientSecret string `json:"client_secret"`
+	MXID         string `json:"mxid"`
+}
+
+// Bind creates an association between the 3PID of a validated session and a MXID. If the request was authenticated
+// through the v2 API, userID is the ID of the authenticated user, which must then match the MXID. Otherwise, userID
+// is an empty string.
+func Bind(
+	r *http.Request, cfg *config.Config, db database.Database, fedClient *gomatrixserverlib.Client, userID string,
+) util.JSONResponse {
+	// Check if we have a request body.
+	if r.Body == nil {
+		return util.JSONResponse{
+			Code: 400,
+			JSON: gomatrix.RespError{
+				ErrCode: "M_MISSING_PARAMS",
+				Err:     "Missing request body",
+			},
+		}
+	}
+
+	defer r.Body.Close()
+
+	// Load the body's JSON into an instance of BindReq.
+	var req BindReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return common.InternalServerError(err)
+	}
+
+	if len(req.MXID) == 0 {
+		return common.MissingParamsError("mxid")
+	}
+
+	if _, _, err := gomatrixserverlib.SplitID('@', req.MXID); err != nil {
+		return common.InvalidParamError("Invalid user ID")
+	}
+
+	if len(userID) > 0 && userID != req.MXID {
+		return util.JSONResponse{
+			Code: 403,
+			JSON: gomatrix.RespError{
+				ErrCode: "M_FORBIDDEN",
+				Err:     "The MXID doesn't match the authenticated user",
+			},
+		}
+	}
+
+	// Check that the session exists and has been validated.
+	session, resp := validation.GetValidatedSession(req.SID, req.ClientSecret, db)
+	if resp != nil {
+		return *resp
+	}
+
+	// Create the association and save it in the database.
+	now := common.NowMS()
+	assoc := types.ThreepidAssociation{
+		Medium:    session.Medium,
+		Address:   session.Address,
+		MXID:      req.MXID,
+		NotBefore: now,
+		NotAfter:  now + int64(AssociationLifetime/time.Millisecond),
+		TS:        now,
+	}
+
+	if err := db.SaveAssociation(&assoc); err != nil {
+		return common.InternalServerError(err)
+	}
+
+	// Send the invites pending for this 3PID to the user's homeserver, if any. We do this in the background so the
+	// client doesn't have to wait for the homeserver to respond. Give it its own copy of the association so it isn't
+	// affected by the signing below.
+	pendingAssoc := assoc
+	go notifyOnBindWithRetries(cfg, db, fedClient, &pendingAssoc)
+
+	// Sign the association and send it back to the client.
+	if err := common.SignWithServerKey(cfg, &assoc); err != nil {
+		return common.InternalServerError(err)
+	}
+
+	return util.JSONResponse{
+		Code: 200,
+		JSON: assoc,
+	}
+}
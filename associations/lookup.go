@@ -0,0 +1,113 @@
+package associations
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/babolivier/ident/common"
+	"github.com/babolivier/ident/common/config"
+	"github.com/babolivier/ident/common/database"
+
+	"github.com/matrix-org/gomatrix"
+	"github.com/matrix-org/util"
+)
+
+type BulkLookupReq struct {
+	Threepids [][]string `json:"threepids"`
+}
+
+type BulkLookupResp struct {
+	Threepids [][]string `json:"threepids"`
+}
+
+func Lookup(r *http.Request, cfg *config.Config, db database.Database) util.JSONResponse {
+	query := r.URL.Query()
+
+	medium := query.Get("medium")
+	if len(medium) == 0 {
+		return common.MissingParamsError("medium")
+	}
+
+	address := query.Get("address")
+	if len(address) == 0 {
+		return common.MissingParamsError("address")
+	}
+
+	assoc, err := db.GetAssociation(medium, address)
+	if err != nil {
+		return common.InternalServerError(err)
+	}
+
+	// The specification says that we must respond with an empty object if no association could be found.
+	if assoc == nil || !isAssociationCurrent(assoc.NotBefore, assoc.NotAfter) {
+		return util.JSONResponse{
+			Code: 200,
+			JSON: struct{}{},
+		}
+	}
+
+	if err = common.SignWithServerKey(cfg, assoc); err != nil {
+		return common.InternalServerError(err)
+	}
+
+	return util.JSONResponse{
+		Code: 200,
+		JSON: assoc,
+	}
+}
+
+func BulkLookup(r *http.Request, db database.Database) util.JSONResponse {
+	// Check if we have a request body.
+	if r.Body == nil {
+		return util.JSONResponse{
+			Code: 400,
+			JSON: gomatrix.RespError{
+				ErrCode: "M_MISSING_PARAMS",
+				Err:     "Missing request body",
+			},
+		}
+	}
+
+	defer r.Body.Close()
+
+	// Load the body's JSON into an instance of BulkLookupReq.
+	var req BulkLookupReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return common.InternalServerError(err)
+	}
+
+	if req.Threepids == nil {
+		return common.MissingParamsError("threepids")
+	}
+
+	resp := BulkLookupResp{
+		Threepids: make([][]string, 0),
+	}
+
+	for _, threepid := range req.Threepids {
+		// Each 3PID must be a [medium, address] pair.
+		if len(threepid) != 2 {
+			return common.InvalidParamError("Each 3PID must be a list of exactly two elements: medium and address")
+		}
+
+		assoc, err := db.GetAssociation(threepid[0], threepid[1])
+		if err != nil {
+			return common.InternalServerError(err)
+		}
+
+		// Only include the 3PIDs we know about in the response.
+		if assoc != nil && isAssociationCurrent(assoc.NotBefore, assoc.NotAfter) {
+			resp.Threepids = append(resp.Threepids, []string{assoc.Medium, assoc.Address, assoc.MXID})
+		}
+	}
+
+	return util.JSONResponse{
+		Code: 200,
+		JSON: resp,
+	}
+}
+
+func isAssociationCurrent(notBefore, notAfter int64) bool {
+	now := common.NowMS()
+	return notBefore <= now && now <= notAfter
+}
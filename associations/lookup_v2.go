@@ -0,0 +1,150 @@
+package associations
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/babolivier/ident/common"
+	"github.com/babolivier/ident/common/database"
+	"github.com/babolivier/ident/common/hashing"
+	"github.com/babolivier/ident/common/types"
+
+	"github.com/matrix-org/gomatrix"
+	"github.com/matrix-org/util"
+)
+
+var supportedAlgorithms = []string{hashing.AlgorithmNone, hashing.AlgorithmSHA256}
+
+type HashDetailsResp struct {
+	Algorithms   []string `json:"algorithms"`
+	LookupPepper string   `json:"lookup_pepper"`
+}
+
+type LookupV2Req struct {
+	Addresses []string `json:"addresses"`
+	Algorithm string   `json:"algorithm"`
+	Pepper    string   `json:"pepper"`
+}
+
+type LookupV2Resp struct {
+	Mappings map[string]string `json:"mappings"`
+}
+
+// invalidPepperError is the content of the error the specification says we must send back to the client if the
+// pepper provided in the request isn't the current one.
+// c.f. https://matrix.org/docs/spec/identity_service/r0.3.0#post-matrix-identity-v2-lookup
+type invalidPepperError struct {
+	gomatrix.RespError
+	Algorithm    string `json:"algorithm"`
+	LookupPepper string `json:"lookup_pepper"`
+}
+
+func HashDetails(db database.Database) util.JSONResponse {
+	pepper, err := db.GetLookupPepper()
+	if err != nil {
+		return common.InternalServerError(err)
+	}
+
+	return util.JSONResponse{
+		Code: 200,
+		JSON: HashDetailsResp{
+			Algorithms:   supportedAlgorithms,
+			LookupPepper: pepper,
+		},
+	}
+}
+
+func LookupV2(r *http.Request, db database.Database) util.JSONResponse {
+	// Check if we have a request body.
+	if r.Body == nil {
+		return util.JSONResponse{
+			Code: 400,
+			JSON: gomatrix.RespError{
+				ErrCode: "M_MISSING_PARAMS",
+				Err:     "Missing request body",
+			},
+		}
+	}
+
+	defer r.Body.Close()
+
+	// Load the body's JSON into an instance of LookupV2Req.
+	var req LookupV2Req
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return common.InternalServerError(err)
+	}
+
+	if req.Addresses == nil {
+		return common.MissingParamsError("addresses")
+	}
+
+	if !isAlgorithmSupported(req.Algorithm) {
+		return common.InvalidParamError("Unsupported algorithm: " + req.Algorithm)
+	}
+
+	pepper, err := db.GetLookupPepper()
+	if err != nil {
+		return common.InternalServerError(err)
+	}
+
+	if req.Pepper != pepper {
+		return util.JSONResponse{
+			Code: 400,
+			JSON: invalidPepperError{
+				RespError: gomatrix.RespError{
+					ErrCode: "M_INVALID_PEPPER",
+					Err:     "Unknown or invalid pepper - has it been rotated?",
+				},
+				Algorithm:    hashing.AlgorithmSHA256,
+				LookupPepper: pepper,
+			},
+		}
+	}
+
+	resp := LookupV2Resp{
+		Mappings: make(map[string]string),
+	}
+
+	for _, address := range req.Addresses {
+		var assoc *types.ThreepidAssociation
+
+		switch req.Algorithm {
+		case hashing.AlgorithmSHA256:
+			assoc, err = db.GetAssociationByLookupHash(address)
+		case hashing.AlgorithmNone:
+			// With this algorithm, each address is in the form "address medium". Addresses can't contain spaces,
+			// but let's split on the last one anyway to be safe.
+			i := strings.LastIndex(address, " ")
+			if i < 0 {
+				return common.InvalidParamError("Addresses must be in the form \"address medium\"")
+			}
+
+			assoc, err = db.GetAssociation(address[i+1:], address[:i])
+		}
+
+		if err != nil {
+			return common.InternalServerError(err)
+		}
+
+		// Only include the 3PIDs we know about in the response.
+		if assoc != nil && isAssociationCurrent(assoc.NotBefore, assoc.NotAfter) {
+			resp.Mappings[address] = assoc.MXID
+		}
+	}
+
+	return util.JSONResponse{
+		Code: 200,
+		JSON: resp,
+	}
+}
+
+func isAlgorithmSupported(algorithm string) bool {
+	for _, supported := range supportedAlgorithms {
+		if algorithm == supported {
+			return true
+		}
+	}
+
+	return false
+}
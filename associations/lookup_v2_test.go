@@ -0,0 +1,139 @@
+package associations
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"testing"
+
+	"github.com/babolivier/ident/common/config"
+	"github.com/babolivier/ident/common/constants"
+	"github.com/babolivier/ident/common/database"
+	"github.com/babolivier/ident/common/hashing"
+	"github.com/babolivier/ident/common/testutils"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLookupV2(t *testing.T) {
+	testutils.TestWithTestServerV2(t, testLookupV2, SetupRoutingV2)
+}
+
+func testLookupV2(t *testing.T, cfg *config.Config, db database.Database, s *httptest.Server) {
+	token := testutils.NewTestAccessToken(t, cfg, db, "@bob:example.com")
+	hashDetailsURL := s.URL + path.Join(constants.APIv2Prefix, "hash_details") + "?access_token=" + token
+	lookupURL := s.URL + path.Join(constants.APIv2Prefix, "lookup") + "?access_token=" + token
+	contentType := "application/json"
+
+	saved := saveTestAssociation(t, db)
+
+	// Test that the hash details include the supported algorithms and the current pepper.
+	resp, err := http.Get(hashDetailsURL)
+	require.Nil(t, err, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var hashDetails HashDetailsResp
+	httpRespToStruct(t, resp, &hashDetails)
+	require.ElementsMatch(t, []string{hashing.AlgorithmSHA256, hashing.AlgorithmNone}, hashDetails.Algorithms)
+	require.NotEmpty(t, hashDetails.LookupPepper)
+
+	// Test that looking up a hashed 3PID returns the associated MXID.
+	savedHash := hashing.LookupHash(saved.Medium, saved.Address, hashDetails.LookupPepper)
+	unknownHash := hashing.LookupHash(saved.Medium, "bob@example.com", hashDetails.LookupPepper)
+
+	req := LookupV2Req{
+		Addresses: []string{savedHash, unknownHash},
+		Algorithm: hashing.AlgorithmSHA256,
+		Pepper:    hashDetails.LookupPepper,
+	}
+
+	resp, err = http.Post(lookupURL, contentType, structToIOReader(t, &req))
+	require.Nil(t, err, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var lookupResp LookupV2Resp
+	httpRespToStruct(t, resp, &lookupResp)
+	require.Equal(t, map[string]string{savedHash: saved.MXID}, lookupResp.Mappings)
+
+	// Test that looking up a plain text 3PID returns the associated MXID.
+	req = LookupV2Req{
+		Addresses: []string{saved.Address + " " + saved.Medium},
+		Algorithm: hashing.AlgorithmNone,
+		Pepper:    hashDetails.LookupPepper,
+	}
+
+	resp, err = http.Post(lookupURL, contentType, structToIOReader(t, &req))
+	require.Nil(t, err, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	lookupResp = LookupV2Resp{}
+	httpRespToStruct(t, resp, &lookupResp)
+	require.Equal(t, map[string]string{saved.Address + " " + saved.Medium: saved.MXID}, lookupResp.Mappings)
+
+	// Test that using an unsupported algorithm results in an error.
+	req.Algorithm = "md5"
+
+	resp, err = http.Post(lookupURL, contentType, structToIOReader(t, &req))
+	require.Nil(t, err, err)
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	// Test that the algorithm is checked even if there's no address to look up.
+	req.Addresses = []string{}
+
+	resp, err = http.Post(lookupURL, contentType, structToIOReader(t, &req))
+	require.Nil(t, err, err)
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	var algorithmErr map[string]string
+	b := httpRespToStruct(t, resp, &algorithmErr)
+	require.Equal(t, "M_INVALID_PARAM", algorithmErr["errcode"], string(b))
+
+	// Test that, once the pepper has been rotated, using the old pepper results in an error that includes the new
+	// pepper, and the hashes computed with the new pepper match.
+	newPepper, err := db.RotateLookupPepper()
+	require.Nil(t, err, err)
+
+	req = LookupV2Req{
+		Addresses: []string{savedHash},
+		Algorithm: hashing.AlgorithmSHA256,
+		Pepper:    hashDetails.LookupPepper,
+	}
+
+	resp, err = http.Post(lookupURL, contentType, structToIOReader(t, &req))
+	require.Nil(t, err, err)
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	var pepperErr map[string]string
+	b = httpRespToStruct(t, resp, &pepperErr)
+	require.Equal(t, "M_INVALID_PEPPER", pepperErr["errcode"], string(b))
+	require.Equal(t, newPepper, pepperErr["lookup_pepper"])
+	require.Equal(t, hashing.AlgorithmSHA256, pepperErr["algorithm"])
+
+	newHash := hashing.LookupHash(saved.Medium, saved.Address, newPepper)
+	req = LookupV2Req{
+		Addresses: []string{newHash},
+		Algorithm: hashing.AlgorithmSHA256,
+		Pepper:    newPepper,
+	}
+
+	resp, err = http.Post(lookupURL, contentType, structToIOReader(t, &req))
+	require.Nil(t, err, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	lookupResp = LookupV2Resp{}
+	httpRespToStruct(t, resp, &lookupResp)
+	require.Equal(t, map[string]string{newHash: saved.MXID}, lookupResp.Mappings)
+}
+
+func TestInvalidPepperErrorJSON(t *testing.T) {
+	// Make sure the error's fields are all at the top level of the JSON object.
+	b, err := json.Marshal(invalidPepperError{Algorithm: "sha256", LookupPepper: "pepper"})
+	require.Nil(t, err, err)
+
+	var m map[string]interface{}
+	err = json.Unmarshal(b, &m)
+	require.Nil(t, err, err)
+	require.Contains(t, m, "errcode")
+	require.Contains(t, m, "lookup_pepper")
+}
@@ -0,0 +1,177 @@
+package associations
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/babolivier/ident/common"
+	"github.com/babolivier/ident/common/config"
+	"github.com/babolivier/ident/common/constants"
+	"github.com/babolivier/ident/common/database"
+	"github.com/babolivier/ident/common/types"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// Maximum number of attempts at sending pending invites to a homeserver after a bind, and the delay to wait for
+// before the first retry (which then doubles after each failed attempt).
+const (
+	onBindMaxAttempts  = 5
+	onBindInitialDelay = 5 * time.Second
+)
+
+type OnBindReq struct {
+	Medium  string         `json:"medium"`
+	Address string         `json:"address"`
+	MXID    string         `json:"mxid"`
+	Invites []OnBindInvite `json:"invites"`
+}
+
+type OnBindInvite struct {
+	Medium  string       `json:"medium"`
+	Address string       `json:"address"`
+	MXID    string       `json:"mxid"`
+	RoomID  string       `json:"room_id"`
+	Sender  string       `json:"sender"`
+	Signed  SignedInvite `json:"signed"`
+}
+
+type SignedInvite struct {
+	MXID       string      `json:"mxid"`
+	Token      string      `json:"token"`
+	Signatures interface{} `json:"signatures,omitempty"`
+}
+
+// notifyOnBindWithRetries calls notifyOnBind and retries with an exponential backoff if it failed. It is meant to be
+// run in a goroutine so that the bind request doesn't have to wait for the homeserver to respond.
+func notifyOnBindWithRetries(
+	cfg *config.Config, db database.Database, client *gomatrixserverlib.Client, assoc *types.ThreepidAssociation,
+) {
+	logger := logrus.WithField("mxid", assoc.MXID)
+	delay := onBindInitialDelay
+
+	for attempt := 1; attempt <= onBindMaxAttempts; attempt++ {
+		err := notifyOnBind(context.Background(), cfg, db, client, assoc)
+		if err == nil {
+			return
+		}
+
+		logger.WithError(err).WithField("attempt", attempt).Warn("Couldn't send pending invites to the homeserver")
+
+		if attempt < onBindMaxAttempts {
+			time.Sleep(delay)
+			delay *= 2
+		}
+	}
+
+	logger.Error("Giving up on sending pending invites to the homeserver")
+}
+
+// notifyOnBind looks up the pending invites for the 3PID of the given association, signs them and sends them to the
+// homeserver of the user the 3PID has been bound to. The invites are only marked as delivered once the homeserver has
+// accepted them.
+func notifyOnBind(
+	ctx context.Context, cfg *config.Config, db database.Database, client *gomatrixserverlib.Client,
+	assoc *types.ThreepidAssociation,
+) error {
+	allInvites, err := db.Get3PIDInvitesForAddress(assoc.Medium, assoc.Address)
+	if err != nil {
+		return errors.Wrap(err, "Couldn't retrieve the pending invites")
+	}
+
+	// Leave out the invites that have been revoked, delivered already, or claimed by another user.
+	invites := make([]*types.ThreepidInvite, 0, len(allInvites))
+	for _, invite := range allInvites {
+		signedForMXID := invite.State == constants.InviteStateSigned && invite.SignedFor == assoc.MXID
+		if invite.State == constants.InviteStatePending || signedForMXID {
+			invites = append(invites, invite)
+		}
+	}
+
+	// Don't bother the homeserver if there's nothing to send.
+	if len(invites) == 0 {
+		return nil
+	}
+
+	req, err := buildOnBindReq(cfg, assoc, invites)
+	if err != nil {
+		return errors.Wrap(err, "Couldn't build the onbind request")
+	}
+
+	_, serverName, err := gomatrixserverlib.SplitID('@', assoc.MXID)
+	if err != nil {
+		return err
+	}
+
+	reqBytes, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	u := url.URL{
+		Scheme: "matrix",
+		Host:   string(serverName),
+		Path:   "/_matrix/federation/v1/3pid/onbind",
+	}
+
+	httpReq, err := http.NewRequest(http.MethodPost, u.String(), bytes.NewReader(reqBytes))
+	if err != nil {
+		return err
+	}
+
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	// The homeserver responds with an empty JSON object, which we don't care about.
+	var resp struct{}
+	if err = client.DoRequestAndParseResponse(ctx, httpReq, &resp); err != nil {
+		return errors.Wrap(err, "The homeserver didn't accept the invites")
+	}
+
+	now := common.NowMS()
+	for _, invite := range invites {
+		if _, err = db.Mark3PIDInviteDelivered(invite.Token, assoc.MXID, now); err != nil {
+			return errors.Wrap(err, "Couldn't mark an invite as delivered")
+		}
+	}
+
+	return nil
+}
+
+func buildOnBindReq(
+	cfg *config.Config, assoc *types.ThreepidAssociation, invites []*types.ThreepidInvite,
+) (*OnBindReq, error) {
+	req := OnBindReq{
+		Medium:  assoc.Medium,
+		Address: assoc.Address,
+		MXID:    assoc.MXID,
+		Invites: make([]OnBindInvite, len(invites)),
+	}
+
+	for i, invite := range invites {
+		signed := SignedInvite{
+			MXID:  assoc.MXID,
+			Token: invite.Token,
+		}
+
+		if err := common.SignWithServerKey(cfg, &signed); err != nil {
+			return nil, err
+		}
+
+		req.Invites[i] = OnBindInvite{
+			Medium:  invite.Medium,
+			Address: invite.Address,
+			MXID:    assoc.MXID,
+			RoomID:  invite.RoomID,
+			Sender:  invite.Sender,
+			Signed:  signed,
+		}
+	}
+
+	return &req, nil
+}
@@ -0,0 +1,134 @@
+package associations
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/babolivier/ident/common/constants"
+	"github.com/babolivier/ident/common/testutils"
+	"github.com/babolivier/ident/common/types"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNotifyOnBind(t *testing.T) {
+	cfg := testutils.NewTestConfig(t)
+	db := testutils.NewTestDB(t)
+
+	var received *OnBindReq
+	fail := true
+
+	// Mock of a homeserver implementing the onbind endpoint.
+	hs := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/_matrix/federation/v1/3pid/onbind", r.URL.Path)
+
+		if fail {
+			w.WriteHeader(http.StatusInternalServerError)
+			_, _ = w.Write([]byte(`{"errcode":"M_UNKNOWN","error":"Something went wrong"}`))
+			return
+		}
+
+		received = new(OnBindReq)
+		err := json.NewDecoder(r.Body).Decode(received)
+		require.Nil(t, err, err)
+
+		_, _ = w.Write([]byte("{}"))
+	}))
+	defer hs.Close()
+
+	serverName := strings.TrimPrefix(hs.URL, "https://")
+
+	invite := &types.ThreepidInvite{
+		Token:   "sometoken",
+		Medium:  constants.MediumEmail,
+		Address: "alice@example.com",
+		RoomID:  "!someroom:example.com",
+		Sender:  "@bob:example.com",
+	}
+	err := db.Save3PIDInvite(invite)
+	require.Nil(t, err, err)
+
+	assoc := &types.ThreepidAssociation{
+		Medium:  invite.Medium,
+		Address: invite.Address,
+		MXID:    "@alice:" + serverName,
+	}
+
+	client := gomatrixserverlib.NewClient()
+
+	// Test that the invites are kept if the homeserver didn't accept them.
+	err = notifyOnBind(context.Background(), cfg, db, client, assoc)
+	require.NotNil(t, err)
+
+	invites, err := db.Get3PIDInvitesForAddress(invite.Medium, invite.Address)
+	require.Nil(t, err, err)
+	require.Len(t, invites, 1)
+
+	// Add invites that mustn't be sent: one claimed by another user, and a revoked one.
+	for _, token := range []string{"someclaimedtoken", "somerevokedtoken"} {
+		err = db.Save3PIDInvite(&types.ThreepidInvite{
+			Token:   token,
+			Medium:  invite.Medium,
+			Address: invite.Address,
+			RoomID:  invite.RoomID,
+			Sender:  invite.Sender,
+		})
+		require.Nil(t, err, err)
+	}
+
+	claimed, err := db.Sign3PIDInvite("someclaimedtoken", "@carol:example.com", 1000)
+	require.Nil(t, err, err)
+	require.True(t, claimed)
+
+	revoked, err := db.Revoke3PIDInvite("somerevokedtoken", 1000)
+	require.Nil(t, err, err)
+	require.True(t, revoked)
+
+	// Test that the invites are sent correctly signed and then marked as delivered if the homeserver accepted them.
+	fail = false
+
+	err = notifyOnBind(context.Background(), cfg, db, client, assoc)
+	require.Nil(t, err, err)
+
+	require.NotNil(t, received)
+	require.Equal(t, assoc.MXID, received.MXID)
+	require.Equal(t, assoc.Medium, received.Medium)
+	require.Equal(t, assoc.Address, received.Address)
+	require.Len(t, received.Invites, 1)
+
+	receivedInvite := received.Invites[0]
+	require.Equal(t, assoc.MXID, receivedInvite.MXID)
+	require.Equal(t, invite.RoomID, receivedInvite.RoomID)
+	require.Equal(t, invite.Sender, receivedInvite.Sender)
+	require.Equal(t, assoc.MXID, receivedInvite.Signed.MXID)
+	require.Equal(t, invite.Token, receivedInvite.Signed.Token)
+
+	signedBytes, err := json.Marshal(receivedInvite.Signed)
+	require.Nil(t, err, err)
+
+	// If err is nil, then the signature is correct.
+	err = gomatrixserverlib.VerifyJSON(
+		cfg.Ident.ServerName,
+		gomatrixserverlib.KeyID(cfg.Ident.SigningKey.Algo+":"+cfg.Ident.SigningKey.ID),
+		cfg.Ident.SigningKey.PubKey,
+		signedBytes,
+	)
+	require.Nil(t, err, err)
+
+	delivered, err := db.Get3PIDInviteByToken(invite.Token)
+	require.Nil(t, err, err)
+	require.Equal(t, constants.InviteStateDelivered, delivered.State)
+	require.Equal(t, assoc.MXID, delivered.SignedFor)
+
+	// Test that delivered invites aren't sent again.
+	received = nil
+
+	err = notifyOnBind(context.Background(), cfg, db, client, assoc)
+	require.Nil(t, err, err)
+	require.Nil(t, received)
+}
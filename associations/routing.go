@@ -0,0 +1,60 @@
+package associations
+
+import (
+	"net/http"
+
+	"github.com/babolivier/ident/common"
+	"github.com/babolivier/ident/common/config"
+	"github.com/babolivier/ident/common/database"
+
+	"github.com/gorilla/mux"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+func SetupRouting(router *mux.Router, cfg *config.Config, db database.Database) {
+	// Client used to send pending invites to homeservers when a 3PID is bound, and to fetch the keys of homeservers
+	// to check the signatures of unbind requests.
+	fedClient := gomatrixserverlib.NewClient()
+	keyRing := common.NewKeyRing(fedClient)
+
+	router.Handle("/3pid/bind", common.MakeAPI(func(r *http.Request) util.JSONResponse {
+		return Bind(r, cfg, db, fedClient, "")
+	})).Methods(http.MethodOptions, http.MethodPost)
+
+	router.Handle("/3pid/unbind", common.MakeAPI(func(r *http.Request) util.JSONResponse {
+		return Unbind(r, cfg, db, keyRing)
+	})).Methods(http.MethodOptions, http.MethodPost)
+
+	router.Handle("/lookup", common.MakeAPI(func(r *http.Request) util.JSONResponse {
+		return Lookup(r, cfg, db)
+	})).Methods(http.MethodGet)
+
+	router.Handle("/bulk_lookup", common.MakeAPI(func(r *http.Request) util.JSONResponse {
+		return BulkLookup(r, db)
+	})).Methods(http.MethodOptions, http.MethodPost)
+}
+
+// SetupRoutingV2 registers the routes of the v2 API for managing associations. Binding requires the request to be
+// authenticated, but unbinding doesn't since the requests are authenticated either with a validation session or with
+// the signature of the user's homeserver. Lookups in the v2 API use hashes of the 3PIDs instead of the 3PIDs.
+func SetupRoutingV2(router *mux.Router, cfg *config.Config, db database.Database) {
+	fedClient := gomatrixserverlib.NewClient()
+	keyRing := common.NewKeyRing(fedClient)
+
+	router.Handle("/3pid/bind", common.MakeAuthAPI(cfg, db, func(r *http.Request, userID string) util.JSONResponse {
+		return Bind(r, cfg, db, fedClient, userID)
+	})).Methods(http.MethodOptions, http.MethodPost)
+
+	router.Handle("/3pid/unbind", common.MakeAPI(func(r *http.Request) util.JSONResponse {
+		return Unbind(r, cfg, db, keyRing)
+	})).Methods(http.MethodOptions, http.MethodPost)
+
+	router.Handle("/hash_details", common.MakeAuthAPI(cfg, db, func(r *http.Request, userID string) util.JSONResponse {
+		return HashDetails(db)
+	})).Methods(http.MethodGet)
+
+	router.Handle("/lookup", common.MakeAuthAPI(cfg, db, func(r *http.Request, userID string) util.JSONResponse {
+		return LookupV2(r, db)
+	})).Methods(http.MethodOptions, http.MethodPost)
+}
@@ -0,0 +1,276 @@
+package associations
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"testing"
+
+	"github.com/babolivier/ident/common"
+	"github.com/babolivier/ident/common/config"
+	"github.com/babolivier/ident/common/constants"
+	"github.com/babolivier/ident/common/database"
+	"github.com/babolivier/ident/common/testutils"
+	"github.com/babolivier/ident/common/types"
+
+	"github.com/matrix-org/gomatrix"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBind(t *testing.T) {
+	testutils.TestWithTestServer(t, testBind, SetupRouting)
+}
+
+func testBind(t *testing.T, cfg *config.Config, db database.Database, s *httptest.Server) {
+	url := s.URL + path.Join(constants.APIPrefix, "3pid/bind")
+	contentType := "application/json"
+
+	session := &types.ValidationSession{
+		ID:           "somesid",
+		Medium:       constants.MediumEmail,
+		Address:      "alice@example.com",
+		ClientSecret: "somesecret",
+		Token:        "sometoken",
+		SendAttempt:  1,
+		CreatedAt:    common.NowMS(),
+	}
+	err := db.SaveValidationSession(session)
+	require.Nil(t, err, err)
+
+	var respError gomatrix.RespError
+
+	// Test that a request with an invalid MXID results in an error.
+	req := BindReq{
+		SID:          session.ID,
+		ClientSecret: session.ClientSecret,
+		MXID:         "alice:example.com",
+	}
+
+	resp, err := http.Post(url, contentType, structToIOReader(t, &req))
+	require.Nil(t, err, err)
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	httpRespToStruct(t, resp, &respError)
+	require.Equal(t, "M_INVALID_PARAM", respError.ErrCode)
+
+	// Test that binding with a session that hasn't been validated results in an error.
+	req.MXID = "@alice:example.com"
+
+	resp, err = http.Post(url, contentType, structToIOReader(t, &req))
+	require.Nil(t, err, err)
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	httpRespToStruct(t, resp, &respError)
+	require.Equal(t, "M_SESSION_NOT_VALIDATED", respError.ErrCode)
+
+	// Test that binding with a validated session results in a signed association.
+	err = db.MarkValidationSessionValidated(session.ID, common.NowMS())
+	require.Nil(t, err, err)
+
+	var assoc types.ThreepidAssociation
+	resp, err = http.Post(url, contentType, structToIOReader(t, &req))
+	require.Nil(t, err, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	b := httpRespToStruct(t, resp, &assoc)
+	require.Equal(t, session.Medium, assoc.Medium)
+	require.Equal(t, session.Address, assoc.Address)
+	require.Equal(t, req.MXID, assoc.MXID)
+	require.True(t, assoc.NotBefore <= assoc.TS)
+	require.True(t, assoc.NotAfter > assoc.TS)
+
+	// If err is nil, then the signature is correct.
+	err = gomatrixserverlib.VerifyJSON(
+		cfg.Ident.ServerName,
+		gomatrixserverlib.KeyID(cfg.Ident.SigningKey.Algo+":"+cfg.Ident.SigningKey.ID),
+		cfg.Ident.SigningKey.PubKey,
+		b,
+	)
+	require.Nil(t, err, err)
+
+	// Test that the association has been saved in the database.
+	saved, err := db.GetAssociation(session.Medium, session.Address)
+	require.Nil(t, err, err)
+	require.NotNil(t, saved)
+	require.Equal(t, req.MXID, saved.MXID)
+}
+
+func TestBindV2(t *testing.T) {
+	testutils.TestWithTestServerV2(t, testBindV2, SetupRoutingV2)
+}
+
+func testBindV2(t *testing.T, cfg *config.Config, db database.Database, s *httptest.Server) {
+	url := s.URL + path.Join(constants.APIv2Prefix, "3pid/bind")
+	contentType := "application/json"
+
+	session := &types.ValidationSession{
+		ID:           "somesid",
+		Medium:       constants.MediumEmail,
+		Address:      "alice@example.com",
+		ClientSecret: "somesecret",
+		Token:        "sometoken",
+		SendAttempt:  1,
+		CreatedAt:    common.NowMS(),
+		ValidatedAt:  common.NowMS(),
+	}
+	err := db.SaveValidationSession(session)
+	require.Nil(t, err, err)
+
+	req := BindReq{
+		SID:          session.ID,
+		ClientSecret: session.ClientSecret,
+		MXID:         "@alice:example.com",
+	}
+
+	// Test that binding without an access token results in an error.
+	resp, err := http.Post(url, contentType, structToIOReader(t, &req))
+	require.Nil(t, err, err)
+	require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	// Test that binding a 3PID to another user than the authenticated one results in an error.
+	token := testutils.NewTestAccessToken(t, cfg, db, "@bob:example.com")
+
+	resp, err = http.Post(url+"?access_token="+token, contentType, structToIOReader(t, &req))
+	require.Nil(t, err, err)
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	var respError gomatrix.RespError
+	httpRespToStruct(t, resp, &respError)
+	require.Equal(t, "M_FORBIDDEN", respError.ErrCode)
+
+	// Test that binding a 3PID to the authenticated user works.
+	token = testutils.NewTestAccessToken(t, cfg, db, req.MXID)
+
+	resp, err = http.Post(url+"?access_token="+token, contentType, structToIOReader(t, &req))
+	require.Nil(t, err, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestLookup(t *testing.T) {
+	testutils.TestWithTestServer(t, testLookup, SetupRouting)
+}
+
+func testLookup(t *testing.T, cfg *config.Config, db database.Database, s *httptest.Server) {
+	lookupURL := s.URL + path.Join(constants.APIPrefix, "lookup")
+
+	saved := saveTestAssociation(t, db)
+
+	// Test that looking up a 3PID without association results in an empty object.
+	resp, err := http.Get(lookupURL + "?medium=email&address=bob%40example.com")
+	require.Nil(t, err, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var empty map[string]interface{}
+	httpRespToStruct(t, resp, &empty)
+	require.Len(t, empty, 0)
+
+	// Test that looking up a 3PID with an association results in the signed association.
+	resp, err = http.Get(lookupURL + "?medium=email&address=alice%40example.com")
+	require.Nil(t, err, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var assoc types.ThreepidAssociation
+	b := httpRespToStruct(t, resp, &assoc)
+	require.Equal(t, saved.MXID, assoc.MXID)
+	require.Equal(t, saved.Address, assoc.Address)
+	require.Equal(t, saved.Medium, assoc.Medium)
+
+	// If err is nil, then the signature is correct.
+	err = gomatrixserverlib.VerifyJSON(
+		cfg.Ident.ServerName,
+		gomatrixserverlib.KeyID(cfg.Ident.SigningKey.Algo+":"+cfg.Ident.SigningKey.ID),
+		cfg.Ident.SigningKey.PubKey,
+		b,
+	)
+	require.Nil(t, err, err)
+
+	// Test that a request with a missing parameter results in an error.
+	resp, err = http.Get(lookupURL + "?medium=email")
+	require.Nil(t, err, err)
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	var respError gomatrix.RespError
+	httpRespToStruct(t, resp, &respError)
+	require.Equal(t, "M_MISSING_PARAMS", respError.ErrCode)
+	require.Equal(t, "Missing params: address", respError.Err)
+}
+
+func TestBulkLookup(t *testing.T) {
+	testutils.TestWithTestServer(t, testBulkLookup, SetupRouting)
+}
+
+func testBulkLookup(t *testing.T, cfg *config.Config, db database.Database, s *httptest.Server) {
+	url := s.URL + path.Join(constants.APIPrefix, "bulk_lookup")
+	contentType := "application/json"
+
+	saved := saveTestAssociation(t, db)
+
+	// Test that only the known 3PIDs are included in the response.
+	req := BulkLookupReq{
+		Threepids: [][]string{
+			{constants.MediumEmail, saved.Address},
+			{constants.MediumEmail, "bob@example.com"},
+		},
+	}
+
+	resp, err := http.Post(url, contentType, structToIOReader(t, &req))
+	require.Nil(t, err, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var bulkLookupResp BulkLookupResp
+	httpRespToStruct(t, resp, &bulkLookupResp)
+	require.Equal(t, [][]string{{saved.Medium, saved.Address, saved.MXID}}, bulkLookupResp.Threepids)
+
+	// Test that a malformed 3PID results in an error.
+	req.Threepids = [][]string{{constants.MediumEmail}}
+
+	resp, err = http.Post(url, contentType, structToIOReader(t, &req))
+	require.Nil(t, err, err)
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	var respError gomatrix.RespError
+	httpRespToStruct(t, resp, &respError)
+	require.Equal(t, "M_INVALID_PARAM", respError.ErrCode)
+}
+
+func saveTestAssociation(t *testing.T, db database.Database) *types.ThreepidAssociation {
+	now := common.NowMS()
+	assoc := &types.ThreepidAssociation{
+		Medium:    constants.MediumEmail,
+		Address:   "alice@example.com",
+		MXID:      "@alice:example.com",
+		NotBefore: now,
+		NotAfter:  now + 60000,
+		TS:        now,
+	}
+
+	err := db.SaveAssociation(assoc)
+	require.Nil(t, err, err)
+
+	return assoc
+}
+
+func structToIOReader(t *testing.T, req interface{}) io.Reader {
+	jsonBytes, err := json.Marshal(req)
+	require.Nil(t, err, err)
+
+	return bytes.NewReader(jsonBytes)
+}
+
+func httpRespToStruct(t *testing.T, resp *http.Response, instance interface{}) []byte {
+	require.NotNil(t, resp.Body)
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(resp.Body)
+	require.Nil(t, err, err)
+
+	err = json.Unmarshal(b, instance)
+	require.Nil(t, err, err)
+
+	return b
+}
@@ -0,0 +1,168 @@
+package associations
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/babolivier/ident/common"
+	"github.com/babolivier/ident/common/config"
+	"github.com/babolivier/ident/common/database"
+	"github.com/babolivier/ident/validation"
+
+	"github.com/matrix-org/gomatrix"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+type UnbindReq struct {
+	SID          string   `json:"sid"`
+	ClientSecret string   `json:"client_secret"`
+	MXID         string   `json:"mxid"`
+	Threepid     Threepid `json:"threepid"`
+}
+
+type Threepid struct {
+	Medium  string `json:"medium"`
+	Address string `json:"address"`
+}
+
+func Unbind(
+	r *http.Request, cfg *config.Config, db database.Database, keys gomatrixserverlib.JSONVerifier,
+) util.JSONResponse {
+	// Check if we have a request body.
+	if r.Body == nil {
+		return util.JSONResponse{
+			Code: 400,
+			JSON: gomatrix.RespError{
+				ErrCode: "M_MISSING_PARAMS",
+				Err:     "Missing request body",
+			},
+		}
+	}
+
+	defer r.Body.Close()
+
+	// Read the whole body first, since we might need to read it again when checking the request's signature.
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return common.InternalServerError(err)
+	}
+
+	// Load the body's JSON into an instance of UnbindReq.
+	var req UnbindReq
+	if err = json.Unmarshal(body, &req); err != nil {
+		return common.InternalServerError(err)
+	}
+
+	if resp := checkUnbindReq(&req); resp != nil {
+		return *resp
+	}
+
+	// The request can either be authenticated by a validation session for the 3PID, or by a signature from the
+	// user's homeserver.
+	if len(req.SID) > 0 || len(req.ClientSecret) > 0 {
+		if resp := checkUnbindSession(&req, db); resp != nil {
+			return *resp
+		}
+	} else {
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		if resp := checkUnbindSignature(r, &req, cfg, keys); resp != nil {
+			return *resp
+		}
+	}
+
+	deleted, err := db.DeleteAssociation(req.Threepid.Medium, req.Threepid.Address, req.MXID)
+	if err != nil {
+		return common.InternalServerError(err)
+	}
+
+	if !deleted {
+		return util.JSONResponse{
+			Code: 404,
+			JSON: gomatrix.RespError{
+				ErrCode: "M_NOT_FOUND",
+				Err:     "No association found for this 3PID and user ID",
+			},
+		}
+	}
+
+	return util.JSONResponse{
+		Code: 200,
+		JSON: struct{}{},
+	}
+}
+
+func checkUnbindReq(req *UnbindReq) *util.JSONResponse {
+	var resp util.JSONResponse
+
+	if len(req.MXID) == 0 {
+		resp = common.MissingParamsError("mxid")
+		return &resp
+	}
+
+	if len(req.Threepid.Medium) == 0 {
+		resp = common.MissingParamsError("threepid.medium")
+		return &resp
+	}
+
+	if len(req.Threepid.Address) == 0 {
+		resp = common.MissingParamsError("threepid.address")
+		return &resp
+	}
+
+	if _, _, err := gomatrixserverlib.SplitID('@', req.MXID); err != nil {
+		resp = common.InvalidParamError("Invalid user ID")
+		return &resp
+	}
+
+	return nil
+}
+
+// checkUnbindSession checks that the session provided in the request has been validated for the 3PID to unbind.
+func checkUnbindSession(req *UnbindReq, db database.Database) *util.JSONResponse {
+	session, resp := validation.GetValidatedSession(req.SID, req.ClientSecret, db)
+	if resp != nil {
+		return resp
+	}
+
+	if session.Medium != req.Threepid.Medium || session.Address != req.Threepid.Address {
+		return &util.JSONResponse{
+			Code: 403,
+			JSON: gomatrix.RespError{
+				ErrCode: "M_FORBIDDEN",
+				Err:     "This validation session doesn't match the 3PID to unbind",
+			},
+		}
+	}
+
+	return nil
+}
+
+// checkUnbindSignature checks that the request has been signed by the homeserver of the user the 3PID is bound to.
+func checkUnbindSignature(
+	r *http.Request, req *UnbindReq, cfg *config.Config, keys gomatrixserverlib.JSONVerifier,
+) *util.JSONResponse {
+	fedReq, resp := gomatrixserverlib.VerifyHTTPRequest(
+		r, time.Now(), gomatrixserverlib.ServerName(cfg.Ident.ServerName), keys,
+	)
+	if fedReq == nil {
+		return &resp
+	}
+
+	// We've already checked that the MXID is valid.
+	_, serverName, _ := gomatrixserverlib.SplitID('@', req.MXID)
+	if fedReq.Origin() != serverName {
+		return &util.JSONResponse{
+			Code: 403,
+			JSON: gomatrix.RespError{
+				ErrCode: "M_FORBIDDEN",
+				Err:     "The request must be signed by the homeserver of the user",
+			},
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,175 @@
+package associations
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/babolivier/ident/common"
+	"github.com/babolivier/ident/common/config"
+	"github.com/babolivier/ident/common/constants"
+	"github.com/babolivier/ident/common/database"
+	"github.com/babolivier/ident/common/testutils"
+	"github.com/babolivier/ident/common/types"
+
+	"github.com/matrix-org/gomatrix"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ed25519"
+)
+
+func TestUnbindWithSession(t *testing.T) {
+	testutils.TestWithTestServer(t, testUnbindWithSession, SetupRouting)
+}
+
+func testUnbindWithSession(t *testing.T, cfg *config.Config, db database.Database, s *httptest.Server) {
+	url := s.URL + path.Join(constants.APIPrefix, "3pid/unbind")
+	contentType := "application/json"
+
+	assoc := saveTestAssociation(t, db)
+
+	session := &types.ValidationSession{
+		ID:           "somesid",
+		Medium:       constants.MediumEmail,
+		Address:      "bob@example.com",
+		ClientSecret: "somesecret",
+		Token:        "sometoken",
+		SendAttempt:  1,
+		CreatedAt:    common.NowMS(),
+		ValidatedAt:  common.NowMS(),
+	}
+	err := db.SaveValidationSession(session)
+	require.Nil(t, err, err)
+
+	var respError gomatrix.RespError
+
+	// Test that a session validated for another 3PID can't be used.
+	req := UnbindReq{
+		SID:          session.ID,
+		ClientSecret: session.ClientSecret,
+		MXID:         assoc.MXID,
+		Threepid: Threepid{
+			Medium:  assoc.Medium,
+			Address: assoc.Address,
+		},
+	}
+
+	resp, err := http.Post(url, contentType, structToIOReader(t, &req))
+	require.Nil(t, err, err)
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	httpRespToStruct(t, resp, &respError)
+	require.Equal(t, "M_FORBIDDEN", respError.ErrCode)
+
+	// Test that a session validated for the right 3PID removes the association.
+	session.ID = "othersid"
+	session.Address = assoc.Address
+	err = db.SaveValidationSession(session)
+	require.Nil(t, err, err)
+
+	req.SID = session.ID
+
+	resp, err = http.Post(url, contentType, structToIOReader(t, &req))
+	require.Nil(t, err, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	saved, err := db.GetAssociation(assoc.Medium, assoc.Address)
+	require.Nil(t, err, err)
+	require.Nil(t, saved)
+
+	// Test that unbinding an association that doesn't exist results in an error.
+	resp, err = http.Post(url, contentType, structToIOReader(t, &req))
+	require.Nil(t, err, err)
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestUnbindWithSignature(t *testing.T) {
+	cfg := testutils.NewTestConfig(t)
+	db := testutils.NewTestDB(t)
+
+	assoc := saveTestAssociation(t, db)
+
+	// Generate signing keys for the user's homeserver and another homeserver, and make them known to the key ring.
+	hsName := gomatrixserverlib.ServerName("example.com")
+	otherHSName := gomatrixserverlib.ServerName("otherdomain.com")
+	hsKeyID := gomatrixserverlib.KeyID("ed25519:1")
+
+	keyCache := common.NewKeyCache()
+	hsPrivKey := storeTestServerKey(t, keyCache, hsName, hsKeyID)
+	otherHSPrivKey := storeTestServerKey(t, keyCache, otherHSName, hsKeyID)
+
+	keyRing := gomatrixserverlib.KeyRing{KeyDatabase: keyCache}
+
+	req := UnbindReq{
+		MXID: assoc.MXID,
+		Threepid: Threepid{
+			Medium:  assoc.Medium,
+			Address: assoc.Address,
+		},
+	}
+
+	// Test that an unsigned request results in an error.
+	resp := Unbind(newUnbindRequest(t, cfg, &req, "", "", nil), cfg, db, keyRing)
+	require.Equal(t, http.StatusUnauthorized, resp.Code)
+
+	// Test that a request signed by another homeserver results in an error.
+	resp = Unbind(newUnbindRequest(t, cfg, &req, otherHSName, hsKeyID, otherHSPrivKey), cfg, db, keyRing)
+	require.Equal(t, http.StatusForbidden, resp.Code)
+	require.Equal(t, "M_FORBIDDEN", resp.JSON.(gomatrix.RespError).ErrCode)
+
+	// Test that a request with an invalid signature from the right homeserver results in an error.
+	resp = Unbind(newUnbindRequest(t, cfg, &req, hsName, hsKeyID, otherHSPrivKey), cfg, db, keyRing)
+	require.Equal(t, http.StatusUnauthorized, resp.Code)
+
+	// Test that a request correctly signed by the user's homeserver removes the association.
+	resp = Unbind(newUnbindRequest(t, cfg, &req, hsName, hsKeyID, hsPrivKey), cfg, db, keyRing)
+	require.Equal(t, http.StatusOK, resp.Code)
+
+	saved, err := db.GetAssociation(assoc.Medium, assoc.Address)
+	require.Nil(t, err, err)
+	require.Nil(t, saved)
+}
+
+func storeTestServerKey(
+	t *testing.T, keyCache *common.KeyCache, serverName gomatrixserverlib.ServerName, keyID gomatrixserverlib.KeyID,
+) ed25519.PrivateKey {
+	pubKey, privKey, err := ed25519.GenerateKey(nil)
+	require.Nil(t, err, err)
+
+	req := gomatrixserverlib.PublicKeyLookupRequest{ServerName: serverName, KeyID: keyID}
+	err = keyCache.StoreKeys(context.Background(), map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{
+		req: {
+			VerifyKey:    gomatrixserverlib.VerifyKey{Key: gomatrixserverlib.Base64String(pubKey)},
+			ValidUntilTS: gomatrixserverlib.AsTimestamp(time.Now().Add(time.Hour)),
+			ExpiredTS:    gomatrixserverlib.PublicKeyNotExpired,
+		},
+	})
+	require.Nil(t, err, err)
+
+	return privKey
+}
+
+func newUnbindRequest(
+	t *testing.T, cfg *config.Config, req *UnbindReq,
+	origin gomatrixserverlib.ServerName, keyID gomatrixserverlib.KeyID, privKey ed25519.PrivateKey,
+) *http.Request {
+	fedReq := gomatrixserverlib.NewFederationRequest(
+		http.MethodPost, gomatrixserverlib.ServerName(cfg.Ident.ServerName), path.Join(constants.APIPrefix, "3pid/unbind"),
+	)
+
+	err := fedReq.SetContent(req)
+	require.Nil(t, err, err)
+
+	if privKey != nil {
+		err = fedReq.Sign(origin, keyID, privKey)
+		require.Nil(t, err, err)
+	}
+
+	httpReq, err := fedReq.HTTPRequest()
+	require.Nil(t, err, err)
+
+	return httpReq
+}
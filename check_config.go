@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/babolivier/ident/common/config"
+	"github.com/babolivier/ident/common/database"
+
+	"github.com/pkg/errors"
+)
+
+func checkConfig(args []string) error {
+	fs, configFile := newFlagSet("check-config")
+	_ = fs.Parse(args)
+
+	// Don't load the templates right away, so every problem with them is reported rather than only the first one.
+	cfg, err := config.ReadConfig(*configFile)
+	if err != nil {
+		return fmt.Errorf("Couldn't load the server configuration: %v", err)
+	}
+
+	problems := checkLoadedConfig(cfg)
+	for _, problem := range problems {
+		fmt.Println(problem)
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("Found %d problem(s) in %s", len(problems), *configFile)
+	}
+
+	fmt.Println("Configuration OK")
+	return nil
+}
+
+// checkLoadedConfig checks the parts of the configuration ParseConfig can't check by itself, i.e. the templates it
+// refers to and the connection to the database. It returns every problem it finds.
+func checkLoadedConfig(cfg *config.Config) (problems []error) {
+	// Build a new registry rather than using the configuration's, as the configuration might have been changed since
+	// it was parsed.
+	problems = config.NewTemplateRegistry(cfg).Check()
+
+	if err := database.CheckConnection(cfg.Database.Driver, cfg.Database.ConnString); err != nil {
+		problems = append(problems, errors.Wrap(err, "Couldn't connect to the database"))
+	}
+
+	return
+}
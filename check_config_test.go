@@ -0,0 +1,50 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/babolivier/ident/common/testutils"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckLoadedConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ident_check_config")
+	require.Nil(t, err, err)
+	defer os.RemoveAll(dir)
+
+	validTemplate := filepath.Join(dir, "valid.txt")
+	require.Nil(t, ioutil.WriteFile(validTemplate, []byte("Hello {{.Address}}"), 0600))
+
+	invalidTemplate := filepath.Join(dir, "invalid.txt")
+	require.Nil(t, ioutil.WriteFile(invalidTemplate, []byte("Hello {{.Address"), 0600))
+
+	// Work on a copy of the test configuration so other tests aren't affected.
+	cfg := *testutils.NewTestConfig(t)
+	cfg.Ident.Invites.EmailTemplate.Text = validTemplate
+	cfg.Ident.Invites.EmailTemplate.HTML = ""
+	cfg.Ident.Validation.Email.EmailTemplate.Text = validTemplate
+	cfg.Ident.Validation.Email.EmailTemplate.HTML = ""
+
+	require.Empty(t, checkLoadedConfig(&cfg))
+
+	// Test that a missing template file, an invalid template and an invalid SMS template are all reported.
+	cfg.Ident.Invites.EmailTemplate.HTML = filepath.Join(dir, "missing.html")
+	cfg.Ident.Validation.Email.EmailTemplate.Text = invalidTemplate
+	cfg.Ident.Validation.MSISDN.SMSTemplate = "Your code is {{.Token"
+
+	require.Len(t, checkLoadedConfig(&cfg), 3)
+
+	// Test that a database that can't be reached is reported.
+	cfg = *testutils.NewTestConfig(t)
+	cfg.Ident.Invites.EmailTemplate.Text = validTemplate
+	cfg.Ident.Invites.EmailTemplate.HTML = ""
+	cfg.Ident.Validation.Email.EmailTemplate.Text = validTemplate
+	cfg.Ident.Validation.Email.EmailTemplate.HTML = ""
+	cfg.Database.ConnString = filepath.Join(dir, "missing", "ident.db")
+
+	require.Len(t, checkLoadedConfig(&cfg), 1)
+}
@@ -2,18 +2,44 @@ package config
 
 import (
 	"encoding/base64"
+	"fmt"
 	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/babolivier/ident/common/templates"
 
 	"github.com/pkg/errors"
 	"golang.org/x/crypto/ed25519"
 	"gopkg.in/yaml.v2"
 )
 
+// DefaultInvitesTTL is the lifetime of 3PID invites if none is configured.
+const DefaultInvitesTTL = 30 * 24 * time.Hour
+
+// Defaults for the outbound mail queue.
+const (
+	DefaultMailQueueWorkers      = 2
+	DefaultMailQueueMaxAttempts  = 10
+	DefaultMailQueueMinBackoff   = 30 * time.Second
+	DefaultMailQueueMaxBackoff   = time.Hour
+	DefaultMailQueuePollInterval = 10 * time.Second
+)
+
+// DefaultSendmailPath is the path of the sendmail binary used by the sendmail transport if none is configured.
+const DefaultSendmailPath = "/usr/sbin/sendmail"
+
 type Config struct {
 	Database DatabaseConfig `yaml:"database"`
 	HTTP     HTTPConfig     `yaml:"http"`
 	Ident    IdentConfig    `yaml:"ident"`
 	Email    EmailConfig    `yaml:"email"`
+	Terms    TermsConfig    `yaml:"terms"`
+	SMS      SMSConfig      `yaml:"sms"`
+
+	// Templates holds the templates of the emails and text messages Ident sends. They're loaded by NewConfig, and can
+	// be reloaded while Ident is running.
+	Templates *templates.Registry `yaml:"-"`
 }
 
 type HTTPConfig struct {
@@ -26,24 +52,115 @@ type DatabaseConfig struct {
 }
 
 type IdentConfig struct {
-	ServerName string           `yaml:"server_name"`
-	BaseURL    string           `yaml:"base_url"`
-	SigningKey SigningKeyConfig `yaml:"signing_key"`
-	Invites    InvitesConfig    `yaml:"invites"`
+	ServerName string `yaml:"server_name"`
+	BaseURL    string `yaml:"base_url"`
+	// SigningKey is the active signing key. It can either be configured directly (if the server only has one key), or
+	// be picked from SigningKeys.
+	SigningKey   SigningKeyConfig   `yaml:"signing_key"`
+	SigningKeys  []SigningKeyConfig `yaml:"signing_keys"`
+	Invites      InvitesConfig      `yaml:"invites"`
+	Validation   ValidationConfig   `yaml:"validation"`
+	Localisation LocalisationConfig `yaml:"localisation"`
 }
 
+// Statuses a signing key can have. Only the active key is used to sign. Retired keys are still considered valid until
+// they expire, so the invites they signed can still be checked. Revoked keys aren't considered valid anymore.
+const (
+	KeyStatusActive  = "active"
+	KeyStatusRetired = "retired"
+	KeyStatusRevoked = "revoked"
+)
+
 type SigningKeyConfig struct {
-	Algo         string `yaml:"algo"`
-	ID           string `yaml:"id"`
-	Seed         string `yaml:"seed"`
+	Algo     string `yaml:"algo"`
+	ID       string `yaml:"id"`
+	Seed     string `yaml:"seed"`
+	SeedFile string `yaml:"seed_file"`
+	SeedEnv  string `yaml:"seed_env"`
+	KeyFile  string `yaml:"key_file"`
+	Status   string `yaml:"status"`
+	// ExpiresAt is an optional RFC 3339 date after which a retired key isn't considered valid anymore.
+	ExpiresAt    string `yaml:"expires_at"`
+	Expiry       time.Time
 	PrivKey      ed25519.PrivateKey
 	PubKey       ed25519.PublicKey
 	PubKeyBase64 string
 }
 
+// KeyID returns the ID of the key in the algo:id format.
+func (k *SigningKeyConfig) KeyID() string {
+	return k.Algo + ":" + k.ID
+}
+
+// IsValid returns whether the key should be considered valid at the given time.
+func (k *SigningKeyConfig) IsValid(now time.Time) bool {
+	if k.Status == KeyStatusRevoked {
+		return false
+	}
+
+	return k.Expiry.IsZero() || now.Before(k.Expiry)
+}
+
+// FindSigningKey returns the signing key with the given ID (in the algo:id format), or nil if there's none.
+func (c *IdentConfig) FindSigningKey(keyID string) *SigningKeyConfig {
+	for i := range c.SigningKeys {
+		if c.SigningKeys[i].KeyID() == keyID {
+			return &c.SigningKeys[i]
+		}
+	}
+
+	return nil
+}
+
+// FindSigningKeyByPubKey returns the signing key with the given base64-encoded public key, or nil if there's none.
+func (c *IdentConfig) FindSigningKeyByPubKey(pubKeyBase64 string) *SigningKeyConfig {
+	for i := range c.SigningKeys {
+		if c.SigningKeys[i].PubKeyBase64 == pubKeyBase64 {
+			return &c.SigningKeys[i]
+		}
+	}
+
+	return nil
+}
+
 type InvitesConfig struct {
 	EmailTemplate   TemplateConfig `yaml:"email_template"`
 	SubjectTemplate string         `yaml:"subject_template"`
+	SMSTemplate     string         `yaml:"sms_template"`
+	// Locales holds the email templates to use instead of the default ones for each locale.
+	Locales map[string]LocalisedEmailConfig `yaml:"locales"`
+	// How long invites and their ephemeral keys stay valid. Defaults to DefaultInvitesTTL.
+	TTL time.Duration `yaml:"ttl"`
+}
+
+type ValidationConfig struct {
+	Email  EmailValidationConfig  `yaml:"email"`
+	MSISDN MSISDNValidationConfig `yaml:"msisdn"`
+}
+
+type MSISDNValidationConfig struct {
+	SMSTemplate string `yaml:"sms_template"`
+}
+
+type EmailValidationConfig struct {
+	EmailTemplate   TemplateConfig `yaml:"email_template"`
+	SubjectTemplate string         `yaml:"subject_template"`
+	// Locales holds the email templates to use instead of the default ones for each locale.
+	Locales map[string]LocalisedEmailConfig `yaml:"locales"`
+}
+
+// LocalisedEmailConfig describes the templates of an email in a given locale, e.g. "fr" or "pt-BR". They replace the
+// default templates as a whole, so the subject and at least one of the text and HTML templates must be set.
+type LocalisedEmailConfig struct {
+	EmailTemplate   TemplateConfig `yaml:"email_template"`
+	SubjectTemplate string         `yaml:"subject_template"`
+}
+
+// LocalisationConfig describes how the locale of an email is picked when the request doesn't say which one to use, nor
+// has an Accept-Language header.
+type LocalisationConfig struct {
+	// Domains maps domain names to the locale to use for the email addresses on them.
+	Domains map[string]string `yaml:"domains"`
 }
 
 type TemplateConfig struct {
@@ -52,19 +169,128 @@ type TemplateConfig struct {
 }
 
 type EmailConfig struct {
-	From string     `yaml:"from"`
-	SMTP SMTPConfig `yaml:"smtp"`
+	// Disabled turns off sending emails. Invites to email addresses are still stored, but the invitee isn't notified,
+	// and email addresses can't be validated.
+	Disabled bool   `yaml:"disabled"`
+	From     string `yaml:"from"`
+	// Transport is how emails are delivered: smtp (the default), sendmail or file.
+	Transport string          `yaml:"transport"`
+	SMTP      SMTPConfig      `yaml:"smtp"`
+	Sendmail  SendmailConfig  `yaml:"sendmail"`
+	File      MailFileConfig  `yaml:"file"`
+	Queue     MailQueueConfig `yaml:"queue"`
+}
+
+type SendmailConfig struct {
+	Path string   `yaml:"path"`
+	Args []string `yaml:"args"`
 }
 
+// MailFileConfig describes where the file transport writes emails. If Maildir is set, the directory is used as a
+// maildir, otherwise emails are written as .eml files directly in it.
+type MailFileConfig struct {
+	Path    string `yaml:"path"`
+	Maildir bool   `yaml:"maildir"`
+}
+
+// MailQueueConfig describes how the emails from the outbound queue are delivered. A failed delivery is retried after
+// a delay that starts at MinBackoff and doubles with each attempt, up to MaxBackoff, until MaxAttempts is reached.
+type MailQueueConfig struct {
+	Workers      int           `yaml:"workers"`
+	MaxAttempts  int           `yaml:"max_attempts"`
+	MinBackoff   time.Duration `yaml:"min_backoff"`
+	MaxBackoff   time.Duration `yaml:"max_backoff"`
+	PollInterval time.Duration `yaml:"poll_interval"`
+}
+
+// TLS modes for the connection to the SMTP server. With implicit TLS, the TLS handshake happens as soon as the
+// connection is established, with STARTTLS, the connection is upgraded after the server's greeting.
+const (
+	SMTPTLSModeNone     = "none"
+	SMTPTLSModeSTARTTLS = "starttls"
+	SMTPTLSModeImplicit = "implicit"
+)
+
+// Mechanisms that can be used to authenticate against the SMTP server.
+const (
+	SMTPAuthNone    = "none"
+	SMTPAuthPlain   = "plain"
+	SMTPAuthLogin   = "login"
+	SMTPAuthCRAMMD5 = "cram-md5"
+)
+
+// Defaults for the timeouts of the connection to the SMTP server.
+const (
+	DefaultSMTPConnectTimeout = 10 * time.Second
+	DefaultSMTPTimeout        = time.Minute
+)
+
 type SMTPConfig struct {
-	Hostname  string `yaml:"hostname"`
-	Port      string `yaml:"port"`
-	Username  string `yaml:"username"`
-	Password  string `yaml:"password"`
+	Hostname string `yaml:"hostname"`
+	Port     string `yaml:"port"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	// EnableTLS is the legacy way of turning on implicit TLS, it's only used if TLSMode isn't set.
 	EnableTLS bool   `yaml:"enable_tls"`
+	TLSMode   string `yaml:"tls_mode"`
+	// Auth defaults to plain if a username is set, and to none otherwise.
+	Auth               string `yaml:"auth"`
+	CAFile             string `yaml:"ca_file"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
+	// ConnectTimeout limits how long establishing the connection can take, Timeout limits the whole exchange with the
+	// server.
+	ConnectTimeout time.Duration `yaml:"connect_timeout"`
+	Timeout        time.Duration `yaml:"timeout"`
 }
 
+// SMSConfig describes how text messages are sent. If no provider is configured, the MSISDN medium is disabled.
+type SMSConfig struct {
+	Provider string        `yaml:"provider"`
+	HTTP     SMSHTTPConfig `yaml:"http"`
+	File     SMSFileConfig `yaml:"file"`
+}
+
+type SMSHTTPConfig struct {
+	URL      string `yaml:"url"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	From     string `yaml:"from"`
+}
+
+type SMSFileConfig struct {
+	Path string `yaml:"path"`
+}
+
+type TermsConfig struct {
+	Policies map[string]PolicyConfig `yaml:"policies"`
+}
+
+type PolicyConfig struct {
+	Version   string                     `yaml:"version"`
+	Languages map[string]PolicyDocConfig `yaml:"languages"`
+}
+
+type PolicyDocConfig struct {
+	Name string `yaml:"name"`
+	URL  string `yaml:"url"`
+}
+
+// NewConfig reads and parses the configuration file, and loads the templates it refers to.
 func NewConfig(filename string) (*Config, error) {
+	c, err := ReadConfig(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = c.Templates.Load(); err != nil {
+		return nil, errors.Wrap(err, "Couldn't load the templates")
+	}
+
+	return c, nil
+}
+
+// ReadConfig reads and parses the configuration file, without loading the templates it refers to.
+func ReadConfig(filename string) (*Config, error) {
 	configBytes, err := ioutil.ReadFile(filename)
 	if err != nil {
 		return nil, errors.Wrap(err, "Couldn't open the configuration file")
@@ -80,14 +306,303 @@ func ParseConfig(b []byte) (*Config, error) {
 		return nil, errors.Wrap(err, "Couldn't read the configuration file")
 	}
 
-	if c.Ident.SigningKey.Algo != "ed25519" {
-		return nil, errors.New("Invalid signing key configuration: only ed25519 is currently allowed")
+	if err := prepareSigningKeys(&c.Ident); err != nil {
+		return nil, errors.Wrap(err, "Invalid signing key configuration")
+	}
+
+	for name, policy := range c.Terms.Policies {
+		if len(policy.Version) == 0 || len(policy.Languages) == 0 {
+			return nil, errors.New("Invalid terms configuration: policy " + name + " needs a version and at least one language")
+		}
+	}
+
+	if err := checkLocales(c.Ident.Invites.Locales); err != nil {
+		return nil, errors.Wrap(err, "Invalid invites configuration")
+	}
+
+	if err := checkLocales(c.Ident.Validation.Email.Locales); err != nil {
+		return nil, errors.Wrap(err, "Invalid validation configuration")
+	}
+
+	if err := prepareLocalisation(&c.Ident.Localisation); err != nil {
+		return nil, errors.Wrap(err, "Invalid localisation configuration")
+	}
+
+	if c.Ident.Invites.TTL == 0 {
+		c.Ident.Invites.TTL = DefaultInvitesTTL
+	} else if c.Ident.Invites.TTL < 0 {
+		return nil, errors.New("Invalid invites configuration: the TTL can't be negative")
+	}
+
+	switch c.Email.Transport {
+	case "":
+		c.Email.Transport = "smtp"
+	case "smtp":
+	case "sendmail":
+		if len(c.Email.Sendmail.Path) == 0 {
+			c.Email.Sendmail.Path = DefaultSendmailPath
+		}
+	case "file":
+		if len(c.Email.File.Path) == 0 {
+			return nil, errors.New("Invalid email configuration: the file transport needs a path")
+		}
+	default:
+		return nil, errors.New("Invalid email configuration: unknown transport " + c.Email.Transport)
 	}
 
-	c.Ident.SigningKey.PrivKey = ed25519.NewKeyFromSeed([]byte(c.Ident.SigningKey.Seed))
-	c.Ident.SigningKey.PubKey = c.Ident.SigningKey.PrivKey.Public().(ed25519.PublicKey)
-	c.Ident.SigningKey.PubKeyBase64 = base64.RawStdEncoding.EncodeToString(c.Ident.SigningKey.PubKey)
+	if err := prepareSMTP(&c.Email.SMTP); err != nil {
+		return nil, errors.Wrap(err, "Invalid SMTP configuration")
+	}
+
+	if err := prepareMailQueue(&c.Email.Queue); err != nil {
+		return nil, errors.Wrap(err, "Invalid mail queue configuration")
+	}
+
+	switch c.SMS.Provider {
+	case "":
+	case "http":
+		if len(c.SMS.HTTP.URL) == 0 {
+			return nil, errors.New("Invalid SMS configuration: the http provider needs a URL")
+		}
+	case "file":
+		if len(c.SMS.File.Path) == 0 {
+			return nil, errors.New("Invalid SMS configuration: the file provider needs a path")
+		}
+	default:
+		return nil, errors.New("Invalid SMS configuration: unknown provider " + c.SMS.Provider)
+	}
+
+	if !c.Email.Disabled {
+		if err := checkEmailTemplates(c.Ident.Invites.SubjectTemplate, c.Ident.Invites.EmailTemplate); err != nil {
+			return nil, errors.Wrap(err, "Invalid invites configuration")
+		}
+
+		validationCfg := c.Ident.Validation.Email
+		if err := checkEmailTemplates(validationCfg.SubjectTemplate, validationCfg.EmailTemplate); err != nil {
+			return nil, errors.Wrap(err, "Invalid validation configuration")
+		}
+	}
+
+	c.Templates = NewTemplateRegistry(c)
 
 	return c, nil
+}
+
+// NewTemplateRegistry registers the templates the given configuration refers to in a new registry, without loading
+// them. The email templates are only registered if sending emails is enabled, and the SMS templates if a SMS provider
+// is configured.
+func NewTemplateRegistry(c *Config) *templates.Registry {
+	registry := templates.NewRegistry()
+
+	if !c.Email.Disabled {
+		invitesCfg := c.Ident.Invites
+		registry.AddEmail(templates.InviteEmail, templates.EmailSource{
+			Subject: invitesCfg.SubjectTemplate,
+			Text:    invitesCfg.EmailTemplate.Text,
+			HTML:    invitesCfg.EmailTemplate.HTML,
+		})
+
+		for locale, localeCfg := range invitesCfg.Locales {
+			registry.AddLocalisedEmail(templates.InviteEmail, locale, templates.EmailSource{
+				Subject: localeCfg.SubjectTemplate,
+				Text:    localeCfg.EmailTemplate.Text,
+				HTML:    localeCfg.EmailTemplate.HTML,
+			})
+		}
+
+		validationCfg := c.Ident.Validation.Email
+		registry.AddEmail(templates.ValidationEmail, templates.EmailSource{
+			Subject: validationCfg.SubjectTemplate,
+			Text:    validationCfg.EmailTemplate.Text,
+			HTML:    validationCfg.EmailTemplate.HTML,
+		})
+
+		for locale, localeCfg := range validationCfg.Locales {
+			registry.AddLocalisedEmail(templates.ValidationEmail, locale, templates.EmailSource{
+				Subject: localeCfg.SubjectTemplate,
+				Text:    localeCfg.EmailTemplate.Text,
+				HTML:    localeCfg.EmailTemplate.HTML,
+			})
+		}
+	}
+
+	if len(c.SMS.Provider) > 0 {
+		registry.AddSMS(templates.InviteSMS, c.Ident.Invites.SMSTemplate)
+		registry.AddSMS(templates.ValidationSMS, c.Ident.Validation.MSISDN.SMSTemplate)
+	}
+
+	return registry
+}
+
+// checkEmailTemplates checks that the default templates of an email have a subject and at least one body.
+func checkEmailTemplates(subjectTemplate string, emailTemplate TemplateConfig) error {
+	if len(subjectTemplate) == 0 || (len(emailTemplate.Text) == 0 && len(emailTemplate.HTML) == 0) {
+		return errors.New("a subject template and at least one email template are needed to send emails")
+	}
+
+	return nil
+}
+
+// checkLocales checks that the templates of each locale can replace the default ones.
+func checkLocales(locales map[string]LocalisedEmailConfig) error {
+	for locale, c := range locales {
+		if len(templates.NormaliseLocale(locale)) == 0 {
+			return errors.New("locales can't be empty")
+		}
+
+		if len(c.SubjectTemplate) == 0 || (len(c.EmailTemplate.Text) == 0 && len(c.EmailTemplate.HTML) == 0) {
+			return errors.New("locale " + locale + " needs a subject template and at least one email template")
+		}
+	}
+
+	return nil
+}
+
+// prepareLocalisation checks the localisation configuration and normalises the domain names and locales in it.
+func prepareLocalisation(c *LocalisationConfig) error {
+	domains := make(map[string]string, len(c.Domains))
+	for domain, locale := range c.Domains {
+		locale = templates.NormaliseLocale(locale)
+		if len(locale) == 0 {
+			return errors.New("no locale set for the domain " + domain)
+		}
+
+		domains[strings.ToLower(domain)] = locale
+	}
+
+	c.Domains = domains
+	return nil
+}
+
+// prepareSMTP checks the SMTP configuration and fills in the defaults.
+func prepareSMTP(c *SMTPConfig) error {
+	c.TLSMode = strings.ToLower(c.TLSMode)
+	switch c.TLSMode {
+	case "":
+		if c.EnableTLS {
+			c.TLSMode = SMTPTLSModeImplicit
+		} else {
+			c.TLSMode = SMTPTLSModeNone
+		}
+	case SMTPTLSModeNone, SMTPTLSModeSTARTTLS, SMTPTLSModeImplicit:
+	default:
+		return errors.New("unknown TLS mode " + c.TLSMode)
+	}
+
+	c.Auth = strings.ToLower(c.Auth)
+	switch c.Auth {
+	case "":
+		if len(c.Username) > 0 {
+			c.Auth = SMTPAuthPlain
+		} else {
+			c.Auth = SMTPAuthNone
+		}
+	case SMTPAuthNone, SMTPAuthPlain, SMTPAuthLogin, SMTPAuthCRAMMD5:
+	default:
+		return errors.New("unknown auth mechanism " + c.Auth)
+	}
+
+	if c.ConnectTimeout < 0 || c.Timeout < 0 {
+		return errors.New("timeouts can't be negative")
+	}
+	if c.ConnectTimeout == 0 {
+		c.ConnectTimeout = DefaultSMTPConnectTimeout
+	}
+	if c.Timeout == 0 {
+		c.Timeout = DefaultSMTPTimeout
+	}
+
+	return nil
+}
+
+// prepareMailQueue checks the mail queue configuration and fills in the defaults.
+func prepareMailQueue(c *MailQueueConfig) error {
+	if c.Workers < 0 || c.MaxAttempts < 0 || c.MinBackoff < 0 || c.MaxBackoff < 0 || c.PollInterval < 0 {
+		return errors.New("values can't be negative")
+	}
+
+	if c.Workers == 0 {
+		c.Workers = DefaultMailQueueWorkers
+	}
+	if c.MaxAttempts == 0 {
+		c.MaxAttempts = DefaultMailQueueMaxAttempts
+	}
+	if c.MinBackoff == 0 {
+		c.MinBackoff = DefaultMailQueueMinBackoff
+	}
+	if c.MaxBackoff == 0 {
+		c.MaxBackoff = DefaultMailQueueMaxBackoff
+	}
+	if c.PollInterval == 0 {
+		c.PollInterval = DefaultMailQueuePollInterval
+	}
+
+	if c.MinBackoff > c.MaxBackoff {
+		return errors.New("min_backoff can't be greater than max_backoff")
+	}
+
+	return nil
+}
+
+// prepareSigningKeys checks the signing keys, derives the key pairs from their seeds, and sets the active one as the
+// configuration's signing key. If only signing_key is set, it's considered as the only, active, key.
+func prepareSigningKeys(c *IdentConfig) error {
+	if len(c.SigningKeys) == 0 {
+		c.SigningKey.Status = KeyStatusActive
+		c.SigningKeys = []SigningKeyConfig{c.SigningKey}
+	}
+
+	var active *SigningKeyConfig
+	ids := make(map[string]bool, len(c.SigningKeys))
+
+	for i := range c.SigningKeys {
+		key := &c.SigningKeys[i]
+
+		if err := loadSigningKey(key); err != nil {
+			return err
+		}
+
+		if key.Algo != "ed25519" {
+			return errors.New("only ed25519 is currently allowed")
+		}
+
+		if ids[key.KeyID()] {
+			return errors.New("duplicate key ID " + key.KeyID())
+		}
+		ids[key.KeyID()] = true
+
+		if len(key.Seed) != ed25519.SeedSize {
+			return fmt.Errorf("the seed of key %s must be %d bytes long, got %d", key.KeyID(), ed25519.SeedSize, len(key.Seed))
+		}
+
+		switch key.Status {
+		case KeyStatusActive:
+			if active != nil {
+				return errors.New("only one key can be active")
+			}
+			active = key
+		case KeyStatusRetired, KeyStatusRevoked:
+		default:
+			return errors.New("unknown status for key " + key.KeyID() + ": " + key.Status)
+		}
+
+		if len(key.ExpiresAt) > 0 {
+			expiry, err := time.Parse(time.RFC3339, key.ExpiresAt)
+			if err != nil {
+				return errors.Wrap(err, "couldn't parse the expiry date of key "+key.KeyID())
+			}
+			key.Expiry = expiry
+		}
+
+		key.PrivKey = ed25519.NewKeyFromSeed([]byte(key.Seed))
+		key.PubKey = key.PrivKey.Public().(ed25519.PublicKey)
+		key.PubKeyBase64 = base64.RawStdEncoding.EncodeToString(key.PubKey)
+	}
+
+	if active == nil {
+		return errors.New("no active key")
+	}
 
+	c.SigningKey = *active
+	return nil
 }
@@ -2,15 +2,33 @@ package config
 
 import (
 	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/babolivier/ident/common/constants"
+	"github.com/babolivier/ident/common/templates"
 
 	"github.com/stretchr/testify/require"
 	"golang.org/x/crypto/ed25519"
 )
 
+// testEmailTemplatesYAML configures the default templates of the invite and validation emails, which are required
+// unless sending emails is disabled. It must be appended to the "ident" section.
+const testEmailTemplatesYAML = "" +
+	"  invites:\n" +
+	"    subject_template: Hello\n" +
+	"    email_template:\n" +
+	"      text: templates/text/invite.txt\n" +
+	"  validation:\n" +
+	"    email:\n" +
+	"      subject_template: Hello\n" +
+	"      email_template:\n" +
+	"        text: templates/text/validation.txt\n"
+
 func TestParseConfig(t *testing.T) {
 	cfg, err := ParseConfig([]byte(constants.TestConfigYAML))
 
@@ -40,12 +58,43 @@ func TestParseConfig(t *testing.T) {
 	require.Equal(t, "/tmp/ident_invite_template_txt", cfg.Ident.Invites.EmailTemplate.Text)
 	require.Equal(t, "/tmp/ident_invite_template_html", cfg.Ident.Invites.EmailTemplate.HTML)
 
+	require.Equal(t, "Confirm your email address for Matrix", cfg.Ident.Validation.Email.SubjectTemplate)
+	require.Equal(t, "/tmp/ident_validation_template_txt", cfg.Ident.Validation.Email.EmailTemplate.Text)
+	require.Equal(t, "/tmp/ident_validation_template_html", cfg.Ident.Validation.Email.EmailTemplate.HTML)
+
+	require.Equal(t, "{{.SenderDisplayName}} invited you to Matrix! Token: {{.Token}}", cfg.Ident.Invites.SMSTemplate)
+	require.Equal(t, 24*time.Hour, cfg.Ident.Invites.TTL)
+	require.Equal(t, "Your Matrix validation code is {{.Token}}", cfg.Ident.Validation.MSISDN.SMSTemplate)
+
+	require.Equal(t, "file", cfg.SMS.Provider)
+	require.Equal(t, "/tmp/ident_sms_log", cfg.SMS.File.Path)
+
+	require.Len(t, cfg.Terms.Policies, 1)
+	require.Equal(t, "1.0", cfg.Terms.Policies["privacy_policy"].Version)
+	require.Equal(t, "Privacy Policy", cfg.Terms.Policies["privacy_policy"].Languages["en"].Name)
+	require.Equal(t, "https://example.com/privacy-1.0-en.html", cfg.Terms.Policies["privacy_policy"].Languages["en"].URL)
+
 	require.Equal(t, "Ident <ident@example.com>", cfg.Email.From)
 	require.Equal(t, "mail.example.com", cfg.Email.SMTP.Hostname)
 	require.Equal(t, "465", cfg.Email.SMTP.Port)
 	require.Equal(t, "ident@example.com", cfg.Email.SMTP.Username)
 	require.Equal(t, "somepassword", cfg.Email.SMTP.Password)
 	require.True(t, cfg.Email.SMTP.EnableTLS)
+	// Test that the legacy enable_tls setting turns on implicit TLS, and that having a username turns on PLAIN auth.
+	require.Equal(t, SMTPTLSModeImplicit, cfg.Email.SMTP.TLSMode)
+	require.Equal(t, SMTPAuthPlain, cfg.Email.SMTP.Auth)
+	require.Equal(t, DefaultSMTPConnectTimeout, cfg.Email.SMTP.ConnectTimeout)
+	require.Equal(t, DefaultSMTPTimeout, cfg.Email.SMTP.Timeout)
+	require.False(t, cfg.Email.Disabled)
+	require.Equal(t, "file", cfg.Email.Transport)
+	require.Equal(t, "/tmp/ident_mail", cfg.Email.File.Path)
+
+	require.Equal(t, 4, cfg.Email.Queue.Workers)
+	require.Equal(t, 10*time.Minute, cfg.Email.Queue.MaxBackoff)
+	// Test that the values that aren't set get their default.
+	require.Equal(t, DefaultMailQueueMaxAttempts, cfg.Email.Queue.MaxAttempts)
+	require.Equal(t, DefaultMailQueueMinBackoff, cfg.Email.Queue.MinBackoff)
+	require.Equal(t, DefaultMailQueuePollInterval, cfg.Email.Queue.PollInterval)
 }
 
 func TestParseConfigInvalidYAML(t *testing.T) {
@@ -69,3 +118,293 @@ func TestParseConfigInvalidKeyAlgo(t *testing.T) {
 	require.NotNil(t, err)
 	require.True(t, strings.HasPrefix(err.Error(), "Invalid signing key configuration"), err)
 }
+
+func TestParseConfigInvalidTerms(t *testing.T) {
+	yaml := "" +
+		"ident:\n" +
+		"  signing_key:\n" +
+		"    algo: ed25519\n" +
+		"    seed: ahphigh9jahchiequiechee4pha1Atuv\n" +
+		"terms:\n" +
+		"  policies:\n" +
+		"    privacy_policy:\n" +
+		"      version: \"1.0\""
+
+	_, err := ParseConfig([]byte(yaml))
+	require.NotNil(t, err)
+	require.True(t, strings.HasPrefix(err.Error(), "Invalid terms configuration"), err)
+}
+
+func TestParseConfigInvalidSMSProvider(t *testing.T) {
+	yaml := "" +
+		"ident:\n" +
+		"  signing_key:\n" +
+		"    algo: ed25519\n" +
+		"    seed: ahphigh9jahchiequiechee4pha1Atuv\n" +
+		"sms:\n" +
+		"  provider: carrier_pigeon"
+
+	_, err := ParseConfig([]byte(yaml))
+	require.NotNil(t, err)
+	require.True(t, strings.HasPrefix(err.Error(), "Invalid SMS configuration"), err)
+}
+
+func TestParseConfigMailTransport(t *testing.T) {
+	yaml := "" +
+		"ident:\n" +
+		"  signing_key:\n" +
+		"    algo: ed25519\n" +
+		"    seed: ahphigh9jahchiequiechee4pha1Atuv\n" +
+		testEmailTemplatesYAML
+
+	// Test that SMTP is used if no transport is set.
+	cfg, err := ParseConfig([]byte(yaml))
+	require.Nil(t, err, err)
+	require.Equal(t, "smtp", cfg.Email.Transport)
+
+	// Test that the sendmail transport gets a default path.
+	cfg, err = ParseConfig([]byte(yaml + "email:\n  transport: sendmail"))
+	require.Nil(t, err, err)
+	require.Equal(t, DefaultSendmailPath, cfg.Email.Sendmail.Path)
+
+	_, err = ParseConfig([]byte(yaml + "email:\n  transport: file"))
+	require.NotNil(t, err)
+	require.True(t, strings.HasPrefix(err.Error(), "Invalid email configuration"), err)
+
+	_, err = ParseConfig([]byte(yaml + "email:\n  transport: carrier_pigeon"))
+	require.NotNil(t, err)
+	require.True(t, strings.HasPrefix(err.Error(), "Invalid email configuration"), err)
+}
+
+func TestParseConfigSMTP(t *testing.T) {
+	yaml := "" +
+		"ident:\n" +
+		"  signing_key:\n" +
+		"    algo: ed25519\n" +
+		"    seed: ahphigh9jahchiequiechee4pha1Atuv\n" +
+		testEmailTemplatesYAML +
+		"email:\n" +
+		"  smtp:\n" +
+		"    hostname: relay.internal\n" +
+		"    port: 25\n"
+
+	// Test that an SMTP server without username nor TLS setting is used in plain text, without authentication.
+	cfg, err := ParseConfig([]byte(yaml))
+	require.Nil(t, err, err)
+	require.Equal(t, SMTPTLSModeNone, cfg.Email.SMTP.TLSMode)
+	require.Equal(t, SMTPAuthNone, cfg.Email.SMTP.Auth)
+
+	cfg, err = ParseConfig([]byte(yaml + "    tls_mode: STARTTLS\n    auth: LOGIN\n    timeout: 30s\n"))
+	require.Nil(t, err, err)
+	require.Equal(t, SMTPTLSModeSTARTTLS, cfg.Email.SMTP.TLSMode)
+	require.Equal(t, SMTPAuthLogin, cfg.Email.SMTP.Auth)
+	require.Equal(t, 30*time.Second, cfg.Email.SMTP.Timeout)
+
+	_, err = ParseConfig([]byte(yaml + "    tls_mode: sometimes\n"))
+	require.NotNil(t, err)
+	require.True(t, strings.HasPrefix(err.Error(), "Invalid SMTP configuration"), err)
+
+	_, err = ParseConfig([]byte(yaml + "    auth: xoauth2\n"))
+	require.NotNil(t, err)
+	require.True(t, strings.HasPrefix(err.Error(), "Invalid SMTP configuration"), err)
+}
+
+func TestParseConfigInvalidMailQueue(t *testing.T) {
+	yaml := "" +
+		"ident:\n" +
+		"  signing_key:\n" +
+		"    algo: ed25519\n" +
+		"    seed: ahphigh9jahchiequiechee4pha1Atuv\n" +
+		"email:\n" +
+		"  queue:\n" +
+		"    min_backoff: 2h\n" +
+		"    max_backoff: 1h"
+
+	_, err := ParseConfig([]byte(yaml))
+	require.NotNil(t, err)
+	require.True(t, strings.HasPrefix(err.Error(), "Invalid mail queue configuration"), err)
+}
+
+func TestParseConfigMultipleSigningKeys(t *testing.T) {
+	yaml := `
+ident:
+  signing_keys:
+    - algo: ed25519
+      id: "0"
+      seed: ahphigh9jahchiequiechee4pha1Atuv
+      status: retired
+      expires_at: "2000-01-01T00:00:00Z"
+    - algo: ed25519
+      id: "1"
+      seed: eiD3oonguu8aePhe2eiCh7xoo5oothei
+      status: active
+    - algo: ed25519
+      id: "2"
+      seed: Ahgh1ahnooshei5quee2ohNg1nee6Eem
+      status: revoked
+email:
+  disabled: true
+`
+
+	cfg, err := ParseConfig([]byte(yaml))
+	require.Nil(t, err, err)
+
+	// Test that the active key is picked as the signing key.
+	require.Equal(t, "ed25519:1", cfg.Ident.SigningKey.KeyID())
+	require.Len(t, cfg.Ident.SigningKeys, 3)
+
+	retired := cfg.Ident.FindSigningKey("ed25519:0")
+	require.NotNil(t, retired)
+	require.Equal(t, ed25519.NewKeyFromSeed([]byte(retired.Seed)), retired.PrivKey)
+	require.True(t, retired.IsValid(time.Date(1999, 1, 1, 0, 0, 0, 0, time.UTC)))
+	require.False(t, retired.IsValid(time.Now()))
+
+	revoked := cfg.Ident.FindSigningKeyByPubKey(cfg.Ident.SigningKeys[2].PubKeyBase64)
+	require.NotNil(t, revoked)
+	require.False(t, revoked.IsValid(time.Now()))
+
+	require.Nil(t, cfg.Ident.FindSigningKey("ed25519:3"))
+}
+
+func TestParseConfigInvalidSigningKeys(t *testing.T) {
+	invalid := map[string]string{
+		"no active key": `
+ident:
+  signing_keys:
+    - {algo: ed25519, id: "0", seed: ahphigh9jahchiequiechee4pha1Atuv, status: retired}
+`,
+		"several active keys": `
+ident:
+  signing_keys:
+    - {algo: ed25519, id: "0", seed: ahphigh9jahchiequiechee4pha1Atuv, status: active}
+    - {algo: ed25519, id: "1", seed: eiD3oonguu8aePhe2eiCh7xoo5oothei, status: active}
+`,
+		"duplicate ID": `
+ident:
+  signing_keys:
+    - {algo: ed25519, id: "0", seed: ahphigh9jahchiequiechee4pha1Atuv, status: active}
+    - {algo: ed25519, id: "0", seed: eiD3oonguu8aePhe2eiCh7xoo5oothei, status: retired}
+`,
+		"short seed": `
+ident:
+  signing_keys:
+    - {algo: ed25519, id: "0", seed: tooshort, status: active}
+`,
+		"invalid expiry": `
+ident:
+  signing_keys:
+    - {algo: ed25519, id: "0", seed: ahphigh9jahchiequiechee4pha1Atuv, status: active, expires_at: tomorrow}
+`,
+	}
+
+	for name, yaml := range invalid {
+		_, err := ParseConfig([]byte(yaml))
+		require.NotNil(t, err, name)
+		require.True(t, strings.HasPrefix(err.Error(), "Invalid signing key configuration"), err)
+	}
+}
+
+func TestNewConfigLoadsTemplates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ident_config")
+	require.Nil(t, err, err)
+	defer os.RemoveAll(dir)
+
+	template := filepath.Join(dir, "invite.txt")
+	yaml := "ident:\n  signing_key:\n    algo: ed25519\n    id: 0\n    seed: " + testSeed + "\n" +
+		"  invites:\n    email_template:\n      text: " + template + "\n    subject_template: Hello\n" +
+		"  validation:\n    email:\n      email_template:\n        text: " + template + "\n" +
+		"      subject_template: Hello\n" +
+		"email:\n  disabled: true\n"
+
+	configFile := filepath.Join(dir, "ident.yaml")
+	require.Nil(t, ioutil.WriteFile(configFile, []byte(yaml), 0600))
+
+	// Test that the templates aren't registered if sending emails is disabled.
+	cfg, err := NewConfig(configFile)
+	require.Nil(t, err, err)
+
+	_, err = cfg.Templates.Email(templates.InviteEmail)
+	require.NotNil(t, err)
+
+	// Test that a missing template file is reported.
+	yaml = strings.Replace(yaml, "disabled: true", "disabled: false", 1)
+	require.Nil(t, ioutil.WriteFile(configFile, []byte(yaml), 0600))
+
+	_, err = NewConfig(configFile)
+	require.NotNil(t, err)
+	require.True(t, strings.HasPrefix(err.Error(), "Couldn't load the templates"), err.Error())
+
+	// Test that the configuration can still be read without loading the templates.
+	_, err = ReadConfig(configFile)
+	require.Nil(t, err, err)
+
+	require.Nil(t, ioutil.WriteFile(template, []byte("Hello {{.Address}}"), 0600))
+
+	cfg, err = NewConfig(configFile)
+	require.Nil(t, err, err)
+
+	email, err := cfg.Templates.Email(templates.InviteEmail)
+	require.Nil(t, err, err)
+	require.NotNil(t, email.Text)
+	require.Nil(t, email.HTML)
+}
+
+func TestParseConfigLocales(t *testing.T) {
+	yaml := "" +
+		"ident:\n" +
+		"  signing_key:\n" +
+		"    algo: ed25519\n" +
+		"    seed: ahphigh9jahchiequiechee4pha1Atuv\n" +
+		"  localisation:\n" +
+		"    domains:\n" +
+		"      Example.FR: fr_FR\n" +
+		"  invites:\n" +
+		"    subject_template: Hello\n" +
+		"    locales:\n" +
+		"      fr:\n" +
+		"        subject_template: Bonjour\n" +
+		"        email_template:\n" +
+		"          text: templates/fr/text/invite.txt\n" +
+		"email:\n" +
+		"  disabled: true\n"
+
+	cfg, err := ParseConfig([]byte(yaml))
+	require.Nil(t, err, err)
+	require.Equal(t, map[string]string{"example.fr": "fr-fr"}, cfg.Ident.Localisation.Domains)
+
+	// Test that a locale without a subject template is rejected.
+	_, err = ParseConfig([]byte(strings.Replace(yaml, "subject_template: Bonjour", "subject_template: \"\"", 1)))
+	require.NotNil(t, err)
+	require.True(t, strings.HasPrefix(err.Error(), "Invalid invites configuration"), err)
+
+	// Test that a domain without a locale is rejected.
+	_, err = ParseConfig([]byte(strings.Replace(yaml, "Example.FR: fr_FR", "example.fr: \"\"", 1)))
+	require.NotNil(t, err)
+	require.True(t, strings.HasPrefix(err.Error(), "Invalid localisation configuration"), err)
+}
+
+func TestParseConfigMissingEmailTemplates(t *testing.T) {
+	yaml := "" +
+		"ident:\n" +
+		"  signing_key:\n" +
+		"    algo: ed25519\n" +
+		"    seed: ahphigh9jahchiequiechee4pha1Atuv\n" +
+		testEmailTemplatesYAML
+
+	_, err := ParseConfig([]byte(yaml))
+	require.Nil(t, err, err)
+
+	// Test that an invite email without a subject template is rejected.
+	_, err = ParseConfig([]byte(strings.Replace(yaml, "    subject_template: Hello\n", "", 1)))
+	require.NotNil(t, err)
+	require.True(t, strings.HasPrefix(err.Error(), "Invalid invites configuration"), err)
+
+	// Test that a validation email without any body template is rejected.
+	_, err = ParseConfig([]byte(strings.Replace(yaml, "        text: templates/text/validation.txt\n", "", 1)))
+	require.NotNil(t, err)
+	require.True(t, strings.HasPrefix(err.Error(), "Invalid validation configuration"), err)
+
+	// Test that the templates aren't required if sending emails is disabled.
+	_, err = ParseConfig([]byte(strings.Replace(yaml, testEmailTemplatesYAML, "", 1) + "email:\n  disabled: true\n"))
+	require.Nil(t, err, err)
+}
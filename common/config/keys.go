@@ -0,0 +1,102 @@
+package config
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// loadSigningKey fills the seed (and, for key files, the algorithm and ID) of the given key from the source it's
+// configured with. A key can have its seed inline (seed), in a file containing only the seed (seed_file), in an
+// environment variable (seed_env), or in a key file using the format used by Synapse and Sydent (key_file), i.e. lines
+// of "<algo> <id> <unpadded base64 seed>". Exactly one of these sources must be set.
+func loadSigningKey(key *SigningKeyConfig) error {
+	var sources int
+	for _, source := range []string{key.Seed, key.SeedFile, key.SeedEnv, key.KeyFile} {
+		if len(source) > 0 {
+			sources++
+		}
+	}
+
+	if sources != 1 {
+		return errors.New("exactly one of seed, seed_file, seed_env and key_file must be set for each key")
+	}
+
+	switch {
+	case len(key.SeedFile) > 0:
+		b, err := readSecretFile(key.SeedFile)
+		if err != nil {
+			return err
+		}
+		key.Seed = strings.TrimSpace(string(b))
+	case len(key.SeedEnv) > 0:
+		seed, ok := os.LookupEnv(key.SeedEnv)
+		if !ok {
+			return errors.New("environment variable " + key.SeedEnv + " isn't set")
+		}
+		key.Seed = seed
+	case len(key.KeyFile) > 0:
+		b, err := readSecretFile(key.KeyFile)
+		if err != nil {
+			return err
+		}
+		return parseKeyFile(key, string(b))
+	}
+
+	return nil
+}
+
+// parseKeyFile looks for the key in the content of a key file. If the key's algorithm or ID is configured, the
+// matching line is used, otherwise the first line is.
+func parseKeyFile(key *SigningKeyConfig, content string) error {
+	for _, line := range strings.Split(content, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		if len(fields) != 3 {
+			return errors.New("malformed line in key file " + key.KeyFile)
+		}
+
+		algo, version := fields[0], fields[1]
+		if (len(key.Algo) > 0 && key.Algo != algo) || (len(key.ID) > 0 && key.ID != version) {
+			continue
+		}
+
+		seed, err := base64.RawStdEncoding.DecodeString(strings.TrimRight(fields[2], "="))
+		if err != nil {
+			return errors.Wrap(err, "couldn't decode the key in key file "+key.KeyFile)
+		}
+
+		key.Algo = algo
+		key.ID = version
+		key.Seed = string(seed)
+		return nil
+	}
+
+	return errors.New("no matching key in key file " + key.KeyFile)
+}
+
+// readSecretFile reads a file containing secret material, after checking that it can't be read by other users than
+// its owner.
+func readSecretFile(path string) ([]byte, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	// Windows doesn't have Unix permissions, so there's nothing meaningful to check there.
+	if runtime.GOOS != "windows" && info.Mode().Perm()&0077 != 0 {
+		return nil, fmt.Errorf(
+			"%s is accessible by other users than its owner (mode %o), it should be 0600", path, info.Mode().Perm(),
+		)
+	}
+
+	return ioutil.ReadFile(path)
+}
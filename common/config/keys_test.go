@@ -0,0 +1,110 @@
+package config
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const testSeed = "ahphigh9jahchiequiechee4pha1Atuv"
+
+func writeKeyTestFile(t *testing.T, dir, name, content string, perm os.FileMode) string {
+	path := filepath.Join(dir, name)
+	require.Nil(t, ioutil.WriteFile(path, []byte(content), perm))
+	// Make sure the permissions aren't altered by the umask.
+	require.Nil(t, os.Chmod(path, perm))
+	return path
+}
+
+func TestLoadSigningKeyFromKeyFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ident_keys")
+	require.Nil(t, err, err)
+	defer os.RemoveAll(dir)
+
+	otherSeed := "eiD3oonguu8aePhe2eiCh7xoo5oothei"
+	content := "ed25519 a_abcd " + base64.RawStdEncoding.EncodeToString([]byte(otherSeed)) + "\n" +
+		"ed25519 a_efgh " + base64.RawStdEncoding.EncodeToString([]byte(testSeed)) + "\n"
+	path := writeKeyTestFile(t, dir, "signing.key", content, 0600)
+
+	// Test that the first key is used if no ID is configured.
+	key := SigningKeyConfig{KeyFile: path}
+	require.Nil(t, loadSigningKey(&key))
+	require.Equal(t, "ed25519:a_abcd", key.KeyID())
+	require.Equal(t, otherSeed, key.Seed)
+
+	// Test that the key matching the configured ID is used.
+	key = SigningKeyConfig{KeyFile: path, ID: "a_efgh"}
+	require.Nil(t, loadSigningKey(&key))
+	require.Equal(t, "ed25519:a_efgh", key.KeyID())
+	require.Equal(t, testSeed, key.Seed)
+
+	key = SigningKeyConfig{KeyFile: path, ID: "a_ijkl"}
+	require.NotNil(t, loadSigningKey(&key))
+
+	// Test that a key file readable by other users is rejected.
+	path = writeKeyTestFile(t, dir, "world_readable.key", content, 0644)
+	key = SigningKeyConfig{KeyFile: path}
+	err = loadSigningKey(&key)
+	require.NotNil(t, err)
+	require.True(t, strings.Contains(err.Error(), "accessible by other users"), err.Error())
+}
+
+func TestLoadSigningKeyFromSeedFileAndEnv(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ident_keys")
+	require.Nil(t, err, err)
+	defer os.RemoveAll(dir)
+
+	path := writeKeyTestFile(t, dir, "seed", testSeed+"\n", 0400)
+
+	key := SigningKeyConfig{SeedFile: path}
+	require.Nil(t, loadSigningKey(&key))
+	require.Equal(t, testSeed, key.Seed)
+
+	// Test that trailing whitespace added by editors is ignored.
+	path = writeKeyTestFile(t, dir, "seed_with_spaces", testSeed+" \t\r\n", 0400)
+
+	key = SigningKeyConfig{SeedFile: path}
+	require.Nil(t, loadSigningKey(&key))
+	require.Equal(t, testSeed, key.Seed)
+
+	require.Nil(t, os.Setenv("IDENT_TEST_SEED", testSeed))
+	defer os.Unsetenv("IDENT_TEST_SEED")
+
+	key = SigningKeyConfig{SeedEnv: "IDENT_TEST_SEED"}
+	require.Nil(t, loadSigningKey(&key))
+	require.Equal(t, testSeed, key.Seed)
+
+	key = SigningKeyConfig{SeedEnv: "IDENT_TEST_UNSET_SEED"}
+	require.NotNil(t, loadSigningKey(&key))
+
+	// Test that setting several sources is rejected.
+	key = SigningKeyConfig{Seed: testSeed, SeedEnv: "IDENT_TEST_SEED"}
+	require.NotNil(t, loadSigningKey(&key))
+}
+
+func TestParseConfigWithKeyFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ident_keys")
+	require.Nil(t, err, err)
+	defer os.RemoveAll(dir)
+
+	// Test that a key file holding a seed of the wrong length is rejected.
+	content := "ed25519 a_abcd " + base64.RawStdEncoding.EncodeToString([]byte("short"))
+	path := writeKeyTestFile(t, dir, "signing.key", content, 0600)
+
+	_, err = ParseConfig([]byte("ident:\n  signing_key:\n    key_file: " + path))
+	require.NotNil(t, err)
+	require.True(t, strings.HasPrefix(err.Error(), "Invalid signing key configuration"), err.Error())
+
+	content = "ed25519 a_abcd " + base64.RawStdEncoding.EncodeToString([]byte(testSeed))
+	path = writeKeyTestFile(t, dir, "signing.key", content, 0600)
+
+	cfg, err := ParseConfig([]byte("ident:\n  signing_key:\n    key_file: " + path + "\nemail:\n  disabled: true"))
+	require.Nil(t, err, err)
+	require.Equal(t, "ed25519:a_abcd", cfg.Ident.SigningKey.KeyID())
+	require.NotEmpty(t, cfg.Ident.SigningKey.PubKeyBase64)
+}
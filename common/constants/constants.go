@@ -1,6 +1,19 @@
 package constants
 
 const APIPrefix = "/_matrix/identity/api/v1"
+const APIv2Prefix = "/_matrix/identity/v2"
 
 const MediumEmail = "email"
 const MediumMSISDN = "msisdn"
+
+// States of a 3PID invite.
+const (
+	// The invite is waiting for the invitee to join.
+	InviteStatePending = "pending"
+	// The invite has been signed through /sign-ed25519 for an MXID, and can't be signed for another one.
+	InviteStateSigned = "signed"
+	// The invite has been sent to the homeserver of the MXID its 3PID was bound to.
+	InviteStateDelivered = "delivered"
+	// The invite has been revoked by an administrator, and can't be signed nor delivered anymore.
+	InviteStateRevoked = "revoked"
+)
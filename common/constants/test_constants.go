@@ -13,20 +13,53 @@ ident:
       text: "/tmp/ident_invite_template_txt"
       html: "/tmp/ident_invite_template_html"
     subject_template: "{{.SenderDisplayName}} invited you to Matrix!"
+    sms_template: "{{.SenderDisplayName}} invited you to Matrix! Token: {{.Token}}"
+    ttl: 24h
+  validation:
+    email:
+      email_template:
+        text: "/tmp/ident_validation_template_txt"
+        html: "/tmp/ident_validation_template_html"
+      subject_template: "Confirm your email address for Matrix"
+    msisdn:
+      sms_template: "Your Matrix validation code is {{.Token}}"
 
 http:
   listen_addr: "127.0.0.1:9999"
 
+terms:
+  policies:
+    privacy_policy:
+      version: "1.0"
+      languages:
+        en:
+          name: "Privacy Policy"
+          url: "https://example.com/privacy-1.0-en.html"
+        fr:
+          name: "Politique de confidentialité"
+          url: "https://example.com/privacy-1.0-fr.html"
+
+sms:
+  provider: file
+  file:
+    path: "/tmp/ident_sms_log"
+
 database:
   driver: sqlite3
   conn_string: ":memory:"
 
 email:
   from: "Ident <ident@example.com>"
+  transport: file
+  file:
+    path: "/tmp/ident_mail"
   smtp:
     hostname: mail.example.com
     port: 465
     username: "ident@example.com"
     password: somepassword
     enable_tls: on
+  queue:
+    workers: 4
+    max_backoff: 10m
 `
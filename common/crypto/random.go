@@ -0,0 +1,78 @@
+// Package crypto generates the secrets Ident hands out (tokens, session IDs, keys, peppers). Everything here reads
+// from the operating system's cryptographically secure random number generator.
+package crypto
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"io"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+const (
+	alphanumeric = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+	digits       = "0123456789"
+)
+
+// RandString returns a random string of n alphanumeric characters.
+func RandString(n int) (string, error) {
+	return randFromAlphabet(alphanumeric, n)
+}
+
+// RandDigits returns a random string of n decimal digits, e.g. to be used as a code the user has to type in.
+func RandDigits(n int) (string, error) {
+	return randFromAlphabet(digits, n)
+}
+
+// RandBytes returns n random bytes.
+func RandBytes(n int) ([]byte, error) {
+	b := make([]byte, n)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		return nil, err
+	}
+
+	return b, nil
+}
+
+// RandBase64 returns n random bytes encoded using the unpadded URL-safe base64 encoding.
+func RandBase64(n int) (string, error) {
+	b, err := RandBytes(n)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// GenerateEd25519Key generates a new ed25519 key pair.
+func GenerateEd25519Key() (ed25519.PublicKey, ed25519.PrivateKey, error) {
+	return ed25519.GenerateKey(rand.Reader)
+}
+
+// randFromAlphabet returns a string of n characters picked uniformly from the given alphabet, which must contain at
+// most 256 characters. Random bytes that would bias the result towards the start of the alphabet are discarded.
+func randFromAlphabet(alphabet string, n int) (string, error) {
+	max := 256 - 256%len(alphabet)
+	out := make([]byte, 0, n)
+	buf := make([]byte, n)
+
+	for len(out) < n {
+		if _, err := io.ReadFull(rand.Reader, buf); err != nil {
+			return "", err
+		}
+
+		for _, b := range buf {
+			if int(b) >= max {
+				continue
+			}
+
+			out = append(out, alphabet[int(b)%len(alphabet)])
+			if len(out) == n {
+				break
+			}
+		}
+	}
+
+	return string(out), nil
+}
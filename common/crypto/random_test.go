@@ -0,0 +1,49 @@
+package crypto
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRandString(t *testing.T) {
+	s, err := RandString(128)
+	require.Nil(t, err, err)
+	require.Len(t, s, 128)
+
+	for _, c := range s {
+		require.True(t, strings.ContainsRune(alphanumeric, c), s)
+	}
+
+	other, err := RandString(128)
+	require.Nil(t, err, err)
+	require.NotEqual(t, s, other)
+}
+
+func TestRandDigits(t *testing.T) {
+	s, err := RandDigits(6)
+	require.Nil(t, err, err)
+	require.Len(t, s, 6)
+
+	for _, c := range s {
+		require.True(t, c >= '0' && c <= '9', s)
+	}
+}
+
+func TestRandBase64(t *testing.T) {
+	s, err := RandBase64(32)
+	require.Nil(t, err, err)
+	// 32 bytes are encoded into 43 characters without padding.
+	require.Len(t, s, 43)
+}
+
+func TestGenerateEd25519Key(t *testing.T) {
+	pub1, priv1, err := GenerateEd25519Key()
+	require.Nil(t, err, err)
+	pub2, priv2, err := GenerateEd25519Key()
+	require.Nil(t, err, err)
+
+	require.NotEqual(t, pub1, pub2)
+	require.NotEqual(t, priv1, priv2)
+}
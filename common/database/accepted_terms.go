@@ -0,0 +1,64 @@
+package database
+
+import (
+	"database/sql"
+)
+
+const acceptedTermsURLsSchema = `
+-- Stores the URLs of the policy documents each user has accepted
+CREATE TABLE IF NOT EXISTS accepted_terms_urls (
+	user_id TEXT NOT NULL,
+	url TEXT NOT NULL,
+	PRIMARY KEY (user_id, url)
+);
+`
+
+const insertAcceptedTermsURLSQL = `
+	INSERT INTO accepted_terms_urls (user_id, url) VALUES ($1, $2)
+	ON CONFLICT (user_id, url) DO NOTHING
+`
+
+const selectAcceptedTermsURLsSQL = `
+	SELECT url FROM accepted_terms_urls WHERE user_id = $1
+`
+
+type acceptedTermsURLsStatements struct {
+	insertAcceptedTermsURLStmt  *sql.Stmt
+	selectAcceptedTermsURLsStmt *sql.Stmt
+}
+
+func (s *acceptedTermsURLsStatements) prepare(db *sql.DB) (err error) {
+	if s.insertAcceptedTermsURLStmt, err = db.Prepare(insertAcceptedTermsURLSQL); err != nil {
+		return
+	}
+	if s.selectAcceptedTermsURLsStmt, err = db.Prepare(selectAcceptedTermsURLsSQL); err != nil {
+		return
+	}
+	return
+}
+
+func (s *acceptedTermsURLsStatements) insertAcceptedTermsURL(userID, url string) (err error) {
+	_, err = s.insertAcceptedTermsURLStmt.Exec(userID, url)
+	return
+}
+
+func (s *acceptedTermsURLsStatements) selectAcceptedTermsURLs(userID string) ([]string, error) {
+	rows, err := s.selectAcceptedTermsURLsStmt.Query(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	urls := make([]string, 0)
+	for rows.Next() {
+		var url string
+		if err = rows.Scan(&url); err != nil {
+			return nil, err
+		}
+
+		urls = append(urls, url)
+	}
+
+	return urls, rows.Err()
+}
@@ -0,0 +1,61 @@
+package database
+
+import (
+	"database/sql"
+)
+
+const accountTokensSchema = `
+-- Stores the access tokens of the accounts registered through the v2 API
+CREATE TABLE IF NOT EXISTS account_tokens (
+	token TEXT PRIMARY KEY,
+	user_id TEXT NOT NULL,
+	created_at BIGINT NOT NULL
+);
+`
+
+const insertAccountTokenSQL = `
+	INSERT INTO account_tokens (token, user_id, created_at)
+	VALUES ($1, $2, $3)
+`
+
+const selectUserIDForTokenSQL = `
+	SELECT user_id FROM account_tokens WHERE token = $1
+`
+
+const deleteAccountTokenSQL = `
+	DELETE FROM account_tokens WHERE token = $1
+`
+
+type accountTokensStatements struct {
+	insertAccountTokenStmt   *sql.Stmt
+	selectUserIDForTokenStmt *sql.Stmt
+	deleteAccountTokenStmt   *sql.Stmt
+}
+
+func (s *accountTokensStatements) prepare(db *sql.DB) (err error) {
+	if s.insertAccountTokenStmt, err = db.Prepare(insertAccountTokenSQL); err != nil {
+		return
+	}
+	if s.selectUserIDForTokenStmt, err = db.Prepare(selectUserIDForTokenSQL); err != nil {
+		return
+	}
+	if s.deleteAccountTokenStmt, err = db.Prepare(deleteAccountTokenSQL); err != nil {
+		return
+	}
+	return
+}
+
+func (s *accountTokensStatements) insertAccountToken(token, userID string, createdAt int64) (err error) {
+	_, err = s.insertAccountTokenStmt.Exec(token, userID, createdAt)
+	return
+}
+
+func (s *accountTokensStatements) selectUserIDForToken(token string) (userID string, err error) {
+	err = s.selectUserIDForTokenStmt.QueryRow(token).Scan(&userID)
+	return
+}
+
+func (s *accountTokensStatements) deleteAccountToken(token string) (err error) {
+	_, err = s.deleteAccountTokenStmt.Exec(token)
+	return
+}
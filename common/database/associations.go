@@ -0,0 +1,145 @@
+package database
+
+import (
+	"database/sql"
+
+	"github.com/babolivier/ident/common/types"
+)
+
+const associationsSchema = `
+-- Stores associations between 3PIDs and Matrix user IDs
+CREATE TABLE IF NOT EXISTS associations (
+	medium TEXT NOT NULL,
+	address TEXT NOT NULL,
+	mxid TEXT NOT NULL,
+	ts BIGINT NOT NULL,
+	not_before BIGINT NOT NULL,
+	not_after BIGINT NOT NULL,
+	-- Hash of the 3PID computed with the current lookup pepper, c.f. hashing.LookupHash
+	lookup_hash TEXT NOT NULL,
+	PRIMARY KEY (medium, address)
+);
+
+CREATE INDEX IF NOT EXISTS associations_lookup_hash_idx ON associations (lookup_hash);
+`
+
+const upsertAssociationSQL = `
+	INSERT INTO associations (medium, address, mxid, ts, not_before, not_after, lookup_hash)
+	VALUES ($1, $2, $3, $4, $5, $6, $7)
+	ON CONFLICT (medium, address) DO UPDATE SET mxid = $3, ts = $4, not_before = $5, not_after = $6, lookup_hash = $7
+`
+
+const selectAssociationSQL = `
+	SELECT medium, address, mxid, ts, not_before, not_after FROM associations
+	WHERE medium = $1 AND address = $2
+`
+
+const selectAssociationByLookupHashSQL = `
+	SELECT medium, address, mxid, ts, not_before, not_after FROM associations
+	WHERE lookup_hash = $1
+`
+
+const selectAllThreepidsSQL = `
+	SELECT medium, address FROM associations
+`
+
+const updateLookupHashSQL = `
+	UPDATE associations SET lookup_hash = $1 WHERE medium = $2 AND address = $3
+`
+
+const deleteAssociationSQL = `
+	DELETE FROM associations WHERE medium = $1 AND address = $2 AND mxid = $3
+`
+
+type associationsStatements struct {
+	upsertAssociationStmt             *sql.Stmt
+	selectAssociationStmt             *sql.Stmt
+	selectAssociationByLookupHashStmt *sql.Stmt
+	selectAllThreepidsStmt            *sql.Stmt
+	updateLookupHashStmt              *sql.Stmt
+	deleteAssociationStmt             *sql.Stmt
+}
+
+func (s *associationsStatements) prepare(db *sql.DB) (err error) {
+	if s.upsertAssociationStmt, err = db.Prepare(upsertAssociationSQL); err != nil {
+		return
+	}
+	if s.selectAssociationStmt, err = db.Prepare(selectAssociationSQL); err != nil {
+		return
+	}
+	if s.selectAssociationByLookupHashStmt, err = db.Prepare(selectAssociationByLookupHashSQL); err != nil {
+		return
+	}
+	if s.selectAllThreepidsStmt, err = db.Prepare(selectAllThreepidsSQL); err != nil {
+		return
+	}
+	if s.updateLookupHashStmt, err = db.Prepare(updateLookupHashSQL); err != nil {
+		return
+	}
+	if s.deleteAssociationStmt, err = db.Prepare(deleteAssociationSQL); err != nil {
+		return
+	}
+	return
+}
+
+func (s *associationsStatements) upsertAssociation(
+	txn *sql.Tx, assoc *types.ThreepidAssociation, lookupHash string,
+) (err error) {
+	_, err = txStmt(txn, s.upsertAssociationStmt).Exec(
+		assoc.Medium, assoc.Address, assoc.MXID, assoc.TS, assoc.NotBefore, assoc.NotAfter, lookupHash,
+	)
+	return
+}
+
+func (s *associationsStatements) selectAssociation(medium, address string) (*types.ThreepidAssociation, error) {
+	return scanAssociation(s.selectAssociationStmt.QueryRow(medium, address))
+}
+
+func (s *associationsStatements) selectAssociationByLookupHash(lookupHash string) (*types.ThreepidAssociation, error) {
+	return scanAssociation(s.selectAssociationByLookupHashStmt.QueryRow(lookupHash))
+}
+
+// selectAllThreepids returns the [medium, address] pairs of all the 3PIDs we have an association for.
+func (s *associationsStatements) selectAllThreepids(txn *sql.Tx) ([][2]string, error) {
+	rows, err := txn.Stmt(s.selectAllThreepidsStmt).Query()
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	threepids := make([][2]string, 0)
+	for rows.Next() {
+		var threepid [2]string
+		if err = rows.Scan(&threepid[0], &threepid[1]); err != nil {
+			return nil, err
+		}
+
+		threepids = append(threepids, threepid)
+	}
+
+	return threepids, rows.Err()
+}
+
+func (s *associationsStatements) updateLookupHash(txn *sql.Tx, medium, address, lookupHash string) (err error) {
+	_, err = txn.Stmt(s.updateLookupHashStmt).Exec(lookupHash, medium, address)
+	return
+}
+
+func (s *associationsStatements) deleteAssociation(medium, address, mxid string) (deleted bool, err error) {
+	res, err := s.deleteAssociationStmt.Exec(medium, address, mxid)
+	if err != nil {
+		return
+	}
+
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func scanAssociation(row *sql.Row) (*types.ThreepidAssociation, error) {
+	var assoc types.ThreepidAssociation
+
+	err := row.Scan(&assoc.Medium, &assoc.Address, &assoc.MXID, &assoc.TS, &assoc.NotBefore, &assoc.NotAfter)
+
+	return &assoc, err
+}
@@ -4,58 +4,106 @@ import (
 	"database/sql"
 
 	"github.com/babolivier/ident/common/types"
-
-	_ "github.com/lib/pq"
-	_ "github.com/mattn/go-sqlite3"
 )
 
-type Database struct {
-	db                  *sql.DB
-	invites             invitesStatements
-	ephemeralPublicKeys ephemeralPublicKeysStatements
-}
+// Database is the storage used by Ident. The getters return a nil result (or an empty string) rather than an error if
+// the requested data doesn't exist.
+type Database interface {
+	// Save3PIDInvite saves the given invite. Invites without a state are saved as pending.
+	Save3PIDInvite(invite *types.ThreepidInvite) error
+	// Save3PIDInviteWithMail saves the given invite along with its ephemeral public key, and queues the given email if
+	// it isn't nil, in a single transaction: none of them are stored if one of them can't be.
+	Save3PIDInviteWithMail(invite *types.ThreepidInvite, mail *types.QueuedMail) error
+	Get3PIDInviteByToken(token string) (*types.ThreepidInvite, error)
+	Get3PIDInvitesForAddress(medium, address string) ([]*types.ThreepidInvite, error)
+	// Delete3PIDInvitesCreatedBefore deletes the invites created before the given timestamp and returns how many were
+	// deleted.
+	Delete3PIDInvitesCreatedBefore(ts int64) (int64, error)
+	// Sign3PIDInvite marks the invite with the given token as signed for the given MXID if it's pending. It returns
+	// false, and leaves the invite untouched, if it isn't pending.
+	Sign3PIDInvite(token, mxid string, ts int64) (bool, error)
+	// Mark3PIDInviteDelivered marks the invite with the given token as delivered to the given MXID, unless it's been
+	// revoked, delivered already or signed for another MXID. It returns whether the invite was updated.
+	Mark3PIDInviteDelivered(token, mxid string, ts int64) (bool, error)
+	// Revoke3PIDInvite revokes the invite with the given token, unless it's been delivered or revoked already, and
+	// deletes its ephemeral public key so it isn't considered valid anymore. It returns whether the invite was revoked.
+	Revoke3PIDInvite(token string, ts int64) (bool, error)
 
-func NewDatabase(driver string, connString string) (*Database, error) {
-	var db *sql.DB
-	var err error
+	SaveEphemeralPublicKey(pubkey string, createdAt int64) error
+	// EphemeralPublicKeyExists returns whether the given ephemeral public key is known and was created at or after
+	// the given timestamp.
+	EphemeralPublicKeyExists(pubkey string, createdAfter int64) (bool, error)
+	// DeleteEphemeralPublicKeysCreatedBefore deletes the ephemeral public keys created before the given timestamp and
+	// returns how many were deleted.
+	DeleteEphemeralPublicKeysCreatedBefore(ts int64) (int64, error)
 
-	if db, err = sql.Open(driver, connString); err != nil {
-		return nil, err
-	}
+	SaveValidationSession(session *types.ValidationSession) error
+	GetValidationSession(sid, clientSecret string) (*types.ValidationSession, error)
+	// GetValidationSessionForThreepid returns the most recent session for the given client secret and 3PID.
+	GetValidationSessionForThreepid(clientSecret, medium, address string) (*types.ValidationSession, error)
+	UpdateValidationSessionSendAttempt(sid string, sendAttempt int) error
+	MarkValidationSessionValidated(sid string, validatedAt int64) error
+	// AddValidationSessionTokenAttempt records an attempt at submitting the token of the given session, unless
+	// maxAttempts attempts have already been recorded, in which case it returns false.
+	AddValidationSessionTokenAttempt(sid string, maxAttempts int) (bool, error)
 
-	invites := invitesStatements{}
-	if err = invites.prepare(db); err != nil {
-		return nil, err
-	}
+	// SaveAssociation saves the given association, along with its hash computed with the current lookup pepper. If an
+	// association already exists for this 3PID, it is replaced.
+	SaveAssociation(assoc *types.ThreepidAssociation) error
+	GetAssociation(medium, address string) (*types.ThreepidAssociation, error)
+	// GetAssociationByLookupHash returns the association whose 3PID matches the given hash, computed with the current
+	// lookup pepper.
+	GetAssociationByLookupHash(lookupHash string) (*types.ThreepidAssociation, error)
+	// DeleteAssociation deletes the association between the given 3PID and MXID. Returns false if no such
+	// association exists.
+	DeleteAssociation(medium, address, mxid string) (bool, error)
 
-	ephemeralPublicKeys := ephemeralPublicKeysStatements{}
-	if err = ephemeralPublicKeys.prepare(db); err != nil {
-		return nil, err
-	}
+	SaveAccountToken(token, userID string, createdAt int64) error
+	// GetUserIDForAccountToken returns the ID of the user the given access token belongs to, or an empty string if
+	// the token is unknown.
+	GetUserIDForAccountToken(token string) (string, error)
+	DeleteAccountToken(token string) error
 
-	return &Database{db, invites, ephemeralPublicKeys}, nil
-}
+	// SaveAcceptedTermsURLs records that the given user has accepted the policy documents with the given URLs.
+	SaveAcceptedTermsURLs(userID string, urls []string) error
+	GetAcceptedTermsURLs(userID string) ([]string, error)
 
-func (d *Database) Save3PIDInvite(invite *types.ThreepidInvite) error {
-	return d.invites.insertInvite(invite)
-}
+	// EnqueueMail adds the given email to the outbound queue. Its ID is ignored, and set by the database.
+	EnqueueMail(mail *types.QueuedMail) error
+	// ClaimDueMails returns up to limit queued emails that are due to be sent at the given time, and pushes their next
+	// attempt back to leaseUntil so they aren't claimed again while they're being sent.
+	ClaimDueMails(now, leaseUntil int64, limit int) ([]*types.QueuedMail, error)
+	// RescheduleMail records a failed attempt at sending a queued email, and when the next attempt is due.
+	RescheduleMail(id int64, attempts int, nextAttemptAt int64, lastError string) error
+	DeleteMail(id int64) error
 
-func (d *Database) Get3PIDInviteByToken(token string) (*types.ThreepidInvite, error) {
-	invite, err := d.invites.selectInviteByToken(token)
+	GetLookupPepper() (string, error)
+	// RotateLookupPepper generates a new lookup pepper and updates the hashes of all associations accordingly.
+	// Returns the new pepper.
+	RotateLookupPepper() (string, error)
+}
 
-	// Don't return an error on empty result set, instead return a nil invite.
-	if err == sql.ErrNoRows {
-		invite = nil
-		err = nil
+// NewDatabase returns the implementation of Database for the given driver. The "memory" driver keeps everything in
+// memory and ignores the connection string; any other driver is handled by SQLDatabase.
+func NewDatabase(driver string, connString string) (Database, error) {
+	if driver == DriverMemory {
+		return NewMemoryDatabase()
 	}
 
-	return invite, err
+	return NewSQLDatabase(driver, connString)
 }
 
-func (d *Database) SaveEphemeralPublicKey(pubkey string) error {
-	return d.ephemeralPublicKeys.insertEphemeralPublicKey(pubkey)
-}
+// CheckConnection checks that a connection to the database can be established, without creating the schema.
+func CheckConnection(driver string, connString string) error {
+	if driver == DriverMemory {
+		return nil
+	}
+
+	db, err := sql.Open(driver, connString)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
 
-func (d *Database) EphemeralPublicKeyExists(pubkey string) (bool, error) {
-	return d.ephemeralPublicKeys.ephemeralPublicKeyExists(pubkey)
+	return db.Ping()
 }
@@ -4,47 +4,458 @@ import (
 	"testing"
 
 	"github.com/babolivier/ident/common/constants"
+	"github.com/babolivier/ident/common/hashing"
 	"github.com/babolivier/ident/common/types"
 
 	"github.com/stretchr/testify/require"
 )
 
-func TestInsertInvite(t *testing.T) {
-	db, err := NewDatabase("sqlite3", ":memory:")
-	require.Nil(t, err, err)
-
-	in := &types.ThreepidInvite{
-		Token:   "sometoken",
-		Medium:  constants.MediumEmail,
-		Address: "alice@example.com",
-		RoomID:  "!someroom:example.com",
-		Sender:  "@bob:example.com",
+// testWithDatabases runs the given test against every implementation of Database.
+func testWithDatabases(t *testing.T, testFunc func(t *testing.T, db Database)) {
+	drivers := map[string]string{
+		DriverSQLite3: ":memory:",
+		DriverMemory:  "",
+	}
+
+	for driver, connString := range drivers {
+		t.Run(driver, func(t *testing.T) {
+			db, err := NewDatabase(driver, connString)
+			require.Nil(t, err, err)
+
+			testFunc(t, db)
+		})
 	}
+}
 
-	err = db.Save3PIDInvite(in)
-	require.Nil(t, err, err)
+func TestInsertInvite(t *testing.T) {
+	testWithDatabases(t, func(t *testing.T, db Database) {
+		in := &types.ThreepidInvite{
+			Token:              "sometoken",
+			Medium:             constants.MediumEmail,
+			Address:            "alice@example.com",
+			RoomID:             "!someroom:example.com",
+			Sender:             "@bob:example.com",
+			CreatedAt:          1000,
+			EphemeralPublicKey: "somekey",
+		}
 
-	out, err := db.invites.selectInviteByToken(in.Token)
-	require.Nil(t, err, err)
+		err := db.Save3PIDInvite(in)
+		require.Nil(t, err, err)
 
-	require.Equal(t, in.Token, out.Token)
-	require.Equal(t, in.Medium, out.Medium)
-	require.Equal(t, in.Address, out.Address)
-	require.Equal(t, in.RoomID, out.RoomID)
-	require.Equal(t, in.Sender, out.Sender)
+		out, err := db.Get3PIDInviteByToken(in.Token)
+		require.Nil(t, err, err)
+
+		require.Equal(t, in.Token, out.Token)
+		require.Equal(t, in.Medium, out.Medium)
+		require.Equal(t, in.Address, out.Address)
+		require.Equal(t, in.RoomID, out.RoomID)
+		require.Equal(t, in.Sender, out.Sender)
+		require.Equal(t, in.CreatedAt, out.CreatedAt)
+		require.Equal(t, in.EphemeralPublicKey, out.EphemeralPublicKey)
+
+		deleted, err := db.Delete3PIDInvitesCreatedBefore(1001)
+		require.Nil(t, err, err)
+		require.Equal(t, int64(1), deleted)
+	})
+}
+
+func TestInviteState(t *testing.T) {
+	testWithDatabases(t, func(t *testing.T, db Database) {
+		for _, token := range []string{"sometoken", "someothertoken"} {
+			err := db.Save3PIDInvite(&types.ThreepidInvite{
+				Token:              token,
+				Medium:             constants.MediumEmail,
+				Address:            "alice@example.com",
+				RoomID:             "!someroom:example.com",
+				Sender:             "@bob:example.com",
+				CreatedAt:          1000,
+				EphemeralPublicKey: token + "key",
+			})
+			require.Nil(t, err, err)
+
+			err = db.SaveEphemeralPublicKey(token+"key", 1000)
+			require.Nil(t, err, err)
+		}
+
+		// Test that invites are pending by default.
+		invite, err := db.Get3PIDInviteByToken("sometoken")
+		require.Nil(t, err, err)
+		require.Equal(t, constants.InviteStatePending, invite.State)
+
+		// Test that an invite can only be signed while it's pending.
+		ok, err := db.Sign3PIDInvite("sometoken", "@alice:example.com", 2000)
+		require.Nil(t, err, err)
+		require.True(t, ok)
+
+		ok, err = db.Sign3PIDInvite("sometoken", "@mallory:example.com", 3000)
+		require.Nil(t, err, err)
+		require.False(t, ok)
+
+		invite, err = db.Get3PIDInviteByToken("sometoken")
+		require.Nil(t, err, err)
+		require.Equal(t, constants.InviteStateSigned, invite.State)
+		require.Equal(t, "@alice:example.com", invite.SignedFor)
+		require.Equal(t, int64(2000), invite.StateChangedAt)
+
+		// Test that a signed invite can only be delivered to the MXID it was signed for.
+		ok, err = db.Mark3PIDInviteDelivered("sometoken", "@mallory:example.com", 3000)
+		require.Nil(t, err, err)
+		require.False(t, ok)
+
+		ok, err = db.Mark3PIDInviteDelivered("sometoken", "@alice:example.com", 3000)
+		require.Nil(t, err, err)
+		require.True(t, ok)
+
+		// Test that delivered invites can't be revoked, but pending ones can.
+		ok, err = db.Revoke3PIDInvite("sometoken", 4000)
+		require.Nil(t, err, err)
+		require.False(t, ok)
+
+		ok, err = db.Revoke3PIDInvite("someothertoken", 4000)
+		require.Nil(t, err, err)
+		require.True(t, ok)
+
+		// Test that revoking an invite deletes its ephemeral public key, and only this one.
+		exists, err := db.EphemeralPublicKeyExists("someothertokenkey", 0)
+		require.Nil(t, err, err)
+		require.False(t, exists)
+
+		exists, err = db.EphemeralPublicKeyExists("sometokenkey", 0)
+		require.Nil(t, err, err)
+		require.True(t, exists)
+
+		// Test that revoked invites can't be signed nor delivered.
+		ok, err = db.Sign3PIDInvite("someothertoken", "@alice:example.com", 5000)
+		require.Nil(t, err, err)
+		require.False(t, ok)
+
+		ok, err = db.Mark3PIDInviteDelivered("someothertoken", "@alice:example.com", 5000)
+		require.Nil(t, err, err)
+		require.False(t, ok)
+
+		invite, err = db.Get3PIDInviteByToken("someothertoken")
+		require.Nil(t, err, err)
+		require.Equal(t, constants.InviteStateRevoked, invite.State)
+		require.Equal(t, int64(4000), invite.StateChangedAt)
+	})
 }
 
 func TestSaveEphemeralPublicKey(t *testing.T) {
-	db, err := NewDatabase("sqlite3", ":memory:")
-	require.Nil(t, err, err)
+	testWithDatabases(t, func(t *testing.T, db Database) {
+		key := "abcdef"
+
+		err := db.SaveEphemeralPublicKey(key, 1000)
+		require.Nil(t, err, err)
+
+		exists, err := db.EphemeralPublicKeyExists(key, 1000)
+		require.Nil(t, err, err)
+		require.True(t, exists)
+
+		// Test that a key created before the given timestamp isn't returned.
+		exists, err = db.EphemeralPublicKeyExists(key, 1001)
+		require.Nil(t, err, err)
+		require.False(t, exists)
+
+		deleted, err := db.DeleteEphemeralPublicKeysCreatedBefore(1001)
+		require.Nil(t, err, err)
+		require.Equal(t, int64(1), deleted)
+	})
+}
+
+func TestSave3PIDInviteWithMail(t *testing.T) {
+	testWithDatabases(t, func(t *testing.T, db Database) {
+		invite := &types.ThreepidInvite{
+			Token:              "sometoken",
+			Medium:             constants.MediumEmail,
+			Address:            "alice@example.com",
+			RoomID:             "!someroom:example.com",
+			Sender:             "@bob:example.com",
+			CreatedAt:          1000,
+			EphemeralPublicKey: "somekey",
+		}
+		mail := &types.QueuedMail{
+			Recipient:     "alice@example.com",
+			Message:       []byte("Subject: Hello\r\n\r\nHello Alice"),
+			NextAttemptAt: 1000,
+			CreatedAt:     1000,
+		}
+
+		err := db.Save3PIDInviteWithMail(invite, mail)
+		require.Nil(t, err, err)
+
+		out, err := db.Get3PIDInviteByToken(invite.Token)
+		require.Nil(t, err, err)
+		require.NotNil(t, out)
+		require.Equal(t, constants.InviteStatePending, out.State)
+
+		exists, err := db.EphemeralPublicKeyExists(invite.EphemeralPublicKey, 1000)
+		require.Nil(t, err, err)
+		require.True(t, exists)
+
+		mails, err := db.ClaimDueMails(1000, 5000, 10)
+		require.Nil(t, err, err)
+		require.Len(t, mails, 1)
+
+		// Test that nothing is stored if the ephemeral public key can't be.
+		err = db.Save3PIDInviteWithMail(&types.ThreepidInvite{
+			Token:              "someothertoken",
+			Medium:             constants.MediumEmail,
+			Address:            "carol@example.com",
+			RoomID:             "!someroom:example.com",
+			Sender:             "@bob:example.com",
+			CreatedAt:          2000,
+			EphemeralPublicKey: "somekey",
+		}, mail)
+		require.NotNil(t, err)
+
+		out, err = db.Get3PIDInviteByToken("someothertoken")
+		require.Nil(t, err, err)
+		require.Nil(t, out)
+
+		mails, err = db.ClaimDueMails(6000, 7000, 10)
+		require.Nil(t, err, err)
+		require.Len(t, mails, 1)
+
+		// Test that the email is optional.
+		invite.Token = "yetanothertoken"
+		invite.EphemeralPublicKey = "someotherkey"
+		require.Nil(t, db.Save3PIDInviteWithMail(invite, nil))
+	})
+}
+
+func TestValidationSession(t *testing.T) {
+	testWithDatabases(t, func(t *testing.T, db Database) {
+		in := &types.ValidationSession{
+			ID:           "somesid",
+			Medium:       constants.MediumEmail,
+			Address:      "alice@example.com",
+			ClientSecret: "somesecret",
+			Token:        "sometoken",
+			SendAttempt:  1,
+			CreatedAt:    1000,
+		}
+
+		err := db.SaveValidationSession(in)
+		require.Nil(t, err, err)
+
+		// Test that the session can't be retrieved with the wrong client secret.
+		out, err := db.GetValidationSession(in.ID, "othersecret")
+		require.Nil(t, err, err)
+		require.Nil(t, out)
+
+		out, err = db.GetValidationSessionForThreepid(in.ClientSecret, in.Medium, in.Address)
+		require.Nil(t, err, err)
+		require.Equal(t, in, out)
+
+		err = db.UpdateValidationSessionSendAttempt(in.ID, 2)
+		require.Nil(t, err, err)
+
+		err = db.MarkValidationSessionValidated(in.ID, 2000)
+		require.Nil(t, err, err)
+
+		out, err = db.GetValidationSession(in.ID, in.ClientSecret)
+		require.Nil(t, err, err)
+		require.Equal(t, 2, out.SendAttempt)
+		require.Equal(t, int64(2000), out.ValidatedAt)
+		require.True(t, out.Validated())
+
+		// Test that token attempts are only recorded until the limit is reached.
+		for i := 0; i < 2; i++ {
+			ok, err := db.AddValidationSessionTokenAttempt(in.ID, 2)
+			require.Nil(t, err, err)
+			require.True(t, ok)
+		}
+
+		ok, err := db.AddValidationSessionTokenAttempt(in.ID, 2)
+		require.Nil(t, err, err)
+		require.False(t, ok)
+
+		out, err = db.GetValidationSession(in.ID, in.ClientSecret)
+		require.Nil(t, err, err)
+		require.Equal(t, 2, out.TokenAttempts)
+	})
+}
+
+func TestSaveAssociation(t *testing.T) {
+	testWithDatabases(t, func(t *testing.T, db Database) {
+		in := &types.ThreepidAssociation{
+			Medium:    constants.MediumEmail,
+			Address:   "alice@example.com",
+			MXID:      "@alice:example.com",
+			NotBefore: 1000,
+			NotAfter:  3000,
+			TS:        1000,
+		}
+
+		err := db.SaveAssociation(in)
+		require.Nil(t, err, err)
+
+		out, err := db.GetAssociation(in.Medium, in.Address)
+		require.Nil(t, err, err)
+		require.Equal(t, in, out)
+
+		// Test that saving an association for the same 3PID replaces the existing one.
+		in.MXID = "@alice:otherdomain.com"
+		in.TS = 2000
+
+		err = db.SaveAssociation(in)
+		require.Nil(t, err, err)
+
+		out, err = db.GetAssociation(in.Medium, in.Address)
+		require.Nil(t, err, err)
+		require.Equal(t, in, out)
+
+		out, err = db.GetAssociation(in.Medium, "bob@example.com")
+		require.Nil(t, err, err)
+		require.Nil(t, out)
+
+		// Test that an association is only deleted if the MXID matches.
+		deleted, err := db.DeleteAssociation(in.Medium, in.Address, "@alice:example.com")
+		require.Nil(t, err, err)
+		require.False(t, deleted)
+
+		deleted, err = db.DeleteAssociation(in.Medium, in.Address, in.MXID)
+		require.Nil(t, err, err)
+		require.True(t, deleted)
+
+		out, err = db.GetAssociation(in.Medium, in.Address)
+		require.Nil(t, err, err)
+		require.Nil(t, out)
+	})
+}
+
+func TestAccountToken(t *testing.T) {
+	testWithDatabases(t, func(t *testing.T, db Database) {
+		token := "sometoken"
+		userID := "@alice:example.com"
+
+		err := db.SaveAccountToken(token, userID, 1000)
+		require.Nil(t, err, err)
+
+		out, err := db.GetUserIDForAccountToken(token)
+		require.Nil(t, err, err)
+		require.Equal(t, userID, out)
+
+		err = db.DeleteAccountToken(token)
+		require.Nil(t, err, err)
+
+		out, err = db.GetUserIDForAccountToken(token)
+		require.Nil(t, err, err)
+		require.Empty(t, out)
+	})
+}
+
+func TestAcceptedTermsURLs(t *testing.T) {
+	testWithDatabases(t, func(t *testing.T, db Database) {
+		userID := "@alice:example.com"
+
+		urls, err := db.GetAcceptedTermsURLs(userID)
+		require.Nil(t, err, err)
+		require.Empty(t, urls)
+
+		err = db.SaveAcceptedTermsURLs(userID, []string{"https://example.com/a", "https://example.com/b"})
+		require.Nil(t, err, err)
+
+		// Test that accepting the same URL twice doesn't fail nor duplicate it.
+		err = db.SaveAcceptedTermsURLs(userID, []string{"https://example.com/a"})
+		require.Nil(t, err, err)
+
+		urls, err = db.GetAcceptedTermsURLs(userID)
+		require.Nil(t, err, err)
+		require.ElementsMatch(t, []string{"https://example.com/a", "https://example.com/b"}, urls)
+	})
+}
+
+func TestRotateLookupPepper(t *testing.T) {
+	testWithDatabases(t, func(t *testing.T, db Database) {
+		// Test that a pepper was generated when creating the database.
+		pepper, err := db.GetLookupPepper()
+		require.Nil(t, err, err)
+		require.NotEmpty(t, pepper)
+
+		assoc := &types.ThreepidAssociation{
+			Medium:  constants.MediumEmail,
+			Address: "alice@example.com",
+			MXID:    "@alice:example.com",
+		}
+
+		err = db.SaveAssociation(assoc)
+		require.Nil(t, err, err)
+
+		out, err := db.GetAssociationByLookupHash(hashing.LookupHash(assoc.Medium, assoc.Address, pepper))
+		require.Nil(t, err, err)
+		require.NotNil(t, out)
+		require.Equal(t, assoc.MXID, out.MXID)
+
+		// Test that rotating the pepper updates the hashes.
+		newPepper, err := db.RotateLookupPepper()
+		require.Nil(t, err, err)
+		require.NotEqual(t, pepper, newPepper)
+
+		savedPepper, err := db.GetLookupPepper()
+		require.Nil(t, err, err)
+		require.Equal(t, newPepper, savedPepper)
+
+		out, err = db.GetAssociationByLookupHash(hashing.LookupHash(assoc.Medium, assoc.Address, pepper))
+		require.Nil(t, err, err)
+		require.Nil(t, out)
+
+		out, err = db.GetAssociationByLookupHash(hashing.LookupHash(assoc.Medium, assoc.Address, newPepper))
+		require.Nil(t, err, err)
+		require.NotNil(t, out)
+		require.Equal(t, assoc.MXID, out.MXID)
+	})
+}
+
+func TestMailQueue(t *testing.T) {
+	testWithDatabases(t, func(t *testing.T, db Database) {
+		err := db.EnqueueMail(&types.QueuedMail{
+			Recipient:     "alice@example.com",
+			Message:       []byte("Subject: Hello\r\n\r\nHello Alice"),
+			NextAttemptAt: 1000,
+			CreatedAt:     1000,
+		})
+		require.Nil(t, err, err)
+
+		err = db.EnqueueMail(&types.QueuedMail{
+			Recipient:     "bob@example.com",
+			Message:       []byte("Subject: Hello\r\n\r\nHello Bob"),
+			NextAttemptAt: 2000,
+			CreatedAt:     1000,
+		})
+		require.Nil(t, err, err)
+
+		// Test that only the emails that are due are claimed.
+		mails, err := db.ClaimDueMails(1500, 5000, 10)
+		require.Nil(t, err, err)
+		require.Len(t, mails, 1)
+		require.Equal(t, "alice@example.com", mails[0].Recipient)
+		require.Equal(t, "Subject: Hello\r\n\r\nHello Alice", string(mails[0].Message))
+		require.Equal(t, int64(5000), mails[0].NextAttemptAt)
+
+		// Test that a claimed email isn't claimed again before its lease ends, and that the limit is respected.
+		mails, err = db.ClaimDueMails(3000, 5000, 10)
+		require.Nil(t, err, err)
+		require.Len(t, mails, 1)
+		require.Equal(t, "bob@example.com", mails[0].Recipient)
 
-	key := "abcdef"
+		err = db.RescheduleMail(mails[0].ID, 1, 4000, "Connection refused")
+		require.Nil(t, err, err)
 
-	err = db.SaveEphemeralPublicKey(key)
-	require.Nil(t, err, err)
+		mails, err = db.ClaimDueMails(6000, 7000, 1)
+		require.Nil(t, err, err)
+		require.Len(t, mails, 1)
+		require.Equal(t, "bob@example.com", mails[0].Recipient)
+		require.Equal(t, 1, mails[0].Attempts)
+		require.Equal(t, "Connection refused", mails[0].LastError)
 
-	exists, err := db.EphemeralPublicKeyExists(key)
-	require.Nil(t, err, err)
+		err = db.DeleteMail(mails[0].ID)
+		require.Nil(t, err, err)
 
-	require.True(t, exists)
+		// Only Alice's email is left.
+		mails, err = db.ClaimDueMails(8000, 9000, 10)
+		require.Nil(t, err, err)
+		require.Len(t, mails, 1)
+		require.Equal(t, "alice@example.com", mails[0].Recipient)
+	})
 }
@@ -5,47 +5,80 @@ import "database/sql"
 const ephemeralPublicKeysSchema = `
 -- Stores public ephemeral keys
 CREATE TABLE IF NOT EXISTS ephemeral_public_keys (
-	ephemeral_public_key TEXT PRIMARY KEY
+	ephemeral_public_key TEXT PRIMARY KEY,
+	created_at BIGINT NOT NULL DEFAULT 0
 );
 `
 
 const insertEphemeralPublicKeySQL = `
-	INSERT INTO ephemeral_public_keys (ephemeral_public_key)
-	VALUES ($1)
+	INSERT INTO ephemeral_public_keys (ephemeral_public_key, created_at)
+	VALUES ($1, $2)
 `
 
 const ephemeralEphemeralPublicKeyExistsSQL = `
-	SELECT COUNT(ephemeral_public_key) FROM ephemeral_public_keys WHERE ephemeral_public_key = $1
+	SELECT COUNT(ephemeral_public_key) FROM ephemeral_public_keys
+	WHERE ephemeral_public_key = $1 AND created_at >= $2
+`
+
+const deleteEphemeralPublicKeysCreatedBeforeSQL = `
+	DELETE FROM ephemeral_public_keys WHERE created_at < $1
+`
+
+const deleteEphemeralPublicKeyForInviteSQL = `
+	DELETE FROM ephemeral_public_keys WHERE ephemeral_public_key IN (
+		SELECT ephemeral_public_key FROM invites WHERE token = $1
+	)
 `
 
 type ephemeralPublicKeysStatements struct {
 	insertEphemeralPublicKeyStmt *sql.Stmt
 	ephemeralPublicKeyExistsStmt *sql.Stmt
+	deleteKeysCreatedBeforeStmt  *sql.Stmt
+	deleteKeyForInviteStmt       *sql.Stmt
 }
 
 func (s *ephemeralPublicKeysStatements) prepare(db *sql.DB) (err error) {
-	_, err = db.Exec(ephemeralPublicKeysSchema)
-	if err != nil {
-		return
-	}
 	if s.insertEphemeralPublicKeyStmt, err = db.Prepare(insertEphemeralPublicKeySQL); err != nil {
 		return
 	}
 	if s.ephemeralPublicKeyExistsStmt, err = db.Prepare(ephemeralEphemeralPublicKeyExistsSQL); err != nil {
 		return
 	}
+	if s.deleteKeysCreatedBeforeStmt, err = db.Prepare(deleteEphemeralPublicKeysCreatedBeforeSQL); err != nil {
+		return
+	}
+	if s.deleteKeyForInviteStmt, err = db.Prepare(deleteEphemeralPublicKeyForInviteSQL); err != nil {
+		return
+	}
 	return
-
 }
 
-func (s *ephemeralPublicKeysStatements) insertEphemeralPublicKey(pubkey string) (err error) {
-	_, err = s.insertEphemeralPublicKeyStmt.Exec(pubkey)
+func (s *ephemeralPublicKeysStatements) insertEphemeralPublicKey(
+	txn *sql.Tx, pubkey string, createdAt int64,
+) (err error) {
+	_, err = txStmt(txn, s.insertEphemeralPublicKeyStmt).Exec(pubkey, createdAt)
 	return
 }
 
-func (s *ephemeralPublicKeysStatements) ephemeralPublicKeyExists(pubkey string) (exists bool, err error) {
+func (s *ephemeralPublicKeysStatements) ephemeralPublicKeyExists(
+	pubkey string, createdAfter int64,
+) (exists bool, err error) {
 	var count int
-	row := s.ephemeralPublicKeyExistsStmt.QueryRow(pubkey)
+	row := s.ephemeralPublicKeyExistsStmt.QueryRow(pubkey, createdAfter)
 	err = row.Scan(&count)
 	return count != 0, err
 }
+
+func (s *ephemeralPublicKeysStatements) deleteKeysCreatedBefore(ts int64) (int64, error) {
+	res, err := s.deleteKeysCreatedBeforeStmt.Exec(ts)
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
+
+func (s *ephemeralPublicKeysStatements) deleteKeyForInvite(txn *sql.Tx, token string) (err error) {
+	_, err = txn.Stmt(s.deleteKeyForInviteStmt).Exec(token)
+	return
+}
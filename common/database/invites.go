@@ -13,41 +13,81 @@ CREATE TABLE IF NOT EXISTS invites (
 	medium TEXT NOT NULL,
 	address TEXT NOT NULL,
 	room_id TEXT NOT NULL,
-	sender TEXT NOT NULL
+	sender TEXT NOT NULL,
+	created_at BIGINT NOT NULL DEFAULT 0
 );
 `
 
+// Binds invites to the ephemeral key generated for them. Invites stored before this column existed get an empty key.
+const invitesEphemeralPublicKeySchema = `
+ALTER TABLE invites ADD COLUMN ephemeral_public_key TEXT NOT NULL DEFAULT '';
+`
+
+// Tracks the state of invites, so they can only be claimed once. Invites stored before these columns existed are
+// considered pending.
+const invitesStateSchema = `
+ALTER TABLE invites ADD COLUMN state TEXT NOT NULL DEFAULT 'pending';
+`
+
+const invitesSignedForSchema = `
+ALTER TABLE invites ADD COLUMN signed_for TEXT NOT NULL DEFAULT '';
+`
+
+const invitesStateChangedAtSchema = `
+ALTER TABLE invites ADD COLUMN state_changed_at BIGINT NOT NULL DEFAULT 0;
+`
+
 const insertInviteSQL = `
-	INSERT INTO invites (token, medium, address, room_id, sender)
-	VALUES ($1, $2, $3, $4, $5)
+	INSERT INTO invites (
+		token, medium, address, room_id, sender, created_at, ephemeral_public_key, state, signed_for, state_changed_at
+	)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
 `
 
 const selectInviteFromTokenSQL = `
-	SELECT medium, address, room_id, sender, token FROM invites
+	SELECT medium, address, room_id, sender, token, created_at, ephemeral_public_key, state, signed_for,
+		state_changed_at
+	FROM invites
 	WHERE token = $1
 `
 
 const selectInvitesForAddressAndMediumSQL = `
-	SELECT medium, address, room_id, sender, token FROM invites
+	SELECT medium, address, room_id, sender, token, created_at, ephemeral_public_key, state, signed_for,
+		state_changed_at
+	FROM invites
 	WHERE medium = $1 AND address = $2
 `
 
-const deleteInvitesByAddressAndMediumSQL = `
-	DELETE FROM invites WHERE medium = $1 AND address = $2
+const signInviteSQL = `
+	UPDATE invites SET state = 'signed', signed_for = $1, state_changed_at = $2
+	WHERE token = $3 AND state = 'pending'
+`
+
+const markInviteDeliveredSQL = `
+	UPDATE invites SET state = 'delivered', signed_for = $1, state_changed_at = $2
+	WHERE token = $3 AND (state = 'pending' OR (state = 'signed' AND signed_for = $1))
+`
+
+const revokeInviteSQL = `
+	UPDATE invites SET state = 'revoked', state_changed_at = $1
+	WHERE token = $2 AND state IN ('pending', 'signed')
+`
+
+const deleteInvitesCreatedBeforeSQL = `
+	DELETE FROM invites WHERE created_at < $1
 `
 
 type invitesStatements struct {
 	insertInviteStmt                     *sql.Stmt
 	selectInviteFromTokenStmt            *sql.Stmt
 	selectInvitesForAddressAndMediumStmt *sql.Stmt
-	deleteInvitesByAddressAndMediumStmt  *sql.Stmt
+	deleteInvitesCreatedBeforeStmt       *sql.Stmt
+	signInviteStmt                       *sql.Stmt
+	markInviteDeliveredStmt              *sql.Stmt
+	revokeInviteStmt                     *sql.Stmt
 }
 
 func (s *invitesStatements) prepare(db *sql.DB) (err error) {
-	_, err = db.Exec(invitesSchema)
-	if err != nil {
-		return
-	}
 	if s.insertInviteStmt, err = db.Prepare(insertInviteSQL); err != nil {
 		return
 	}
@@ -57,16 +97,25 @@ func (s *invitesStatements) prepare(db *sql.DB) (err error) {
 	if s.selectInvitesForAddressAndMediumStmt, err = db.Prepare(selectInvitesForAddressAndMediumSQL); err != nil {
 		return
 	}
-	if s.deleteInvitesByAddressAndMediumStmt, err = db.Prepare(deleteInvitesByAddressAndMediumSQL); err != nil {
+	if s.deleteInvitesCreatedBeforeStmt, err = db.Prepare(deleteInvitesCreatedBeforeSQL); err != nil {
+		return
+	}
+	if s.signInviteStmt, err = db.Prepare(signInviteSQL); err != nil {
+		return
+	}
+	if s.markInviteDeliveredStmt, err = db.Prepare(markInviteDeliveredSQL); err != nil {
+		return
+	}
+	if s.revokeInviteStmt, err = db.Prepare(revokeInviteSQL); err != nil {
 		return
 	}
 	return
-
 }
 
-func (s *invitesStatements) insertInvite(invite *types.ThreepidInvite) (err error) {
-	_, err = s.insertInviteStmt.Exec(
-		invite.Token, invite.Medium, invite.Address, invite.RoomID, invite.Sender,
+func (s *invitesStatements) insertInvite(txn *sql.Tx, invite *types.ThreepidInvite) (err error) {
+	_, err = txStmt(txn, s.insertInviteStmt).Exec(
+		invite.Token, invite.Medium, invite.Address, invite.RoomID, invite.Sender, invite.CreatedAt,
+		invite.EphemeralPublicKey, invite.State, invite.SignedFor, invite.StateChangedAt,
 	)
 	return
 }
@@ -75,7 +124,75 @@ func (s *invitesStatements) selectInviteByToken(token string) (*types.ThreepidIn
 	var invite types.ThreepidInvite
 
 	row := s.selectInviteFromTokenStmt.QueryRow(token)
-	err := row.Scan(&invite.Medium, &invite.Address, &invite.RoomID, &invite.Sender, &invite.Token)
+	err := row.Scan(
+		&invite.Medium, &invite.Address, &invite.RoomID, &invite.Sender, &invite.Token, &invite.CreatedAt,
+		&invite.EphemeralPublicKey, &invite.State, &invite.SignedFor, &invite.StateChangedAt,
+	)
 
 	return &invite, err
 }
+
+func (s *invitesStatements) selectInvitesForAddressAndMedium(
+	medium, address string,
+) ([]*types.ThreepidInvite, error) {
+	rows, err := s.selectInvitesForAddressAndMediumStmt.Query(medium, address)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	invites := make([]*types.ThreepidInvite, 0)
+	for rows.Next() {
+		var invite types.ThreepidInvite
+		if err = rows.Scan(
+			&invite.Medium, &invite.Address, &invite.RoomID, &invite.Sender, &invite.Token, &invite.CreatedAt,
+			&invite.EphemeralPublicKey, &invite.State, &invite.SignedFor, &invite.StateChangedAt,
+		); err != nil {
+			return nil, err
+		}
+
+		invites = append(invites, &invite)
+	}
+
+	return invites, rows.Err()
+}
+
+func (s *invitesStatements) deleteInvitesCreatedBefore(ts int64) (int64, error) {
+	res, err := s.deleteInvitesCreatedBeforeStmt.Exec(ts)
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
+
+func (s *invitesStatements) signInvite(token, mxid string, ts int64) (bool, error) {
+	res, err := s.signInviteStmt.Exec(mxid, ts, token)
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := res.RowsAffected()
+	return affected > 0, err
+}
+
+func (s *invitesStatements) markInviteDelivered(token, mxid string, ts int64) (bool, error) {
+	res, err := s.markInviteDeliveredStmt.Exec(mxid, ts, token)
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := res.RowsAffected()
+	return affected > 0, err
+}
+
+func (s *invitesStatements) revokeInvite(txn *sql.Tx, token string, ts int64) (bool, error) {
+	res, err := txn.Stmt(s.revokeInviteStmt).Exec(ts, token)
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := res.RowsAffected()
+	return affected > 0, err
+}
@@ -0,0 +1,79 @@
+package database
+
+import (
+	"database/sql"
+
+	"github.com/babolivier/ident/common/crypto"
+)
+
+const lookupPepperSchema = `
+-- Stores the pepper used to hash 3PIDs for lookups. This table only ever contains one row.
+CREATE TABLE IF NOT EXISTS lookup_pepper (
+	pepper TEXT NOT NULL
+);
+`
+
+const insertLookupPepperSQL = `
+	INSERT INTO lookup_pepper (pepper) VALUES ($1)
+`
+
+const selectLookupPepperSQL = `
+	SELECT pepper FROM lookup_pepper
+`
+
+const updateLookupPepperSQL = `
+	UPDATE lookup_pepper SET pepper = $1
+`
+
+// Doesn't change anything, but takes the same lock as a rotation until the end of the transaction.
+const lockLookupPepperSQL = `
+	UPDATE lookup_pepper SET pepper = pepper
+`
+
+type lookupPepperStatements struct {
+	insertLookupPepperStmt *sql.Stmt
+	selectLookupPepperStmt *sql.Stmt
+	updateLookupPepperStmt *sql.Stmt
+	lockLookupPepperStmt   *sql.Stmt
+}
+
+func (s *lookupPepperStatements) prepare(db *sql.DB) (err error) {
+	if s.insertLookupPepperStmt, err = db.Prepare(insertLookupPepperSQL); err != nil {
+		return
+	}
+	if s.selectLookupPepperStmt, err = db.Prepare(selectLookupPepperSQL); err != nil {
+		return
+	}
+	if s.updateLookupPepperStmt, err = db.Prepare(updateLookupPepperSQL); err != nil {
+		return
+	}
+	if s.lockLookupPepperStmt, err = db.Prepare(lockLookupPepperSQL); err != nil {
+		return
+	}
+	return
+}
+
+func (s *lookupPepperStatements) insertLookupPepper(pepper string) (err error) {
+	_, err = s.insertLookupPepperStmt.Exec(pepper)
+	return
+}
+
+func (s *lookupPepperStatements) selectLookupPepper(txn *sql.Tx) (pepper string, err error) {
+	err = txStmt(txn, s.selectLookupPepperStmt).QueryRow().Scan(&pepper)
+	return
+}
+
+func (s *lookupPepperStatements) updateLookupPepper(txn *sql.Tx, pepper string) (err error) {
+	_, err = txn.Stmt(s.updateLookupPepperStmt).Exec(pepper)
+	return
+}
+
+// lockLookupPepper prevents the lookup pepper from being rotated until the given transaction ends.
+func (s *lookupPepperStatements) lockLookupPepper(txn *sql.Tx) (err error) {
+	_, err = txn.Stmt(s.lockLookupPepperStmt).Exec()
+	return
+}
+
+func generateLookupPepper() (string, error) {
+	return crypto.RandBase64(32)
+}
@@ -0,0 +1,142 @@
+package database
+
+import (
+	"database/sql"
+
+	"github.com/babolivier/ident/common/types"
+)
+
+// The only difference between the drivers is how the auto-incremented ID is declared.
+const mailQueueSchemaSQLite3 = `
+-- Stores the emails waiting to be delivered
+CREATE TABLE IF NOT EXISTS mail_queue (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	recipient TEXT NOT NULL,
+	message TEXT NOT NULL,
+	attempts INTEGER NOT NULL DEFAULT 0,
+	next_attempt_at BIGINT NOT NULL,
+	last_error TEXT NOT NULL DEFAULT '',
+	created_at BIGINT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS mail_queue_next_attempt_at_idx ON mail_queue (next_attempt_at);
+`
+
+const mailQueueSchemaPostgres = `
+-- Stores the emails waiting to be delivered
+CREATE TABLE IF NOT EXISTS mail_queue (
+	id BIGSERIAL PRIMARY KEY,
+	recipient TEXT NOT NULL,
+	message TEXT NOT NULL,
+	attempts INTEGER NOT NULL DEFAULT 0,
+	next_attempt_at BIGINT NOT NULL,
+	last_error TEXT NOT NULL DEFAULT '',
+	created_at BIGINT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS mail_queue_next_attempt_at_idx ON mail_queue (next_attempt_at);
+`
+
+const insertMailSQL = `
+	INSERT INTO mail_queue (recipient, message, attempts, next_attempt_at, last_error, created_at)
+	VALUES ($1, $2, $3, $4, $5, $6)
+`
+
+const selectDueMailsSQL = `
+	SELECT id, recipient, message, attempts, next_attempt_at, last_error, created_at FROM mail_queue
+	WHERE next_attempt_at <= $1
+	ORDER BY next_attempt_at LIMIT $2
+`
+
+// Only claim the email if no one else did since we selected it.
+const claimMailSQL = `
+	UPDATE mail_queue SET next_attempt_at = $1 WHERE id = $2 AND next_attempt_at = $3
+`
+
+const rescheduleMailSQL = `
+	UPDATE mail_queue SET attempts = $1, next_attempt_at = $2, last_error = $3 WHERE id = $4
+`
+
+const deleteMailSQL = `
+	DELETE FROM mail_queue WHERE id = $1
+`
+
+type mailQueueStatements struct {
+	insertMailStmt     *sql.Stmt
+	selectDueMailsStmt *sql.Stmt
+	claimMailStmt      *sql.Stmt
+	rescheduleMailStmt *sql.Stmt
+	deleteMailStmt     *sql.Stmt
+}
+
+func (s *mailQueueStatements) prepare(db *sql.DB) (err error) {
+	if s.insertMailStmt, err = db.Prepare(insertMailSQL); err != nil {
+		return
+	}
+	if s.selectDueMailsStmt, err = db.Prepare(selectDueMailsSQL); err != nil {
+		return
+	}
+	if s.claimMailStmt, err = db.Prepare(claimMailSQL); err != nil {
+		return
+	}
+	if s.rescheduleMailStmt, err = db.Prepare(rescheduleMailSQL); err != nil {
+		return
+	}
+	if s.deleteMailStmt, err = db.Prepare(deleteMailSQL); err != nil {
+		return
+	}
+	return
+}
+
+func (s *mailQueueStatements) insertMail(txn *sql.Tx, mail *types.QueuedMail) (err error) {
+	// The message is stored as text, as drivers don't agree on how to store a []byte in a TEXT column.
+	_, err = txStmt(txn, s.insertMailStmt).Exec(
+		mail.Recipient, string(mail.Message), mail.Attempts, mail.NextAttemptAt, mail.LastError, mail.CreatedAt,
+	)
+	return
+}
+
+func (s *mailQueueStatements) selectDueMails(now int64, limit int) ([]*types.QueuedMail, error) {
+	rows, err := s.selectDueMailsStmt.Query(now, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	mails := make([]*types.QueuedMail, 0)
+	for rows.Next() {
+		var message string
+		mail := new(types.QueuedMail)
+		if err = rows.Scan(
+			&mail.ID, &mail.Recipient, &message, &mail.Attempts, &mail.NextAttemptAt, &mail.LastError,
+			&mail.CreatedAt,
+		); err != nil {
+			return nil, err
+		}
+
+		mail.Message = []byte(message)
+		mails = append(mails, mail)
+	}
+
+	return mails, rows.Err()
+}
+
+func (s *mailQueueStatements) claimMail(id, nextAttemptAt, leaseUntil int64) (bool, error) {
+	res, err := s.claimMailStmt.Exec(leaseUntil, id, nextAttemptAt)
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := res.RowsAffected()
+	return affected > 0, err
+}
+
+func (s *mailQueueStatements) rescheduleMail(id int64, attempts int, nextAttemptAt int64, lastError string) (err error) {
+	_, err = s.rescheduleMailStmt.Exec(attempts, nextAttemptAt, lastError, id)
+	return
+}
+
+func (s *mailQueueStatements) deleteMail(id int64) (err error) {
+	_, err = s.deleteMailStmt.Exec(id)
+	return
+}
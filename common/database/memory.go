@@ -0,0 +1,507 @@
+package database
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/babolivier/ident/common/constants"
+	"github.com/babolivier/ident/common/hashing"
+	"github.com/babolivier/ident/common/types"
+
+	"github.com/pkg/errors"
+)
+
+// threepid identifies a 3PID by its medium and address.
+type threepid struct {
+	medium  string
+	address string
+}
+
+// MemoryDatabase is an implementation of Database that keeps everything in memory, meant for tests and ephemeral
+// development instances. Everything is lost when the process stops.
+type MemoryDatabase struct {
+	mutex               sync.RWMutex
+	invites             map[string]types.ThreepidInvite
+	ephemeralPublicKeys map[string]int64
+	validationSessions  map[string]types.ValidationSession
+	associations        map[threepid]types.ThreepidAssociation
+	accountTokens       map[string]string
+	acceptedTermsURLs   map[string]map[string]bool
+	mailQueue           map[int64]types.QueuedMail
+	lastMailID          int64
+	lookupPepper        string
+}
+
+// NewMemoryDatabase returns an empty in-memory database with a freshly generated lookup pepper.
+func NewMemoryDatabase() (*MemoryDatabase, error) {
+	pepper, err := generateLookupPepper()
+	if err != nil {
+		return nil, err
+	}
+
+	return &MemoryDatabase{
+		invites:             make(map[string]types.ThreepidInvite),
+		ephemeralPublicKeys: make(map[string]int64),
+		validationSessions:  make(map[string]types.ValidationSession),
+		associations:        make(map[threepid]types.ThreepidAssociation),
+		accountTokens:       make(map[string]string),
+		acceptedTermsURLs:   make(map[string]map[string]bool),
+		mailQueue:           make(map[int64]types.QueuedMail),
+		lookupPepper:        pepper,
+	}, nil
+}
+
+func (d *MemoryDatabase) Save3PIDInvite(invite *types.ThreepidInvite) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if _, ok := d.invites[invite.Token]; ok {
+		return errors.New("An invite already exists with this token")
+	}
+
+	if len(invite.State) == 0 {
+		invite.State = constants.InviteStatePending
+	}
+
+	d.invites[invite.Token] = *invite
+	return nil
+}
+
+func (d *MemoryDatabase) Save3PIDInviteWithMail(invite *types.ThreepidInvite, mail *types.QueuedMail) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	// Check everything before writing anything, so nothing is stored if something can't be.
+	if _, ok := d.invites[invite.Token]; ok {
+		return errors.New("An invite already exists with this token")
+	}
+
+	if _, ok := d.ephemeralPublicKeys[invite.EphemeralPublicKey]; ok {
+		return errors.New("This ephemeral public key already exists")
+	}
+
+	if len(invite.State) == 0 {
+		invite.State = constants.InviteStatePending
+	}
+
+	d.invites[invite.Token] = *invite
+	d.ephemeralPublicKeys[invite.EphemeralPublicKey] = invite.CreatedAt
+
+	if mail != nil {
+		d.lastMailID++
+		stored := *mail
+		stored.ID = d.lastMailID
+		d.mailQueue[stored.ID] = stored
+	}
+
+	return nil
+}
+
+func (d *MemoryDatabase) Get3PIDInviteByToken(token string) (*types.ThreepidInvite, error) {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+
+	invite, ok := d.invites[token]
+	if !ok {
+		return nil, nil
+	}
+
+	return &invite, nil
+}
+
+func (d *MemoryDatabase) Get3PIDInvitesForAddress(medium, address string) ([]*types.ThreepidInvite, error) {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+
+	invites := make([]*types.ThreepidInvite, 0)
+	for _, invite := range d.invites {
+		if invite.Medium == medium && invite.Address == address {
+			invite := invite
+			invites = append(invites, &invite)
+		}
+	}
+
+	return invites, nil
+}
+
+func (d *MemoryDatabase) Delete3PIDInvitesCreatedBefore(ts int64) (int64, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	var deleted int64
+	for token, invite := range d.invites {
+		if invite.CreatedAt < ts {
+			delete(d.invites, token)
+			deleted++
+		}
+	}
+
+	return deleted, nil
+}
+
+func (d *MemoryDatabase) Sign3PIDInvite(token, mxid string, ts int64) (bool, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	invite, ok := d.invites[token]
+	if !ok || invite.State != constants.InviteStatePending {
+		return false, nil
+	}
+
+	invite.State = constants.InviteStateSigned
+	invite.SignedFor = mxid
+	invite.StateChangedAt = ts
+	d.invites[token] = invite
+	return true, nil
+}
+
+func (d *MemoryDatabase) Mark3PIDInviteDelivered(token, mxid string, ts int64) (bool, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	invite, ok := d.invites[token]
+	if !ok {
+		return false, nil
+	}
+
+	signedForMXID := invite.State == constants.InviteStateSigned && invite.SignedFor == mxid
+	if invite.State != constants.InviteStatePending && !signedForMXID {
+		return false, nil
+	}
+
+	invite.State = constants.InviteStateDelivered
+	invite.SignedFor = mxid
+	invite.StateChangedAt = ts
+	d.invites[token] = invite
+	return true, nil
+}
+
+func (d *MemoryDatabase) Revoke3PIDInvite(token string, ts int64) (bool, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	invite, ok := d.invites[token]
+	if !ok || (invite.State != constants.InviteStatePending && invite.State != constants.InviteStateSigned) {
+		return false, nil
+	}
+
+	invite.State = constants.InviteStateRevoked
+	invite.StateChangedAt = ts
+	d.invites[token] = invite
+
+	delete(d.ephemeralPublicKeys, invite.EphemeralPublicKey)
+	return true, nil
+}
+
+func (d *MemoryDatabase) SaveEphemeralPublicKey(pubkey string, createdAt int64) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if _, ok := d.ephemeralPublicKeys[pubkey]; ok {
+		return errors.New("This ephemeral public key already exists")
+	}
+
+	d.ephemeralPublicKeys[pubkey] = createdAt
+	return nil
+}
+
+func (d *MemoryDatabase) EphemeralPublicKeyExists(pubkey string, createdAfter int64) (bool, error) {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+
+	createdAt, ok := d.ephemeralPublicKeys[pubkey]
+	return ok && createdAt >= createdAfter, nil
+}
+
+func (d *MemoryDatabase) DeleteEphemeralPublicKeysCreatedBefore(ts int64) (int64, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	var deleted int64
+	for pubkey, createdAt := range d.ephemeralPublicKeys {
+		if createdAt < ts {
+			delete(d.ephemeralPublicKeys, pubkey)
+			deleted++
+		}
+	}
+
+	return deleted, nil
+}
+
+func (d *MemoryDatabase) SaveValidationSession(session *types.ValidationSession) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if _, ok := d.validationSessions[session.ID]; ok {
+		return errors.New("A validation session already exists with this ID")
+	}
+
+	d.validationSessions[session.ID] = *session
+	return nil
+}
+
+func (d *MemoryDatabase) GetValidationSession(sid, clientSecret string) (*types.ValidationSession, error) {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+
+	session, ok := d.validationSessions[sid]
+	if !ok || session.ClientSecret != clientSecret {
+		return nil, nil
+	}
+
+	return &session, nil
+}
+
+func (d *MemoryDatabase) GetValidationSessionForThreepid(
+	clientSecret, medium, address string,
+) (*types.ValidationSession, error) {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+
+	var latest *types.ValidationSession
+	for _, session := range d.validationSessions {
+		if session.ClientSecret != clientSecret || session.Medium != medium || session.Address != address {
+			continue
+		}
+
+		if latest == nil || session.CreatedAt > latest.CreatedAt {
+			session := session
+			latest = &session
+		}
+	}
+
+	return latest, nil
+}
+
+func (d *MemoryDatabase) UpdateValidationSessionSendAttempt(sid string, sendAttempt int) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if session, ok := d.validationSessions[sid]; ok {
+		session.SendAttempt = sendAttempt
+		d.validationSessions[sid] = session
+	}
+
+	return nil
+}
+
+func (d *MemoryDatabase) MarkValidationSessionValidated(sid string, validatedAt int64) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if session, ok := d.validationSessions[sid]; ok {
+		session.ValidatedAt = validatedAt
+		d.validationSessions[sid] = session
+	}
+
+	return nil
+}
+
+func (d *MemoryDatabase) AddValidationSessionTokenAttempt(sid string, maxAttempts int) (bool, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	session, ok := d.validationSessions[sid]
+	if !ok || session.TokenAttempts >= maxAttempts {
+		return false, nil
+	}
+
+	session.TokenAttempts++
+	d.validationSessions[sid] = session
+	return true, nil
+}
+
+func (d *MemoryDatabase) SaveAssociation(assoc *types.ThreepidAssociation) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	// Signatures aren't stored, same as with the SQL database.
+	stored := *assoc
+	stored.Signatures = nil
+
+	d.associations[threepid{assoc.Medium, assoc.Address}] = stored
+	return nil
+}
+
+func (d *MemoryDatabase) GetAssociation(medium, address string) (*types.ThreepidAssociation, error) {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+
+	assoc, ok := d.associations[threepid{medium, address}]
+	if !ok {
+		return nil, nil
+	}
+
+	return &assoc, nil
+}
+
+func (d *MemoryDatabase) GetAssociationByLookupHash(lookupHash string) (*types.ThreepidAssociation, error) {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+
+	// Hashes are computed on the fly rather than stored, since rotating the pepper would otherwise mean recomputing
+	// them all anyway.
+	for _, assoc := range d.associations {
+		if hashing.LookupHash(assoc.Medium, assoc.Address, d.lookupPepper) == lookupHash {
+			assoc := assoc
+			return &assoc, nil
+		}
+	}
+
+	return nil, nil
+}
+
+func (d *MemoryDatabase) DeleteAssociation(medium, address, mxid string) (bool, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	key := threepid{medium, address}
+	assoc, ok := d.associations[key]
+	if !ok || assoc.MXID != mxid {
+		return false, nil
+	}
+
+	delete(d.associations, key)
+	return true, nil
+}
+
+func (d *MemoryDatabase) SaveAccountToken(token, userID string, createdAt int64) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if _, ok := d.accountTokens[token]; ok {
+		return errors.New("This access token already exists")
+	}
+
+	d.accountTokens[token] = userID
+	return nil
+}
+
+func (d *MemoryDatabase) GetUserIDForAccountToken(token string) (string, error) {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+
+	return d.accountTokens[token], nil
+}
+
+func (d *MemoryDatabase) DeleteAccountToken(token string) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	delete(d.accountTokens, token)
+	return nil
+}
+
+func (d *MemoryDatabase) SaveAcceptedTermsURLs(userID string, urls []string) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.acceptedTermsURLs[userID] == nil {
+		d.acceptedTermsURLs[userID] = make(map[string]bool)
+	}
+
+	for _, url := range urls {
+		d.acceptedTermsURLs[userID][url] = true
+	}
+
+	return nil
+}
+
+func (d *MemoryDatabase) GetAcceptedTermsURLs(userID string) ([]string, error) {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+
+	urls := make([]string, 0, len(d.acceptedTermsURLs[userID]))
+	for url := range d.acceptedTermsURLs[userID] {
+		urls = append(urls, url)
+	}
+
+	sort.Strings(urls)
+	return urls, nil
+}
+
+func (d *MemoryDatabase) EnqueueMail(mail *types.QueuedMail) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	d.lastMailID++
+	stored := *mail
+	stored.ID = d.lastMailID
+
+	d.mailQueue[stored.ID] = stored
+	return nil
+}
+
+func (d *MemoryDatabase) ClaimDueMails(now, leaseUntil int64, limit int) ([]*types.QueuedMail, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	due := make([]*types.QueuedMail, 0)
+	for _, mail := range d.mailQueue {
+		if mail.NextAttemptAt <= now {
+			mail := mail
+			due = append(due, &mail)
+		}
+	}
+
+	// Claim the emails that have been waiting the longest first, same as with the SQL database.
+	sort.Slice(due, func(i, j int) bool {
+		if due[i].NextAttemptAt == due[j].NextAttemptAt {
+			return due[i].ID < due[j].ID
+		}
+		return due[i].NextAttemptAt < due[j].NextAttemptAt
+	})
+
+	if len(due) > limit {
+		due = due[:limit]
+	}
+
+	for _, mail := range due {
+		mail.NextAttemptAt = leaseUntil
+		d.mailQueue[mail.ID] = *mail
+	}
+
+	return due, nil
+}
+
+func (d *MemoryDatabase) RescheduleMail(id int64, attempts int, nextAttemptAt int64, lastError string) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if mail, ok := d.mailQueue[id]; ok {
+		mail.Attempts = attempts
+		mail.NextAttemptAt = nextAttemptAt
+		mail.LastError = lastError
+		d.mailQueue[id] = mail
+	}
+
+	return nil
+}
+
+func (d *MemoryDatabase) DeleteMail(id int64) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	delete(d.mailQueue, id)
+	return nil
+}
+
+func (d *MemoryDatabase) GetLookupPepper() (string, error) {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+
+	return d.lookupPepper, nil
+}
+
+func (d *MemoryDatabase) RotateLookupPepper() (string, error) {
+	pepper, err := generateLookupPepper()
+	if err != nil {
+		return "", err
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	d.lookupPepper = pepper
+	return pepper, nil
+}
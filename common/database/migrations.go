@@ -0,0 +1,279 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// Names of the supported database drivers.
+const (
+	DriverSQLite3  = "sqlite3"
+	DriverPostgres = "postgres"
+	DriverMemory   = "memory"
+)
+
+const schemaVersionSchema = `
+-- Stores the versions of the migrations that have been applied to the database
+CREATE TABLE IF NOT EXISTS schema_version (
+	version INTEGER PRIMARY KEY,
+	description TEXT NOT NULL,
+	applied_at BIGINT NOT NULL
+);
+`
+
+const selectSchemaVersionSQL = `
+	SELECT COALESCE(MAX(version), 0) FROM schema_version
+`
+
+const insertSchemaVersionSQL = `
+	INSERT INTO schema_version (version, description, applied_at) VALUES ($1, $2, $3)
+`
+
+// ErrSchemaTooNew is returned when the database has been migrated by a more recent version of Ident than this one.
+var ErrSchemaTooNew = errors.New("The database schema is more recent than this version of Ident supports")
+
+// ErrSchemaOutdated is returned when the database is missing migrations. Ident doesn't apply them on its own when
+// starting up, so operators can choose when to run them, and back up the database beforehand.
+var ErrSchemaOutdated = errors.New("The database schema is out of date, run \"ident migrate\" to update it")
+
+// A migration brings the schema from the previous version to its own version. Migrations are applied in order, each
+// one in its own transaction.
+type migration struct {
+	version     int
+	description string
+	// statements maps a driver name to the statements to run for this driver. Every supported driver must have an
+	// entry, even if it's the same statements for all of them.
+	statements map[string][]string
+	// fn, if set, is run after the statements, in the same transaction.
+	fn func(txn *sql.Tx, driver string) error
+}
+
+// allDrivers returns a statements map running the same statements for every supported driver.
+func allDrivers(statements ...string) map[string][]string {
+	return map[string][]string{
+		DriverSQLite3:  statements,
+		DriverPostgres: statements,
+	}
+}
+
+// migrations is the ordered list of the migrations to the database schema. Migrations must never be modified once
+// released, changes to the schema must be done by appending new migrations.
+var migrations = []migration{
+	{
+		version:     1,
+		description: "Initial schema",
+		statements: allDrivers(
+			invitesSchema, ephemeralPublicKeysSchema, validationSessionsSchema, associationsSchema,
+			accountTokensSchema, lookupPepperSchema, acceptedTermsURLsSchema,
+		),
+		// Databases created before migrations existed only had the invites and ephemeral_public_keys tables, created
+		// without timestamps. The statements above don't alter existing tables, so add the timestamps here.
+		fn: func(txn *sql.Tx, driver string) error {
+			for _, table := range []string{"invites", "ephemeral_public_keys"} {
+				if err := addCreatedAtColumn(txn, driver, table); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+	{
+		version:     2,
+		description: "Outbound mail queue",
+		statements: map[string][]string{
+			DriverSQLite3:  {mailQueueSchemaSQLite3},
+			DriverPostgres: {mailQueueSchemaPostgres},
+		},
+	},
+	{
+		version:     3,
+		description: "Ephemeral public key of invites",
+		statements:  allDrivers(invitesEphemeralPublicKeySchema),
+	},
+	{
+		version:     4,
+		description: "State of invites",
+		statements:  allDrivers(invitesStateSchema, invitesSignedForSchema, invitesStateChangedAtSchema),
+	},
+	{
+		version:     5,
+		description: "Token attempts of validation sessions",
+		statements:  allDrivers(validationSessionsTokenAttemptsSchema),
+	},
+}
+
+// LatestSchemaVersion returns the version of the schema this version of Ident expects.
+func LatestSchemaVersion() int {
+	return migrations[len(migrations)-1].version
+}
+
+// Migrate connects to the database and applies the migrations it's missing. It returns the schema versions before
+// and after the migrations.
+func Migrate(driver, connString string) (from int, to int, err error) {
+	if driver == DriverMemory {
+		return 0, 0, errors.New("The in-memory database doesn't need to be migrated")
+	}
+
+	db, err := open(driver, connString)
+	if err != nil {
+		return
+	}
+	defer db.Close()
+
+	return migrate(db, driver)
+}
+
+func migrate(db *sql.DB, driver string) (from int, to int, err error) {
+	if _, ok := migrations[0].statements[driver]; !ok {
+		return 0, 0, errors.New("Unsupported database driver " + driver)
+	}
+
+	if _, err = db.Exec(schemaVersionSchema); err != nil {
+		return
+	}
+
+	if err = db.QueryRow(selectSchemaVersionSQL).Scan(&from); err != nil {
+		return
+	}
+
+	if from > LatestSchemaVersion() {
+		return from, from, errors.Wrap(
+			ErrSchemaTooNew, fmt.Sprintf("database is at version %d, latest known is %d", from, LatestSchemaVersion()),
+		)
+	}
+
+	to = from
+	for _, m := range migrations {
+		if m.version <= from {
+			continue
+		}
+
+		logrus.WithFields(logrus.Fields{
+			"version":     m.version,
+			"description": m.description,
+		}).Info("Applying database migration")
+
+		if err = applyMigration(db, driver, &m); err != nil {
+			return from, to, errors.Wrapf(err, "Couldn't apply migration %d (%s)", m.version, m.description)
+		}
+
+		to = m.version
+	}
+
+	return
+}
+
+// checkSchemaVersion checks that the database has been migrated to the schema version this version of Ident expects.
+func checkSchemaVersion(db *sql.DB, driver string) error {
+	exists, err := tableExists(db, driver, "schema_version")
+	if err != nil {
+		return err
+	}
+
+	var version int
+	if exists {
+		if err = db.QueryRow(selectSchemaVersionSQL).Scan(&version); err != nil {
+			return err
+		}
+	}
+
+	latest := LatestSchemaVersion()
+	if version < latest {
+		return errors.Wrapf(ErrSchemaOutdated, "database is at version %d, expected %d", version, latest)
+	}
+
+	if version > latest {
+		return errors.Wrapf(ErrSchemaTooNew, "database is at version %d, latest known is %d", version, latest)
+	}
+
+	return nil
+}
+
+func applyMigration(db *sql.DB, driver string, m *migration) (err error) {
+	txn, err := db.Begin()
+	if err != nil {
+		return
+	}
+
+	defer func() {
+		if err != nil {
+			_ = txn.Rollback()
+		}
+	}()
+
+	for _, statement := range m.statements[driver] {
+		if _, err = txn.Exec(statement); err != nil {
+			return
+		}
+	}
+
+	if m.fn != nil {
+		if err = m.fn(txn, driver); err != nil {
+			return
+		}
+	}
+
+	if _, err = txn.Exec(insertSchemaVersionSQL, m.version, m.description, nowMS()); err != nil {
+		return
+	}
+
+	return txn.Commit()
+}
+
+// tableExists checks whether the database has a table with the given name.
+func tableExists(db *sql.DB, driver, table string) (bool, error) {
+	var query string
+	switch driver {
+	case DriverSQLite3:
+		query = "SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = $1"
+	case DriverPostgres:
+		query = "SELECT COUNT(*) FROM information_schema.tables WHERE table_name = $1"
+	default:
+		return false, errors.New("Unsupported database driver " + driver)
+	}
+
+	var count int
+	err := db.QueryRow(query, table).Scan(&count)
+	return count > 0, err
+}
+
+// columnExists checks whether the given table has a column with the given name.
+func columnExists(txn *sql.Tx, driver, table, column string) (bool, error) {
+	var query string
+	switch driver {
+	case DriverSQLite3:
+		query = "SELECT COUNT(*) FROM pragma_table_info($1) WHERE name = $2"
+	case DriverPostgres:
+		query = "SELECT COUNT(*) FROM information_schema.columns WHERE table_name = $1 AND column_name = $2"
+	default:
+		return false, errors.New("Unsupported database driver " + driver)
+	}
+
+	var count int
+	err := txn.QueryRow(query, table, column).Scan(&count)
+	return count > 0, err
+}
+
+// addCreatedAtColumn adds a created_at column to the given table if it was created before the column existed. Rows
+// that predate the column are considered as created now, so they get a full lifetime instead of expiring right away.
+func addCreatedAtColumn(txn *sql.Tx, driver, table string) error {
+	exists, err := columnExists(txn, driver, table, "created_at")
+	if err != nil || exists {
+		return err
+	}
+
+	if _, err = txn.Exec("ALTER TABLE " + table + " ADD COLUMN created_at BIGINT NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+
+	_, err = txn.Exec("UPDATE "+table+" SET created_at = $1", nowMS())
+	return err
+}
+
+func nowMS() int64 {
+	return time.Now().UnixNano() / int64(time.Millisecond)
+}
@@ -0,0 +1,119 @@
+package database
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestRawDB(t *testing.T) *sql.DB {
+	db, err := open(DriverSQLite3, ":memory:")
+	require.Nil(t, err, err)
+	return db
+}
+
+func TestMigrate(t *testing.T) {
+	db := newTestRawDB(t)
+
+	from, to, err := migrate(db, DriverSQLite3)
+	require.Nil(t, err, err)
+	require.Equal(t, 0, from)
+	require.Equal(t, LatestSchemaVersion(), to)
+
+	// Test that migrating an up to date database does nothing.
+	from, to, err = migrate(db, DriverSQLite3)
+	require.Nil(t, err, err)
+	require.Equal(t, LatestSchemaVersion(), from)
+	require.Equal(t, LatestSchemaVersion(), to)
+}
+
+func TestMigrateLegacyDatabase(t *testing.T) {
+	db := newTestRawDB(t)
+
+	// Create the tables as they were before migrations existed.
+	_, err := db.Exec(`
+		CREATE TABLE invites (
+			token TEXT PRIMARY KEY, medium TEXT NOT NULL, address TEXT NOT NULL, room_id TEXT NOT NULL,
+			sender TEXT NOT NULL
+		);
+		CREATE TABLE ephemeral_public_keys (ephemeral_public_key TEXT PRIMARY KEY);
+		INSERT INTO ephemeral_public_keys (ephemeral_public_key) VALUES ('oldkey');
+	`)
+	require.Nil(t, err, err)
+
+	_, _, err = migrate(db, DriverSQLite3)
+	require.Nil(t, err, err)
+
+	// Test that the existing key is considered as just created.
+	var s ephemeralPublicKeysStatements
+	require.Nil(t, s.prepare(db))
+
+	exists, err := s.ephemeralPublicKeyExists("oldkey", nowMS()-int64(time.Minute/time.Millisecond))
+	require.Nil(t, err, err)
+	require.True(t, exists)
+}
+
+func TestMigrateSchemaTooNew(t *testing.T) {
+	db := newTestRawDB(t)
+
+	_, _, err := migrate(db, DriverSQLite3)
+	require.Nil(t, err, err)
+
+	_, err = db.Exec(insertSchemaVersionSQL, LatestSchemaVersion()+1, "From the future", nowMS())
+	require.Nil(t, err, err)
+
+	_, _, err = migrate(db, DriverSQLite3)
+	require.NotNil(t, err)
+	require.Equal(t, ErrSchemaTooNew, errors.Cause(err))
+}
+
+func TestMigrationsOrdered(t *testing.T) {
+	for i, m := range migrations {
+		require.Equal(t, i+1, m.version, "Migrations must be numbered sequentially from 1")
+
+		for _, driver := range []string{DriverSQLite3, DriverPostgres} {
+			_, ok := m.statements[driver]
+			require.True(t, ok, "Migration %d has no statements for %s", m.version, driver)
+		}
+	}
+}
+
+func TestNewSQLDatabaseChecksSchemaVersion(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ident_migrations")
+	require.Nil(t, err, err)
+	defer os.RemoveAll(dir)
+
+	connString := filepath.Join(dir, "ident.db")
+
+	// Test that a database that hasn't been migrated isn't used.
+	_, err = NewSQLDatabase(DriverSQLite3, connString)
+	require.NotNil(t, err)
+	require.Equal(t, ErrSchemaOutdated, errors.Cause(err))
+
+	from, to, err := Migrate(DriverSQLite3, connString)
+	require.Nil(t, err, err)
+	require.Equal(t, 0, from)
+	require.Equal(t, LatestSchemaVersion(), to)
+
+	db, err := NewSQLDatabase(DriverSQLite3, connString)
+	require.Nil(t, err, err)
+	require.Nil(t, db.db.Close())
+
+	// Test that a database migrated by a more recent version of Ident isn't used either.
+	raw, err := open(DriverSQLite3, connString)
+	require.Nil(t, err, err)
+	defer raw.Close()
+
+	_, err = raw.Exec(insertSchemaVersionSQL, LatestSchemaVersion()+1, "From the future", nowMS())
+	require.Nil(t, err, err)
+
+	_, err = NewSQLDatabase(DriverSQLite3, connString)
+	require.NotNil(t, err)
+	require.Equal(t, ErrSchemaTooNew, errors.Cause(err))
+}
@@ -0,0 +1,460 @@
+package database
+
+import (
+	"database/sql"
+
+	"github.com/babolivier/ident/common/constants"
+	"github.com/babolivier/ident/common/hashing"
+	"github.com/babolivier/ident/common/types"
+
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// SQLDatabase is the implementation of Database backed by a SQL database (SQLite or PostgreSQL).
+type SQLDatabase struct {
+	db                  *sql.DB
+	invites             invitesStatements
+	ephemeralPublicKeys ephemeralPublicKeysStatements
+	validationSessions  validationSessionsStatements
+	associations        associationsStatements
+	accountTokens       accountTokensStatements
+	lookupPepper        lookupPepperStatements
+	acceptedTermsURLs   acceptedTermsURLsStatements
+	mailQueue           mailQueueStatements
+}
+
+// NewSQLDatabase connects to the database and prepares the statements. It refuses to use a database whose schema isn't
+// at the version this version of Ident expects, in which case "ident migrate" must be run first. In-memory SQLite
+// databases can't be migrated beforehand, so they're migrated here.
+func NewSQLDatabase(driver string, connString string) (*SQLDatabase, error) {
+	db, err := open(driver, connString)
+	if err != nil {
+		return nil, err
+	}
+
+	if isInMemorySQLite(driver, connString) {
+		_, _, err = migrate(db, driver)
+	} else {
+		err = checkSchemaVersion(db, driver)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	invites := invitesStatements{}
+	if err = invites.prepare(db); err != nil {
+		return nil, err
+	}
+
+	ephemeralPublicKeys := ephemeralPublicKeysStatements{}
+	if err = ephemeralPublicKeys.prepare(db); err != nil {
+		return nil, err
+	}
+
+	validationSessions := validationSessionsStatements{}
+	if err = validationSessions.prepare(db); err != nil {
+		return nil, err
+	}
+
+	associations := associationsStatements{}
+	if err = associations.prepare(db); err != nil {
+		return nil, err
+	}
+
+	accountTokens := accountTokensStatements{}
+	if err = accountTokens.prepare(db); err != nil {
+		return nil, err
+	}
+
+	lookupPepper := lookupPepperStatements{}
+	if err = lookupPepper.prepare(db); err != nil {
+		return nil, err
+	}
+
+	acceptedTermsURLs := acceptedTermsURLsStatements{}
+	if err = acceptedTermsURLs.prepare(db); err != nil {
+		return nil, err
+	}
+
+	mailQueue := mailQueueStatements{}
+	if err = mailQueue.prepare(db); err != nil {
+		return nil, err
+	}
+
+	d := &SQLDatabase{
+		db, invites, ephemeralPublicKeys, validationSessions, associations, accountTokens, lookupPepper,
+		acceptedTermsURLs, mailQueue,
+	}
+
+	// Generate the lookup pepper if this is the first time we're starting up with this database.
+	if err = d.ensureLookupPepper(); err != nil {
+		return nil, err
+	}
+
+	return d, nil
+}
+
+func open(driver string, connString string) (*sql.DB, error) {
+	db, err := sql.Open(driver, connString)
+	if err != nil {
+		return nil, err
+	}
+
+	// Each connection to an in-memory SQLite database gets its own database, so make sure we only ever use one.
+	if isInMemorySQLite(driver, connString) {
+		db.SetMaxOpenConns(1)
+	}
+
+	return db, nil
+}
+
+func (d *SQLDatabase) Save3PIDInvite(invite *types.ThreepidInvite) error {
+	if len(invite.State) == 0 {
+		invite.State = constants.InviteStatePending
+	}
+
+	return d.invites.insertInvite(nil, invite)
+}
+
+func (d *SQLDatabase) Save3PIDInviteWithMail(invite *types.ThreepidInvite, mail *types.QueuedMail) (err error) {
+	if len(invite.State) == 0 {
+		invite.State = constants.InviteStatePending
+	}
+
+	txn, err := d.db.Begin()
+	if err != nil {
+		return
+	}
+
+	defer func() {
+		if err != nil {
+			_ = txn.Rollback()
+		}
+	}()
+
+	if err = d.invites.insertInvite(txn, invite); err != nil {
+		return
+	}
+
+	pubkey := invite.EphemeralPublicKey
+	if err = d.ephemeralPublicKeys.insertEphemeralPublicKey(txn, pubkey, invite.CreatedAt); err != nil {
+		return
+	}
+
+	if mail != nil {
+		if err = d.mailQueue.insertMail(txn, mail); err != nil {
+			return
+		}
+	}
+
+	err = txn.Commit()
+	return
+}
+
+func (d *SQLDatabase) Get3PIDInviteByToken(token string) (*types.ThreepidInvite, error) {
+	invite, err := d.invites.selectInviteByToken(token)
+
+	// Don't return an error on empty result set, instead return a nil invite.
+	if err == sql.ErrNoRows {
+		invite = nil
+		err = nil
+	}
+
+	return invite, err
+}
+
+func (d *SQLDatabase) Get3PIDInvitesForAddress(medium, address string) ([]*types.ThreepidInvite, error) {
+	return d.invites.selectInvitesForAddressAndMedium(medium, address)
+}
+
+func (d *SQLDatabase) Delete3PIDInvitesCreatedBefore(ts int64) (int64, error) {
+	return d.invites.deleteInvitesCreatedBefore(ts)
+}
+
+func (d *SQLDatabase) Sign3PIDInvite(token, mxid string, ts int64) (bool, error) {
+	return d.invites.signInvite(token, mxid, ts)
+}
+
+func (d *SQLDatabase) Mark3PIDInviteDelivered(token, mxid string, ts int64) (bool, error) {
+	return d.invites.markInviteDelivered(token, mxid, ts)
+}
+
+func (d *SQLDatabase) Revoke3PIDInvite(token string, ts int64) (revoked bool, err error) {
+	txn, err := d.db.Begin()
+	if err != nil {
+		return
+	}
+
+	defer func() {
+		if err != nil {
+			_ = txn.Rollback()
+		}
+	}()
+
+	if revoked, err = d.invites.revokeInvite(txn, token, ts); err != nil {
+		return
+	}
+
+	if !revoked {
+		return false, txn.Rollback()
+	}
+
+	// Delete the invite's ephemeral public key, so homeservers don't accept the invite if it's been signed already.
+	if err = d.ephemeralPublicKeys.deleteKeyForInvite(txn, token); err != nil {
+		return
+	}
+
+	err = txn.Commit()
+	return
+}
+
+func (d *SQLDatabase) SaveEphemeralPublicKey(pubkey string, createdAt int64) error {
+	return d.ephemeralPublicKeys.insertEphemeralPublicKey(nil, pubkey, createdAt)
+}
+
+func (d *SQLDatabase) EphemeralPublicKeyExists(pubkey string, createdAfter int64) (bool, error) {
+	return d.ephemeralPublicKeys.ephemeralPublicKeyExists(pubkey, createdAfter)
+}
+
+func (d *SQLDatabase) DeleteEphemeralPublicKeysCreatedBefore(ts int64) (int64, error) {
+	return d.ephemeralPublicKeys.deleteKeysCreatedBefore(ts)
+}
+
+func (d *SQLDatabase) SaveValidationSession(session *types.ValidationSession) error {
+	return d.validationSessions.insertValidationSession(session)
+}
+
+func (d *SQLDatabase) GetValidationSession(sid, clientSecret string) (*types.ValidationSession, error) {
+	session, err := d.validationSessions.selectValidationSession(sid, clientSecret)
+
+	// Don't return an error on empty result set, instead return a nil session.
+	if err == sql.ErrNoRows {
+		session = nil
+		err = nil
+	}
+
+	return session, err
+}
+
+func (d *SQLDatabase) GetValidationSessionForThreepid(
+	clientSecret, medium, address string,
+) (*types.ValidationSession, error) {
+	session, err := d.validationSessions.selectValidationSessionForThreepid(clientSecret, medium, address)
+
+	// Don't return an error on empty result set, instead return a nil session.
+	if err == sql.ErrNoRows {
+		session = nil
+		err = nil
+	}
+
+	return session, err
+}
+
+func (d *SQLDatabase) UpdateValidationSessionSendAttempt(sid string, sendAttempt int) error {
+	return d.validationSessions.updateValidationSessionSendAttempt(sid, sendAttempt)
+}
+
+func (d *SQLDatabase) MarkValidationSessionValidated(sid string, validatedAt int64) error {
+	return d.validationSessions.updateValidationSessionValidatedAt(sid, validatedAt)
+}
+
+func (d *SQLDatabase) AddValidationSessionTokenAttempt(sid string, maxAttempts int) (bool, error) {
+	return d.validationSessions.updateValidationSessionTokenAttempts(sid, maxAttempts)
+}
+
+func (d *SQLDatabase) SaveAssociation(assoc *types.ThreepidAssociation) (err error) {
+	txn, err := d.db.Begin()
+	if err != nil {
+		return
+	}
+
+	defer func() {
+		if err != nil {
+			_ = txn.Rollback()
+		}
+	}()
+
+	// Lock the pepper before reading it, so it can't be rotated before the association is saved with a hash computed
+	// from it. The association would otherwise keep a hash from the old pepper.
+	if err = d.lookupPepper.lockLookupPepper(txn); err != nil {
+		return
+	}
+
+	pepper, err := d.lookupPepper.selectLookupPepper(txn)
+	if err != nil {
+		return
+	}
+
+	lookupHash := hashing.LookupHash(assoc.Medium, assoc.Address, pepper)
+	if err = d.associations.upsertAssociation(txn, assoc, lookupHash); err != nil {
+		return
+	}
+
+	err = txn.Commit()
+	return
+}
+
+func (d *SQLDatabase) GetAssociation(medium, address string) (*types.ThreepidAssociation, error) {
+	assoc, err := d.associations.selectAssociation(medium, address)
+
+	// Don't return an error on empty result set, instead return a nil association.
+	if err == sql.ErrNoRows {
+		assoc = nil
+		err = nil
+	}
+
+	return assoc, err
+}
+
+func (d *SQLDatabase) GetAssociationByLookupHash(lookupHash string) (*types.ThreepidAssociation, error) {
+	assoc, err := d.associations.selectAssociationByLookupHash(lookupHash)
+
+	// Don't return an error on empty result set, instead return a nil association.
+	if err == sql.ErrNoRows {
+		assoc = nil
+		err = nil
+	}
+
+	return assoc, err
+}
+
+func (d *SQLDatabase) DeleteAssociation(medium, address, mxid string) (bool, error) {
+	return d.associations.deleteAssociation(medium, address, mxid)
+}
+
+func (d *SQLDatabase) SaveAccountToken(token, userID string, createdAt int64) error {
+	return d.accountTokens.insertAccountToken(token, userID, createdAt)
+}
+
+func (d *SQLDatabase) GetUserIDForAccountToken(token string) (string, error) {
+	userID, err := d.accountTokens.selectUserIDForToken(token)
+
+	// Don't return an error on empty result set, instead return an empty user ID.
+	if err == sql.ErrNoRows {
+		err = nil
+	}
+
+	return userID, err
+}
+
+func (d *SQLDatabase) DeleteAccountToken(token string) error {
+	return d.accountTokens.deleteAccountToken(token)
+}
+
+func (d *SQLDatabase) SaveAcceptedTermsURLs(userID string, urls []string) error {
+	for _, url := range urls {
+		if err := d.acceptedTermsURLs.insertAcceptedTermsURL(userID, url); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (d *SQLDatabase) GetAcceptedTermsURLs(userID string) ([]string, error) {
+	return d.acceptedTermsURLs.selectAcceptedTermsURLs(userID)
+}
+
+func (d *SQLDatabase) EnqueueMail(mail *types.QueuedMail) error {
+	return d.mailQueue.insertMail(nil, mail)
+}
+
+func (d *SQLDatabase) ClaimDueMails(now, leaseUntil int64, limit int) ([]*types.QueuedMail, error) {
+	mails, err := d.mailQueue.selectDueMails(now, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	// Another process using the same database might have selected the same emails, so only keep the ones we manage
+	// to claim.
+	claimed := make([]*types.QueuedMail, 0, len(mails))
+	for _, mail := range mails {
+		ok, err := d.mailQueue.claimMail(mail.ID, mail.NextAttemptAt, leaseUntil)
+		if err != nil {
+			return nil, err
+		}
+
+		if ok {
+			mail.NextAttemptAt = leaseUntil
+			claimed = append(claimed, mail)
+		}
+	}
+
+	return claimed, nil
+}
+
+func (d *SQLDatabase) RescheduleMail(id int64, attempts int, nextAttemptAt int64, lastError string) error {
+	return d.mailQueue.rescheduleMail(id, attempts, nextAttemptAt, lastError)
+}
+
+func (d *SQLDatabase) DeleteMail(id int64) error {
+	return d.mailQueue.deleteMail(id)
+}
+
+func (d *SQLDatabase) GetLookupPepper() (string, error) {
+	return d.lookupPepper.selectLookupPepper(nil)
+}
+
+func (d *SQLDatabase) RotateLookupPepper() (pepper string, err error) {
+	if pepper, err = generateLookupPepper(); err != nil {
+		return
+	}
+
+	txn, err := d.db.Begin()
+	if err != nil {
+		return
+	}
+
+	defer func() {
+		if err != nil {
+			_ = txn.Rollback()
+		}
+	}()
+
+	if err = d.lookupPepper.updateLookupPepper(txn, pepper); err != nil {
+		return
+	}
+
+	threepids, err := d.associations.selectAllThreepids(txn)
+	if err != nil {
+		return
+	}
+
+	for _, threepid := range threepids {
+		lookupHash := hashing.LookupHash(threepid[0], threepid[1], pepper)
+		if err = d.associations.updateLookupHash(txn, threepid[0], threepid[1], lookupHash); err != nil {
+			return
+		}
+	}
+
+	err = txn.Commit()
+	return
+}
+
+func (d *SQLDatabase) ensureLookupPepper() error {
+	_, err := d.lookupPepper.selectLookupPepper(nil)
+	if err != sql.ErrNoRows {
+		return err
+	}
+
+	pepper, err := generateLookupPepper()
+	if err != nil {
+		return err
+	}
+
+	return d.lookupPepper.insertLookupPepper(pepper)
+}
+
+func isInMemorySQLite(driver string, connString string) bool {
+	return driver == DriverSQLite3 && connString == ":memory:"
+}
+
+// txStmt returns the given statement, bound to the given transaction if there's one.
+func txStmt(txn *sql.Tx, stmt *sql.Stmt) *sql.Stmt {
+	if txn != nil {
+		return txn.Stmt(stmt)
+	}
+
+	return stmt
+}
@@ -0,0 +1,146 @@
+package database
+
+import (
+	"database/sql"
+
+	"github.com/babolivier/ident/common/types"
+)
+
+const validationSessionsSchema = `
+-- Stores 3PID validation sessions
+CREATE TABLE IF NOT EXISTS validation_sessions (
+	sid TEXT PRIMARY KEY,
+	medium TEXT NOT NULL,
+	address TEXT NOT NULL,
+	client_secret TEXT NOT NULL,
+	token TEXT NOT NULL,
+	send_attempt INTEGER NOT NULL,
+	next_link TEXT NOT NULL,
+	created_at BIGINT NOT NULL,
+	validated_at BIGINT NOT NULL DEFAULT 0
+);
+
+CREATE INDEX IF NOT EXISTS validation_sessions_client_secret_medium_address_idx
+	ON validation_sessions (client_secret, medium, address);
+`
+
+const validationSessionsTokenAttemptsSchema = `
+ALTER TABLE validation_sessions ADD COLUMN token_attempts INTEGER NOT NULL DEFAULT 0;
+`
+
+const insertValidationSessionSQL = `
+	INSERT INTO validation_sessions (
+		sid, medium, address, client_secret, token, send_attempt, next_link, created_at, validated_at, token_attempts
+	)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+`
+
+const selectValidationSessionSQL = `
+	SELECT sid, medium, address, client_secret, token, send_attempt, next_link, created_at, validated_at,
+		token_attempts
+	FROM validation_sessions WHERE sid = $1 AND client_secret = $2
+`
+
+const selectValidationSessionForThreepidSQL = `
+	SELECT sid, medium, address, client_secret, token, send_attempt, next_link, created_at, validated_at,
+		token_attempts
+	FROM validation_sessions WHERE client_secret = $1 AND medium = $2 AND address = $3
+	ORDER BY created_at DESC LIMIT 1
+`
+
+const updateValidationSessionSendAttemptSQL = `
+	UPDATE validation_sessions SET send_attempt = $1 WHERE sid = $2
+`
+
+const updateValidationSessionValidatedAtSQL = `
+	UPDATE validation_sessions SET validated_at = $1 WHERE sid = $2
+`
+
+// Only counts the attempt if the limit hasn't been reached, so concurrent attempts can't go over it.
+const updateValidationSessionTokenAttemptsSQL = `
+	UPDATE validation_sessions SET token_attempts = token_attempts + 1 WHERE sid = $1 AND token_attempts < $2
+`
+
+type validationSessionsStatements struct {
+	insertValidationSessionStmt              *sql.Stmt
+	selectValidationSessionStmt              *sql.Stmt
+	selectValidationSessionForThreepidStmt   *sql.Stmt
+	updateValidationSessionSendAttemptStmt   *sql.Stmt
+	updateValidationSessionValidatedAtStmt   *sql.Stmt
+	updateValidationSessionTokenAttemptsStmt *sql.Stmt
+}
+
+func (s *validationSessionsStatements) prepare(db *sql.DB) (err error) {
+	if s.insertValidationSessionStmt, err = db.Prepare(insertValidationSessionSQL); err != nil {
+		return
+	}
+	if s.selectValidationSessionStmt, err = db.Prepare(selectValidationSessionSQL); err != nil {
+		return
+	}
+	if s.selectValidationSessionForThreepidStmt, err = db.Prepare(selectValidationSessionForThreepidSQL); err != nil {
+		return
+	}
+	if s.updateValidationSessionSendAttemptStmt, err = db.Prepare(updateValidationSessionSendAttemptSQL); err != nil {
+		return
+	}
+	if s.updateValidationSessionValidatedAtStmt, err = db.Prepare(updateValidationSessionValidatedAtSQL); err != nil {
+		return
+	}
+	if s.updateValidationSessionTokenAttemptsStmt, err = db.Prepare(updateValidationSessionTokenAttemptsSQL); err != nil {
+		return
+	}
+	return
+}
+
+func (s *validationSessionsStatements) insertValidationSession(session *types.ValidationSession) (err error) {
+	_, err = s.insertValidationSessionStmt.Exec(
+		session.ID, session.Medium, session.Address, session.ClientSecret, session.Token, session.SendAttempt,
+		session.NextLink, session.CreatedAt, session.ValidatedAt, session.TokenAttempts,
+	)
+	return
+}
+
+func (s *validationSessionsStatements) selectValidationSession(
+	sid, clientSecret string,
+) (*types.ValidationSession, error) {
+	return scanValidationSession(s.selectValidationSessionStmt.QueryRow(sid, clientSecret))
+}
+
+func (s *validationSessionsStatements) selectValidationSessionForThreepid(
+	clientSecret, medium, address string,
+) (*types.ValidationSession, error) {
+	return scanValidationSession(s.selectValidationSessionForThreepidStmt.QueryRow(clientSecret, medium, address))
+}
+
+func (s *validationSessionsStatements) updateValidationSessionSendAttempt(sid string, sendAttempt int) (err error) {
+	_, err = s.updateValidationSessionSendAttemptStmt.Exec(sendAttempt, sid)
+	return
+}
+
+func (s *validationSessionsStatements) updateValidationSessionValidatedAt(sid string, validatedAt int64) (err error) {
+	_, err = s.updateValidationSessionValidatedAtStmt.Exec(validatedAt, sid)
+	return
+}
+
+func (s *validationSessionsStatements) updateValidationSessionTokenAttempts(
+	sid string, maxAttempts int,
+) (bool, error) {
+	res, err := s.updateValidationSessionTokenAttemptsStmt.Exec(sid, maxAttempts)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func scanValidationSession(row *sql.Row) (*types.ValidationSession, error) {
+	var session types.ValidationSession
+
+	err := row.Scan(
+		&session.ID, &session.Medium, &session.Address, &session.ClientSecret, &session.Token, &session.SendAttempt,
+		&session.NextLink, &session.CreatedAt, &session.ValidatedAt, &session.TokenAttempts,
+	)
+
+	return &session, err
+}
@@ -0,0 +1,56 @@
+package email
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/babolivier/ident/common/config"
+	"github.com/babolivier/ident/common/crypto"
+
+	"github.com/pkg/errors"
+)
+
+// FileTransport doesn't send emails but writes them to a directory, either as .eml files or as a maildir. It's meant
+// to be used for testing and development.
+type FileTransport struct {
+	path    string
+	maildir bool
+}
+
+func NewFileTransport(cfg *config.MailFileConfig) *FileTransport {
+	return &FileTransport{path: cfg.Path, maildir: cfg.Maildir}
+}
+
+func (t *FileTransport) Send(from, to string, msg []byte) error {
+	// Start the name with the time so the files are sorted in the order the emails were sent.
+	suffix, err := crypto.RandString(8)
+	if err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%d.%s", time.Now().UnixNano(), suffix)
+
+	if !t.maildir {
+		if err = os.MkdirAll(t.path, 0700); err != nil {
+			return errors.Wrap(err, "Couldn't create the mail directory")
+		}
+
+		return ioutil.WriteFile(filepath.Join(t.path, name+".eml"), msg, 0600)
+	}
+
+	for _, dir := range []string{"tmp", "new", "cur"} {
+		if err = os.MkdirAll(filepath.Join(t.path, dir), 0700); err != nil {
+			return errors.Wrap(err, "Couldn't create the maildir")
+		}
+	}
+
+	// Write the email in tmp and then move it to new, so readers never see a partially written email.
+	tmpPath := filepath.Join(t.path, "tmp", name)
+	if err = ioutil.WriteFile(tmpPath, msg, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, filepath.Join(t.path, "new", name))
+}
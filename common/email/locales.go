@@ -0,0 +1,31 @@
+package email
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/babolivier/ident/common/config"
+	"github.com/babolivier/ident/common/templates"
+)
+
+// Locales returns the locales to pick the templates of an email to the given address from, in order of preference:
+// the locale given in the request if any, then the ones from the request's Accept-Language header, then the one
+// configured for the address's domain. The request can be nil if the email isn't sent because of one.
+func Locales(cfg *config.Config, r *http.Request, requested, address string) []string {
+	var locales []string
+	if len(requested) > 0 {
+		locales = append(locales, requested)
+	}
+
+	if r != nil {
+		locales = append(locales, templates.ParseAcceptLanguage(r.Header.Get("Accept-Language"))...)
+	}
+
+	if i := strings.LastIndex(address, "@"); i >= 0 {
+		if locale, ok := cfg.Ident.Localisation.Domains[strings.ToLower(address[i+1:])]; ok {
+			locales = append(locales, locale)
+		}
+	}
+
+	return locales
+}
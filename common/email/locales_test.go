@@ -0,0 +1,28 @@
+package email
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/babolivier/ident/common/testutils"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLocales(t *testing.T) {
+	cfg := *testutils.NewTestConfig(t)
+	cfg.Ident.Localisation.Domains = map[string]string{"example.fr": "fr"}
+
+	r, err := http.NewRequest(http.MethodPost, "/", nil)
+	require.Nil(t, err, err)
+
+	require.Empty(t, Locales(&cfg, r, "", "alice@example.com"))
+	require.Equal(t, []string{"fr"}, Locales(&cfg, r, "", "alice@Example.FR"))
+
+	// Test that the requested locale comes first, then the ones from Accept-Language, then the domain's.
+	r.Header.Set("Accept-Language", "en;q=0.5, de")
+	require.Equal(t, []string{"pt-BR", "de", "en", "fr"}, Locales(&cfg, r, "pt-BR", "alice@example.fr"))
+
+	// Test that there can be no request.
+	require.Equal(t, []string{"de", "fr"}, Locales(&cfg, nil, "de", "alice@example.fr"))
+}
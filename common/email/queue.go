@@ -0,0 +1,168 @@
+package email
+
+import (
+	"time"
+
+	"github.com/babolivier/ident/common"
+	"github.com/babolivier/ident/common/config"
+	"github.com/babolivier/ident/common/database"
+	"github.com/babolivier/ident/common/types"
+
+	"github.com/sirupsen/logrus"
+)
+
+// How long a worker has to send an email before it can be claimed again, e.g. if Ident stopped while sending it.
+const mailLease = 10 * time.Minute
+
+// deliver sends the queued emails. Tests replace it to simulate failures.
+var deliver = deliverMail
+
+// wakeUp tells RunQueue that an email has just been queued, so it doesn't wait until the next poll to send it.
+var wakeUp = make(chan struct{}, 1)
+
+// Enabled returns whether sending emails is enabled in the configuration.
+func Enabled(cfg *config.Config) bool {
+	return !cfg.Email.Disabled
+}
+
+// NewQueuedMail generates an email from the templates with the given name, in the first of the given locales they exist
+// in, and the given data, ready to be added to the outbound queue. Once it's stored in the database, Notify tells
+// RunQueue to send it.
+func NewQueuedMail(
+	cfg *config.Config, to, templateName string, locales []string, data interface{},
+) (*types.QueuedMail, error) {
+	msg, err := renderMail(cfg, to, templateName, locales, data)
+	if err != nil {
+		return nil, err
+	}
+
+	now := common.NowMS()
+	return &types.QueuedMail{
+		Recipient:     to,
+		Message:       msg,
+		NextAttemptAt: now,
+		CreatedAt:     now,
+	}, nil
+}
+
+// Notify tells RunQueue that emails have just been queued, so it doesn't wait until the next poll to send them.
+func Notify() {
+	select {
+	case wakeUp <- struct{}{}:
+	default:
+	}
+}
+
+// RunQueue sends the emails from the outbound queue with the configured number of workers, retrying the ones that
+// fail with an exponential backoff. It never returns, and is meant to be run in its own goroutine.
+func RunQueue(cfg *config.Config, db database.Database) {
+	queueCfg := cfg.Email.Queue
+	mails := make(chan *types.QueuedMail)
+
+	for i := 0; i < queueCfg.Workers; i++ {
+		go func() {
+			for mail := range mails {
+				processMail(cfg, db, mail)
+			}
+		}()
+	}
+
+	ticker := time.NewTicker(queueCfg.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		due, err := claimDueMails(cfg, db)
+		if err != nil {
+			logrus.WithError(err).Error("Couldn't retrieve the queued emails")
+		}
+
+		for _, mail := range due {
+			mails <- mail
+		}
+
+		// If we got as many emails as we asked for, there might be more waiting.
+		if len(due) == queueCfg.Workers {
+			continue
+		}
+
+		select {
+		case <-ticker.C:
+		case <-wakeUp:
+		}
+	}
+}
+
+// FlushQueue sends the queued emails that are due right away, in the calling goroutine. Failed emails are rescheduled
+// as they would be by RunQueue.
+func FlushQueue(cfg *config.Config, db database.Database) error {
+	for {
+		due, err := claimDueMails(cfg, db)
+		if err != nil {
+			return err
+		}
+
+		for _, mail := range due {
+			processMail(cfg, db, mail)
+		}
+
+		if len(due) < cfg.Email.Queue.Workers {
+			return nil
+		}
+	}
+}
+
+// claimDueMails claims as many of the emails that are due to be sent as there are workers.
+func claimDueMails(cfg *config.Config, db database.Database) ([]*types.QueuedMail, error) {
+	now := common.NowMS()
+	return db.ClaimDueMails(now, now+durationMS(mailLease), cfg.Email.Queue.Workers)
+}
+
+// processMail tries to send the given queued email. It's removed from the queue if it was sent, or if there's no
+// attempt left, and rescheduled otherwise.
+func processMail(cfg *config.Config, db database.Database, mail *types.QueuedMail) {
+	logger := logrus.WithField("mail_id", mail.ID)
+
+	sendErr := deliver(cfg, mail.Recipient, mail.Message)
+	if sendErr == nil {
+		if err := db.DeleteMail(mail.ID); err != nil {
+			logger.WithError(err).Error("Couldn't remove a sent email from the queue")
+		}
+		return
+	}
+
+	attempts := mail.Attempts + 1
+	logger = logger.WithError(sendErr).WithField("attempts", attempts)
+
+	if attempts >= cfg.Email.Queue.MaxAttempts {
+		logger.Error("Couldn't send email, giving up")
+		if err := db.DeleteMail(mail.ID); err != nil {
+			logger.WithError(err).Error("Couldn't remove a failed email from the queue")
+		}
+		return
+	}
+
+	delay := backoff(&cfg.Email.Queue, attempts)
+	logger.WithField("retry_in", delay).Warn("Couldn't send email, will retry")
+
+	if err := db.RescheduleMail(mail.ID, attempts, common.NowMS()+durationMS(delay), sendErr.Error()); err != nil {
+		logger.WithError(err).Error("Couldn't reschedule a failed email")
+	}
+}
+
+// backoff returns how long to wait before the next attempt at sending an email that failed the given number of times.
+func backoff(cfg *config.MailQueueConfig, attempts int) time.Duration {
+	delay := cfg.MinBackoff
+	for i := 1; i < attempts && delay < cfg.MaxBackoff; i++ {
+		delay *= 2
+	}
+
+	if delay > cfg.MaxBackoff {
+		delay = cfg.MaxBackoff
+	}
+
+	return delay
+}
+
+func durationMS(d time.Duration) int64 {
+	return int64(d / time.Millisecond)
+}
@@ -0,0 +1,146 @@
+package email
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/babolivier/ident/common"
+	"github.com/babolivier/ident/common/config"
+	"github.com/babolivier/ident/common/database"
+	"github.com/babolivier/ident/common/templates"
+	"github.com/babolivier/ident/common/testutils"
+	"github.com/babolivier/ident/common/types"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackoff(t *testing.T) {
+	cfg := &config.MailQueueConfig{
+		MinBackoff: 30 * time.Second,
+		MaxBackoff: 5 * time.Minute,
+	}
+
+	require.Equal(t, 30*time.Second, backoff(cfg, 1))
+	require.Equal(t, time.Minute, backoff(cfg, 2))
+	require.Equal(t, 2*time.Minute, backoff(cfg, 3))
+	require.Equal(t, 4*time.Minute, backoff(cfg, 4))
+	require.Equal(t, 5*time.Minute, backoff(cfg, 5))
+	require.Equal(t, 5*time.Minute, backoff(cfg, 50))
+}
+
+func TestNewQueuedMail(t *testing.T) {
+	cfg := testutils.NewTestConfig(t)
+
+	files := map[string]string{
+		cfg.Ident.Invites.EmailTemplate.Text: "{{.SenderDisplayName}} - {{.RoomID}} - {{.Token}}",
+	}
+
+	testutils.TestWithTemplates(t, testNewQueuedMail, files)
+}
+
+func testNewQueuedMail(t *testing.T) {
+	cfg := testutils.NewTestConfig(t)
+	db := testutils.NewTestDB(t)
+
+	data := req{
+		RoomID:            "!someroom:example.com",
+		SenderDisplayName: "Alice",
+		Token:             "sometoken",
+	}
+
+	mail, err := NewQueuedMail(cfg, "bob@example.com", templates.InviteEmail, nil, &data)
+	require.Nil(t, err, err)
+	require.Nil(t, db.EnqueueMail(mail))
+
+	mails, err := claimDueMails(cfg, db)
+	require.Nil(t, err, err)
+	require.Len(t, mails, 1)
+	require.Equal(t, "bob@example.com", mails[0].Recipient)
+	require.Contains(t, string(mails[0].Message), "To: bob@example.com\r\n")
+	require.Contains(t, string(mails[0].Message), "Alice - !someroom:example.com - sometoken")
+}
+
+func TestProcessMail(t *testing.T) {
+	cfg := testutils.NewTestConfig(t)
+	db := testutils.NewTestDB(t)
+
+	// Replace the delivery with one that fails as long as failures is positive.
+	failures := cfg.Email.Queue.MaxAttempts - 1
+	var delivered []string
+	deliver = func(cfg *config.Config, to string, msg []byte) error {
+		if failures > 0 {
+			failures--
+			return errors.New("Connection refused")
+		}
+
+		delivered = append(delivered, to)
+		return nil
+	}
+	defer func() { deliver = deliverMail }()
+
+	err := db.EnqueueMail(newQueuedMail("alice@example.com"))
+	require.Nil(t, err, err)
+
+	// Test that a failed email is rescheduled according to the backoff, and sent once the mail server is back.
+	mail := claimOne(t, db, common.NowMS())
+	for i := 1; i < cfg.Email.Queue.MaxAttempts; i++ {
+		before := common.NowMS()
+		processMail(cfg, db, mail)
+		after := common.NowMS()
+		require.Empty(t, delivered)
+
+		delay := durationMS(backoff(&cfg.Email.Queue, i))
+
+		mails, err := db.ClaimDueMails(before+delay-1, 0, 10)
+		require.Nil(t, err, err)
+		require.Empty(t, mails)
+
+		// Claiming with a lease of 0 keeps the email due for the next iteration.
+		mail = claimOne(t, db, after+delay)
+		require.Equal(t, i, mail.Attempts)
+		require.Equal(t, "Connection refused", mail.LastError)
+	}
+
+	processMail(cfg, db, mail)
+	require.Equal(t, []string{"alice@example.com"}, delivered)
+	requireQueueEmpty(t, db)
+
+	// Test that an email is dropped once there's no attempt left.
+	failures = 1
+	delivered = nil
+
+	queued := newQueuedMail("bob@example.com")
+	queued.Attempts = cfg.Email.Queue.MaxAttempts - 1
+	err = db.EnqueueMail(queued)
+	require.Nil(t, err, err)
+
+	processMail(cfg, db, claimOne(t, db, common.NowMS()))
+	require.Empty(t, delivered)
+	requireQueueEmpty(t, db)
+}
+
+func newQueuedMail(to string) *types.QueuedMail {
+	now := common.NowMS()
+	return &types.QueuedMail{
+		Recipient:     to,
+		Message:       []byte("Subject: Hello\r\n\r\nHello"),
+		NextAttemptAt: now,
+		CreatedAt:     now,
+	}
+}
+
+// claimOne claims the only email due at the given time, and leaves it due.
+func claimOne(t *testing.T, db database.Database, now int64) *types.QueuedMail {
+	mails, err := db.ClaimDueMails(now, 0, 10)
+	require.Nil(t, err, err)
+	require.Len(t, mails, 1)
+
+	return mails[0]
+}
+
+func requireQueueEmpty(t *testing.T, db database.Database) {
+	mails, err := db.ClaimDueMails(common.NowMS()+durationMS(24*time.Hour), 0, 10)
+	require.Nil(t, err, err)
+	require.Empty(t, mails)
+}
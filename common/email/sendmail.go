@@ -2,91 +2,68 @@ package email
 
 import (
 	"bytes"
-	"crypto/tls"
 	"fmt"
-	"html/template"
 	"io"
-	"io/ioutil"
+	"mime"
 	"mime/multipart"
-	"net"
-	"net/smtp"
+	"mime/quotedprintable"
+	"net/mail"
 	"net/textproto"
+	"strings"
+	"text/template"
 	"time"
+	"unicode/utf8"
 
 	"github.com/babolivier/ident/common/config"
+	"github.com/babolivier/ident/common/templates"
 
 	"github.com/pkg/errors"
 )
 
-func SendMail(cfg *config.Config, to, templateTXT, templateHTML string, data interface{}) (err error) {
-	// Dial the SMTP server.
-	var conn net.Conn
-	addr := cfg.Email.SMTP.Hostname + ":" + cfg.Email.SMTP.Port
-
-	// Dial with a TLS handshake if TLS is enabled, use a standard TCP connection otherwise.
-	if cfg.Email.SMTP.EnableTLS {
-		tlsconfig := &tls.Config{ServerName: cfg.Email.SMTP.Hostname}
-		conn, err = tls.Dial("tcp", addr, tlsconfig)
-		if err != nil {
-			return errors.Wrap(err, "Couldn't dial the SMTP server (TLS on)")
-		}
-	} else {
-		conn, err = net.Dial("tcp", addr)
-		if err != nil {
-			return errors.Wrap(err, "Couldn't dial the SMTP server (TLS off)")
-		}
-	}
-
-	// Initiate the SMTP client.
-	client, err := smtp.NewClient(conn, cfg.Email.SMTP.Hostname)
+// SendMail generates an email from the templates with the given name, in the first of the given locales they exist
+// in, and the given data, and sends it right away. Emails that don't need to be sent while the caller waits should go
+// through Enqueue instead.
+func SendMail(cfg *config.Config, to, templateName string, locales []string, data interface{}) error {
+	msg, err := renderMail(cfg, to, templateName, locales, data)
 	if err != nil {
-		return errors.Wrap(err, "Couldn't instantiate the SMTP client")
-	}
-
-	// Auth against the SMTP server
-	auth := smtp.PlainAuth("", cfg.Email.SMTP.Username, cfg.Email.SMTP.Password, cfg.Email.SMTP.Hostname)
-	if err = client.Auth(auth); err != nil {
-		return errors.Wrap(err, "Couldn't authenticate against the SMTP server")
-	}
-
-	// Send the MAIL FROM command.
-	if err = client.Mail(cfg.Email.From); err != nil {
-		return errors.Wrap(err, "Couldn't send MAIL FROM to the SMTP server")
+		return err
 	}
 
-	// Send the RCPT TO command.
-	if err = client.Rcpt(to); err != nil {
-		return errors.Wrap(err, "Couldn't send RCPT TO to the SMTP server")
-	}
+	return deliverMail(cfg, to, msg)
+}
 
-	// Send the DATA command and get the writer to write the email's body to.
-	w, err := client.Data()
+// renderMail generates the full message, headers included, for an email from the templates with the given name, in
+// the first of the given locales they exist in, and the given data.
+func renderMail(cfg *config.Config, to, templateName string, locales []string, data interface{}) ([]byte, error) {
+	tmpl, err := cfg.Templates.Email(templateName, locales...)
 	if err != nil {
-		return errors.Wrap(err, "Couldn't send DATA to the SMTP server")
+		return nil, err
 	}
 
-	// Generate the email body.
-	if err = generateEmail(cfg, w, to, templateTXT, templateHTML, data); err != nil {
-		return errors.Wrap(err, "Couldn't generate the email's body")
+	buf := bytes.NewBuffer(nil)
+	if err = generateEmail(cfg, buf, to, tmpl, data); err != nil {
+		return nil, errors.Wrap(err, "Couldn't generate the email's body")
 	}
 
-	// Close the writer now that all of the content is written.
-	if err = w.Close(); err != nil {
-		return errors.Wrap(err, "Couldn't close the email body writer")
-	}
+	return buf.Bytes(), nil
+}
 
-	// Send the QUIT command to validate the operation with the server.
-	if err = client.Quit(); err != nil {
-		return errors.Wrap(err, "Couldn't send QUIT to the SMTP server")
+// deliverMail sends the given message using the configured transport.
+func deliverMail(cfg *config.Config, to string, msg []byte) error {
+	transport, err := NewTransport(&cfg.Email)
+	if err != nil {
+		return err
 	}
 
-	return nil
+	return transport.Send(envelopeAddress(cfg.Email.From), to, msg)
 }
 
-func generateEmail(cfg *config.Config, w io.Writer, to, templateTXT, templateHTML string, data interface{}) (err error) {
+func generateEmail(
+	cfg *config.Config, w io.Writer, to string, tmpl *templates.Email, data interface{},
+) (err error) {
 	// Instantiate the multipart.Writer and generate the subject from the template.
 	mw := multipart.NewWriter(w)
-	subject, err := loadSubjectTemplate(cfg, data)
+	subject, err := loadSubjectTemplate(tmpl.Subject, data)
 	if err != nil {
 		return
 	}
@@ -95,13 +72,13 @@ func generateEmail(cfg *config.Config, w io.Writer, to, templateTXT, templateHTM
 	if _, err = fmt.Fprintf(w, "Date: %s\r\n", time.Now().Format(time.RFC1123Z)); err != nil {
 		return
 	}
-	if _, err = fmt.Fprintf(w, "From: %s\r\n", cfg.Email.From); err != nil {
+	if _, err = fmt.Fprintf(w, "From: %s\r\n", encodeAddressHeader(cfg.Email.From)); err != nil {
 		return
 	}
-	if _, err = fmt.Fprintf(w, "To: %s\r\n", to); err != nil {
+	if _, err = fmt.Fprintf(w, "To: %s\r\n", encodeAddressHeader(to)); err != nil {
 		return
 	}
-	if _, err = fmt.Fprintf(w, "Subject: %s\r\n", subject); err != nil {
+	if _, err = fmt.Fprintf(w, "Subject: %s\r\n", encodeHeader(subject)); err != nil {
 		return
 	}
 	if _, err = fmt.Fprintf(w, "MIME-Version: 1.0\r\n"); err != nil {
@@ -132,47 +109,90 @@ func generateEmail(cfg *config.Config, w io.Writer, to, templateTXT, templateHTM
 	}
 
 	// Generate the plain text version from the plain text template if there's one.
-	if len(templateTXT) > 0 {
-		if err = loadBodyTemplate(aw, templateTXT, "text/plain", data); err != nil {
+	if tmpl.Text != nil {
+		if err = loadBodyTemplate(aw, tmpl.Text, "text/plain", data); err != nil {
 			return errors.Wrap(err, "Couldn't generate the plain text part of the message")
 		}
 	}
 
 	// Generate the HTML version from the HTML template if there's one.
-	if len(templateHTML) > 0 {
+	if tmpl.HTML != nil {
 		rw := multipart.NewWriter(w)
 		_, _ = aw.CreatePart(textproto.MIMEHeader{"Content-Type": {"multipart/related; boundary=" + rw.Boundary()}})
 
-		if err = loadBodyTemplate(rw, templateHTML, "text/html", data); err != nil {
+		if err = loadBodyTemplate(rw, tmpl.HTML, "text/html", data); err != nil {
 			return errors.Wrap(err, "Couldn't generate the plain HTML of the message")
 		}
+
+		if err = rw.Close(); err != nil {
+			return
+		}
 	}
 
-	return nil
+	// Write the closing boundaries.
+	if err = aw.Close(); err != nil {
+		return
+	}
+
+	return mw.Close()
 }
 
-func loadSubjectTemplate(cfg *config.Config, data interface{}) (subject string, err error) {
+// loadSubjectTemplate generates the subject of an email. As it ends up in a header rather than in an HTML document, it
+// uses text/template, and any line break is replaced with a space.
+func loadSubjectTemplate(tmpl *template.Template, data interface{}) (subject string, err error) {
 	buf := bytes.NewBuffer(nil)
 
-	// Parse the template.
-	tmpl, err := template.New("subject").Parse(cfg.Ident.Invites.SubjectTemplate)
-	if err != nil {
-		return
-	}
-
 	// Generate bytes from the template and data.
 	if err = tmpl.Execute(buf, data); err != nil {
 		return
 	}
 
-	return buf.String(), nil
+	return headerReplacer.Replace(buf.String()), nil
+}
+
+// headerReplacer removes line breaks from header values, so data given to the templates can't add headers.
+var headerReplacer = strings.NewReplacer("\r\n", " ", "\r", " ", "\n", " ")
+
+// encodeHeader encodes the given header value as described in RFC 2047 if it isn't plain ASCII.
+func encodeHeader(value string) string {
+	return mime.QEncoding.Encode("UTF-8", headerReplacer.Replace(value))
+}
+
+// encodeAddressHeader formats the given address for an address header, encoding its display name as described in
+// RFC 2047 if it isn't plain ASCII. Other addresses, including the ones that can't be parsed, are written as they are.
+func encodeAddressHeader(address string) string {
+	address = headerReplacer.Replace(address)
+
+	addr, err := mail.ParseAddress(address)
+	if err != nil || isASCII(addr.Name) {
+		return address
+	}
+
+	return addr.String()
 }
 
-func loadBodyTemplate(w *multipart.Writer, templateName, mimetype string, data interface{}) error {
-	// Define the part's header.
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+
+	return true
+}
+
+// bodyTemplate is implemented by both text/template's and html/template's Template.
+type bodyTemplate interface {
+	Execute(w io.Writer, data interface{}) error
+}
+
+func loadBodyTemplate(w *multipart.Writer, tmpl bodyTemplate, mimetype string, data interface{}) error {
+	// Define the part's header. The body is encoded as quoted-printable so non-ASCII characters and long lines (e.g.
+	// links) go through any mail server.
 	mimeHeader := textproto.MIMEHeader{
-		"Content-Type":        {mimetype + "; charset=UTF-8"},
-		"Content-Disposition": {"inline"},
+		"Content-Type":              {mimetype + "; charset=UTF-8"},
+		"Content-Disposition":       {"inline"},
+		"Content-Transfer-Encoding": {"quoted-printable"},
 	}
 
 	// Create the part in the multipart body.
@@ -181,18 +201,11 @@ func loadBodyTemplate(w *multipart.Writer, templateName, mimetype string, data i
 		return err
 	}
 
-	// Open and read the template file.
-	b, err := ioutil.ReadFile(templateName)
-	if err != nil {
-		return err
-	}
-
-	// Parse the template file.
-	tmpl, err := template.New(mimetype).Parse(string(b))
-	if err != nil {
+	// Generate bytes from the template and the data and write them to the multipart.Writer.
+	qpw := quotedprintable.NewWriter(part)
+	if err = tmpl.Execute(qpw, data); err != nil {
 		return err
 	}
 
-	// Generate bytes from the template and the data and write them to the multipart.Writer.
-	return tmpl.Execute(part, data)
+	return qpw.Close()
 }
@@ -0,0 +1,37 @@
+package email
+
+import (
+	"bytes"
+	"os/exec"
+	"strings"
+
+	"github.com/babolivier/ident/common/config"
+
+	"github.com/pkg/errors"
+)
+
+// SendmailTransport sends emails by piping them to a local sendmail binary, which reads the recipients from the
+// message's headers.
+type SendmailTransport struct {
+	path string
+	args []string
+}
+
+func NewSendmailTransport(cfg *config.SendmailConfig) *SendmailTransport {
+	return &SendmailTransport{path: cfg.Path, args: cfg.Args}
+}
+
+func (t *SendmailTransport) Send(from, to string, msg []byte) error {
+	args := append([]string{"-t", "-i", "-f", from}, t.args...)
+
+	var stderr bytes.Buffer
+	cmd := exec.Command(t.path, args...)
+	cmd.Stdin = bytes.NewReader(msg)
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return errors.Wrap(err, "sendmail failed: "+strings.TrimSpace(stderr.String()))
+	}
+
+	return nil
+}
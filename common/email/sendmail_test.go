@@ -4,11 +4,14 @@ import (
 	"bufio"
 	"bytes"
 	"io"
+	"mime"
 	"mime/multipart"
 	"net/mail"
 	"strings"
 	"testing"
+	"text/template"
 
+	"github.com/babolivier/ident/common/templates"
 	"github.com/babolivier/ident/common/testutils"
 
 	"github.com/stretchr/testify/require"
@@ -23,17 +26,6 @@ type req struct {
 }
 
 func TestGenerateEmail(t *testing.T) {
-	cfg := testutils.NewTestConfig(t)
-
-	files := map[string]string{
-		cfg.Ident.Invites.EmailTemplate.Text: "{{.SenderDisplayName}} - {{.RoomID}} - {{.Token}}",
-		cfg.Ident.Invites.EmailTemplate.HTML: "<p>{{.SenderDisplayName}} - {{.RoomID}} - {{.Token}}</p>",
-	}
-
-	testutils.TestWithTmpFiles(t, testGenerateEmail, files)
-}
-
-func testGenerateEmail(t *testing.T) {
 	// Tests that generateEmail builds a multipart message with the right structure.
 	//
 	// The structure to follow is:
@@ -58,14 +50,21 @@ func testGenerateEmail(t *testing.T) {
 		Token:             "sometoken",
 	}
 
-	err := generateEmail(cfg, buf, to, cfg.Ident.Invites.EmailTemplate.Text, cfg.Ident.Invites.EmailTemplate.HTML, req)
+	tmpl, err := templates.ParseEmail(
+		cfg.Ident.Invites.SubjectTemplate,
+		"{{.SenderDisplayName}} - {{.RoomID}} - {{.Token}}",
+		"<p>{{.SenderDisplayName}} - {{.RoomID}} - {{.Token}}</p>",
+	)
+	require.Nil(t, err, err)
+
+	err = generateEmail(cfg, buf, to, tmpl, req)
 	require.Nil(t, err, err)
 
 	reader := bytes.NewReader(buf.Bytes())
 	msg, err := mail.ReadMessage(reader)
 	require.Nil(t, err, err)
 
-	parsedSubject, err := loadSubjectTemplate(cfg, req)
+	parsedSubject, err := loadSubjectTemplate(tmpl.Subject, req)
 	require.Nil(t, err, err)
 
 	// Test email headers
@@ -138,28 +137,19 @@ func testGenerateEmail(t *testing.T) {
 }
 
 func TestLoadBodyTemplate(t *testing.T) {
-	cfg := testutils.NewTestConfig(t)
-
-	files := map[string]string{
-		cfg.Ident.Invites.EmailTemplate.Text: "{{.SenderDisplayName}} - {{.RoomID}} - {{.Token}}",
-	}
-
-	testutils.TestWithTmpFiles(t, testLoadBodyTemplate, files)
-}
-
-func testLoadBodyTemplate(t *testing.T) {
-	cfg := testutils.NewTestConfig(t)
-
 	req := &req{
 		SenderDisplayName: "alice",
 		RoomID:            "!someroom:example.com",
 		Token:             "sometoken",
 	}
 
+	tmpl, err := template.New("text").Parse("{{.SenderDisplayName}} - {{.RoomID}} - {{.Token}}")
+	require.Nil(t, err, err)
+
 	buf := bytes.NewBuffer(nil)
 	mw := multipart.NewWriter(buf)
 
-	err := loadBodyTemplate(mw, cfg.Ident.Invites.EmailTemplate.Text, "text/plain", req)
+	err = loadBodyTemplate(mw, tmpl, "text/plain", req)
 	require.Nil(t, err, err)
 
 	r := strings.NewReader(buf.String())
@@ -175,8 +165,10 @@ func testLoadBodyTemplate(t *testing.T) {
 		case 1:
 			require.Equal(t, "Content-Disposition: inline", line)
 		case 2:
+			require.Equal(t, "Content-Transfer-Encoding: quoted-printable", line)
+		case 3:
 			require.Equal(t, "Content-Type: text/plain; charset=UTF-8", line)
-		case 4:
+		case 5:
 			require.Equal(t, "alice - !someroom:example.com - sometoken", line)
 		}
 
@@ -191,8 +183,69 @@ func TestLoadSubjectTemplate(t *testing.T) {
 		SenderDisplayName: "alice",
 	}
 
-	subj, err := loadSubjectTemplate(cfg, req)
+	tmpl, err := template.New("subject").Parse(cfg.Ident.Invites.SubjectTemplate)
+	require.Nil(t, err, err)
+
+	subj, err := loadSubjectTemplate(tmpl, req)
 
 	require.Nil(t, err, err)
 	require.Equal(t, "alice invited you to Matrix!", subj)
 }
+
+func TestGenerateEmailNonASCII(t *testing.T) {
+	cfg := *testutils.NewTestConfig(t)
+	cfg.Email.From = "Zoë's Ident <ident@example.com>"
+
+	req := &req{
+		SenderDisplayName: "Zoë O'Brien & Co",
+		RoomID:            "!someroom:example.com",
+	}
+
+	tmpl, err := templates.ParseEmail(
+		"{{.SenderDisplayName}} invited you to Matrix!",
+		"{{.SenderDisplayName}} invited you to {{.RoomID}}",
+		"<p>{{.SenderDisplayName}} invited you to {{.RoomID}}</p>",
+	)
+	require.Nil(t, err, err)
+
+	buf := bytes.NewBuffer(nil)
+	err = generateEmail(&cfg, buf, "alice@example.com", tmpl, req)
+	require.Nil(t, err, err)
+
+	// Test that non-ASCII headers are encoded, and that the raw message is plain ASCII.
+	raw := buf.String()
+	require.NotContains(t, raw, "Zoë")
+	for _, r := range raw {
+		require.True(t, r < 128, "Non-ASCII character %q in the raw message", r)
+	}
+
+	received := &testutils.TestEmail{Raw: buf.Bytes()}
+	testutils.ParseTestEmail(received)
+
+	decoder := new(mime.WordDecoder)
+	subject, err := decoder.DecodeHeader(received.Header.Get("Subject"))
+	require.Nil(t, err, err)
+	require.Equal(t, "Zoë O'Brien & Co invited you to Matrix!", subject)
+
+	from, err := received.Header.AddressList("From")
+	require.Nil(t, err, err)
+	require.Equal(t, []*mail.Address{{Name: "Zoë's Ident", Address: "ident@example.com"}}, from)
+
+	// Test that the data is only escaped in the HTML part.
+	require.Equal(t, "Zoë O'Brien & Co invited you to !someroom:example.com", received.Part("text/plain"))
+	require.Equal(t, "<p>Zoë O&#39;Brien &amp; Co invited you to !someroom:example.com</p>", received.Part("text/html"))
+}
+
+func TestLoadSubjectTemplateLineBreaks(t *testing.T) {
+	req := &req{
+		SenderDisplayName: "alice\r\nBcc: mallory@example.com",
+	}
+
+	// Test that the data can't add headers through the subject.
+	tmpl, err := template.New("subject").Parse("{{.SenderDisplayName}} invited you to Matrix!")
+	require.Nil(t, err, err)
+
+	subj, err := loadSubjectTemplate(tmpl, req)
+	require.Nil(t, err, err)
+	require.Equal(t, "alice Bcc: mallory@example.com invited you to Matrix!", subj)
+}
@@ -0,0 +1,200 @@
+package email
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"net/smtp"
+	"strings"
+	"time"
+
+	"github.com/babolivier/ident/common/config"
+
+	"github.com/pkg/errors"
+)
+
+// SMTPTransport sends emails through an SMTP server.
+type SMTPTransport struct {
+	cfg *config.SMTPConfig
+}
+
+func NewSMTPTransport(cfg *config.SMTPConfig) *SMTPTransport {
+	return &SMTPTransport{cfg: cfg}
+}
+
+func (t *SMTPTransport) Send(from, to string, msg []byte) (err error) {
+	tlsConfig, err := t.tlsConfig()
+	if err != nil {
+		return err
+	}
+
+	// Dial the SMTP server.
+	var conn net.Conn
+	addr := net.JoinHostPort(t.cfg.Hostname, t.cfg.Port)
+	dialer := &net.Dialer{Timeout: t.cfg.ConnectTimeout}
+
+	// Dial with a TLS handshake if implicit TLS is enabled, use a standard TCP connection otherwise.
+	if t.cfg.TLSMode == config.SMTPTLSModeImplicit {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, tlsConfig)
+		if err != nil {
+			return errors.Wrap(err, "Couldn't dial the SMTP server (TLS on)")
+		}
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+		if err != nil {
+			return errors.Wrap(err, "Couldn't dial the SMTP server (TLS off)")
+		}
+	}
+
+	// Don't let a slow or unresponsive server hold the connection forever.
+	if err = conn.SetDeadline(time.Now().Add(t.cfg.Timeout)); err != nil {
+		conn.Close()
+		return errors.Wrap(err, "Couldn't set the deadline of the SMTP connection")
+	}
+
+	// Initiate the SMTP client.
+	client, err := smtp.NewClient(conn, t.cfg.Hostname)
+	if err != nil {
+		conn.Close()
+		return errors.Wrap(err, "Couldn't instantiate the SMTP client")
+	}
+	defer client.Close()
+
+	// Upgrade the connection if STARTTLS is enabled. Don't fall back to plain text if the server doesn't support it, as
+	// that's what an attacker stripping STARTTLS from the server's response would want.
+	if t.cfg.TLSMode == config.SMTPTLSModeSTARTTLS {
+		if ok, _ := client.Extension("STARTTLS"); !ok {
+			return errors.New("The SMTP server doesn't support STARTTLS")
+		}
+
+		if err = client.StartTLS(tlsConfig); err != nil {
+			return errors.Wrap(err, "Couldn't upgrade the connection to the SMTP server with STARTTLS")
+		}
+	}
+
+	// Auth against the SMTP server
+	if auth := t.auth(); auth != nil {
+		if err = client.Auth(auth); err != nil {
+			return errors.Wrap(err, "Couldn't authenticate against the SMTP server")
+		}
+	}
+
+	// Send the MAIL FROM command.
+	if err = client.Mail(from); err != nil {
+		return errors.Wrap(err, "Couldn't send MAIL FROM to the SMTP server")
+	}
+
+	// Send the RCPT TO command.
+	if err = client.Rcpt(to); err != nil {
+		return errors.Wrap(err, "Couldn't send RCPT TO to the SMTP server")
+	}
+
+	// Send the DATA command and get the writer to write the email's body to.
+	w, err := client.Data()
+	if err != nil {
+		return errors.Wrap(err, "Couldn't send DATA to the SMTP server")
+	}
+
+	// Write the email body.
+	if _, err = w.Write(msg); err != nil {
+		return errors.Wrap(err, "Couldn't write the email's body")
+	}
+
+	// Close the writer now that all of the content is written.
+	if err = w.Close(); err != nil {
+		return errors.Wrap(err, "Couldn't close the email body writer")
+	}
+
+	// Send the QUIT command to validate the operation with the server.
+	if err = client.Quit(); err != nil {
+		return errors.Wrap(err, "Couldn't send QUIT to the SMTP server")
+	}
+
+	return nil
+}
+
+// tlsConfig returns the TLS configuration to use to talk to the SMTP server, trusting the configured CA if there's one
+// on top of the system's.
+func (t *SMTPTransport) tlsConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName:         t.cfg.Hostname,
+		InsecureSkipVerify: t.cfg.InsecureSkipVerify,
+	}
+
+	if len(t.cfg.CAFile) == 0 {
+		return tlsConfig, nil
+	}
+
+	pem, err := ioutil.ReadFile(t.cfg.CAFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "Couldn't read the SMTP server's CA file")
+	}
+
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.New("Couldn't find any certificate in the SMTP server's CA file")
+	}
+
+	tlsConfig.RootCAs = pool
+	return tlsConfig, nil
+}
+
+// auth returns the smtp.Auth for the configured mechanism, or nil if no authentication is needed.
+func (t *SMTPTransport) auth() smtp.Auth {
+	switch t.cfg.Auth {
+	case config.SMTPAuthPlain:
+		return smtp.PlainAuth("", t.cfg.Username, t.cfg.Password, t.cfg.Hostname)
+	case config.SMTPAuthLogin:
+		return &loginAuth{username: t.cfg.Username, password: t.cfg.Password, host: t.cfg.Hostname}
+	case config.SMTPAuthCRAMMD5:
+		return smtp.CRAMMD5Auth(t.cfg.Username, t.cfg.Password)
+	default:
+		return nil
+	}
+}
+
+// loginAuth implements the LOGIN authentication mechanism, which net/smtp doesn't provide. Like smtp.PlainAuth, it
+// refuses to send the credentials over an unencrypted connection, unless the server is on localhost.
+type loginAuth struct {
+	username string
+	password string
+	host     string
+}
+
+func (a *loginAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if !server.TLS && !isLocalhost(server.Name) {
+		return "", nil, errors.New("unencrypted connection")
+	}
+
+	if server.Name != a.host {
+		return "", nil, errors.New("wrong host name")
+	}
+
+	return "LOGIN", nil, nil
+}
+
+func (a *loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+
+	// Servers usually ask for "Username:" and "Password:", but some use slightly different prompts.
+	prompt := strings.ToLower(string(fromServer))
+	switch {
+	case strings.HasPrefix(prompt, "user"):
+		return []byte(a.username), nil
+	case strings.HasPrefix(prompt, "pass"):
+		return []byte(a.password), nil
+	default:
+		return nil, errors.New("unexpected LOGIN challenge: " + string(fromServer))
+	}
+}
+
+func isLocalhost(name string) bool {
+	return name == "localhost" || name == "127.0.0.1" || name == "::1"
+}
@@ -0,0 +1,142 @@
+package email
+
+import (
+	"io/ioutil"
+	"net/smtp"
+	"os"
+	"testing"
+
+	"github.com/babolivier/ident/common/config"
+	"github.com/babolivier/ident/common/testutils"
+
+	"github.com/stretchr/testify/require"
+)
+
+// newTestSMTPConfig returns the SMTP configuration to send emails through the given test server.
+func newTestSMTPConfig(server *testutils.TestSMTPServer) *config.SMTPConfig {
+	var cfg config.Config
+	server.Configure(&cfg)
+	return &cfg.Email.SMTP
+}
+
+func TestSMTPTransportNoAuth(t *testing.T) {
+	server := testutils.NewTestSMTPServer(t, nil)
+	defer server.Close()
+
+	// Test that emails can be relayed without authenticating.
+	transport := NewSMTPTransport(newTestSMTPConfig(server))
+	err := transport.Send("ident@example.com", "alice@example.com", []byte(testMessage))
+	require.Nil(t, err, err)
+
+	received := server.LastEmailTo(t, "alice@example.com")
+	require.Equal(t, "ident@example.com", received.From)
+	require.Equal(t, []string{"alice@example.com"}, received.To)
+	require.False(t, received.TLS)
+	require.False(t, received.Authenticated)
+	require.Equal(t, "Hello", received.Header.Get("Subject"))
+}
+
+func TestSMTPTransportSTARTTLS(t *testing.T) {
+	server := testutils.NewTestSMTPServer(t, &testutils.TestSMTPServerOptions{
+		STARTTLS: true,
+		Username: "ident",
+		Password: "secret",
+	})
+	defer server.Close()
+
+	// Test that emails are sent over TLS, trusting the configured CA, and after authenticating.
+	cfg := newTestSMTPConfig(server)
+	err := NewSMTPTransport(cfg).Send("ident@example.com", "alice@example.com", []byte(testMessage))
+	require.Nil(t, err, err)
+
+	received := server.LastEmailTo(t, "alice@example.com")
+	require.True(t, received.TLS)
+	require.True(t, received.Authenticated)
+
+	// Test that the server's certificate isn't trusted without the CA.
+	cfg.CAFile = ""
+	err = NewSMTPTransport(cfg).Send("ident@example.com", "alice@example.com", []byte(testMessage))
+	require.NotNil(t, err)
+
+	// Test that wrong credentials are rejected.
+	cfg = newTestSMTPConfig(server)
+	cfg.Password = "wrong"
+	err = NewSMTPTransport(cfg).Send("ident@example.com", "alice@example.com", []byte(testMessage))
+	require.NotNil(t, err)
+	require.Len(t, server.Emails(), 1)
+}
+
+func TestSMTPTransportSTARTTLSUnsupported(t *testing.T) {
+	server := testutils.NewTestSMTPServer(t, nil)
+	defer server.Close()
+
+	// Test that we don't fall back to plain text if the server doesn't support STARTTLS.
+	cfg := newTestSMTPConfig(server)
+	cfg.TLSMode = config.SMTPTLSModeSTARTTLS
+
+	err := NewSMTPTransport(cfg).Send("ident@example.com", "alice@example.com", []byte(testMessage))
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "STARTTLS")
+	require.Empty(t, server.Emails())
+}
+
+func TestSMTPTransportTLSConfig(t *testing.T) {
+	cfg := &config.SMTPConfig{Hostname: "mail.example.com", InsecureSkipVerify: true}
+
+	tlsConfig, err := NewSMTPTransport(cfg).tlsConfig()
+	require.Nil(t, err, err)
+	require.Equal(t, "mail.example.com", tlsConfig.ServerName)
+	require.True(t, tlsConfig.InsecureSkipVerify)
+	require.Nil(t, tlsConfig.RootCAs)
+
+	// Test that a CA file without any certificate is rejected.
+	f, err := ioutil.TempFile("", "ident-ca")
+	require.Nil(t, err, err)
+	defer os.Remove(f.Name())
+	_, err = f.WriteString("not a certificate")
+	require.Nil(t, err, err)
+	require.Nil(t, f.Close())
+
+	cfg.CAFile = f.Name()
+	_, err = NewSMTPTransport(cfg).tlsConfig()
+	require.NotNil(t, err)
+}
+
+func TestSMTPTransportAuth(t *testing.T) {
+	cfg := &config.SMTPConfig{Hostname: "mail.example.com", Username: "ident", Password: "secret"}
+
+	cfg.Auth = config.SMTPAuthNone
+	require.Nil(t, NewSMTPTransport(cfg).auth())
+
+	cfg.Auth = config.SMTPAuthPlain
+	mech, _, err := NewSMTPTransport(cfg).auth().Start(&smtp.ServerInfo{Name: "mail.example.com", TLS: true})
+	require.Nil(t, err, err)
+	require.Equal(t, "PLAIN", mech)
+
+	cfg.Auth = config.SMTPAuthCRAMMD5
+	mech, _, err = NewSMTPTransport(cfg).auth().Start(&smtp.ServerInfo{Name: "mail.example.com"})
+	require.Nil(t, err, err)
+	require.Equal(t, "CRAM-MD5", mech)
+
+	cfg.Auth = config.SMTPAuthLogin
+	auth := NewSMTPTransport(cfg).auth()
+
+	// Test that LOGIN refuses to send the credentials in plain text to a remote server.
+	_, _, err = auth.Start(&smtp.ServerInfo{Name: "mail.example.com"})
+	require.NotNil(t, err)
+
+	mech, _, err = auth.Start(&smtp.ServerInfo{Name: "mail.example.com", TLS: true})
+	require.Nil(t, err, err)
+	require.Equal(t, "LOGIN", mech)
+
+	resp, err := auth.Next([]byte("Username:"), true)
+	require.Nil(t, err, err)
+	require.Equal(t, "ident", string(resp))
+
+	resp, err = auth.Next([]byte("Password:"), true)
+	require.Nil(t, err, err)
+	require.Equal(t, "secret", string(resp))
+
+	_, err = auth.Next([]byte("Something else:"), true)
+	require.NotNil(t, err)
+}
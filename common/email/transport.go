@@ -0,0 +1,39 @@
+package email
+
+import (
+	"net/mail"
+
+	"github.com/babolivier/ident/common/config"
+
+	"github.com/pkg/errors"
+)
+
+// Transport delivers emails. The message is complete, headers included; from and to are the envelope addresses.
+type Transport interface {
+	Send(from, to string, msg []byte) error
+}
+
+// NewTransport returns the Transport matching the transport set in the configuration.
+func NewTransport(cfg *config.EmailConfig) (Transport, error) {
+	switch cfg.Transport {
+	case "smtp", "":
+		return NewSMTPTransport(&cfg.SMTP), nil
+	case "sendmail":
+		return NewSendmailTransport(&cfg.Sendmail), nil
+	case "file":
+		return NewFileTransport(&cfg.File), nil
+	default:
+		return nil, errors.New("Unknown mail transport " + cfg.Transport)
+	}
+}
+
+// envelopeAddress returns the bare address from an address that can include a display name, e.g.
+// "Ident <ident@example.com>", to be used as an envelope address. If it can't be parsed, it's returned as is.
+func envelopeAddress(address string) string {
+	parsed, err := mail.ParseAddress(address)
+	if err != nil {
+		return address
+	}
+
+	return parsed.Address
+}
@@ -0,0 +1,108 @@
+package email
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/babolivier/ident/common/config"
+
+	"github.com/stretchr/testify/require"
+)
+
+const testMessage = "To: alice@example.com\r\nSubject: Hello\r\n\r\nHello Alice\r\n"
+
+func TestNewTransport(t *testing.T) {
+	transport, err := NewTransport(&config.EmailConfig{Transport: "smtp"})
+	require.Nil(t, err, err)
+	require.IsType(t, &SMTPTransport{}, transport)
+
+	transport, err = NewTransport(&config.EmailConfig{Transport: "sendmail"})
+	require.Nil(t, err, err)
+	require.IsType(t, &SendmailTransport{}, transport)
+
+	transport, err = NewTransport(&config.EmailConfig{Transport: "file"})
+	require.Nil(t, err, err)
+	require.IsType(t, &FileTransport{}, transport)
+
+	_, err = NewTransport(&config.EmailConfig{Transport: "carrier_pigeon"})
+	require.NotNil(t, err)
+}
+
+func TestEnvelopeAddress(t *testing.T) {
+	require.Equal(t, "ident@example.com", envelopeAddress("Ident <ident@example.com>"))
+	require.Equal(t, "ident@example.com", envelopeAddress("ident@example.com"))
+	require.Equal(t, "not an address", envelopeAddress("not an address"))
+}
+
+func TestFileTransport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ident-mail")
+	require.Nil(t, err, err)
+	defer os.RemoveAll(dir)
+
+	transport := NewFileTransport(&config.MailFileConfig{Path: filepath.Join(dir, "eml")})
+	err = transport.Send("ident@example.com", "alice@example.com", []byte(testMessage))
+	require.Nil(t, err, err)
+
+	files, err := filepath.Glob(filepath.Join(dir, "eml", "*.eml"))
+	require.Nil(t, err, err)
+	require.Len(t, files, 1)
+
+	b, err := ioutil.ReadFile(files[0])
+	require.Nil(t, err, err)
+	require.Equal(t, testMessage, string(b))
+
+	// Test that, as a maildir, emails end up in new and nothing is left in tmp.
+	transport = NewFileTransport(&config.MailFileConfig{Path: filepath.Join(dir, "maildir"), Maildir: true})
+	err = transport.Send("ident@example.com", "alice@example.com", []byte(testMessage))
+	require.Nil(t, err, err)
+
+	files, err = filepath.Glob(filepath.Join(dir, "maildir", "new", "*"))
+	require.Nil(t, err, err)
+	require.Len(t, files, 1)
+
+	files, err = filepath.Glob(filepath.Join(dir, "maildir", "tmp", "*"))
+	require.Nil(t, err, err)
+	require.Empty(t, files)
+}
+
+func TestSendmailTransport(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("The fake sendmail is a shell script")
+	}
+
+	dir, err := ioutil.TempDir("", "ident-sendmail")
+	require.Nil(t, err, err)
+	defer os.RemoveAll(dir)
+
+	// The fake sendmail writes its arguments and the message it reads from stdin to files.
+	argsPath := filepath.Join(dir, "args")
+	msgPath := filepath.Join(dir, "msg")
+	script := "#!/bin/sh\necho \"$@\" > " + argsPath + "\ncat > " + msgPath + "\n"
+	sendmailPath := filepath.Join(dir, "sendmail")
+	err = ioutil.WriteFile(sendmailPath, []byte(script), 0700)
+	require.Nil(t, err, err)
+
+	transport := NewSendmailTransport(&config.SendmailConfig{Path: sendmailPath, Args: []string{"-oi"}})
+	err = transport.Send("ident@example.com", "alice@example.com", []byte(testMessage))
+	require.Nil(t, err, err)
+
+	args, err := ioutil.ReadFile(argsPath)
+	require.Nil(t, err, err)
+	require.Equal(t, "-t -i -f ident@example.com -oi", strings.TrimSpace(string(args)))
+
+	msg, err := ioutil.ReadFile(msgPath)
+	require.Nil(t, err, err)
+	require.Equal(t, testMessage, string(msg))
+
+	// Test that a failing sendmail results in an error that includes what it printed.
+	err = ioutil.WriteFile(sendmailPath, []byte("#!/bin/sh\necho 'no route to host' >&2\nexit 1\n"), 0700)
+	require.Nil(t, err, err)
+
+	err = transport.Send("ident@example.com", "alice@example.com", []byte(testMessage))
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "no route to host")
+}
@@ -0,0 +1,20 @@
+package hashing
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+)
+
+// Algorithms supported for lookups in the v2 API.
+const (
+	AlgorithmSHA256 = "sha256"
+	AlgorithmNone   = "none"
+)
+
+// LookupHash computes the hash of a 3PID to use for lookups with the sha256 algorithm, i.e. the unpadded URL-safe
+// base64 representation of the SHA-256 hash of "address medium pepper".
+// c.f. https://matrix.org/docs/spec/identity_service/r0.3.0#sha256
+func LookupHash(medium, address, pepper string) string {
+	sum := sha256.Sum256([]byte(address + " " + medium + " " + pepper))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
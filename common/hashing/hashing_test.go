@@ -0,0 +1,14 @@
+package hashing
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLookupHash(t *testing.T) {
+	// Example taken from the specification.
+	// c.f. https://matrix.org/docs/spec/identity_service/r0.3.0#sha256
+	hash := LookupHash("email", "alice@example.com", "matrixrocks")
+	require.Equal(t, "4kenr7N9drpCJ4AfalmlGQVsOn3o2RHjkADUpXJWZUc", hash)
+}
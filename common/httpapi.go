@@ -2,6 +2,10 @@ package common
 
 import (
 	"net/http"
+	"strings"
+
+	"github.com/babolivier/ident/common/config"
+	"github.com/babolivier/ident/common/database"
 
 	"github.com/matrix-org/gomatrix"
 	"github.com/matrix-org/util"
@@ -14,6 +18,112 @@ func MakeAPI(f func(r *http.Request) util.JSONResponse) http.Handler {
 	return h
 }
 
+// MakeAuthAPI wraps the given function in a handler that requires the request to be authenticated with an access
+// token issued through the v2 API's registration process, and the user to have accepted the current version of every
+// policy in the terms of service. The function is given the ID of the user the token belongs to.
+func MakeAuthAPI(
+	cfg *config.Config, db database.Database, f func(r *http.Request, userID string) util.JSONResponse,
+) http.Handler {
+	return MakeAuthAPIWithoutTerms(db, func(r *http.Request, userID string) util.JSONResponse {
+		signed, err := hasAcceptedTerms(cfg, db, userID)
+		if err != nil {
+			return InternalServerError(err)
+		}
+
+		if !signed {
+			return util.JSONResponse{
+				Code: 403,
+				JSON: gomatrix.RespError{
+					ErrCode: "M_TERMS_NOT_SIGNED",
+					Err:     "Terms not signed",
+				},
+			}
+		}
+
+		return f(r, userID)
+	})
+}
+
+// MakeAuthAPIWithoutTerms does the same thing as MakeAuthAPI, except it doesn't check whether the user has accepted
+// the terms of service. It's meant to be used for the endpoints the user needs to access in order to accept them.
+func MakeAuthAPIWithoutTerms(
+	db database.Database, f func(r *http.Request, userID string) util.JSONResponse,
+) http.Handler {
+	return MakeAPI(func(r *http.Request) util.JSONResponse {
+		token := GetAccessToken(r)
+		if len(token) == 0 {
+			return util.JSONResponse{
+				Code: 401,
+				JSON: gomatrix.RespError{
+					ErrCode: "M_UNAUTHORIZED",
+					Err:     "Missing access token",
+				},
+			}
+		}
+
+		userID, err := db.GetUserIDForAccountToken(token)
+		if err != nil {
+			return InternalServerError(err)
+		}
+
+		if len(userID) == 0 {
+			return util.JSONResponse{
+				Code: 401,
+				JSON: gomatrix.RespError{
+					ErrCode: "M_UNAUTHORIZED",
+					Err:     "Unrecognised access token",
+				},
+			}
+		}
+
+		return f(r, userID)
+	})
+}
+
+// hasAcceptedTerms checks if the given user has accepted the current version of every policy in the terms of service,
+// in any language.
+func hasAcceptedTerms(cfg *config.Config, db database.Database, userID string) (bool, error) {
+	if len(cfg.Terms.Policies) == 0 {
+		return true, nil
+	}
+
+	acceptedURLs, err := db.GetAcceptedTermsURLs(userID)
+	if err != nil {
+		return false, err
+	}
+
+	accepted := make(map[string]bool, len(acceptedURLs))
+	for _, url := range acceptedURLs {
+		accepted[url] = true
+	}
+
+	for _, policy := range cfg.Terms.Policies {
+		var policyAccepted bool
+		for _, doc := range policy.Languages {
+			if accepted[doc.URL] {
+				policyAccepted = true
+				break
+			}
+		}
+
+		if !policyAccepted {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+// GetAccessToken extracts the access token from the request, either from the Authorization header or from the
+// access_token query parameter. Returns an empty string if the request doesn't include any access token.
+func GetAccessToken(r *http.Request) string {
+	if authHeader := r.Header.Get("Authorization"); strings.HasPrefix(authHeader, "Bearer ") {
+		return strings.TrimPrefix(authHeader, "Bearer ")
+	}
+
+	return r.URL.Query().Get("access_token")
+}
+
 func InternalServerError(err error) util.JSONResponse {
 	logrus.WithError(err).Error("An error happened")
 
@@ -0,0 +1,68 @@
+package common
+
+import (
+	"context"
+	"sync"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// KeyCache is an in-memory implementation of gomatrixserverlib.KeyDatabase, which caches the signing keys of remote
+// homeservers so we don't have to fetch them again every time we need to verify a request.
+type KeyCache struct {
+	keys  map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult
+	mutex sync.RWMutex
+}
+
+func NewKeyCache() *KeyCache {
+	return &KeyCache{
+		keys: make(map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult),
+	}
+}
+
+// NewKeyRing returns a key ring that fetches the keys of remote homeservers directly from them, and caches them in
+// memory.
+func NewKeyRing(client *gomatrixserverlib.Client) gomatrixserverlib.KeyRing {
+	return gomatrixserverlib.KeyRing{
+		KeyFetchers: []gomatrixserverlib.KeyFetcher{
+			&gomatrixserverlib.DirectKeyFetcher{Client: *client},
+		},
+		KeyDatabase: NewKeyCache(),
+	}
+}
+
+// FetcherName implements gomatrixserverlib.KeyFetcher.
+func (c *KeyCache) FetcherName() string {
+	return "KeyCache"
+}
+
+// FetchKeys implements gomatrixserverlib.KeyFetcher.
+func (c *KeyCache) FetchKeys(
+	ctx context.Context, requests map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp,
+) (map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult, error) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	results := make(map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult)
+	for req := range requests {
+		if key, ok := c.keys[req]; ok {
+			results[req] = key
+		}
+	}
+
+	return results, nil
+}
+
+// StoreKeys implements gomatrixserverlib.KeyDatabase.
+func (c *KeyCache) StoreKeys(
+	ctx context.Context, results map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult,
+) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for req, key := range results {
+		c.keys[req] = key
+	}
+
+	return nil
+}
@@ -0,0 +1,34 @@
+package common
+
+import (
+	"context"
+	"testing"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeyCache(t *testing.T) {
+	cache := NewKeyCache()
+
+	known := gomatrixserverlib.PublicKeyLookupRequest{ServerName: "example.com", KeyID: "ed25519:1"}
+	unknown := gomatrixserverlib.PublicKeyLookupRequest{ServerName: "example.com", KeyID: "ed25519:2"}
+
+	key := gomatrixserverlib.PublicKeyLookupResult{
+		VerifyKey: gomatrixserverlib.VerifyKey{Key: gomatrixserverlib.Base64String("somekey")},
+	}
+
+	err := cache.StoreKeys(context.Background(), map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{
+		known: key,
+	})
+	require.Nil(t, err, err)
+
+	// Test that only the keys we know about are returned.
+	results, err := cache.FetchKeys(context.Background(), map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp{
+		known:   0,
+		unknown: 0,
+	})
+	require.Nil(t, err, err)
+	require.Len(t, results, 1)
+	require.Equal(t, key, results[known])
+}
@@ -0,0 +1,31 @@
+package common
+
+import (
+	"encoding/json"
+
+	"github.com/babolivier/ident/common/config"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// SignWithServerKey signs the JSON representation of the given instance with the server's active signing key, then
+// unmarshals the signed JSON back into the instance. Therefore, the instance must have a "signatures" field for the
+// signatures to be kept.
+func SignWithServerKey(cfg *config.Config, instance interface{}) error {
+	unsignedBytes, err := json.Marshal(instance)
+	if err != nil {
+		return err
+	}
+
+	signedBytes, err := gomatrixserverlib.SignJSON(
+		cfg.Ident.ServerName,
+		gomatrixserverlib.KeyID(cfg.Ident.SigningKey.KeyID()),
+		cfg.Ident.SigningKey.PrivKey,
+		unsignedBytes,
+	)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(signedBytes, instance)
+}
@@ -0,0 +1,42 @@
+package common
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/babolivier/ident/common/config"
+	"github.com/babolivier/ident/common/constants"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/stretchr/testify/require"
+)
+
+type signedStruct struct {
+	Foo        string      `json:"foo"`
+	Signatures interface{} `json:"signatures,omitempty"`
+}
+
+func TestSignWithServerKey(t *testing.T) {
+	// We can't use testutils here as it would create an import cycle.
+	cfg, err := config.ParseConfig([]byte(constants.TestConfigYAML))
+	require.Nil(t, err, err)
+
+	s := signedStruct{Foo: "bar"}
+
+	err = SignWithServerKey(cfg, &s)
+	require.Nil(t, err, err)
+	require.NotNil(t, s.Signatures)
+	require.Equal(t, "bar", s.Foo)
+
+	b, err := json.Marshal(&s)
+	require.Nil(t, err, err)
+
+	// If err is nil, then the signature is correct.
+	err = gomatrixserverlib.VerifyJSON(
+		cfg.Ident.ServerName,
+		gomatrixserverlib.KeyID(cfg.Ident.SigningKey.Algo+":"+cfg.Ident.SigningKey.ID),
+		cfg.Ident.SigningKey.PubKey,
+		b,
+	)
+	require.Nil(t, err, err)
+}
@@ -0,0 +1,45 @@
+package sms
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// FileSender doesn't send text messages but appends them to a file, one JSON object per line. It's meant to be used
+// for testing and development.
+type FileSender struct {
+	path string
+	mut  sync.Mutex
+}
+
+// FileSMS is the representation of a text message written by a FileSender.
+type FileSMS struct {
+	To   string `json:"to"`
+	Body string `json:"body"`
+}
+
+func NewFileSender(path string) *FileSender {
+	return &FileSender{path: path}
+}
+
+func (s *FileSender) SendSMS(to, body string) error {
+	b, err := json.Marshal(FileSMS{To: to, Body: body})
+	if err != nil {
+		return err
+	}
+
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	f, err := os.OpenFile(s.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return errors.Wrap(err, "Couldn't open the SMS file")
+	}
+	defer f.Close()
+
+	_, err = f.Write(append(b, '\n'))
+	return err
+}
@@ -0,0 +1,67 @@
+package sms
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/babolivier/ident/common/config"
+
+	"github.com/pkg/errors"
+)
+
+// HTTPSender sends text messages through a HTTP gateway. Each message is sent as a POST request to the configured
+// URL, with a JSON body following the format of httpSMSReq, and authenticated using basic auth if credentials are
+// configured. Any 2xx response is considered a success.
+type HTTPSender struct {
+	cfg    *config.SMSHTTPConfig
+	client *http.Client
+}
+
+type httpSMSReq struct {
+	From string `json:"from,omitempty"`
+	To   string `json:"to"`
+	Body string `json:"body"`
+}
+
+func NewHTTPSender(cfg *config.SMSHTTPConfig) *HTTPSender {
+	return &HTTPSender{
+		cfg:    cfg,
+		client: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+func (s *HTTPSender) SendSMS(to, body string) error {
+	b, err := json.Marshal(httpSMSReq{
+		From: s.cfg.From,
+		To:   "+" + to,
+		Body: body,
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, s.cfg.URL, bytes.NewReader(b))
+	if err != nil {
+		return errors.Wrap(err, "Couldn't build the request to the SMS gateway")
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	if len(s.cfg.Username) > 0 {
+		req.SetBasicAuth(s.cfg.Username, s.cfg.Password)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "Couldn't reach the SMS gateway")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("SMS gateway responded with status %d", resp.StatusCode)
+	}
+
+	return nil
+}
@@ -0,0 +1,97 @@
+package sms
+
+import (
+	"errors"
+	"strings"
+)
+
+var (
+	ErrUnknownCountry     = errors.New("Unknown country code")
+	ErrInvalidPhoneNumber = errors.New("Invalid phone number")
+)
+
+// callingCodes maps ISO 3166-1 alpha-2 country codes to their international calling code.
+var callingCodes = map[string]string{
+	"AD": "376", "AE": "971", "AL": "355", "AM": "374", "AR": "54", "AT": "43", "AU": "61", "AZ": "994",
+	"BA": "387", "BD": "880", "BE": "32", "BG": "359", "BH": "973", "BO": "591", "BR": "55", "BY": "375",
+	"CA": "1", "CH": "41", "CL": "56", "CN": "86", "CO": "57", "CR": "506", "CY": "357", "CZ": "420",
+	"DE": "49", "DK": "45", "DO": "1", "DZ": "213", "EC": "593", "EE": "372", "EG": "20", "ES": "34",
+	"FI": "358", "FR": "33", "GB": "44", "GE": "995", "GH": "233", "GR": "30", "GT": "502", "HK": "852",
+	"HR": "385", "HU": "36", "ID": "62", "IE": "353", "IL": "972", "IN": "91", "IQ": "964", "IR": "98",
+	"IS": "354", "IT": "39", "JM": "1", "JO": "962", "JP": "81", "KE": "254", "KR": "82", "KW": "965",
+	"KZ": "7", "LB": "961", "LI": "423", "LK": "94", "LT": "370", "LU": "352", "LV": "371", "MA": "212",
+	"MC": "377", "MD": "373", "ME": "382", "MK": "389", "MT": "356", "MX": "52", "MY": "60", "NG": "234",
+	"NL": "31", "NO": "47", "NZ": "64", "OM": "968", "PA": "507", "PE": "51", "PH": "63", "PK": "92",
+	"PL": "48", "PR": "1", "PT": "351", "PY": "595", "QA": "974", "RO": "40", "RS": "381", "RU": "7",
+	"SA": "966", "SE": "46", "SG": "65", "SI": "386", "SK": "421", "SM": "378", "SN": "221", "TH": "66",
+	"TN": "216", "TR": "90", "TW": "886", "UA": "380", "US": "1", "UY": "598", "UZ": "998", "VA": "39",
+	"VE": "58", "VN": "84", "ZA": "27",
+}
+
+// Countries in which the leading 0 of a national number is part of the number and must be kept when converting it
+// to the international format.
+var keepsLeadingZero = map[string]bool{
+	"IT": true, "SM": true, "VA": true,
+}
+
+// NormalisePhoneNumber converts a phone number, given in either the national or international format along with
+// the ISO 3166-1 alpha-2 code of the country it belongs to, into the E.164 format without the leading "+" (which is
+// the canonical form of a MSISDN in Matrix). Spaces, dashes, dots and parentheses are ignored.
+// Numbers in the international format (i.e. starting with "+" or "00") don't need a country code.
+func NormalisePhoneNumber(country, phoneNumber string) (string, error) {
+	number := strings.Map(func(r rune) rune {
+		switch r {
+		case ' ', '-', '.', '(', ')':
+			return -1
+		}
+		return r
+	}, strings.TrimSpace(phoneNumber))
+
+	var msisdn string
+	switch {
+	case strings.HasPrefix(number, "+"):
+		msisdn = number[1:]
+	case strings.HasPrefix(number, "00"):
+		msisdn = number[2:]
+	default:
+		country = strings.ToUpper(strings.TrimSpace(country))
+		code, ok := callingCodes[country]
+		if !ok {
+			return "", ErrUnknownCountry
+		}
+
+		switch {
+		case code == "1":
+			// In the North American Numbering Plan, the trunk prefix is "1", which is also the calling code.
+			if len(number) == 11 && strings.HasPrefix(number, "1") {
+				number = number[1:]
+			}
+		case !keepsLeadingZero[country]:
+			number = strings.TrimPrefix(number, "0")
+		}
+
+		msisdn = code + number
+	}
+
+	if !IsMSISDNValid(msisdn) {
+		return "", ErrInvalidPhoneNumber
+	}
+
+	return msisdn, nil
+}
+
+// IsMSISDNValid checks whether the given string looks like a MSISDN in its canonical form, i.e. between 8 and 15
+// digits without any leading "+" or "0".
+func IsMSISDNValid(msisdn string) bool {
+	if len(msisdn) < 8 || len(msisdn) > 15 || msisdn[0] == '0' {
+		return false
+	}
+
+	for _, c := range msisdn {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+
+	return true
+}
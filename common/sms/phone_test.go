@@ -0,0 +1,43 @@
+package sms
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNormalisePhoneNumber(t *testing.T) {
+	valid := map[[2]string]string{
+		{"GB", "07700 900123"}:     "447700900123",
+		{"gb", "7700-900-123"}:     "447700900123",
+		{"FR", "06.12.34.56.78"}:   "33612345678",
+		{"US", "(202) 555-0143"}:   "12025550143",
+		{"US", "1 202 555 0143"}:   "12025550143",
+		{"IT", "06 1234 5678"}:     "390612345678",
+		{"", "+44 7700 900123"}:    "447700900123",
+		{"FR", "0044 7700 900123"}: "447700900123",
+	}
+
+	for in, expected := range valid {
+		msisdn, err := NormalisePhoneNumber(in[0], in[1])
+		require.Nil(t, err, err)
+		require.Equal(t, expected, msisdn, in)
+	}
+
+	_, err := NormalisePhoneNumber("XX", "07700900123")
+	require.Equal(t, ErrUnknownCountry, err)
+
+	_, err = NormalisePhoneNumber("GB", "0770abc0123")
+	require.Equal(t, ErrInvalidPhoneNumber, err)
+
+	_, err = NormalisePhoneNumber("GB", "123")
+	require.Equal(t, ErrInvalidPhoneNumber, err)
+}
+
+func TestIsMSISDNValid(t *testing.T) {
+	require.True(t, IsMSISDNValid("447700900123"))
+	require.False(t, IsMSISDNValid("+447700900123"))
+	require.False(t, IsMSISDNValid("07700900123"))
+	require.False(t, IsMSISDNValid("1234567"))
+	require.False(t, IsMSISDNValid("1234567890123456"))
+}
@@ -0,0 +1,58 @@
+package sms
+
+import (
+	"bytes"
+
+	"github.com/babolivier/ident/common/config"
+
+	"github.com/pkg/errors"
+)
+
+// SMSSender sends a text message to a phone number. The phone number is given in the E.164 format, without the
+// leading "+".
+type SMSSender interface {
+	SendSMS(to, body string) error
+}
+
+// ErrNoProvider is returned when trying to send a text message while no SMS provider is configured.
+var ErrNoProvider = errors.New("No SMS provider configured")
+
+// NewSMSSender returns the SMSSender matching the provider set in the configuration.
+func NewSMSSender(cfg *config.SMSConfig) (SMSSender, error) {
+	switch cfg.Provider {
+	case "http":
+		return NewHTTPSender(&cfg.HTTP), nil
+	case "file":
+		return NewFileSender(cfg.File.Path), nil
+	case "":
+		return nil, ErrNoProvider
+	default:
+		return nil, errors.New("Unknown SMS provider " + cfg.Provider)
+	}
+}
+
+// Enabled returns whether a SMS provider is configured.
+func Enabled(cfg *config.Config) bool {
+	return len(cfg.SMS.Provider) > 0
+}
+
+// SendSMS renders the template with the given name with the given data and sends the result to the given phone number
+// using the configured provider.
+func SendSMS(cfg *config.Config, to, templateName string, data interface{}) error {
+	sender, err := NewSMSSender(&cfg.SMS)
+	if err != nil {
+		return err
+	}
+
+	tmpl, err := cfg.Templates.SMS(templateName)
+	if err != nil {
+		return err
+	}
+
+	var body bytes.Buffer
+	if err = tmpl.Execute(&body, data); err != nil {
+		return errors.Wrap(err, "Couldn't execute the SMS template")
+	}
+
+	return sender.SendSMS(to, body.String())
+}
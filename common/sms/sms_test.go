@@ -0,0 +1,84 @@
+package sms
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/babolivier/ident/common/config"
+	"github.com/babolivier/ident/common/templates"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileSender(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ident_sms")
+	require.Nil(t, err, err)
+	defer os.RemoveAll(dir)
+
+	cfg := &config.Config{
+		SMS: config.SMSConfig{
+			Provider: "file",
+			File:     config.SMSFileConfig{Path: filepath.Join(dir, "sms")},
+		},
+		Templates: templates.NewRegistry(),
+	}
+
+	cfg.Templates.AddSMS("code", "Your code is {{.Token}}")
+	cfg.Templates.AddSMS("hello", "Hello")
+	require.Nil(t, cfg.Templates.Load())
+
+	require.Nil(t, SendSMS(cfg, "447700900123", "code", map[string]string{"Token": "123456"}))
+	require.Nil(t, SendSMS(cfg, "33612345678", "hello", nil))
+
+	// Test that an unknown template is reported.
+	require.NotNil(t, SendSMS(cfg, "33612345678", "goodbye", nil))
+
+	b, err := ioutil.ReadFile(cfg.SMS.File.Path)
+	require.Nil(t, err, err)
+
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	require.Len(t, lines, 2)
+
+	var msg FileSMS
+	require.Nil(t, json.Unmarshal([]byte(lines[0]), &msg))
+	require.Equal(t, FileSMS{To: "447700900123", Body: "Your code is 123456"}, msg)
+}
+
+func TestHTTPSender(t *testing.T) {
+	var received httpSMSReq
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username, password, ok := r.BasicAuth()
+		if !ok || username != "ident" || password != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		require.Nil(t, json.NewDecoder(r.Body).Decode(&received))
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer gateway.Close()
+
+	cfg := &config.SMSHTTPConfig{
+		URL:      gateway.URL,
+		Username: "ident",
+		Password: "secret",
+		From:     "Ident",
+	}
+
+	require.Nil(t, NewHTTPSender(cfg).SendSMS("447700900123", "Hello"))
+	require.Equal(t, httpSMSReq{From: "Ident", To: "+447700900123", Body: "Hello"}, received)
+
+	// Test that a failure from the gateway is reported.
+	cfg.Password = "wrong"
+	require.NotNil(t, NewHTTPSender(cfg).SendSMS("447700900123", "Hello"))
+}
+
+func TestNoProvider(t *testing.T) {
+	require.Equal(t, ErrNoProvider, SendSMS(&config.Config{}, "447700900123", "Hello", nil))
+}
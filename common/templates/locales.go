@@ -0,0 +1,85 @@
+package templates
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// NormaliseLocale returns the given locale in lower case and with dashes as separators, so "pt_BR", "pt-BR" and
+// "pt-br" are the same locale.
+func NormaliseLocale(locale string) string {
+	return strings.ToLower(strings.Replace(strings.TrimSpace(locale), "_", "-", -1))
+}
+
+// ParseAcceptLanguage returns the locales listed in the value of an Accept-Language header, sorted from the most
+// preferred to the least. Wildcards and locales with a weight of 0 are ignored, as are malformed weights.
+func ParseAcceptLanguage(header string) []string {
+	type weightedLocale struct {
+		locale string
+		weight float64
+	}
+
+	var weighted []weightedLocale
+	for _, item := range strings.Split(header, ",") {
+		params := strings.Split(item, ";")
+
+		locale := NormaliseLocale(params[0])
+		if len(locale) == 0 || locale == "*" {
+			continue
+		}
+
+		weight := 1.0
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if !strings.HasPrefix(param, "q=") {
+				continue
+			}
+
+			var err error
+			if weight, err = strconv.ParseFloat(param[2:], 64); err != nil {
+				weight = 0
+			}
+		}
+
+		if weight > 0 {
+			weighted = append(weighted, weightedLocale{locale, weight})
+		}
+	}
+
+	// Keep the order of the header for locales with the same weight.
+	sort.SliceStable(weighted, func(i, j int) bool { return weighted[i].weight > weighted[j].weight })
+
+	locales := make([]string, len(weighted))
+	for i, w := range weighted {
+		locales[i] = w.locale
+	}
+
+	return locales
+}
+
+// fallbackChain returns the locales to look templates up for, in order, from the given locales in order of
+// preference. Each locale is followed by the more generic ones it's derived from, e.g. "zh-hant-tw" is followed by
+// "zh-hant" then "zh".
+func fallbackChain(locales []string) []string {
+	var chain []string
+	seen := make(map[string]bool)
+
+	for _, locale := range locales {
+		for locale = NormaliseLocale(locale); len(locale) > 0; {
+			if !seen[locale] {
+				seen[locale] = true
+				chain = append(chain, locale)
+			}
+
+			i := strings.LastIndex(locale, "-")
+			if i < 0 {
+				break
+			}
+
+			locale = locale[:i]
+		}
+	}
+
+	return chain
+}
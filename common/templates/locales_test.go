@@ -0,0 +1,31 @@
+package templates
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseAcceptLanguage(t *testing.T) {
+	require.Empty(t, ParseAcceptLanguage(""))
+	require.Equal(t, []string{"fr"}, ParseAcceptLanguage("fr"))
+
+	// Test that locales are sorted by weight, and that the order of the header is kept for the same weight.
+	require.Equal(
+		t, []string{"pt-br", "fr-ca", "en"},
+		ParseAcceptLanguage("en;q=0.5, pt_BR , fr-CA;q=0.9"),
+	)
+	require.Equal(t, []string{"de", "fr", "it"}, ParseAcceptLanguage("de,fr,it;q=0.1"))
+
+	// Test that wildcards, locales with a weight of 0 and malformed weights are ignored.
+	require.Equal(t, []string{"en"}, ParseAcceptLanguage("*, fr;q=0, de;q=abc, en;q=0.1"))
+}
+
+func TestFallbackChain(t *testing.T) {
+	require.Empty(t, fallbackChain(nil))
+	require.Equal(t, []string{"fr"}, fallbackChain([]string{"fr"}))
+	require.Equal(
+		t, []string{"zh-hant-tw", "zh-hant", "zh", "pt-br", "pt"},
+		fallbackChain([]string{"zh-Hant-TW", "pt_BR", "zh", ""}),
+	)
+}
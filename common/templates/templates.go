@@ -0,0 +1,241 @@
+package templates
+
+import (
+	htmltemplate "html/template"
+	"io/ioutil"
+	"sort"
+	"sync"
+	"text/template"
+
+	"github.com/pkg/errors"
+)
+
+// Names of the templates Ident uses.
+const (
+	InviteEmail     = "invite"
+	ValidationEmail = "validation"
+	InviteSMS       = "invite"
+	ValidationSMS   = "validation"
+)
+
+// EmailSource describes where the templates of an email come from. Subject is the template itself, Text and HTML are
+// paths to template files, and are optional.
+type EmailSource struct {
+	Subject string
+	Text    string
+	HTML    string
+}
+
+// Email holds the parsed templates of an email. Text or HTML is nil if the email doesn't have this part.
+type Email struct {
+	Subject *template.Template
+	Text    *template.Template
+	HTML    *htmltemplate.Template
+}
+
+// ParseEmail parses the templates of an email. The subject and the plain text part use text/template, as they're not
+// HTML documents, and the HTML part uses html/template. An empty text or HTML template means there's no such part.
+func ParseEmail(subject, text, html string) (*Email, error) {
+	var email Email
+	var err error
+
+	if email.Subject, err = template.New("subject").Parse(subject); err != nil {
+		return nil, errors.Wrap(err, "Couldn't parse the subject template")
+	}
+
+	if len(text) > 0 {
+		if email.Text, err = template.New("text").Parse(text); err != nil {
+			return nil, errors.Wrap(err, "Couldn't parse the plain text template")
+		}
+	}
+
+	if len(html) > 0 {
+		if email.HTML, err = htmltemplate.New("html").Parse(html); err != nil {
+			return nil, errors.Wrap(err, "Couldn't parse the HTML template")
+		}
+	}
+
+	return &email, nil
+}
+
+// Registry holds the parsed templates of the emails and text messages Ident sends, so the template files are only read
+// and parsed once rather than every time one is sent. Emails can have a set of templates for each locale, on top of
+// the default one.
+type Registry struct {
+	emailSources map[emailKey]EmailSource
+	smsSources   map[string]string
+
+	mutex  sync.RWMutex
+	emails map[emailKey]*Email
+	sms    map[string]*template.Template
+}
+
+// emailKey identifies the templates of an email in a given locale. The default templates have an empty locale.
+type emailKey struct {
+	name   string
+	locale string
+}
+
+func (k emailKey) String() string {
+	if len(k.locale) == 0 {
+		return k.name
+	}
+
+	return k.name + " (" + k.locale + ")"
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		emailSources: make(map[emailKey]EmailSource),
+		smsSources:   make(map[string]string),
+	}
+}
+
+// AddEmail registers the default templates of an email. They're only read and parsed by Load.
+func (r *Registry) AddEmail(name string, source EmailSource) {
+	r.emailSources[emailKey{name, ""}] = source
+}
+
+// AddLocalisedEmail registers the templates of an email for the given locale, e.g. "fr" or "pt-BR". They're only read
+// and parsed by Load.
+func (r *Registry) AddLocalisedEmail(name, locale string, source EmailSource) {
+	r.emailSources[emailKey{name, NormaliseLocale(locale)}] = source
+}
+
+// AddSMS registers the template of a text message. It's only parsed by Load.
+func (r *Registry) AddSMS(name, source string) {
+	r.smsSources[name] = source
+}
+
+// Load reads and parses all of the registered templates. If one of them can't be loaded, it returns an error and
+// keeps the templates that were previously loaded, so a typo in a template can't break a running server.
+func (r *Registry) Load() error {
+	emails, sms, problems := r.parse()
+	if len(problems) > 0 {
+		return problems[0]
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.emails = emails
+	r.sms = sms
+	return nil
+}
+
+// Check reads and parses all of the registered templates without replacing the loaded ones, and returns every
+// problem it finds.
+func (r *Registry) Check() []error {
+	_, _, problems := r.parse()
+	return problems
+}
+
+// Email returns the parsed templates of the email with the given name, in the first of the given locales it has
+// templates for. Each locale falls back to the more generic ones it's derived from (e.g. "pt-br" to "pt") before the
+// next locale is tried, and the default templates are returned if none of the locales match.
+func (r *Registry) Email(name string, locales ...string) (*Email, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	for _, locale := range fallbackChain(locales) {
+		if email, ok := r.emails[emailKey{name, locale}]; ok {
+			return email, nil
+		}
+	}
+
+	email, ok := r.emails[emailKey{name, ""}]
+	if !ok {
+		return nil, errors.New("No templates loaded for the email " + name)
+	}
+
+	return email, nil
+}
+
+// SMS returns the parsed template of the text message with the given name.
+func (r *Registry) SMS(name string) (*template.Template, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	tmpl, ok := r.sms[name]
+	if !ok {
+		return nil, errors.New("No template loaded for the text message " + name)
+	}
+
+	return tmpl, nil
+}
+
+func (r *Registry) parse() (emails map[emailKey]*Email, sms map[string]*template.Template, problems []error) {
+	emails = make(map[emailKey]*Email, len(r.emailSources))
+	for _, key := range sortedEmailKeys(r.emailSources) {
+		email, err := loadEmail(r.emailSources[key])
+		if err != nil {
+			problems = append(problems, errors.Wrap(err, "Invalid "+key.String()+" email templates"))
+			continue
+		}
+
+		emails[key] = email
+	}
+
+	sms = make(map[string]*template.Template, len(r.smsSources))
+	for _, name := range sortedSMSNames(r.smsSources) {
+		tmpl, err := template.New("sms").Parse(r.smsSources[name])
+		if err != nil {
+			problems = append(problems, errors.Wrap(err, "Invalid "+name+" SMS template"))
+			continue
+		}
+
+		sms[name] = tmpl
+	}
+
+	return
+}
+
+// sortedEmailKeys returns the keys of the given email sources sorted by name then locale, so problems are always
+// reported in the same order.
+func sortedEmailKeys(sources map[emailKey]EmailSource) []emailKey {
+	keys := make([]emailKey, 0, len(sources))
+	for key := range sources {
+		keys = append(keys, key)
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].name != keys[j].name {
+			return keys[i].name < keys[j].name
+		}
+
+		return keys[i].locale < keys[j].locale
+	})
+
+	return keys
+}
+
+// sortedSMSNames returns the names of the given SMS sources in alphabetical order.
+func sortedSMSNames(sources map[string]string) []string {
+	names := make([]string, 0, len(sources))
+	for name := range sources {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+// loadEmail reads the template files of an email and parses them.
+func loadEmail(source EmailSource) (*Email, error) {
+	var text, html []byte
+	var err error
+
+	if len(source.Text) > 0 {
+		if text, err = ioutil.ReadFile(source.Text); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(source.HTML) > 0 {
+		if html, err = ioutil.ReadFile(source.HTML); err != nil {
+			return nil, err
+		}
+	}
+
+	return ParseEmail(source.Subject, string(text), string(html))
+}
@@ -0,0 +1,113 @@
+package templates
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegistry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ident_templates")
+	require.Nil(t, err, err)
+	defer os.RemoveAll(dir)
+
+	text := filepath.Join(dir, "invite.txt")
+	require.Nil(t, ioutil.WriteFile(text, []byte("Hello {{.}}"), 0600))
+
+	registry := NewRegistry()
+	registry.AddEmail(InviteEmail, EmailSource{Subject: "Invite for {{.}}", Text: text})
+	registry.AddSMS(InviteSMS, "Hi {{.}}")
+
+	// Test that nothing is available until the templates are loaded.
+	_, err = registry.Email(InviteEmail)
+	require.NotNil(t, err)
+
+	require.Empty(t, registry.Check())
+	require.Nil(t, registry.Load())
+
+	email, err := registry.Email(InviteEmail)
+	require.Nil(t, err, err)
+	require.Nil(t, email.HTML)
+	require.Equal(t, "Hello alice", execute(t, email.Text.Execute, "alice"))
+
+	sms, err := registry.SMS(InviteSMS)
+	require.Nil(t, err, err)
+	require.Equal(t, "Hi alice", execute(t, sms.Execute, "alice"))
+
+	_, err = registry.Email(ValidationEmail)
+	require.NotNil(t, err)
+
+	// Test that the templates are only read from the files when they're loaded.
+	require.Nil(t, ioutil.WriteFile(text, []byte("Bonjour {{.}}"), 0600))
+	require.Equal(t, "Hello alice", execute(t, email.Text.Execute, "alice"))
+
+	require.Nil(t, registry.Load())
+	email, err = registry.Email(InviteEmail)
+	require.Nil(t, err, err)
+	require.Equal(t, "Bonjour alice", execute(t, email.Text.Execute, "alice"))
+
+	// Test that invalid templates are all reported, and that the ones previously loaded are kept.
+	require.Nil(t, ioutil.WriteFile(text, []byte("Bonjour {{."), 0600))
+	registry.AddEmail(ValidationEmail, EmailSource{Subject: "Validate", HTML: filepath.Join(dir, "missing.html")})
+
+	require.Len(t, registry.Check(), 2)
+	require.NotNil(t, registry.Load())
+
+	email, err = registry.Email(InviteEmail)
+	require.Nil(t, err, err)
+	require.Equal(t, "Bonjour alice", execute(t, email.Text.Execute, "alice"))
+
+	_, err = registry.Email(ValidationEmail)
+	require.NotNil(t, err)
+}
+
+func TestParseEmail(t *testing.T) {
+	email, err := ParseEmail("{{.}} invited you", "", "<p>{{.}} invited you</p>")
+	require.Nil(t, err, err)
+	require.Nil(t, email.Text)
+
+	// Test that the data is only escaped in the HTML part.
+	require.Equal(t, "O'Brien invited you", execute(t, email.Subject.Execute, "O'Brien"))
+	require.Equal(t, "<p>O&#39;Brien invited you</p>", execute(t, email.HTML.Execute, "O'Brien"))
+
+	_, err = ParseEmail("{{.", "", "")
+	require.NotNil(t, err)
+	require.True(t, strings.HasPrefix(err.Error(), "Couldn't parse the subject template"), err.Error())
+}
+
+func execute(t *testing.T, fn func(w io.Writer, data interface{}) error, data interface{}) string {
+	buf := bytes.NewBuffer(nil)
+	require.Nil(t, fn(buf, data))
+	return buf.String()
+}
+
+func TestRegistryLocales(t *testing.T) {
+	registry := NewRegistry()
+	registry.AddEmail(InviteEmail, EmailSource{Subject: "Invitation"})
+	registry.AddLocalisedEmail(InviteEmail, "fr", EmailSource{Subject: "Invitation (fr)"})
+	registry.AddLocalisedEmail(InviteEmail, "pt_BR", EmailSource{Subject: "Invitation (pt-br)"})
+	require.Nil(t, registry.Load())
+
+	subject := func(locales ...string) string {
+		email, err := registry.Email(InviteEmail, locales...)
+		require.Nil(t, err, err)
+		return execute(t, email.Subject.Execute, nil)
+	}
+
+	require.Equal(t, "Invitation", subject())
+	require.Equal(t, "Invitation (fr)", subject("fr"))
+	require.Equal(t, "Invitation (pt-br)", subject("pt-BR"))
+
+	// Test that a locale falls back to the more generic one before the next locale is tried.
+	require.Equal(t, "Invitation (fr)", subject("fr-CA", "pt-BR"))
+
+	// Test that the first locale with templates is picked, and that the default templates are used if there's none.
+	require.Equal(t, "Invitation (pt-br)", subject("de", "pt-br", "fr"))
+	require.Equal(t, "Invitation", subject("de", "pt"))
+}
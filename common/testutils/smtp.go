@@ -0,0 +1,412 @@
+package testutils
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"html"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/babolivier/ident/common/config"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestSMTPServerOptions describes what a TestSMTPServer supports.
+type TestSMTPServerOptions struct {
+	// STARTTLS makes the server support STARTTLS, with a self-signed certificate.
+	STARTTLS bool
+	// If Username is set, clients must authenticate with AUTH PLAIN before sending emails.
+	Username string
+	Password string
+}
+
+// TestSMTPServer is an in-process SMTP server that records the emails it receives instead of delivering them.
+type TestSMTPServer struct {
+	listener  net.Listener
+	opts      TestSMTPServerOptions
+	tlsConfig *tls.Config
+	caFile    string
+	mut       sync.Mutex
+	emails    []*TestEmail
+}
+
+// TestEmail is an email received by a TestSMTPServer.
+type TestEmail struct {
+	// Envelope.
+	From string
+	To   []string
+	// Whether the email was sent over TLS, and after authenticating.
+	TLS           bool
+	Authenticated bool
+	Raw           []byte
+	Header        mail.Header
+	// Parts are the leaf parts of the message (or the message itself if it's not multipart), decoded.
+	Parts []TestEmailPart
+}
+
+type TestEmailPart struct {
+	ContentType string
+	Body        string
+}
+
+// NewTestSMTPServer starts a TestSMTPServer listening on localhost. If opts is nil, the server doesn't support STARTTLS
+// nor authentication. It must be closed with Close.
+func NewTestSMTPServer(t *testing.T, opts *TestSMTPServerOptions) *TestSMTPServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err, err)
+
+	if opts == nil {
+		opts = &TestSMTPServerOptions{}
+	}
+
+	s := &TestSMTPServer{listener: l, opts: *opts}
+
+	if opts.STARTTLS {
+		s.tlsConfig, s.caFile = newTestCertificate(t)
+	}
+
+	go s.serve()
+	return s
+}
+
+// Close stops the server.
+func (s *TestSMTPServer) Close() {
+	s.listener.Close()
+	if len(s.caFile) > 0 {
+		os.Remove(s.caFile)
+	}
+}
+
+// Configure makes the given configuration send emails through this server.
+func (s *TestSMTPServer) Configure(cfg *config.Config) {
+	host, port, _ := net.SplitHostPort(s.listener.Addr().String())
+
+	cfg.Email.Transport = "smtp"
+	cfg.Email.SMTP = config.SMTPConfig{
+		Hostname:       host,
+		Port:           port,
+		TLSMode:        config.SMTPTLSModeNone,
+		Auth:           config.SMTPAuthNone,
+		ConnectTimeout: time.Second,
+		Timeout:        5 * time.Second,
+	}
+
+	if s.opts.STARTTLS {
+		cfg.Email.SMTP.TLSMode = config.SMTPTLSModeSTARTTLS
+		cfg.Email.SMTP.CAFile = s.caFile
+	}
+
+	if len(s.opts.Username) > 0 {
+		cfg.Email.SMTP.Auth = config.SMTPAuthPlain
+		cfg.Email.SMTP.Username = s.opts.Username
+		cfg.Email.SMTP.Password = s.opts.Password
+	}
+}
+
+// Emails returns the emails received so far.
+func (s *TestSMTPServer) Emails() []*TestEmail {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	return append([]*TestEmail(nil), s.emails...)
+}
+
+// LastEmailTo returns the last email received for the given recipient, and fails the test if there's none.
+func (s *TestSMTPServer) LastEmailTo(t *testing.T, to string) *TestEmail {
+	emails := s.Emails()
+	for i := len(emails) - 1; i >= 0; i-- {
+		for _, rcpt := range emails[i].To {
+			if rcpt == to {
+				return emails[i]
+			}
+		}
+	}
+
+	require.FailNow(t, "No email was received for "+to)
+	return nil
+}
+
+func (s *TestSMTPServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		go s.handle(conn)
+	}
+}
+
+// handle runs an SMTP session. It only implements what net/smtp needs to send an email.
+func (s *TestSMTPServer) handle(conn net.Conn) {
+	defer func() { conn.Close() }()
+
+	var isTLS, authenticated bool
+	var email *TestEmail
+	text := textproto.NewConn(conn)
+
+	reply := func(code int, lines ...string) {
+		for i, line := range lines {
+			sep := "-"
+			if i == len(lines)-1 {
+				sep = " "
+			}
+			_ = text.PrintfLine("%d%s%s", code, sep, line)
+		}
+	}
+
+	reply(220, "localhost ESMTP test server")
+	for {
+		line, err := text.ReadLine()
+		if err != nil {
+			return
+		}
+
+		verb, arg := line, ""
+		if i := strings.Index(line, " "); i >= 0 {
+			verb, arg = line[:i], line[i+1:]
+		}
+
+		switch strings.ToUpper(verb) {
+		case "EHLO", "HELO":
+			exts := []string{"localhost", "8BITMIME"}
+			if s.tlsConfig != nil && !isTLS {
+				exts = append(exts, "STARTTLS")
+			}
+			if len(s.opts.Username) > 0 {
+				exts = append(exts, "AUTH PLAIN")
+			}
+			reply(250, exts...)
+		case "STARTTLS":
+			if s.tlsConfig == nil || isTLS {
+				reply(502, "Not supported")
+				continue
+			}
+			reply(220, "Ready to start TLS")
+
+			tlsConn := tls.Server(conn, s.tlsConfig)
+			if err = tlsConn.Handshake(); err != nil {
+				return
+			}
+			conn, isTLS = tlsConn, true
+			text = textproto.NewConn(conn)
+		case "AUTH":
+			fields := strings.Fields(arg)
+			if len(fields) != 2 || strings.ToUpper(fields[0]) != "PLAIN" {
+				reply(504, "Unsupported authentication mechanism")
+				continue
+			}
+
+			creds, err := base64.StdEncoding.DecodeString(fields[1])
+			if err == nil && string(creds) == "\x00"+s.opts.Username+"\x00"+s.opts.Password {
+				authenticated = true
+				reply(235, "Authenticated")
+			} else {
+				reply(535, "Invalid credentials")
+			}
+		case "MAIL":
+			if len(s.opts.Username) > 0 && !authenticated {
+				reply(530, "Authentication required")
+				continue
+			}
+			email = &TestEmail{From: envelopeArg(arg, "FROM:"), TLS: isTLS, Authenticated: authenticated}
+			reply(250, "OK")
+		case "RCPT":
+			if email == nil {
+				reply(503, "MAIL first")
+				continue
+			}
+			email.To = append(email.To, envelopeArg(arg, "TO:"))
+			reply(250, "OK")
+		case "DATA":
+			if email == nil || len(email.To) == 0 {
+				reply(503, "RCPT first")
+				continue
+			}
+			reply(354, "Go ahead")
+
+			if email.Raw, err = ioutil.ReadAll(text.DotReader()); err != nil {
+				return
+			}
+			ParseTestEmail(email)
+
+			s.mut.Lock()
+			s.emails = append(s.emails, email)
+			s.mut.Unlock()
+
+			email = nil
+			reply(250, "Queued")
+		case "RSET":
+			email = nil
+			reply(250, "OK")
+		case "NOOP":
+			reply(250, "OK")
+		case "QUIT":
+			reply(221, "Bye")
+			return
+		default:
+			reply(502, "Unrecognised command")
+		}
+	}
+}
+
+// envelopeArg extracts the address from the argument of a MAIL or RCPT command, e.g. "FROM:<a@b.c> BODY=8BITMIME".
+func envelopeArg(arg, prefix string) string {
+	arg = strings.TrimSpace(arg)
+	if len(arg) >= len(prefix) && strings.EqualFold(arg[:len(prefix)], prefix) {
+		arg = arg[len(prefix):]
+	}
+
+	if i := strings.Index(arg, ">"); i >= 0 {
+		arg = arg[:i]
+	}
+
+	return strings.TrimPrefix(strings.TrimSpace(arg), "<")
+}
+
+// ParseTestEmail fills in the header and parts of the given email from its raw content. Parsing errors are ignored,
+// tests will notice that the parts they're looking for are missing.
+func ParseTestEmail(email *TestEmail) {
+	msg, err := mail.ReadMessage(bytes.NewReader(email.Raw))
+	if err != nil {
+		return
+	}
+
+	email.Header = msg.Header
+	email.Parts = parseTestEmailParts(textproto.MIMEHeader(msg.Header), msg.Body)
+}
+
+func parseTestEmailParts(header textproto.MIMEHeader, body io.Reader) (parts []TestEmailPart) {
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		mediaType = "text/plain"
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		mr := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := mr.NextPart()
+			if err != nil {
+				return
+			}
+
+			parts = append(parts, parseTestEmailParts(part.Header, part)...)
+		}
+	}
+
+	switch strings.ToLower(header.Get("Content-Transfer-Encoding")) {
+	case "quoted-printable":
+		body = quotedprintable.NewReader(body)
+	case "base64":
+		body = base64.NewDecoder(base64.StdEncoding, body)
+	}
+
+	b, _ := ioutil.ReadAll(body)
+	return []TestEmailPart{{ContentType: mediaType, Body: string(b)}}
+}
+
+// Part returns the body of the first part with the given content type, or an empty string if there's none.
+func (e *TestEmail) Part(contentType string) string {
+	for _, part := range e.Parts {
+		if part.ContentType == contentType {
+			return part.Body
+		}
+	}
+
+	return ""
+}
+
+var linkRegexp = regexp.MustCompile(`https?://[^\s"'<>]+`)
+
+// Link returns the first link in the email that contains the given string. It's looked for in the plain text part
+// first, then in the HTML part.
+func (e *TestEmail) Link(t *testing.T, contains string) string {
+	for _, body := range []string{e.Part("text/plain"), html.UnescapeString(e.Part("text/html"))} {
+		for _, link := range linkRegexp.FindAllString(body, -1) {
+			if strings.Contains(link, contains) {
+				return link
+			}
+		}
+	}
+
+	require.FailNow(t, "No link found in the email", "Looked for a link containing %q", contains)
+	return ""
+}
+
+// InviteLink returns the link to join the room from an invite email, i.e. the link that includes the URL to sign the
+// invite with.
+func (e *TestEmail) InviteLink(t *testing.T) string {
+	return e.Link(t, "signurl=")
+}
+
+// InviteSignParams returns the token and the base64-encoded ephemeral private key from the sign URL of the given
+// invite link, decoded the way clients decode them.
+func InviteSignParams(t *testing.T, link string) (token, privateKey string) {
+	// The parameters can be either in the query or in the fragment, depending on the client the link is for.
+	i := strings.Index(link, "?")
+	require.True(t, i >= 0, "No query in the invite link")
+
+	params, err := url.ParseQuery(link[i+1:])
+	require.Nil(t, err, err)
+	require.NotEmpty(t, params.Get("signurl"), "No sign URL in the invite link")
+
+	signURL, err := url.Parse(params.Get("signurl"))
+	require.Nil(t, err, err)
+
+	return signURL.Query().Get("token"), signURL.Query().Get("private_key")
+}
+
+// newTestCertificate generates a self-signed certificate for localhost. It returns a TLS configuration using it and
+// the path of a file with the certificate in the PEM format, which can be used as a CA file.
+func newTestCertificate(t *testing.T) (*tls.Config, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "localhost"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.Nil(t, err, err)
+
+	f, err := ioutil.TempFile("", "ident-test-ca")
+	require.Nil(t, err, err)
+	defer f.Close()
+
+	err = pem.Encode(f, &pem.Block{Type: "CERTIFICATE", Bytes: der})
+	require.Nil(t, err, err)
+
+	cert := tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+	return &tls.Config{Certificates: []tls.Certificate{cert}}, f.Name()
+}
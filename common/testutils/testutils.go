@@ -1,16 +1,22 @@
 package testutils
 
 import (
+	"bufio"
+	"encoding/json"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/babolivier/ident/common"
 	"github.com/babolivier/ident/common/config"
 	"github.com/babolivier/ident/common/constants"
+	"github.com/babolivier/ident/common/crypto"
 	"github.com/babolivier/ident/common/database"
+	"github.com/babolivier/ident/common/sms"
+	"github.com/babolivier/ident/common/templates"
 
 	"github.com/gorilla/mux"
 	"github.com/matrix-org/gomatrix"
@@ -29,23 +35,37 @@ func NewTestConfig(t *testing.T) *config.Config {
 	testConfig, err = config.ParseConfig([]byte(constants.TestConfigYAML))
 	require.Nil(t, err, err)
 
+	// The email templates are files that only exist while a test runs with TestWithTemplates, so only load the SMS
+	// templates here.
+	testConfig.Templates = templates.NewRegistry()
+	testConfig.Templates.AddSMS(templates.InviteSMS, testConfig.Ident.Invites.SMSTemplate)
+	testConfig.Templates.AddSMS(templates.ValidationSMS, testConfig.Ident.Validation.MSISDN.SMSTemplate)
+	require.Nil(t, testConfig.Templates.Load())
+
 	return testConfig
 }
 
-func NewTestDB(t *testing.T) *database.Database {
-	cfg := NewTestConfig(t)
-	db, err := database.NewDatabase(cfg.Database.Driver, cfg.Database.ConnString)
+// NewTestDB returns an empty in-memory database.
+func NewTestDB(t *testing.T) database.Database {
+	db, err := database.NewMemoryDatabase()
 	require.Nil(t, err, err)
 
 	return db
 }
 
 func NewTestServer(
-	cfg *config.Config, db *database.Database,
-	setupRouting func(*mux.Router, *config.Config, *database.Database),
+	cfg *config.Config, db database.Database,
+	setupRouting func(*mux.Router, *config.Config, database.Database),
+) *httptest.Server {
+	return newTestServerWithPrefix(cfg, db, setupRouting, constants.APIPrefix)
+}
+
+func newTestServerWithPrefix(
+	cfg *config.Config, db database.Database,
+	setupRouting func(*mux.Router, *config.Config, database.Database), prefix string,
 ) *httptest.Server {
 	// Create the router and register the handler for the status check route.
-	router := mux.NewRouter().UseEncodedPath().PathPrefix(constants.APIPrefix).Subrouter()
+	router := mux.NewRouter().UseEncodedPath().PathPrefix(prefix).Subrouter()
 	setupRouting(router, cfg, db)
 
 	router.NotFoundHandler = common.MakeAPI(func(r *http.Request) util.JSONResponse {
@@ -63,8 +83,8 @@ func NewTestServer(
 
 func TestWithTestServer(
 	t *testing.T,
-	testFunc func(t *testing.T, cfg *config.Config, db *database.Database, s *httptest.Server),
-	setupRouting func(*mux.Router, *config.Config, *database.Database),
+	testFunc func(t *testing.T, cfg *config.Config, db database.Database, s *httptest.Server),
+	setupRouting func(*mux.Router, *config.Config, database.Database),
 ) {
 	cfg := NewTestConfig(t)
 	db := NewTestDB(t)
@@ -75,6 +95,44 @@ func TestWithTestServer(
 	testFunc(t, cfg, db, s)
 }
 
+// TestWithTestServerV2 does the same thing as TestWithTestServer, except the routes are registered under the prefix
+// of the v2 API.
+func TestWithTestServerV2(
+	t *testing.T,
+	testFunc func(t *testing.T, cfg *config.Config, db database.Database, s *httptest.Server),
+	setupRouting func(*mux.Router, *config.Config, database.Database),
+) {
+	cfg := NewTestConfig(t)
+	db := NewTestDB(t)
+	s := newTestServerWithPrefix(cfg, db, setupRouting, constants.APIv2Prefix)
+
+	defer s.Close()
+
+	testFunc(t, cfg, db, s)
+}
+
+// NewTestAccessToken registers an access token for the given user ID in the database and returns it. The user is
+// also recorded as having accepted every policy from the configuration.
+func NewTestAccessToken(t *testing.T, cfg *config.Config, db database.Database, userID string) string {
+	token, err := crypto.RandString(64)
+	require.Nil(t, err, err)
+
+	err = db.SaveAccountToken(token, userID, common.NowMS())
+	require.Nil(t, err, err)
+
+	var urls []string
+	for _, policy := range cfg.Terms.Policies {
+		for _, doc := range policy.Languages {
+			urls = append(urls, doc.URL)
+		}
+	}
+
+	err = db.SaveAcceptedTermsURLs(userID, urls)
+	require.Nil(t, err, err)
+
+	return token
+}
+
 func TestWithTmpFiles(t *testing.T, testFunc func(t *testing.T), files map[string]string) {
 	for name, content := range files {
 		err := ioutil.WriteFile(name, []byte(content), 0655)
@@ -85,3 +143,77 @@ func TestWithTmpFiles(t *testing.T, testFunc func(t *testing.T), files map[strin
 
 	testFunc(t)
 }
+
+// TestWithTemplates writes the given content to the template files of the test configuration, loads all of its
+// templates, and runs the given test with them. Template files that aren't in the map are written empty, i.e. the
+// matching part isn't included in the emails.
+func TestWithTemplates(t *testing.T, testFunc func(t *testing.T), files map[string]string) {
+	cfg := NewTestConfig(t)
+
+	allFiles := map[string]string{
+		cfg.Ident.Invites.EmailTemplate.Text:          "",
+		cfg.Ident.Invites.EmailTemplate.HTML:          "",
+		cfg.Ident.Validation.Email.EmailTemplate.Text: "",
+		cfg.Ident.Validation.Email.EmailTemplate.HTML: "",
+	}
+	for name, content := range files {
+		allFiles[name] = content
+	}
+
+	TestWithTmpFiles(t, func(t *testing.T) {
+		registry := config.NewTemplateRegistry(cfg)
+		require.Nil(t, registry.Load())
+
+		previous := cfg.Templates
+		cfg.Templates = registry
+		defer func() { cfg.Templates = previous }()
+
+		testFunc(t)
+	}, allFiles)
+}
+
+// LastTestSMS returns the body of the last text message sent to the given phone number, as written by the file SMS
+// provider the test configuration uses.
+func LastTestSMS(t *testing.T, cfg *config.Config, to string) string {
+	f, err := os.Open(cfg.SMS.File.Path)
+	require.Nil(t, err, err)
+	defer f.Close()
+
+	var body string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var msg sms.FileSMS
+		require.Nil(t, json.Unmarshal(scanner.Bytes(), &msg))
+
+		if msg.To == to {
+			body = msg.Body
+		}
+	}
+	require.Nil(t, scanner.Err())
+
+	require.NotEmpty(t, body, "No text message was sent to "+to)
+	return body
+}
+
+// LastTestEmail returns the last email sent to the given address, as written by the file mail transport the test
+// configuration uses. As there's no envelope in this case, only the headers and parts of the returned email are set.
+func LastTestEmail(t *testing.T, cfg *config.Config, to string) *TestEmail {
+	files, err := ioutil.ReadDir(cfg.Email.File.Path)
+	require.Nil(t, err, err)
+
+	// The files are named after the time the emails were sent, so start with the most recent one.
+	for i := len(files) - 1; i >= 0; i-- {
+		b, err := ioutil.ReadFile(filepath.Join(cfg.Email.File.Path, files[i].Name()))
+		require.Nil(t, err, err)
+
+		email := &TestEmail{Raw: b}
+		ParseTestEmail(email)
+
+		if email.Header.Get("To") == to {
+			return email
+		}
+	}
+
+	require.FailNow(t, "No email was sent to "+to)
+	return nil
+}
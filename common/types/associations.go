@@ -0,0 +1,11 @@
+package types
+
+type ThreepidAssociation struct {
+	Medium     string      `json:"medium"`
+	Address    string      `json:"address"`
+	MXID       string      `json:"mxid"`
+	NotBefore  int64       `json:"not_before"`
+	NotAfter   int64       `json:"not_after"`
+	TS         int64       `json:"ts"`
+	Signatures interface{} `json:"signatures,omitempty"`
+}
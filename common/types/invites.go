@@ -1,9 +1,18 @@
 package types
 
 type ThreepidInvite struct {
-	Medium  string `json:"medium"`
-	Address string `json:"address"`
-	RoomID  string `json:"room_id"`
-	Sender  string `json:"sender"`
-	Token   string
+	Medium    string `json:"medium"`
+	Address   string `json:"address"`
+	RoomID    string `json:"room_id"`
+	Sender    string `json:"sender"`
+	Token     string
+	CreatedAt int64 `json:"-"`
+	// EphemeralPublicKey is the base64-encoded public half of the ephemeral key generated for this invite. It's empty
+	// for invites stored before it was recorded.
+	EphemeralPublicKey string `json:"-"`
+	// State is one of the constants.InviteState* values.
+	State string `json:"-"`
+	// SignedFor is the MXID the invite was signed for or delivered to, if any.
+	SignedFor      string `json:"-"`
+	StateChangedAt int64  `json:"-"`
 }
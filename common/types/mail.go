@@ -0,0 +1,13 @@
+package types
+
+// QueuedMail is an email waiting in the outbound queue to be delivered.
+type QueuedMail struct {
+	ID        int64
+	Recipient string
+	// Message is the full message, headers included, as it's sent to the SMTP server.
+	Message       []byte
+	Attempts      int
+	NextAttemptAt int64
+	LastError     string
+	CreatedAt     int64
+}
@@ -0,0 +1,20 @@
+package types
+
+type ValidationSession struct {
+	ID           string
+	Medium       string
+	Address      string
+	ClientSecret string
+	Token        string
+	SendAttempt  int
+	NextLink     string
+	CreatedAt    int64
+	ValidatedAt  int64
+	// TokenAttempts is the number of times a token has been submitted for this session.
+	TokenAttempts int
+}
+
+// Validated returns true if the token of this session has been successfully submitted.
+func (s *ValidationSession) Validated() bool {
+	return s.ValidatedAt != 0
+}
@@ -1,16 +1,27 @@
 package common
 
 import (
-	"math/rand"
+	"strings"
+	"time"
 )
 
-const letterBytes = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+func IsEmailAddressValid(email string) bool {
+	var atCount int
+	atCount = strings.Count(email, "@")
 
-// Shamelessly stolen from https://stackoverflow.com/a/31832326
-func RandString(n int) string {
-	b := make([]byte, n)
-	for i := range b {
-		b[i] = letterBytes[rand.Int63()%int64(len(letterBytes))]
-	}
-	return string(b)
+	// Prevent username@domain1@domain2
+	// c.f. https://matrix.org/blog/2019/04/18/security-update-sydent-1-0-2
+	// Also ensure that there's a localpart and a server name.
+	return atCount == 1 && len(email) >= 3
+}
+
+// NowMS returns the current time as a UNIX timestamp in milliseconds.
+func NowMS() int64 {
+	return time.Now().UnixNano() / int64(time.Millisecond)
+}
+
+// ExpiryThreshold returns the UNIX timestamp in milliseconds before which something that lives for the given duration
+// has expired.
+func ExpiryThreshold(lifetime time.Duration) int64 {
+	return NowMS() - int64(lifetime/time.Millisecond)
 }
@@ -0,0 +1,19 @@
+package common
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestIsEmailAddressValid(t *testing.T) {
+	require.True(t, IsEmailAddressValid("test@example.com"))
+	require.False(t, IsEmailAddressValid("testexample.com"))
+	require.False(t, IsEmailAddressValid("test@example.com@otherdomain.com"))
+}
+
+func TestExpiryThreshold(t *testing.T) {
+	threshold := ExpiryThreshold(time.Hour)
+	require.InDelta(t, NowMS()-int64(time.Hour/time.Millisecond), threshold, 1000)
+}
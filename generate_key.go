@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"os"
+
+	"github.com/babolivier/ident/common/crypto"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+func generateKey(args []string) error {
+	fs, _ := newFlagSet("generate-key")
+	output := fs.String("output", "signing.key", "Path of the key file to write")
+	id := fs.String("id", "", "ID of the key (default: a random ID in the a_XXXX format)")
+	_ = fs.Parse(args)
+
+	if len(*id) == 0 {
+		suffix, err := crypto.RandString(4)
+		if err != nil {
+			return err
+		}
+		*id = "a_" + suffix
+	}
+
+	if err := writeKeyFile(*output, *id); err != nil {
+		return err
+	}
+
+	fmt.Printf("Wrote key ed25519:%s to %s\n", *id, *output)
+	return nil
+}
+
+// writeKeyFile generates a new ed25519 key and writes it to the given path using the format used by Synapse and
+// Sydent, which can then be used as the key_file of a signing key. It refuses to overwrite an existing file.
+func writeKeyFile(path, id string) error {
+	seed, err := crypto.RandBytes(ed25519.SeedSize)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+
+	if _, err = fmt.Fprintf(f, "ed25519 %s %s\n", id, base64.RawStdEncoding.EncodeToString(seed)); err != nil {
+		_ = f.Close()
+		return err
+	}
+
+	return f.Close()
+}
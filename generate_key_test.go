@@ -0,0 +1,33 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/babolivier/ident/common/config"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteKeyFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ident_generate_key")
+	require.Nil(t, err, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "signing.key")
+	require.Nil(t, writeKeyFile(path, "a_test"))
+
+	info, err := os.Stat(path)
+	require.Nil(t, err, err)
+	require.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	// Test that the generated file can be used as a key file.
+	cfg, err := config.ParseConfig([]byte("ident:\n  signing_key:\n    key_file: " + path + "\nemail:\n  disabled: true"))
+	require.Nil(t, err, err)
+	require.Equal(t, "ed25519:a_test", cfg.Ident.SigningKey.KeyID())
+
+	// Test that an existing key file isn't overwritten.
+	require.NotNil(t, writeKeyFile(path, "a_other"))
+}
@@ -0,0 +1,53 @@
+package invites
+
+import (
+	"time"
+
+	"github.com/babolivier/ident/common"
+	"github.com/babolivier/ident/common/config"
+	"github.com/babolivier/ident/common/database"
+
+	"github.com/sirupsen/logrus"
+)
+
+// How often the reaper looks for expired invites and ephemeral keys.
+const reaperInterval = time.Hour
+
+// RunReaper deletes expired invites and ephemeral keys from the database once when called, then every reaperInterval.
+// It never returns, and is meant to be run in its own goroutine.
+func RunReaper(cfg *config.Config, db database.Database) {
+	ticker := time.NewTicker(reaperInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := ReapExpired(cfg, db); err != nil {
+			logrus.WithError(err).Error("Couldn't delete expired invites")
+		}
+
+		<-ticker.C
+	}
+}
+
+// ReapExpired deletes the invites and ephemeral keys that are older than the configured TTL.
+func ReapExpired(cfg *config.Config, db database.Database) error {
+	threshold := common.ExpiryThreshold(cfg.Ident.Invites.TTL)
+
+	invites, err := db.Delete3PIDInvitesCreatedBefore(threshold)
+	if err != nil {
+		return err
+	}
+
+	keys, err := db.DeleteEphemeralPublicKeysCreatedBefore(threshold)
+	if err != nil {
+		return err
+	}
+
+	if invites > 0 || keys > 0 {
+		logrus.WithFields(logrus.Fields{
+			"invites":        invites,
+			"ephemeral_keys": keys,
+		}).Info("Deleted expired invites")
+	}
+
+	return nil
+}
@@ -0,0 +1,58 @@
+package invites
+
+import (
+	"testing"
+	"time"
+
+	"github.com/babolivier/ident/common"
+	"github.com/babolivier/ident/common/constants"
+	"github.com/babolivier/ident/common/testutils"
+	"github.com/babolivier/ident/common/types"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestReapExpired(t *testing.T) {
+	cfg := testutils.NewTestConfig(t)
+	db := testutils.NewTestDB(t)
+
+	expiredTS := common.NowMS() - int64((cfg.Ident.Invites.TTL+time.Minute)/time.Millisecond)
+
+	for token, createdAt := range map[string]int64{"expired": expiredTS, "current": common.NowMS()} {
+		err := db.Save3PIDInvite(&types.ThreepidInvite{
+			Medium:    constants.MediumEmail,
+			Address:   "alice@example.com",
+			RoomID:    "!someroom:example.com",
+			Sender:    "@bob:example.com",
+			Token:     token,
+			CreatedAt: createdAt,
+		})
+		require.Nil(t, err, err)
+
+		err = db.SaveEphemeralPublicKey(token+"key", createdAt)
+		require.Nil(t, err, err)
+	}
+
+	// Test that the expired key isn't considered valid even before it's deleted.
+	exists, err := db.EphemeralPublicKeyExists("expiredkey", common.ExpiryThreshold(cfg.Ident.Invites.TTL))
+	require.Nil(t, err, err)
+	require.False(t, exists)
+
+	require.Nil(t, ReapExpired(cfg, db))
+
+	invite, err := db.Get3PIDInviteByToken("expired")
+	require.Nil(t, err, err)
+	require.Nil(t, invite)
+
+	invite, err = db.Get3PIDInviteByToken("current")
+	require.Nil(t, err, err)
+	require.NotNil(t, invite)
+
+	exists, err = db.EphemeralPublicKeyExists("expiredkey", 0)
+	require.Nil(t, err, err)
+	require.False(t, exists)
+
+	exists, err = db.EphemeralPublicKeyExists("currentkey", 0)
+	require.Nil(t, err, err)
+	require.True(t, exists)
+}
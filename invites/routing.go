@@ -11,7 +11,7 @@ import (
 	"github.com/matrix-org/util"
 )
 
-func SetupRouting(router *mux.Router, cfg *config.Config, db *database.Database) {
+func SetupRouting(router *mux.Router, cfg *config.Config, db database.Database) {
 	router.Handle("/store-invite", common.MakeAPI(func(r *http.Request) util.JSONResponse {
 		return StoreInvite(r, cfg, db)
 	})).Methods(http.MethodOptions, http.MethodPost)
@@ -20,3 +20,15 @@ func SetupRouting(router *mux.Router, cfg *config.Config, db *database.Database)
 		return SignED25519(r, cfg, db)
 	})).Methods(http.MethodOptions, http.MethodPost)
 }
+
+// SetupRoutingV2 registers the same routes as SetupRouting, but requires the requests to be authenticated as per the
+// v2 API.
+func SetupRoutingV2(router *mux.Router, cfg *config.Config, db database.Database) {
+	router.Handle("/store-invite", common.MakeAuthAPI(cfg, db, func(r *http.Request, userID string) util.JSONResponse {
+		return StoreInvite(r, cfg, db)
+	})).Methods(http.MethodOptions, http.MethodPost)
+
+	router.Handle("/sign-ed25519", common.MakeAuthAPI(cfg, db, func(r *http.Request, userID string) util.JSONResponse {
+		return SignED25519(r, cfg, db)
+	})).Methods(http.MethodOptions, http.MethodPost)
+}
@@ -6,15 +6,21 @@ import (
 	"encoding/json"
 	"io"
 	"io/ioutil"
+	"mime"
 	"net/http"
 	"net/http/httptest"
+	"os"
 	"path"
+	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/babolivier/ident/common"
 	"github.com/babolivier/ident/common/config"
 	"github.com/babolivier/ident/common/constants"
 	"github.com/babolivier/ident/common/database"
+	"github.com/babolivier/ident/common/email"
 	"github.com/babolivier/ident/common/testutils"
 	"github.com/babolivier/ident/common/types"
 
@@ -24,15 +30,394 @@ import (
 	"golang.org/x/crypto/ed25519"
 )
 
-// TODO: Add a test for "/store-invite". This requires a way to setup a mocked SMTP server (or a real one) in the CI,
-//  otherwise the request will 500. Alternatively, we could keep the mail sending on invite optional and disable it
-//  if no SMTP configuration is provided.
+func TestStoreInviteEmail(t *testing.T) {
+	cfg := testutils.NewTestConfig(t)
+
+	files := map[string]string{
+		cfg.Ident.Invites.EmailTemplate.Text: "{{.SenderDisplayName}} invited you, token: {{.Token}}",
+		cfg.Ident.Invites.EmailTemplate.HTML: "<p>{{.SenderDisplayName}} invited you, token: {{.Token}}</p>",
+	}
+
+	testutils.TestWithTemplates(t, func(t *testing.T) {
+		testutils.TestWithTestServer(t, testStoreInviteEmail, SetupRouting)
+	}, files)
+}
+
+func testStoreInviteEmail(t *testing.T, cfg *config.Config, db database.Database, s *httptest.Server) {
+	url := s.URL + path.Join(constants.APIPrefix, "store-invite")
+	contentType := "application/json"
+
+	// Test that inviting an email address queues the invite email instead of waiting for the mail server.
+	req := map[string]interface{}{
+		"medium":              constants.MediumEmail,
+		"address":             "alice@example.com",
+		"room_id":             "!someroom:example.com",
+		"sender":              "@bob:example.com",
+		"sender_display_name": "Bob",
+	}
+
+	resp, err := http.Post(url, contentType, structToIOReader(t, &req))
+	require.Nil(t, err, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var storeInviteResp StoreInviteResp
+	httpRespToStruct(t, resp, &storeInviteResp)
+	require.Equal(t, "a...@e...", storeInviteResp.DisplayName)
+
+	// Send the queued invite email, which the test configuration writes to a file.
+	err = email.FlushQueue(cfg, db)
+	require.Nil(t, err, err)
+
+	received := testutils.LastTestEmail(t, cfg, "alice@example.com")
+	require.Equal(t, "Bob invited you, token: "+storeInviteResp.Token, received.Part("text/plain"))
+
+	invites, err := db.Get3PIDInvitesForAddress(constants.MediumEmail, "alice@example.com")
+	require.Nil(t, err, err)
+	require.Len(t, invites, 1)
+
+	// Test that the invite is still stored, but no email is queued, if sending emails is disabled.
+	cfg.Email.Disabled = true
+	defer func() { cfg.Email.Disabled = false }()
+
+	req["address"] = "carol@example.com"
+	resp, err = http.Post(url, contentType, structToIOReader(t, &req))
+	require.Nil(t, err, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	mails, err := db.ClaimDueMails(common.NowMS(), common.NowMS(), 10)
+	require.Nil(t, err, err)
+	require.Empty(t, mails)
+
+	invites, err = db.Get3PIDInvitesForAddress(constants.MediumEmail, "carol@example.com")
+	require.Nil(t, err, err)
+	require.Len(t, invites, 1)
+}
+
+func TestStoreInviteRoundTrip(t *testing.T) {
+	cfg := testutils.NewTestConfig(t)
+
+	inviteTXT, err := ioutil.ReadFile("../templates/text/invite.txt")
+	require.Nil(t, err, err)
+
+	inviteHTML, err := ioutil.ReadFile("../templates/html/invite.html")
+	require.Nil(t, err, err)
+
+	// Test that the invite can be signed with the link from the plain text part.
+	files := map[string]string{
+		cfg.Ident.Invites.EmailTemplate.Text: string(inviteTXT),
+		cfg.Ident.Invites.EmailTemplate.HTML: string(inviteHTML),
+	}
+
+	testutils.TestWithTemplates(t, func(t *testing.T) {
+		testStoreInviteRoundTrip(t, "alice@example.com")
+	}, files)
+
+	// Test that it also works with the link from the HTML part.
+	files = map[string]string{
+		cfg.Ident.Invites.EmailTemplate.HTML: string(inviteHTML),
+	}
+
+	testutils.TestWithTemplates(t, func(t *testing.T) {
+		testStoreInviteRoundTrip(t, "carol@example.com")
+	}, files)
+}
+
+// testStoreInviteRoundTrip stores an invite for the given address, sends the invite email through a test SMTP server,
+// and signs the invite with the token and key from the link in the email, like a client would.
+func testStoreInviteRoundTrip(t *testing.T, address string) {
+	smtpServer := testutils.NewTestSMTPServer(t, &testutils.TestSMTPServerOptions{
+		STARTTLS: true,
+		Username: "ident",
+		Password: "somepassword",
+	})
+	defer smtpServer.Close()
+
+	// Work on a copy of the configuration, so other tests keep using the file transport.
+	cfg := *testutils.NewTestConfig(t)
+	smtpServer.Configure(&cfg)
+
+	db := testutils.NewTestDB(t)
+	s := testutils.NewTestServer(&cfg, db, SetupRouting)
+	defer s.Close()
+
+	contentType := "application/json"
+
+	req := map[string]interface{}{
+		"medium":              constants.MediumEmail,
+		"address":             address,
+		"room_id":             "!someroom:example.com",
+		"room_name":           "Some room",
+		"sender":              "@bob:example.com",
+		"sender_display_name": "Zoë O'Brien & Co",
+	}
+
+	resp, err := http.Post(s.URL+path.Join(constants.APIPrefix, "store-invite"), contentType, structToIOReader(t, &req))
+	require.Nil(t, err, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var storeInviteResp StoreInviteResp
+	httpRespToStruct(t, resp, &storeInviteResp)
+
+	err = email.FlushQueue(&cfg, db)
+	require.Nil(t, err, err)
+
+	received := smtpServer.LastEmailTo(t, address)
+	require.Equal(t, "ident@example.com", received.From)
+	require.True(t, received.TLS)
+	require.True(t, received.Authenticated)
+
+	// Check that the display name isn't mangled in the subject nor the plain text part.
+	subject, err := new(mime.WordDecoder).DecodeHeader(received.Header.Get("Subject"))
+	require.Nil(t, err, err)
+	require.Equal(t, "Zoë O'Brien & Co invited you to Matrix!", subject)
+
+	if text := received.Part("text/plain"); len(text) > 0 {
+		require.Contains(t, text, "inviter_name=Zo%C3%AB+O%27Brien+%26+Co")
+	}
+
+	token, privateKey := testutils.InviteSignParams(t, received.InviteLink(t))
+	require.Equal(t, storeInviteResp.Token, token)
+
+	signReq := map[string]interface{}{
+		"mxid":        "@alice:example.com",
+		"token":       token,
+		"private_key": privateKey,
+	}
+
+	resp, err = http.Post(s.URL+path.Join(constants.APIPrefix, "sign-ed25519"), contentType, structToIOReader(t, &signReq))
+	require.Nil(t, err, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var signED25519Resp SignED25519Resp
+	b := httpRespToStruct(t, resp, &signED25519Resp)
+	require.Equal(t, "@bob:example.com", signED25519Resp.Sender)
+	require.Equal(t, token, signED25519Resp.Token)
+
+	// Check that the signature matches the ephemeral public key the homeserver was given.
+	ephemeralPubKey, err := base64.RawStdEncoding.DecodeString(storeInviteResp.PublicKeys[1].PublicKey)
+	require.Nil(t, err, err)
+
+	err = gomatrixserverlib.VerifyJSON(
+		cfg.Ident.ServerName, gomatrixserverlib.KeyID(cfg.Ident.SigningKey.KeyID()), ed25519.PublicKey(ephemeralPubKey), b,
+	)
+	require.Nil(t, err, err)
+}
+
+func TestStoreInviteLocales(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ident_invite_locales")
+	require.Nil(t, err, err)
+	defer os.RemoveAll(dir)
+
+	frTemplate := filepath.Join(dir, "invite.txt")
+	require.Nil(t, ioutil.WriteFile(frTemplate, []byte("{{.SenderDisplayName}} vous a invité"), 0600))
+
+	cfg := testutils.NewTestConfig(t)
+	files := map[string]string{
+		cfg.Ident.Invites.EmailTemplate.Text: "{{.SenderDisplayName}} invited you",
+	}
+
+	testutils.TestWithTemplates(t, func(t *testing.T) {
+		// Work on a copy of the configuration, so other tests keep using the default templates only.
+		localisedCfg := *cfg
+		localisedCfg.Ident.Localisation.Domains = map[string]string{"example.fr": "fr"}
+		localisedCfg.Ident.Invites.Locales = map[string]config.LocalisedEmailConfig{
+			"fr": {
+				SubjectTemplate: "{{.SenderDisplayName}} vous a invité sur Matrix !",
+				EmailTemplate:   config.TemplateConfig{Text: frTemplate},
+			},
+		}
+
+		localisedCfg.Templates = config.NewTemplateRegistry(&localisedCfg)
+		require.Nil(t, localisedCfg.Templates.Load())
+
+		db := testutils.NewTestDB(t)
+		s := testutils.NewTestServer(&localisedCfg, db, SetupRouting)
+		defer s.Close()
+
+		testStoreInviteLocales(t, &localisedCfg, db, s)
+	}, files)
+}
+
+func testStoreInviteLocales(t *testing.T, cfg *config.Config, db database.Database, s *httptest.Server) {
+	// storeInvite invites the given address, and returns the plain text part of the invite email.
+	storeInvite := func(address string, body map[string]interface{}, acceptLanguage string) string {
+		body["medium"] = constants.MediumEmail
+		body["address"] = address
+		body["room_id"] = "!someroom:example.com"
+		body["sender"] = "@bob:example.com"
+		body["sender_display_name"] = "Bob"
+
+		httpReq, err := http.NewRequest(
+			http.MethodPost, s.URL+path.Join(constants.APIPrefix, "store-invite"), structToIOReader(t, &body),
+		)
+		require.Nil(t, err, err)
+		httpReq.Header.Set("Content-Type", "application/json")
+		if len(acceptLanguage) > 0 {
+			httpReq.Header.Set("Accept-Language", acceptLanguage)
+		}
+
+		resp, err := http.DefaultClient.Do(httpReq)
+		require.Nil(t, err, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+
+		err = email.FlushQueue(cfg, db)
+		require.Nil(t, err, err)
+
+		return testutils.LastTestEmail(t, cfg, address).Part("text/plain")
+	}
+
+	// Test that the default templates are used if nothing tells which locale to use.
+	require.Equal(t, "Bob invited you", storeInvite("alice@example.com", map[string]interface{}{}, ""))
+
+	// Test that the locale can be picked by the request, in both the locale and lang fields.
+	require.Equal(
+		t, "Bob vous a invité", storeInvite("bob@example.com", map[string]interface{}{"locale": "fr-CA"}, ""),
+	)
+	require.Equal(t, "Bob vous a invité", storeInvite("carol@example.com", map[string]interface{}{"lang": "fr"}, ""))
+
+	// Test that the locale can be picked from the Accept-Language header.
+	require.Equal(
+		t, "Bob vous a invité", storeInvite("dave@example.com", map[string]interface{}{}, "de, fr;q=0.8, en;q=0.5"),
+	)
+
+	// Test that the locale can be picked from the address's domain.
+	require.Equal(t, "Bob vous a invité", storeInvite("eve@example.fr", map[string]interface{}{}, ""))
+
+	// Test that the subject is localised too.
+	received := testutils.LastTestEmail(t, cfg, "eve@example.fr")
+	subject, err := new(mime.WordDecoder).DecodeHeader(received.Header.Get("Subject"))
+	require.Nil(t, err, err)
+	require.Equal(t, "Bob vous a invité sur Matrix !", subject)
+}
+
+func TestStoreInviteThreepidInUse(t *testing.T) {
+	testutils.TestWithTestServer(t, testStoreInviteThreepidInUse, SetupRouting)
+}
+
+func testStoreInviteThreepidInUse(t *testing.T, cfg *config.Config, db database.Database, s *httptest.Server) {
+	url := s.URL + path.Join(constants.APIPrefix, "store-invite")
+	contentType := "application/json"
+
+	err := db.SaveAssociation(&types.ThreepidAssociation{
+		Medium:  constants.MediumEmail,
+		Address: "alice@example.com",
+		MXID:    "@alice:example.com",
+	})
+	require.Nil(t, err, err)
+
+	// Test that trying to invite a 3PID that's already associated with a MXID results in an error.
+	req := map[string]interface{}{
+		"medium":  constants.MediumEmail,
+		"address": "alice@example.com",
+		"room_id": "!someroom:example.com",
+		"sender":  "@bob:example.com",
+	}
+
+	resp, err := http.Post(url, contentType, structToIOReader(t, &req))
+	require.Nil(t, err, err)
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	var respError gomatrix.RespError
+	httpRespToStruct(t, resp, &respError)
+	require.Equal(t, "M_THREEPID_IN_USE", respError.ErrCode)
+}
+
+func TestStoreInviteMSISDN(t *testing.T) {
+	testutils.TestWithTestServer(t, testStoreInviteMSISDN, SetupRouting)
+}
+
+func testStoreInviteMSISDN(t *testing.T, cfg *config.Config, db database.Database, s *httptest.Server) {
+	url := s.URL + path.Join(constants.APIPrefix, "store-invite")
+	contentType := "application/json"
+
+	// Test that inviting a phone number sends the invite by SMS.
+	req := map[string]interface{}{
+		"medium":              constants.MediumMSISDN,
+		"address":             "447700900002",
+		"room_id":             "!someroom:example.com",
+		"sender":              "@bob:example.com",
+		"sender_display_name": "Bob",
+	}
+
+	resp, err := http.Post(url, contentType, structToIOReader(t, &req))
+	require.Nil(t, err, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var storeInviteResp StoreInviteResp
+	httpRespToStruct(t, resp, &storeInviteResp)
+	require.Equal(t, "44770090...", storeInviteResp.DisplayName)
+
+	body := testutils.LastTestSMS(t, cfg, "447700900002")
+	require.Equal(t, "Bob invited you to Matrix! Token: "+storeInviteResp.Token, body)
+
+	invites, err := db.Get3PIDInvitesForAddress(constants.MediumMSISDN, "447700900002")
+	require.Nil(t, err, err)
+	require.Len(t, invites, 1)
+}
+
+func TestStoreInviteUniqueSecrets(t *testing.T) {
+	testutils.TestWithTestServer(t, testStoreInviteUniqueSecrets, SetupRouting)
+}
+
+func testStoreInviteUniqueSecrets(t *testing.T, cfg *config.Config, db database.Database, s *httptest.Server) {
+	url := s.URL + path.Join(constants.APIPrefix, "store-invite")
+	contentType := "application/json"
+
+	// Store several invites at the same time, and check that none of them share a token or an ephemeral key.
+	n := 20
+	resps := make(chan StoreInviteResp, n)
+	errs := make(chan error, n)
+
+	for i := 0; i < n; i++ {
+		go func() {
+			req := map[string]interface{}{
+				"medium":  constants.MediumMSISDN,
+				"address": "447700900003",
+				"room_id": "!someroom:example.com",
+				"sender":  "@bob:example.com",
+			}
+
+			resp, err := http.Post(url, contentType, structToIOReader(t, &req))
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer resp.Body.Close()
+
+			var storeInviteResp StoreInviteResp
+			if err = json.NewDecoder(resp.Body).Decode(&storeInviteResp); err != nil {
+				errs <- err
+				return
+			}
+
+			resps <- storeInviteResp
+		}()
+	}
+
+	tokens := make(map[string]bool)
+	keys := make(map[string]bool)
+	for i := 0; i < n; i++ {
+		select {
+		case err := <-errs:
+			require.Nil(t, err, err)
+		case resp := <-resps:
+			require.Len(t, resp.PublicKeys, 2)
+			require.NotEmpty(t, resp.Token)
+
+			require.False(t, tokens[resp.Token], "Duplicate token")
+			require.False(t, keys[resp.PublicKeys[1].PublicKey], "Duplicate ephemeral key")
+
+			tokens[resp.Token] = true
+			keys[resp.PublicKeys[1].PublicKey] = true
+		}
+	}
+}
 
 func TestSignED25519(t *testing.T) {
 	testutils.TestWithTestServer(t, testSignED25519, SetupRouting)
 }
 
-func testSignED25519(t *testing.T, cfg *config.Config, db *database.Database, s *httptest.Server) {
+func testSignED25519(t *testing.T, cfg *config.Config, db database.Database, s *httptest.Server) {
 	url := s.URL + path.Join(constants.APIPrefix, "sign-ed25519")
 	contentType := "application/json"
 
@@ -82,17 +467,45 @@ func testSignED25519(t *testing.T, cfg *config.Config, db *database.Database, s
 	require.Equal(t, "M_INVALID_PARAM", respError.ErrCode)
 	require.True(t, strings.HasPrefix(respError.Err, "Decoded the base64 representation of the private key"))
 
+	// base64 representation of the public key matching the private key used below
+	pubKey := "3L7IUZnoR0LfqzsV3nXLts19zJbqVLZDxUDFWiRga4g"
+
 	// Test that a valid request results in a valid response containing a valid signature.
 	sender := "@bob:example.com"
 	err = db.Save3PIDInvite(&types.ThreepidInvite{
-		Token:   req["token"].(string),
-		Medium:  constants.MediumEmail,
-		Address: "alice@example.com",
-		RoomID:  "!someroom:example.com",
-		Sender:  sender,
+		Token:              req["token"].(string),
+		Medium:             constants.MediumEmail,
+		Address:            "alice@example.com",
+		RoomID:             "!someroom:example.com",
+		Sender:             sender,
+		CreatedAt:          common.NowMS(),
+		EphemeralPublicKey: pubKey,
 	})
 	require.Nil(t, err, err)
 
+	// Test that a private key that wasn't issued for the invite is rejected.
+	_, otherPrivKey, err := ed25519.GenerateKey(nil)
+	require.Nil(t, err, err)
+	req["private_key"] = base64.RawStdEncoding.EncodeToString(otherPrivKey)
+
+	resp, err = http.Post(url, contentType, structToIOReader(t, &req))
+	require.Nil(t, err, err)
+	require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	httpRespToStruct(t, resp, &respError)
+	require.Equal(t, "M_UNAUTHORIZED", respError.ErrCode)
+
+	// Test that a private key with the right public half but another seed is rejected too.
+	decodedPubKey, err := base64.RawStdEncoding.DecodeString(pubKey)
+	require.Nil(t, err, err)
+
+	forgedPrivKey := append(otherPrivKey.Seed(), decodedPubKey...)
+	req["private_key"] = base64.RawStdEncoding.EncodeToString(forgedPrivKey)
+
+	resp, err = http.Post(url, contentType, structToIOReader(t, &req))
+	require.Nil(t, err, err)
+	require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
 	// base64 representation of an actual ed25519 private key generated with ed25519.NewKeyFromSeed
 	req["private_key"] = "SG9oNmdlaTZnbzJHb2hwaGVpM3JlaXhvd3VvOHNob2ncvshRmehHQt+rOxXedcu2zX3MlupUtkPFQMVaJGBriA"
 
@@ -112,11 +525,88 @@ func testSignED25519(t *testing.T, cfg *config.Config, db *database.Database, s
 	// If err is nil, then the signature is correct.
 	err = gomatrixserverlib.VerifyJSON(
 		cfg.Ident.ServerName,
-		gomatrixserverlib.KeyID("ed25519:0"),
+		gomatrixserverlib.KeyID(cfg.Ident.SigningKey.KeyID()),
 		ed25519.PrivateKey(decodedPrivateKey).Public().(ed25519.PublicKey),
 		b,
 	)
 	require.Nil(t, err, err)
+
+	// Test that signing the same invite again for the same MXID works.
+	resp, err = http.Post(url, contentType, structToIOReader(t, &req))
+	require.Nil(t, err, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	invite, err := db.Get3PIDInviteByToken(req["token"].(string))
+	require.Nil(t, err, err)
+	require.Equal(t, constants.InviteStateSigned, invite.State)
+	require.Equal(t, req["mxid"], invite.SignedFor)
+
+	// Test that it can't be signed for another MXID.
+	req["mxid"] = "@mallory:example.com"
+
+	resp, err = http.Post(url, contentType, structToIOReader(t, &req))
+	require.Nil(t, err, err)
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	httpRespToStruct(t, resp, &respError)
+	require.Equal(t, "M_FORBIDDEN", respError.ErrCode)
+
+	// Test that a revoked invite can't be signed.
+	revoked, err := db.Revoke3PIDInvite(req["token"].(string), common.NowMS())
+	require.Nil(t, err, err)
+	require.True(t, revoked)
+
+	req["mxid"] = "@alice:example.com"
+
+	resp, err = http.Post(url, contentType, structToIOReader(t, &req))
+	require.Nil(t, err, err)
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	httpRespToStruct(t, resp, &respError)
+	require.Equal(t, "M_FORBIDDEN", respError.ErrCode)
+	require.Equal(t, "This invite has been revoked", respError.Err)
+
+	// Test that invites stored before their key was recorded can be signed with a key we generated.
+	req["token"] = "someoldtoken"
+	err = db.Save3PIDInvite(&types.ThreepidInvite{
+		Token:     req["token"].(string),
+		Medium:    constants.MediumEmail,
+		Address:   "alice@example.com",
+		RoomID:    "!someroom:example.com",
+		Sender:    sender,
+		CreatedAt: common.NowMS(),
+	})
+	require.Nil(t, err, err)
+
+	resp, err = http.Post(url, contentType, structToIOReader(t, &req))
+	require.Nil(t, err, err)
+	require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	err = db.SaveEphemeralPublicKey(pubKey, common.NowMS())
+	require.Nil(t, err, err)
+
+	resp, err = http.Post(url, contentType, structToIOReader(t, &req))
+	require.Nil(t, err, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// Test that an expired invite can't be signed.
+	req["token"] = "someexpiredtoken"
+	err = db.Save3PIDInvite(&types.ThreepidInvite{
+		Token:     req["token"].(string),
+		Medium:    constants.MediumEmail,
+		Address:   "alice@example.com",
+		RoomID:    "!someroom:example.com",
+		Sender:    sender,
+		CreatedAt: common.NowMS() - int64(2*cfg.Ident.Invites.TTL/time.Millisecond),
+	})
+	require.Nil(t, err, err)
+
+	resp, err = http.Post(url, contentType, structToIOReader(t, &req))
+	require.Nil(t, err, err)
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	httpRespToStruct(t, resp, &respError)
+	require.Equal(t, "M_UNRECOGNIZED", respError.ErrCode)
 }
 
 func structToIOReader(t *testing.T, req interface{}) io.Reader {
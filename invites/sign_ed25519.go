@@ -1,13 +1,17 @@
 package invites
 
 import (
+	"bytes"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"net/http"
 
 	"github.com/babolivier/ident/common"
 	"github.com/babolivier/ident/common/config"
+	"github.com/babolivier/ident/common/constants"
 	"github.com/babolivier/ident/common/database"
+	"github.com/babolivier/ident/common/types"
 
 	"github.com/matrix-org/gomatrix"
 	"github.com/matrix-org/gomatrixserverlib"
@@ -28,7 +32,7 @@ type SignED25519Resp struct {
 	Signatures interface{} `json:"signatures,omitempty"`
 }
 
-func SignED25519(r *http.Request, cfg *config.Config, db *database.Database) util.JSONResponse {
+func SignED25519(r *http.Request, cfg *config.Config, db database.Database) util.JSONResponse {
 	// Check if we have a request body.
 	if r.Body == nil {
 		return util.JSONResponse{
@@ -68,6 +72,72 @@ func SignED25519(r *http.Request, cfg *config.Config, db *database.Database) uti
 		}
 	}
 
+	// Refuse to sign for an invite that has expired but hasn't been deleted by the reaper yet.
+	if invite.CreatedAt < common.ExpiryThreshold(cfg.Ident.Invites.TTL) {
+		return util.JSONResponse{
+			Code: 404,
+			JSON: gomatrix.RespError{
+				ErrCode: "M_UNRECOGNIZED",
+				Err:     "Expired token",
+			},
+		}
+	}
+
+	if resp := checkInviteState(invite, req.MXID); resp != nil {
+		return *resp
+	}
+
+	// Only sign with the key that was generated for this invite, so holding a token isn't enough to get signatures
+	// from any key. The key is derived from its seed, as the public half sent by the client can't be trusted.
+	privKey := ed25519.NewKeyFromSeed(ed25519.PrivateKey(req.PrivateKey).Seed())
+	if !bytes.Equal(privKey, req.PrivateKey) {
+		return unauthorizedKeyResponse()
+	}
+
+	pubKeyBase64 := base64.RawStdEncoding.EncodeToString(privKey.Public().(ed25519.PublicKey))
+	if len(invite.EphemeralPublicKey) > 0 {
+		if pubKeyBase64 != invite.EphemeralPublicKey {
+			return unauthorizedKeyResponse()
+		}
+	} else {
+		// Invites stored before their key was recorded can only be checked against the keys we've generated.
+		exists, err := db.EphemeralPublicKeyExists(pubKeyBase64, common.ExpiryThreshold(cfg.Ident.Invites.TTL))
+		if err != nil {
+			return common.InternalServerError(err)
+		}
+
+		if !exists {
+			return unauthorizedKeyResponse()
+		}
+	}
+
+	// Claim the invite for this MXID. This only succeeds if the invite is still pending, so if it doesn't, check its
+	// state again in case it's been signed or revoked since we retrieved it. Signing again for the same MXID is fine.
+	claimed, err := db.Sign3PIDInvite(invite.Token, req.MXID, common.NowMS())
+	if err != nil {
+		return common.InternalServerError(err)
+	}
+
+	if !claimed {
+		if invite, err = db.Get3PIDInviteByToken(req.Token); err != nil {
+			return common.InternalServerError(err)
+		}
+
+		if invite == nil {
+			return util.JSONResponse{
+				Code: 404,
+				JSON: gomatrix.RespError{
+					ErrCode: "M_UNRECOGNIZED",
+					Err:     "Unrecognised token",
+				},
+			}
+		}
+
+		if resp := checkInviteState(invite, req.MXID); resp != nil {
+			return *resp
+		}
+	}
+
 	// Sign the data.
 	resp := SignED25519Resp{
 		MXID:   req.MXID,
@@ -80,14 +150,14 @@ func SignED25519(r *http.Request, cfg *config.Config, db *database.Database) uti
 		return common.InternalServerError(err)
 	}
 
-	// Using ed25519:0 as the key ID here isn't part of the spec (yet), however
+	// The key ID to use here isn't part of the spec (yet), however
 	// https://github.com/matrix-org/matrix-doc/issues/2170 says that the ID used
-	// here is of little importance, that the implementation is free to use
-	// whichever it wants, and that "ed25519:0" is a good default value.
+	// here is of little importance and that the implementation is free to use
+	// whichever it wants, so we use the ID of our active signing key.
 	signedRespBytes, err := gomatrixserverlib.SignJSON(
 		cfg.Ident.ServerName,
-		gomatrixserverlib.KeyID("ed25519:0"),
-		ed25519.PrivateKey(req.PrivateKey),
+		gomatrixserverlib.KeyID(cfg.Ident.SigningKey.KeyID()),
+		privKey,
 		unsignedRespBytes,
 	)
 	if err != nil {
@@ -110,6 +180,42 @@ func SignED25519(r *http.Request, cfg *config.Config, db *database.Database) uti
 	}
 }
 
+// checkInviteState checks that the given invite can be signed for the given MXID, i.e. that it hasn't been revoked, nor
+// claimed by another user.
+func checkInviteState(invite *types.ThreepidInvite, mxid string) *util.JSONResponse {
+	if invite.State == constants.InviteStateRevoked {
+		return &util.JSONResponse{
+			Code: 403,
+			JSON: gomatrix.RespError{
+				ErrCode: "M_FORBIDDEN",
+				Err:     "This invite has been revoked",
+			},
+		}
+	}
+
+	if len(invite.SignedFor) > 0 && invite.SignedFor != mxid {
+		return &util.JSONResponse{
+			Code: 403,
+			JSON: gomatrix.RespError{
+				ErrCode: "M_FORBIDDEN",
+				Err:     "This invite has already been claimed by another user",
+			},
+		}
+	}
+
+	return nil
+}
+
+func unauthorizedKeyResponse() util.JSONResponse {
+	return util.JSONResponse{
+		Code: 401,
+		JSON: gomatrix.RespError{
+			ErrCode: "M_UNAUTHORIZED",
+			Err:     "This private key wasn't issued for this invite",
+		},
+	}
+}
+
 func checkSignED25519Req(req *SignED25519Req) *util.JSONResponse {
 	var resp util.JSONResponse
 
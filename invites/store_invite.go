@@ -4,26 +4,28 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
-	"math/rand"
 	"net/http"
 	"path"
 	"strings"
-	"time"
 
 	"github.com/babolivier/ident/common"
 	"github.com/babolivier/ident/common/config"
 	"github.com/babolivier/ident/common/constants"
+	"github.com/babolivier/ident/common/crypto"
 	"github.com/babolivier/ident/common/database"
 	"github.com/babolivier/ident/common/email"
+	"github.com/babolivier/ident/common/sms"
+	"github.com/babolivier/ident/common/templates"
 	"github.com/babolivier/ident/common/types"
 
 	"github.com/matrix-org/gomatrix"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
 	"github.com/sirupsen/logrus"
-	"golang.org/x/crypto/ed25519"
 )
 
+const inviteTokenLength = 128
+
 type StoreInviteReq struct {
 	types.ThreepidInvite
 	RoomAlias         string `json:"room_alias"`
@@ -32,8 +34,11 @@ type StoreInviteReq struct {
 	RoomName          string `json:"room_name"`
 	SenderDisplayName string `json:"sender_display_name"`
 	SenderAvatarURL   string `json:"sender_avatar_url"`
-	PrivKeyBase64     string
-	BaseURL           string
+	// Locale (or Lang) is the locale the invite email should be written in, e.g. "fr" or "pt-BR". It's optional.
+	Locale        string `json:"locale"`
+	Lang          string `json:"lang"`
+	PrivKeyBase64 string
+	BaseURL       string
 }
 
 type StoreInviteResp struct {
@@ -48,7 +53,7 @@ type PublicKey struct {
 	KeyValidityURL string `json:"key_validity_url"`
 }
 
-func StoreInvite(r *http.Request, cfg *config.Config, db *database.Database) util.JSONResponse {
+func StoreInvite(r *http.Request, cfg *config.Config, db database.Database) util.JSONResponse {
 	// Check if we have a request body.
 	if r.Body == nil {
 		return util.JSONResponse{
@@ -76,41 +81,89 @@ func StoreInvite(r *http.Request, cfg *config.Config, db *database.Database) uti
 		return *resp
 	}
 
-	// TODO: Check if there's an MXID associated with this 3PID and return here with it if so.
+	// Invites to phone numbers can only be sent if a SMS provider is configured.
+	if req.Medium == constants.MediumMSISDN && !sms.Enabled(cfg) {
+		return common.InvalidParamError("Unsupported medium: " + req.Medium)
+	}
 
-	// Generate the ephemeral key.
-	pubKey, privKey, err := ed25519.GenerateKey(rand.New(rand.NewSource(time.Now().Unix())))
+	// Check if there's already an MXID associated with this 3PID, in which case the homeserver should invite this user
+	// directly instead.
+	assoc, err := db.GetAssociation(req.Medium, req.Address)
 	if err != nil {
 		return common.InternalServerError(err)
 	}
 
-	// Add additional info to the request instance (will be used when processing the templates)
-	req.PrivKeyBase64 = base64.RawStdEncoding.EncodeToString(privKey)
-	req.BaseURL = cfg.Ident.BaseURL
-	req.Token = common.RandString(128)
-
-	// Send the invite email.
-	if err = email.SendMail(
-		cfg, req.Address, cfg.Ident.Invites.EmailTemplate.Text, cfg.Ident.Invites.EmailTemplate.HTML, &req,
-	); err != nil {
-		// Log the error as the mail sending process is a bit more complex.
-		logrus.WithError(err).Error("Couldn't send 3PID invite email")
+	if assoc != nil {
+		return util.JSONResponse{
+			Code: 400,
+			JSON: gomatrix.RespError{
+				ErrCode: "M_THREEPID_IN_USE",
+				Err:     "Binding already known",
+			},
+		}
+	}
+
+	// Generate the ephemeral key.
+	pubKey, privKey, err := crypto.GenerateEd25519Key()
+	if err != nil {
 		return common.InternalServerError(err)
 	}
 
-	// Save the data about the invite in the database.
-	if err = db.Save3PIDInvite(&req.ThreepidInvite); err != nil {
+	// Generate the token the invite will be identified with.
+	token, err := crypto.RandString(inviteTokenLength)
+	if err != nil {
 		return common.InternalServerError(err)
 	}
 
-	// Encode the public key into base 64 to save it in the database and send it to the client.
+	// Add additional info to the request instance (will be used when processing the templates)
+	req.PrivKeyBase64 = base64.RawStdEncoding.EncodeToString(privKey)
+	req.BaseURL = cfg.Ident.BaseURL
+	req.Token = token
+	req.CreatedAt = common.NowMS()
+	req.State = constants.InviteStatePending
+	req.StateChangedAt = req.CreatedAt
+
+	// Encode the public key into base 64 to save it in the database and send it to the client. It's stored with the
+	// invite so /sign-ed25519 only signs with the key generated for it.
 	pubKeyBase64 := base64.RawStdEncoding.EncodeToString(pubKey)
+	req.EphemeralPublicKey = pubKeyBase64
+
+	// Text messages are sent right away, before storing the invite, so the homeserver knows if the invitee couldn't be
+	// reached.
+	if req.Medium == constants.MediumMSISDN {
+		if err = sms.SendSMS(cfg, req.Address, templates.InviteSMS, &req); err != nil {
+			// Log the error as the sending process is a bit more complex.
+			logrus.WithError(err).WithField("medium", req.Medium).Error("Couldn't send 3PID invite")
+			return common.InternalServerError(err)
+		}
+	}
+
+	// Emails go through the outbound queue, so we don't have to wait for the mail server, which will be retried if it
+	// can't be reached.
+	var mail *types.QueuedMail
+	if req.Medium == constants.MediumEmail && email.Enabled(cfg) {
+		locale := req.Locale
+		if len(locale) == 0 {
+			locale = req.Lang
+		}
 
-	// Save the data about the public key in the database.
-	if err = db.SaveEphemeralPublicKey(pubKeyBase64); err != nil {
+		locales := email.Locales(cfg, r, locale, req.Address)
+		if mail, err = email.NewQueuedMail(cfg, req.Address, templates.InviteEmail, locales, &req); err != nil {
+			logrus.WithError(err).WithField("medium", req.Medium).Error("Couldn't generate 3PID invite email")
+			return common.InternalServerError(err)
+		}
+	}
+
+	// Save the invite, its public key and its email together, so a failure doesn't leave an invite that can't be
+	// stored again.
+	if err = db.Save3PIDInviteWithMail(&req.ThreepidInvite, mail); err != nil {
 		return common.InternalServerError(err)
 	}
 
+	if mail != nil {
+		email.Notify()
+	}
+
 	// Send the invite data to the client.
 	return util.JSONResponse{
 		Code: 200,
@@ -122,14 +175,13 @@ func checkStoreInviteReq(req *StoreInviteReq) *util.JSONResponse {
 	var resp util.JSONResponse
 
 	// Check if we support this medium.
-	// TODO: Implement MSISDN.
-	if req.Medium != constants.MediumEmail {
+	if req.Medium != constants.MediumEmail && req.Medium != constants.MediumMSISDN {
 		resp = common.InvalidParamError("Unsupported medium: " + req.Medium)
 		return &resp
 	}
 
 	// Check if the email address is valid.
-	if req.Medium == constants.MediumEmail && !isEmailAddressValid(req.Address) {
+	if req.Medium == constants.MediumEmail && !common.IsEmailAddressValid(req.Address) {
 		resp = util.JSONResponse{
 			Code: 400,
 			JSON: gomatrix.RespError{
@@ -140,6 +192,18 @@ func checkStoreInviteReq(req *StoreInviteReq) *util.JSONResponse {
 		return &resp
 	}
 
+	// Check if the phone number is in its canonical form.
+	if req.Medium == constants.MediumMSISDN && !sms.IsMSISDNValid(req.Address) {
+		resp = util.JSONResponse{
+			Code: 400,
+			JSON: gomatrix.RespError{
+				ErrCode: "M_INVALID_PHONE_NUMBER",
+				Err:     "Invalid phone number",
+			},
+		}
+		return &resp
+	}
+
 	if _, _, err := gomatrixserverlib.SplitID('!', req.RoomID); err != nil {
 		// Check if the room ID is valid.
 		resp = common.InvalidParamError("Invalid room ID")
@@ -155,23 +219,13 @@ func checkStoreInviteReq(req *StoreInviteReq) *util.JSONResponse {
 	return nil
 }
 
-func isEmailAddressValid(email string) bool {
-	var atCount int
-	atCount = strings.Count(email, "@")
-
-	// Prevent username@domain1@domain2
-	// c.f. https://matrix.org/blog/2019/04/18/security-update-sydent-1-0-2
-	// Also ensure that there's a localpart and a server name.
-	return atCount == 1 && len(email) >= 3
-}
-
 func getStoreInviteResp(req *StoreInviteReq, cfg *config.Config, pubKeyBase64 string) *StoreInviteResp {
 	// Instantiate a response.
 	resp := StoreInviteResp{
 		Token:       req.Token,
 		PublicKey:   cfg.Ident.SigningKey.PubKeyBase64,
 		PublicKeys:  make([]PublicKey, 2),
-		DisplayName: redactEmail(req.Address),
+		DisplayName: redactAddress(req.Medium, req.Address),
 	}
 
 	// Add the public key's details.
@@ -187,6 +241,23 @@ func getStoreInviteResp(req *StoreInviteReq, cfg *config.Config, pubKeyBase64 st
 	return &resp
 }
 
+func redactAddress(medium, address string) string {
+	if medium == constants.MediumMSISDN {
+		return redactMSISDN(address)
+	}
+
+	return redactEmail(address)
+}
+
+// redactMSISDN hides the last digits of the phone number.
+func redactMSISDN(msisdn string) string {
+	if len(msisdn) <= 4 {
+		return "..."
+	}
+
+	return msisdn[:len(msisdn)-4] + "..."
+}
+
 func redactEmail(email string) string {
 	split := strings.SplitN(email, "@", 2)
 
@@ -30,7 +30,7 @@ func TestCheckReqValid(t *testing.T) {
 func TestCheckReqUnsupportedMedium(t *testing.T) {
 	req := &StoreInviteReq{
 		ThreepidInvite: types.ThreepidInvite{
-			Medium:  constants.MediumMSISDN, // TODO: Change this when MSISDN is supported.
+			Medium:  "carrier_pigeon",
 			Address: "test@example.com",
 			RoomID:  "!someroom:example.com",
 			Sender:  "@alice:example.com",
@@ -40,7 +40,25 @@ func TestCheckReqUnsupportedMedium(t *testing.T) {
 	resp := checkStoreInviteReq(req)
 	require.NotNil(t, resp)
 	require.Equal(t, "M_INVALID_PARAM", resp.JSON.(gomatrix.RespError).ErrCode)
-	require.True(t, strings.HasSuffix(resp.JSON.(gomatrix.RespError).Err, constants.MediumMSISDN))
+	require.True(t, strings.HasSuffix(resp.JSON.(gomatrix.RespError).Err, "carrier_pigeon"))
+}
+
+func TestCheckReqMSISDN(t *testing.T) {
+	req := &StoreInviteReq{
+		ThreepidInvite: types.ThreepidInvite{
+			Medium:  constants.MediumMSISDN,
+			Address: "447700900123",
+			RoomID:  "!someroom:example.com",
+			Sender:  "@alice:example.com",
+		},
+	}
+
+	require.Nil(t, checkStoreInviteReq(req))
+
+	req.Address = "+44 7700 900123"
+	resp := checkStoreInviteReq(req)
+	require.NotNil(t, resp)
+	require.Equal(t, "M_INVALID_PHONE_NUMBER", resp.JSON.(gomatrix.RespError).ErrCode)
 }
 
 func TestCheckReqBadEmail(t *testing.T) {
@@ -109,12 +127,6 @@ func TestCheckReqBadSender(t *testing.T) {
 	require.Equal(t, "Invalid sender ID", resp.JSON.(gomatrix.RespError).Err)
 }
 
-func TestIsEmailAddressValid(t *testing.T) {
-	require.True(t, isEmailAddressValid("test@example.com"))
-	require.False(t, isEmailAddressValid("testexample.com"))
-	require.False(t, isEmailAddressValid("test@example.com@otherdomain.com"))
-}
-
 func TestGetResp(t *testing.T) {
 	cfg := testutils.NewTestConfig(t)
 
@@ -139,6 +151,11 @@ func TestGetResp(t *testing.T) {
 	require.Equal(t, "a...@e...", resp.DisplayName)
 }
 
+func TestRedactMSISDN(t *testing.T) {
+	require.Equal(t, "44770090...", redactAddress(constants.MediumMSISDN, "447700900123"))
+	require.Equal(t, "...", redactMSISDN("123"))
+}
+
 func TestRedactEmail(t *testing.T) {
 	require.Equal(t, "a...@e...", redactEmail("alice@example.com"))
 	// We don't really care about the result here, just that it doesn't panic.
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/babolivier/ident/common"
+	"github.com/babolivier/ident/common/constants"
+	"github.com/babolivier/ident/common/database"
+	"github.com/babolivier/ident/common/types"
+)
+
+func listInvites(args []string) error {
+	fs, configFile := newFlagSet("list-invites")
+	medium := fs.String("medium", constants.MediumEmail, "Medium of the invited 3PID")
+	address := fs.String("address", "", "Address of the invited 3PID")
+	token := fs.String("token", "", "Token of the invite")
+	_ = fs.Parse(args)
+
+	if (len(*address) == 0) == (len(*token) == 0) {
+		return errors.New("Exactly one of the -address and -token flags is required")
+	}
+
+	cfg, err := loadConfig(*configFile)
+	if err != nil {
+		return err
+	}
+
+	db, err := database.NewDatabase(cfg.Database.Driver, cfg.Database.ConnString)
+	if err != nil {
+		return err
+	}
+
+	var invites []*types.ThreepidInvite
+	if len(*token) > 0 {
+		invite, err := db.Get3PIDInviteByToken(*token)
+		if err != nil {
+			return err
+		}
+
+		if invite != nil {
+			invites = append(invites, invite)
+		}
+	} else if invites, err = db.Get3PIDInvitesForAddress(*medium, *address); err != nil {
+		return err
+	}
+
+	if len(invites) == 0 {
+		fmt.Println("No invite found")
+		return nil
+	}
+
+	return printInvites(os.Stdout, invites)
+}
+
+func revokeInvite(args []string) error {
+	fs, configFile := newFlagSet("revoke-invite")
+	token := fs.String("token", "", "Token of the invite to revoke")
+	_ = fs.Parse(args)
+
+	if len(*token) == 0 {
+		return errors.New("The -token flag is required")
+	}
+
+	cfg, err := loadConfig(*configFile)
+	if err != nil {
+		return err
+	}
+
+	db, err := database.NewDatabase(cfg.Database.Driver, cfg.Database.ConnString)
+	if err != nil {
+		return err
+	}
+
+	if err = revokeInviteWithToken(db, *token); err != nil {
+		return err
+	}
+
+	fmt.Println("Invite revoked")
+	return nil
+}
+
+// revokeInviteWithToken revokes the invite with the given token, and explains why if it can't be revoked.
+func revokeInviteWithToken(db database.Database, token string) error {
+	revoked, err := db.Revoke3PIDInvite(token, common.NowMS())
+	if err != nil {
+		return err
+	}
+
+	if revoked {
+		return nil
+	}
+
+	invite, err := db.Get3PIDInviteByToken(token)
+	if err != nil {
+		return err
+	}
+
+	if invite == nil {
+		return errors.New("No invite found with this token")
+	}
+
+	return fmt.Errorf("The invite can't be revoked as it's %s", invite.State)
+}
+
+// printInvites writes the given invites and their state as a table.
+func printInvites(w io.Writer, invites []*types.ThreepidInvite) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "TOKEN\tMEDIUM\tADDRESS\tROOM\tSENDER\tCREATED\tSTATE\tSIGNED FOR\tSTATE CHANGED")
+
+	for _, invite := range invites {
+		fmt.Fprintf(
+			tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			invite.Token, invite.Medium, invite.Address, invite.RoomID, invite.Sender, formatTimestamp(invite.CreatedAt),
+			invite.State, orDash(invite.SignedFor), formatTimestamp(invite.StateChangedAt),
+		)
+	}
+
+	return tw.Flush()
+}
+
+// formatTimestamp formats the given timestamp in milliseconds, or returns a dash if it's not set.
+func formatTimestamp(ts int64) string {
+	if ts == 0 {
+		return "-"
+	}
+
+	return time.Unix(0, ts*int64(time.Millisecond)).UTC().Format(time.RFC3339)
+}
+
+func orDash(s string) string {
+	if len(s) == 0 {
+		return "-"
+	}
+
+	return s
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/babolivier/ident/common/config"
+	"github.com/babolivier/ident/common/constants"
+	"github.com/babolivier/ident/common/database"
+	"github.com/babolivier/ident/common/email"
+	"github.com/babolivier/ident/common/testutils"
+	"github.com/babolivier/ident/common/types"
+	"github.com/babolivier/ident/invites"
+	"github.com/babolivier/ident/pubkey"
+	"github.com/babolivier/ident/routing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRevokeInviteWithToken(t *testing.T) {
+	db := testutils.NewTestDB(t)
+
+	for _, token := range []string{"sometoken", "someothertoken"} {
+		err := db.Save3PIDInvite(&types.ThreepidInvite{
+			Token:     token,
+			Medium:    constants.MediumEmail,
+			Address:   "alice@example.com",
+			RoomID:    "!someroom:example.com",
+			Sender:    "@bob:example.com",
+			CreatedAt: 1000,
+		})
+		require.Nil(t, err, err)
+	}
+
+	require.Nil(t, revokeInviteWithToken(db, "sometoken"))
+
+	invite, err := db.Get3PIDInviteByToken("sometoken")
+	require.Nil(t, err, err)
+	require.Equal(t, constants.InviteStateRevoked, invite.State)
+
+	// Test that unknown and already delivered invites are reported.
+	require.NotNil(t, revokeInviteWithToken(db, "someunknowntoken"))
+
+	_, err = db.Mark3PIDInviteDelivered("someothertoken", "@alice:example.com", 2000)
+	require.Nil(t, err, err)
+
+	err = revokeInviteWithToken(db, "someothertoken")
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), constants.InviteStateDelivered)
+}
+
+func TestPrintInvites(t *testing.T) {
+	var buf bytes.Buffer
+	err := printInvites(&buf, []*types.ThreepidInvite{
+		{
+			Token:          "sometoken",
+			Medium:         constants.MediumEmail,
+			Address:        "alice@example.com",
+			RoomID:         "!someroom:example.com",
+			Sender:         "@bob:example.com",
+			CreatedAt:      1000,
+			State:          constants.InviteStateSigned,
+			SignedFor:      "@alice:example.com",
+			StateChangedAt: 2000,
+		},
+	})
+	require.Nil(t, err, err)
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	require.Len(t, lines, 2)
+	require.Equal(
+		t,
+		[]string{
+			"sometoken", "email", "alice@example.com", "!someroom:example.com", "@bob:example.com",
+			"1970-01-01T00:00:01Z", "signed", "@alice:example.com", "1970-01-01T00:00:02Z",
+		},
+		strings.Fields(lines[1]),
+	)
+}
+
+func TestRevokeSignedInvite(t *testing.T) {
+	cfg := testutils.NewTestConfig(t)
+
+	inviteTXT, err := ioutil.ReadFile("templates/text/invite.txt")
+	require.Nil(t, err, err)
+
+	files := map[string]string{cfg.Ident.Invites.EmailTemplate.Text: string(inviteTXT)}
+
+	testutils.TestWithTemplates(t, func(t *testing.T) {
+		db := testutils.NewTestDB(t)
+		s := httptest.NewServer(routing.NewRouter(cfg, db))
+		defer s.Close()
+
+		testRevokeSignedInvite(t, cfg, db, s)
+	}, files)
+}
+
+func testRevokeSignedInvite(t *testing.T, cfg *config.Config, db database.Database, s *httptest.Server) {
+	// post sends the given request as JSON to the given endpoint and decodes the response into resp.
+	post := func(endpoint string, req, resp interface{}) {
+		b, err := json.Marshal(req)
+		require.Nil(t, err, err)
+
+		u := s.URL + path.Join(constants.APIPrefix, endpoint)
+		httpResp, err := http.Post(u, "application/json", bytes.NewReader(b))
+		require.Nil(t, err, err)
+		defer httpResp.Body.Close()
+
+		require.Equal(t, http.StatusOK, httpResp.StatusCode)
+		require.Nil(t, json.NewDecoder(httpResp.Body).Decode(resp))
+	}
+
+	// isValid returns whether the identity server considers the given ephemeral public key valid.
+	isValid := func(pubKey string) bool {
+		query := url.Values{}
+		query.Set("public_key", pubKey)
+
+		u := s.URL + path.Join(constants.APIPrefix, "pubkey/ephemeral/isvalid") + "?" + query.Encode()
+		httpResp, err := http.Get(u)
+		require.Nil(t, err, err)
+		defer httpResp.Body.Close()
+
+		var resp pubkey.PublicKeyValidResponse
+		require.Nil(t, json.NewDecoder(httpResp.Body).Decode(&resp))
+		return resp.Valid
+	}
+
+	var storeInviteResp invites.StoreInviteResp
+	post("store-invite", map[string]string{
+		"medium":    constants.MediumEmail,
+		"address":   "alice@example.com",
+		"room_id":   "!someroom:example.com",
+		"sender":    "@bob:example.com",
+		"room_name": "Some room",
+	}, &storeInviteResp)
+
+	require.Nil(t, email.FlushQueue(cfg, db))
+	received := testutils.LastTestEmail(t, cfg, "alice@example.com")
+	token, privateKey := testutils.InviteSignParams(t, received.InviteLink(t))
+
+	// Sign the invite as the invitee's homeserver would.
+	var signResp invites.SignED25519Resp
+	post("sign-ed25519", map[string]string{
+		"mxid":        "@alice:example.com",
+		"token":       token,
+		"private_key": privateKey,
+	}, &signResp)
+
+	ephemeralPubKey := storeInviteResp.PublicKeys[1].PublicKey
+	require.True(t, isValid(ephemeralPubKey))
+
+	// Test that revoking the signed invite makes its ephemeral public key invalid, so the signed invite is rejected.
+	require.Nil(t, revokeInviteWithToken(db, token))
+	require.False(t, isValid(ephemeralPubKey))
+}
@@ -2,35 +2,84 @@ package main
 
 import (
 	"flag"
-	"net/http"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
 
 	"github.com/babolivier/ident/common/config"
-	"github.com/babolivier/ident/common/database"
-	"github.com/babolivier/ident/routing"
 
 	"github.com/sirupsen/logrus"
 )
 
+// A command is a subcommand of the ident binary, e.g. "ident serve".
+type command struct {
+	description string
+	run         func(args []string) error
+}
+
+var commands = map[string]command{
+	"serve":           {"Start the identity server (default)", serve},
+	"generate-key":    {"Generate a new signing key file", generateKey},
+	"check-config":    {"Check the configuration, the templates it refers to and the database connection", checkConfig},
+	"send-test-email": {"Send an invite email rendered with sample data", sendTestEmail},
+	"migrate":         {"Apply the pending database schema migrations", migrate},
+	"list-invites":    {"Show the 3PID invites for an address or a token, and their state", listInvites},
+	"revoke-invite":   {"Revoke a 3PID invite so it can't be signed nor delivered anymore", revokeInvite},
+	"rotate-pepper":   {"Generate a new lookup pepper and update the lookup hashes of the associations", rotatePepper},
+}
+
 func main() {
-	configFile := flag.String("config", "config.yaml", "Path to the configuration file")
-	flag.Parse()
+	// Default to serving if no command is given, so "ident --config config.yaml" keeps working.
+	name, args := "serve", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
 
-	// Load the configuration from the configuration file.
-	cfg, err := config.NewConfig(*configFile)
-	if err != nil {
-		logrus.WithError(err).Fatal("Couldn't load the server configuration")
+	if name == "help" {
+		usage()
+		return
 	}
 
-	// Initiate the connection to the database and prepare statements.
-	db, err := database.NewDatabase(cfg.Database.Driver, cfg.Database.ConnString)
-	if err != nil {
-		logrus.WithError(err).Fatal("Couldn't initiate a connection to the database")
+	cmd, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n\n", name)
+		usage()
+		os.Exit(2)
 	}
 
-	router := routing.NewRouter(cfg, db)
+	if err := cmd.run(args); err != nil {
+		logrus.WithError(err).Fatal("Command " + name + " failed")
+	}
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s [command] [flags]\n\nCommands:\n", os.Args[0])
 
-	logrus.WithField("listen_addr", cfg.HTTP.ListenAddr).Info("Starting up HTTP server")
-	if err := http.ListenAndServe(cfg.HTTP.ListenAddr, router); err != nil {
-		logrus.WithError(err).Fatal("Failed to serve http")
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
 	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-16s %s\n", name, commands[name].description)
+	}
+	fmt.Fprintf(os.Stderr, "\nRun '%s <command> -h' for the flags of a command.\n", os.Args[0])
+}
+
+// newFlagSet returns a flag set for the given command, with the --config flag registered.
+func newFlagSet(name string) (*flag.FlagSet, *string) {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	configFile := fs.String("config", "config.yaml", "Path to the configuration file")
+	return fs, configFile
+}
+
+func loadConfig(configFile string) (*config.Config, error) {
+	cfg, err := config.NewConfig(configFile)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't load the server configuration: %v", err)
+	}
+
+	return cfg, nil
 }
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/babolivier/ident/common/database"
+)
+
+func migrate(args []string) error {
+	fs, configFile := newFlagSet("migrate")
+	_ = fs.Parse(args)
+
+	cfg, err := loadConfig(*configFile)
+	if err != nil {
+		return err
+	}
+
+	from, to, err := database.Migrate(cfg.Database.Driver, cfg.Database.ConnString)
+	if err != nil {
+		return err
+	}
+
+	if from == to {
+		fmt.Printf("Database schema already up to date (version %d)\n", to)
+	} else {
+		fmt.Printf("Database schema migrated from version %d to version %d\n", from, to)
+	}
+
+	return nil
+}
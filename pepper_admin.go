@@ -0,0 +1,30 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/babolivier/ident/common/database"
+)
+
+func rotatePepper(args []string) error {
+	fs, configFile := newFlagSet("rotate-pepper")
+	_ = fs.Parse(args)
+
+	cfg, err := loadConfig(*configFile)
+	if err != nil {
+		return err
+	}
+
+	db, err := database.NewDatabase(cfg.Database.Driver, cfg.Database.ConnString)
+	if err != nil {
+		return err
+	}
+
+	pepper, err := db.RotateLookupPepper()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Lookup pepper rotated, the new pepper is %s\n", pepper)
+	return nil
+}
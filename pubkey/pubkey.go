@@ -1,8 +1,9 @@
 package pubkey
 
 import (
-	"strings"
+	"time"
 
+	"github.com/babolivier/ident/common"
 	"github.com/babolivier/ident/common/config"
 	"github.com/babolivier/ident/common/database"
 
@@ -19,46 +20,43 @@ type PublicKeyValidResponse struct {
 	Valid bool `json:"valid"`
 }
 
+// GetKey returns the public key with the given ID, as long as it hasn't been revoked. Retired keys are still served
+// so that signatures they produced can be checked.
 func GetKey(keyID string, cfg *config.Config) util.JSONResponse {
-	notFoundJSONResponse := util.JSONResponse{
-		Code: 404,
-		JSON: gomatrix.RespError{
-			ErrCode: "M_NOT_FOUND",
-			Err:     "The public key was not found",
-		},
-	}
-
-	split := strings.SplitN(keyID, ":", 2)
-
-	// If the key ID isn't in the format algo:id, then we don't know it.
-	if len(split) != 2 {
-		return notFoundJSONResponse
-	}
-
-	// Check if the key's metadata matches with our signing key.
-	if split[0] != cfg.Ident.SigningKey.Algo || split[1] != cfg.Ident.SigningKey.ID {
-		return notFoundJSONResponse
+	key := cfg.Ident.FindSigningKey(keyID)
+	if key == nil || key.Status == config.KeyStatusRevoked {
+		return util.JSONResponse{
+			Code: 404,
+			JSON: gomatrix.RespError{
+				ErrCode: "M_NOT_FOUND",
+				Err:     "The public key was not found",
+			},
+		}
 	}
 
 	return util.JSONResponse{
 		Code: 200,
 		JSON: PublicKeyResponse{
-			PublicKey: string(cfg.Ident.SigningKey.PubKeyBase64),
+			PublicKey: key.PubKeyBase64,
 		},
 	}
 }
 
+// IsPubKeyValid checks whether the given key is one of our signing keys, and hasn't expired nor been revoked.
 func IsPubKeyValid(keyBase64 string, cfg *config.Config) util.JSONResponse {
+	key := cfg.Ident.FindSigningKeyByPubKey(keyBase64)
+
 	return util.JSONResponse{
 		Code: 200,
 		JSON: PublicKeyValidResponse{
-			Valid: keyBase64 == cfg.Ident.SigningKey.PubKeyBase64,
+			Valid: key != nil && key.IsValid(time.Now()),
 		},
 	}
 }
 
-func IsEphemeralPubKeyValid(keyBase64 string, db *database.Database) util.JSONResponse {
-	exists, err := db.EphemeralPublicKeyExists(keyBase64)
+// IsEphemeralPubKeyValid checks whether the given key is a known ephemeral public key that hasn't expired yet.
+func IsEphemeralPubKeyValid(keyBase64 string, cfg *config.Config, db database.Database) util.JSONResponse {
+	exists, err := db.EphemeralPublicKeyExists(keyBase64, common.ExpiryThreshold(cfg.Ident.Invites.TTL))
 
 	if err != nil {
 		logrus.WithError(err).Error("Error trying to check the existence of an ephemeral key")
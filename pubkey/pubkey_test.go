@@ -3,7 +3,9 @@ package pubkey
 import (
 	"net/http"
 	"testing"
+	"time"
 
+	"github.com/babolivier/ident/common"
 	"github.com/babolivier/ident/common/config"
 	"github.com/babolivier/ident/common/database"
 	"github.com/babolivier/ident/common/testutils"
@@ -14,7 +16,7 @@ import (
 func TestGetKey(t *testing.T) {
 	cfg := testutils.NewTestConfig(t)
 
-	realKeyID := cfg.Ident.SigningKey.Algo + ":" + cfg.Ident.SigningKey.ID
+	realKeyID := cfg.Ident.SigningKey.KeyID()
 	testGetKey(t, realKeyID, cfg, http.StatusOK)
 	testGetKey(t, "abcdef", cfg, http.StatusNotFound)
 	testGetKey(t, "abc:def", cfg, http.StatusNotFound)
@@ -32,6 +34,40 @@ func testGetKey(t *testing.T, keyID string, cfg *config.Config, expectedCode int
 	}
 }
 
+const multipleKeysConfigYAML = `
+ident:
+  signing_keys:
+    - {algo: ed25519, id: "0", seed: ahphigh9jahchiequiechee4pha1Atuv, status: retired}
+    - {algo: ed25519, id: "1", seed: eiD3oonguu8aePhe2eiCh7xoo5oothei, status: active}
+    - {algo: ed25519, id: "2", seed: Ahgh1ahnooshei5quee2ohNg1nee6Eem, status: revoked}
+    - {algo: ed25519, id: "3", seed: ohgh9Ahru4aiyoh7ohcaezuPheib9eeX, status: retired, expires_at: "2000-01-01T00:00:00Z"}
+email:
+  disabled: true
+`
+
+func TestMultipleKeys(t *testing.T) {
+	cfg, err := config.ParseConfig([]byte(multipleKeysConfigYAML))
+	require.Nil(t, err, err)
+
+	// Test that retired keys are still served, but revoked ones aren't.
+	resp := GetKey("ed25519:0", cfg)
+	require.Equal(t, http.StatusOK, resp.Code)
+	require.Equal(t, cfg.Ident.SigningKeys[0].PubKeyBase64, resp.JSON.(PublicKeyResponse).PublicKey)
+
+	resp = GetKey("ed25519:1", cfg)
+	require.Equal(t, http.StatusOK, resp.Code)
+	require.Equal(t, cfg.Ident.SigningKey.PubKeyBase64, resp.JSON.(PublicKeyResponse).PublicKey)
+
+	resp = GetKey("ed25519:2", cfg)
+	require.Equal(t, http.StatusNotFound, resp.Code)
+
+	// Test that retired keys are valid until they expire, and that revoked keys are never valid.
+	testIsPubKeyValid(t, cfg.Ident.SigningKeys[0].PubKeyBase64, cfg, true)
+	testIsPubKeyValid(t, cfg.Ident.SigningKeys[1].PubKeyBase64, cfg, true)
+	testIsPubKeyValid(t, cfg.Ident.SigningKeys[2].PubKeyBase64, cfg, false)
+	testIsPubKeyValid(t, cfg.Ident.SigningKeys[3].PubKeyBase64, cfg, false)
+}
+
 func TestIsPubKeyValid(t *testing.T) {
 	cfg := testutils.NewTestConfig(t)
 
@@ -52,16 +88,23 @@ func testIsPubKeyValid(t *testing.T, b64 string, cfg *config.Config, expected bo
 func TestIsEphemeralPubKeyValid(t *testing.T) {
 	db := testutils.NewTestDB(t)
 
+	cfg := testutils.NewTestConfig(t)
+
 	realPubKey := "somekey"
-	err := db.SaveEphemeralPublicKey(realPubKey)
+	err := db.SaveEphemeralPublicKey(realPubKey, common.NowMS())
+	require.Nil(t, err, err)
+
+	expiredPubKey := "someexpiredkey"
+	err = db.SaveEphemeralPublicKey(expiredPubKey, common.NowMS()-int64(2*cfg.Ident.Invites.TTL/time.Millisecond))
 	require.Nil(t, err, err)
 
-	testIsEphemeralPubKeyValid(t, realPubKey, db, true)
-	testIsEphemeralPubKeyValid(t, "abcdef", db, false)
+	testIsEphemeralPubKeyValid(t, realPubKey, cfg, db, true)
+	testIsEphemeralPubKeyValid(t, expiredPubKey, cfg, db, false)
+	testIsEphemeralPubKeyValid(t, "abcdef", cfg, db, false)
 }
 
-func testIsEphemeralPubKeyValid(t *testing.T, b64 string, db *database.Database, expected bool) {
-	resp := IsEphemeralPubKeyValid(b64, db)
+func testIsEphemeralPubKeyValid(t *testing.T, b64 string, cfg *config.Config, db database.Database, expected bool) {
+	resp := IsEphemeralPubKeyValid(b64, cfg, db)
 
 	require.Equal(t, http.StatusOK, resp.Code)
 
@@ -11,13 +11,13 @@ import (
 	"github.com/matrix-org/util"
 )
 
-func SetupRouting(router *mux.Router, cfg *config.Config, db *database.Database) {
+func SetupRouting(router *mux.Router, cfg *config.Config, db database.Database) {
 	router.Handle("/pubkey/isvalid", common.MakeAPI(func(r *http.Request) util.JSONResponse {
 		return IsPubKeyValid(r.URL.Query().Get("public_key"), cfg)
 	})).Methods(http.MethodGet)
 
 	router.Handle("/pubkey/ephemeral/isvalid", common.MakeAPI(func(r *http.Request) util.JSONResponse {
-		return IsEphemeralPubKeyValid(r.URL.Query().Get("public_key"), db)
+		return IsEphemeralPubKeyValid(r.URL.Query().Get("public_key"), cfg, db)
 	})).Methods(http.MethodGet)
 
 	router.Handle("/pubkey/{keyId}", common.MakeAPI(func(r *http.Request) util.JSONResponse {
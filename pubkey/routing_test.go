@@ -9,6 +9,7 @@ import (
 	"path"
 	"testing"
 
+	"github.com/babolivier/ident/common"
 	"github.com/babolivier/ident/common/config"
 	"github.com/babolivier/ident/common/constants"
 	"github.com/babolivier/ident/common/database"
@@ -18,7 +19,7 @@ import (
 )
 
 func TestGetPubKey(t *testing.T) {
-	testutils.TestWithTestServer(t, func(t *testing.T, cfg *config.Config, db *database.Database, s *httptest.Server) {
+	testutils.TestWithTestServer(t, func(t *testing.T, cfg *config.Config, db database.Database, s *httptest.Server) {
 		realKeyID := cfg.Ident.SigningKey.Algo + ":" + cfg.Ident.SigningKey.ID
 		testGetPubKey(t, s.URL, realKeyID, cfg, http.StatusOK)
 		testGetPubKey(t, s.URL, "abcdef", cfg, http.StatusNotFound)
@@ -50,7 +51,7 @@ func testGetPubKey(t *testing.T, serverURL, keyID string, cfg *config.Config, ex
 }
 
 func TestPubKeyIsValid(t *testing.T) {
-	testutils.TestWithTestServer(t, func(t *testing.T, cfg *config.Config, db *database.Database, s *httptest.Server) {
+	testutils.TestWithTestServer(t, func(t *testing.T, cfg *config.Config, db database.Database, s *httptest.Server) {
 		realB64 := cfg.Ident.SigningKey.PubKeyBase64
 		testPubKeyIsValid(t, s.URL, realB64, false, true)
 		testPubKeyIsValid(t, s.URL, "abcdef", false, false)
@@ -58,9 +59,9 @@ func TestPubKeyIsValid(t *testing.T) {
 }
 
 func TestPubKeyEphemeralIsValid(t *testing.T) {
-	testutils.TestWithTestServer(t, func(t *testing.T, cfg *config.Config, db *database.Database, s *httptest.Server) {
+	testutils.TestWithTestServer(t, func(t *testing.T, cfg *config.Config, db database.Database, s *httptest.Server) {
 		realPubKey := "somekey"
-		err := db.SaveEphemeralPublicKey(realPubKey)
+		err := db.SaveEphemeralPublicKey(realPubKey, common.NowMS())
 		require.Nil(t, err, err)
 
 		testPubKeyIsValid(t, s.URL, realPubKey, true, true)
@@ -3,30 +3,50 @@ package routing
 import (
 	"net/http"
 
+	"github.com/babolivier/ident/account"
+	"github.com/babolivier/ident/associations"
 	"github.com/babolivier/ident/common"
 	"github.com/babolivier/ident/common/config"
 	"github.com/babolivier/ident/common/constants"
 	"github.com/babolivier/ident/common/database"
 	"github.com/babolivier/ident/invites"
 	"github.com/babolivier/ident/pubkey"
+	"github.com/babolivier/ident/terms"
+	"github.com/babolivier/ident/validation"
 
 	"github.com/gorilla/mux"
 	"github.com/matrix-org/gomatrix"
 	"github.com/matrix-org/util"
 )
 
-func NewRouter(cfg *config.Config, db *database.Database) *mux.Router {
-	// Create the router and register the handler for the status check route.
-	router := mux.NewRouter().UseEncodedPath().PathPrefix(constants.APIPrefix).Subrouter()
-	router.Handle("", common.MakeAPI(func(r *http.Request) util.JSONResponse {
+func NewRouter(cfg *config.Config, db database.Database) *mux.Router {
+	// Create the router and one sub-router for each version of the API.
+	router := mux.NewRouter().UseEncodedPath()
+	v1Router := router.PathPrefix(constants.APIPrefix).Subrouter()
+	v2Router := router.PathPrefix(constants.APIv2Prefix).Subrouter()
+
+	// Register the handler for the status check route.
+	statusCheck := common.MakeAPI(func(r *http.Request) util.JSONResponse {
 		return util.JSONResponse{
 			Code: 200,
 			JSON: struct{}{},
 		}
-	})).Methods(http.MethodGet)
+	})
+	v1Router.Handle("", statusCheck).Methods(http.MethodGet)
+	v2Router.Handle("", statusCheck).Methods(http.MethodGet)
+
+	pubkey.SetupRouting(v1Router, cfg, db)
+	invites.SetupRouting(v1Router, cfg, db)
+	validation.SetupRouting(v1Router, cfg, db)
+	associations.SetupRouting(v1Router, cfg, db)
 
-	pubkey.SetupRouting(router, cfg, db)
-	invites.SetupRouting(router, cfg, db)
+	// Key management isn't authenticated in the v2 API either, so we can use the same routes.
+	pubkey.SetupRouting(v2Router, cfg, db)
+	account.SetupRouting(v2Router, cfg, db)
+	terms.SetupRouting(v2Router, cfg, db)
+	invites.SetupRoutingV2(v2Router, cfg, db)
+	validation.SetupRoutingV2(v2Router, cfg, db)
+	associations.SetupRoutingV2(v2Router, cfg, db)
 
 	router.NotFoundHandler = common.MakeAPI(func(r *http.Request) util.JSONResponse {
 		return util.JSONResponse{
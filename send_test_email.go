@@ -0,0 +1,52 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/babolivier/ident/common/constants"
+	"github.com/babolivier/ident/common/email"
+	"github.com/babolivier/ident/common/templates"
+	"github.com/babolivier/ident/common/types"
+	"github.com/babolivier/ident/invites"
+)
+
+func sendTestEmail(args []string) error {
+	fs, configFile := newFlagSet("send-test-email")
+	to := fs.String("to", "", "Address to send the test email to")
+	locale := fs.String("locale", "", "Locale to render the email in, e.g. fr")
+	_ = fs.Parse(args)
+
+	if len(*to) == 0 {
+		return errors.New("The -to flag is required")
+	}
+
+	cfg, err := loadConfig(*configFile)
+	if err != nil {
+		return err
+	}
+
+	// Sample data, similar to what a homeserver would send to /store-invite.
+	data := invites.StoreInviteReq{
+		ThreepidInvite: types.ThreepidInvite{
+			Medium:  constants.MediumEmail,
+			Address: *to,
+			RoomID:  "!someroom:example.com",
+			Sender:  "@alice:example.com",
+			Token:   "sometoken",
+		},
+		RoomAlias:         "#someroom:example.com",
+		RoomName:          "Some room",
+		SenderDisplayName: "Alice",
+		PrivKeyBase64:     "someprivatekey",
+		BaseURL:           cfg.Ident.BaseURL,
+	}
+
+	locales := email.Locales(cfg, nil, *locale, *to)
+	if err = email.SendMail(cfg, *to, templates.InviteEmail, locales, &data); err != nil {
+		return err
+	}
+
+	fmt.Println("Test email sent to " + *to)
+	return nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/babolivier/ident/common/config"
+	"github.com/babolivier/ident/common/database"
+	"github.com/babolivier/ident/common/email"
+	"github.com/babolivier/ident/invites"
+	"github.com/babolivier/ident/routing"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+func serve(args []string) error {
+	fs, configFile := newFlagSet("serve")
+	_ = fs.Parse(args)
+
+	// Load the configuration from the configuration file.
+	cfg, err := loadConfig(*configFile)
+	if err != nil {
+		return err
+	}
+
+	// Initiate the connection to the database and prepare statements.
+	db, err := database.NewDatabase(cfg.Database.Driver, cfg.Database.ConnString)
+	if err != nil {
+		return errors.Wrap(err, "Couldn't initiate a connection to the database")
+	}
+
+	// Regularly delete expired invites and ephemeral keys.
+	go invites.RunReaper(cfg, db)
+
+	// Send the emails from the outbound queue.
+	if email.Enabled(cfg) {
+		go email.RunQueue(cfg, db)
+	}
+
+	// Reload the templates when asked to, so they can be changed without restarting Ident.
+	go reloadTemplatesOnSIGHUP(cfg)
+
+	router := routing.NewRouter(cfg, db)
+
+	logrus.WithField("listen_addr", cfg.HTTP.ListenAddr).Info("Starting up HTTP server")
+	return errors.Wrap(http.ListenAndServe(cfg.HTTP.ListenAddr, router), "Failed to serve http")
+}
+
+// reloadTemplatesOnSIGHUP reloads the templates every time the process receives a SIGHUP. If they can't be loaded, the
+// ones previously loaded are kept. It never returns, and is meant to be run in its own goroutine.
+func reloadTemplatesOnSIGHUP(cfg *config.Config) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+
+	for range signals {
+		if err := cfg.Templates.Load(); err != nil {
+			logrus.WithError(err).Error("Couldn't reload the templates, keeping the previous ones")
+			continue
+		}
+
+		logrus.Info("Reloaded the templates")
+	}
+}
@@ -0,0 +1,23 @@
+package terms
+
+import (
+	"net/http"
+
+	"github.com/babolivier/ident/common"
+	"github.com/babolivier/ident/common/config"
+	"github.com/babolivier/ident/common/database"
+
+	"github.com/gorilla/mux"
+	"github.com/matrix-org/util"
+)
+
+// SetupRouting registers the terms of service routes. These routes are only available in the v2 API.
+func SetupRouting(router *mux.Router, cfg *config.Config, db database.Database) {
+	router.Handle("/terms", common.MakeAPI(func(r *http.Request) util.JSONResponse {
+		return GetTerms(cfg)
+	})).Methods(http.MethodGet)
+
+	router.Handle("/terms", common.MakeAuthAPIWithoutTerms(db, func(r *http.Request, userID string) util.JSONResponse {
+		return AcceptTerms(r, cfg, db, userID)
+	})).Methods(http.MethodOptions, http.MethodPost)
+}
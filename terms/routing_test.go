@@ -0,0 +1,119 @@
+package terms
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"testing"
+
+	"github.com/babolivier/ident/common"
+	"github.com/babolivier/ident/common/config"
+	"github.com/babolivier/ident/common/constants"
+	"github.com/babolivier/ident/common/crypto"
+	"github.com/babolivier/ident/common/database"
+	"github.com/babolivier/ident/common/testutils"
+
+	"github.com/gorilla/mux"
+	"github.com/matrix-org/gomatrix"
+	"github.com/matrix-org/util"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTerms(t *testing.T) {
+	testutils.TestWithTestServerV2(t, testTerms, setupTestRouting)
+}
+
+// setupTestRouting registers the terms routes along with an authenticated endpoint that requires the terms to be
+// accepted, so we can check that accepting the terms lifts the restriction.
+func setupTestRouting(router *mux.Router, cfg *config.Config, db database.Database) {
+	SetupRouting(router, cfg, db)
+
+	router.Handle("/protected", common.MakeAuthAPI(cfg, db, func(r *http.Request, userID string) util.JSONResponse {
+		return util.JSONResponse{
+			Code: 200,
+			JSON: struct{}{},
+		}
+	})).Methods(http.MethodGet)
+}
+
+func testTerms(t *testing.T, cfg *config.Config, db database.Database, s *httptest.Server) {
+	termsURL := s.URL + path.Join(constants.APIv2Prefix, "terms")
+	protectedURL := s.URL + path.Join(constants.APIv2Prefix, "protected")
+	contentType := "application/json"
+
+	// Test that the terms are correctly advertised.
+	resp, err := http.Get(termsURL)
+	require.Nil(t, err, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var terms struct {
+		Policies map[string]map[string]json.RawMessage `json:"policies"`
+	}
+	httpRespToStruct(t, resp, &terms)
+	require.Len(t, terms.Policies, 1)
+
+	policy, ok := terms.Policies["privacy_policy"]
+	require.True(t, ok)
+	require.Equal(t, `"1.0"`, string(policy["version"]))
+
+	var doc Document
+	require.Nil(t, json.Unmarshal(policy["en"], &doc))
+	require.Equal(t, "Privacy Policy", doc.Name)
+	require.Equal(t, "https://example.com/privacy-1.0-en.html", doc.URL)
+
+	// Register a token without accepting any policy.
+	userID := "@alice:example.com"
+	token, err := crypto.RandString(64)
+	require.Nil(t, err, err)
+	require.Nil(t, db.SaveAccountToken(token, userID, common.NowMS()))
+
+	// Test that an endpoint requiring the terms to be accepted can't be used yet.
+	resp, err = http.Get(protectedURL + "?access_token=" + token)
+	require.Nil(t, err, err)
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	var respError gomatrix.RespError
+	httpRespToStruct(t, resp, &respError)
+	require.Equal(t, "M_TERMS_NOT_SIGNED", respError.ErrCode)
+
+	// Test that accepting the terms requires an access token.
+	req := AcceptTermsReq{
+		UserAccepts: []string{"https://example.com/privacy-1.0-fr.html", "https://example.com/not-a-policy.html"},
+	}
+
+	resp, err = http.Post(termsURL, contentType, structToIOReader(t, &req))
+	require.Nil(t, err, err)
+	require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	// Test that accepting the terms in any of the available languages lifts the restriction.
+	resp, err = http.Post(termsURL+"?access_token="+token, contentType, structToIOReader(t, &req))
+	require.Nil(t, err, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp, err = http.Get(protectedURL + "?access_token=" + token)
+	require.Nil(t, err, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// Test that the URLs that don't belong to any policy aren't recorded.
+	acceptedURLs, err := db.GetAcceptedTermsURLs(userID)
+	require.Nil(t, err, err)
+	require.Equal(t, []string{"https://example.com/privacy-1.0-fr.html"}, acceptedURLs)
+}
+
+func structToIOReader(t *testing.T, in interface{}) io.Reader {
+	b, err := json.Marshal(in)
+	require.Nil(t, err, err)
+
+	return bytes.NewReader(b)
+}
+
+func httpRespToStruct(t *testing.T, resp *http.Response, out interface{}) {
+	b, err := ioutil.ReadAll(resp.Body)
+	require.Nil(t, err, err)
+
+	require.Nil(t, json.Unmarshal(b, out), string(b))
+}
@@ -0,0 +1,109 @@
+package terms
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/babolivier/ident/common"
+	"github.com/babolivier/ident/common/config"
+	"github.com/babolivier/ident/common/database"
+
+	"github.com/matrix-org/gomatrix"
+	"github.com/matrix-org/util"
+)
+
+// GetTermsResp is the list of policies, mapped by name. Each policy is represented as a map containing its version
+// (under the "version" key) and one Document per language (under the language code).
+// c.f. https://matrix.org/docs/spec/identity_service/r0.3.0#get-matrix-identity-v2-terms
+type GetTermsResp struct {
+	Policies map[string]map[string]interface{} `json:"policies"`
+}
+
+type Document struct {
+	Name string `json:"name"`
+	URL  string `json:"url"`
+}
+
+type AcceptTermsReq struct {
+	UserAccepts []string `json:"user_accepts"`
+}
+
+func GetTerms(cfg *config.Config) util.JSONResponse {
+	resp := GetTermsResp{
+		Policies: make(map[string]map[string]interface{}, len(cfg.Terms.Policies)),
+	}
+
+	for name, policy := range cfg.Terms.Policies {
+		p := map[string]interface{}{
+			"version": policy.Version,
+		}
+
+		for lang, doc := range policy.Languages {
+			p[lang] = Document{
+				Name: doc.Name,
+				URL:  doc.URL,
+			}
+		}
+
+		resp.Policies[name] = p
+	}
+
+	return util.JSONResponse{
+		Code: 200,
+		JSON: resp,
+	}
+}
+
+func AcceptTerms(r *http.Request, cfg *config.Config, db database.Database, userID string) util.JSONResponse {
+	// Check if we have a request body.
+	if r.Body == nil {
+		return util.JSONResponse{
+			Code: 400,
+			JSON: gomatrix.RespError{
+				ErrCode: "M_MISSING_PARAMS",
+				Err:     "Missing request body",
+			},
+		}
+	}
+
+	defer r.Body.Close()
+
+	// Load the body's JSON into an instance of AcceptTermsReq.
+	var req AcceptTermsReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return common.InternalServerError(err)
+	}
+
+	if req.UserAccepts == nil {
+		return common.MissingParamsError("user_accepts")
+	}
+
+	// Only record the URLs of the current policy documents, there's no point in storing anything else.
+	if err := db.SaveAcceptedTermsURLs(userID, knownURLs(cfg, req.UserAccepts)); err != nil {
+		return common.InternalServerError(err)
+	}
+
+	return util.JSONResponse{
+		Code: 200,
+		JSON: struct{}{},
+	}
+}
+
+// knownURLs returns the URLs from the given list that belong to a document of the configured policies.
+func knownURLs(cfg *config.Config, urls []string) []string {
+	known := make(map[string]bool)
+	for _, policy := range cfg.Terms.Policies {
+		for _, doc := range policy.Languages {
+			known[doc.URL] = true
+		}
+	}
+
+	res := make([]string, 0, len(urls))
+	for _, url := range urls {
+		if known[url] {
+			res = append(res, url)
+		}
+	}
+
+	return res
+}
@@ -0,0 +1,140 @@
+package validation
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/babolivier/ident/common"
+	"github.com/babolivier/ident/common/config"
+	"github.com/babolivier/ident/common/constants"
+	"github.com/babolivier/ident/common/crypto"
+	"github.com/babolivier/ident/common/database"
+	"github.com/babolivier/ident/common/email"
+	"github.com/babolivier/ident/common/templates"
+
+	"github.com/matrix-org/gomatrix"
+	"github.com/matrix-org/util"
+	"github.com/sirupsen/logrus"
+)
+
+const emailTokenLength = 32
+
+type RequestEmailTokenReq struct {
+	ClientSecret string `json:"client_secret"`
+	Email        string `json:"email"`
+	SendAttempt  int    `json:"send_attempt"`
+	NextLink     string `json:"next_link"`
+}
+
+type RequestTokenResp struct {
+	SID string `json:"sid"`
+}
+
+// Data given to the templates of the validation email.
+type emailTemplateData struct {
+	Address      string
+	ClientSecret string
+	SID          string
+	Token        string
+	BaseURL      string
+}
+
+func RequestEmailToken(r *http.Request, cfg *config.Config, db database.Database) util.JSONResponse {
+	// Check if we have a request body.
+	if r.Body == nil {
+		return util.JSONResponse{
+			Code: 400,
+			JSON: gomatrix.RespError{
+				ErrCode: "M_MISSING_PARAMS",
+				Err:     "Missing request body",
+			},
+		}
+	}
+
+	defer r.Body.Close()
+
+	// Load the body's JSON into an instance of RequestEmailTokenReq.
+	var req RequestEmailTokenReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return common.InternalServerError(err)
+	}
+
+	// Check that the request params are valid.
+	if resp := checkRequestEmailTokenReq(&req); resp != nil {
+		return *resp
+	}
+
+	// Check that we can actually send emails.
+	if !email.Enabled(cfg) {
+		return util.JSONResponse{
+			Code: 400,
+			JSON: gomatrix.RespError{
+				ErrCode: "M_UNRECOGNIZED",
+				Err:     "This server doesn't support validating email addresses",
+			},
+		}
+	}
+
+	session, send, err := getOrCreateSession(
+		db, req.ClientSecret, constants.MediumEmail, req.Email, req.SendAttempt, req.NextLink,
+		func() (string, error) { return crypto.RandString(emailTokenLength) },
+	)
+	if err != nil {
+		return common.InternalServerError(err)
+	}
+
+	// Send the validation email if needed.
+	if send {
+		data := emailTemplateData{
+			Address:      session.Address,
+			ClientSecret: session.ClientSecret,
+			SID:          session.ID,
+			Token:        session.Token,
+			BaseURL:      cfg.Ident.BaseURL,
+		}
+
+		locales := email.Locales(cfg, r, "", session.Address)
+		if err = email.SendMail(cfg, session.Address, templates.ValidationEmail, locales, &data); err != nil {
+			// Log the error as the mail sending process is a bit more complex.
+			logrus.WithError(err).Error("Couldn't send validation email")
+			return common.InternalServerError(err)
+		}
+	}
+
+	return util.JSONResponse{
+		Code: 200,
+		JSON: RequestTokenResp{SID: session.ID},
+	}
+}
+
+func checkRequestEmailTokenReq(req *RequestEmailTokenReq) *util.JSONResponse {
+	var resp util.JSONResponse
+
+	if len(req.ClientSecret) == 0 {
+		resp = common.MissingParamsError("client_secret")
+		return &resp
+	}
+
+	if len(req.Email) == 0 {
+		resp = common.MissingParamsError("email")
+		return &resp
+	}
+
+	if !isClientSecretValid(req.ClientSecret) {
+		resp = common.InvalidParamError("Invalid client secret")
+		return &resp
+	}
+
+	if !common.IsEmailAddressValid(req.Email) {
+		resp = util.JSONResponse{
+			Code: 400,
+			JSON: gomatrix.RespError{
+				ErrCode: "M_INVALID_EMAIL",
+				Err:     "Invalid email address",
+			},
+		}
+		return &resp
+	}
+
+	return nil
+}
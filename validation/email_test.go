@@ -0,0 +1,35 @@
+package validation
+
+import (
+	"testing"
+
+	"github.com/matrix-org/gomatrix"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckRequestEmailTokenReq(t *testing.T) {
+	req := &RequestEmailTokenReq{
+		ClientSecret: "somesecret",
+		Email:        "alice@example.com",
+		SendAttempt:  1,
+	}
+
+	require.Nil(t, checkRequestEmailTokenReq(req))
+
+	req.Email = "alice@example.com@otherdomain.com"
+	resp := checkRequestEmailTokenReq(req)
+	require.NotNil(t, resp)
+	require.Equal(t, "M_INVALID_EMAIL", resp.JSON.(gomatrix.RespError).ErrCode)
+
+	req.ClientSecret = "some secret"
+	resp = checkRequestEmailTokenReq(req)
+	require.NotNil(t, resp)
+	require.Equal(t, "M_INVALID_PARAM", resp.JSON.(gomatrix.RespError).ErrCode)
+	require.Equal(t, "Invalid client secret", resp.JSON.(gomatrix.RespError).Err)
+
+	req.Email = ""
+	resp = checkRequestEmailTokenReq(req)
+	require.NotNil(t, resp)
+	require.Equal(t, "M_MISSING_PARAMS", resp.JSON.(gomatrix.RespError).ErrCode)
+	require.Equal(t, "Missing params: email", resp.JSON.(gomatrix.RespError).Err)
+}
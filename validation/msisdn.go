@@ -0,0 +1,140 @@
+package validation
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/babolivier/ident/common"
+	"github.com/babolivier/ident/common/config"
+	"github.com/babolivier/ident/common/constants"
+	"github.com/babolivier/ident/common/crypto"
+	"github.com/babolivier/ident/common/database"
+	"github.com/babolivier/ident/common/sms"
+	"github.com/babolivier/ident/common/templates"
+
+	"github.com/matrix-org/gomatrix"
+	"github.com/matrix-org/util"
+	"github.com/sirupsen/logrus"
+)
+
+// The token sent by SMS is a numeric code the user types in, so it needs to be short.
+const msisdnTokenLength = 6
+
+type RequestMSISDNTokenReq struct {
+	ClientSecret string `json:"client_secret"`
+	Country      string `json:"country"`
+	PhoneNumber  string `json:"phone_number"`
+	SendAttempt  int    `json:"send_attempt"`
+	NextLink     string `json:"next_link"`
+}
+
+type RequestMSISDNTokenResp struct {
+	RequestTokenResp
+	MSISDN  string `json:"msisdn"`
+	IntlFmt string `json:"intl_fmt"`
+}
+
+// Data given to the template of the validation text message.
+type smsTemplateData struct {
+	MSISDN string
+	Token  string
+}
+
+func RequestMSISDNToken(r *http.Request, cfg *config.Config, db database.Database) util.JSONResponse {
+	// Check if we have a request body.
+	if r.Body == nil {
+		return util.JSONResponse{
+			Code: 400,
+			JSON: gomatrix.RespError{
+				ErrCode: "M_MISSING_PARAMS",
+				Err:     "Missing request body",
+			},
+		}
+	}
+
+	defer r.Body.Close()
+
+	// Load the body's JSON into an instance of RequestMSISDNTokenReq.
+	var req RequestMSISDNTokenReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return common.InternalServerError(err)
+	}
+
+	// Check that the request params are valid.
+	if resp := checkRequestMSISDNTokenReq(&req); resp != nil {
+		return *resp
+	}
+
+	// Check that we can actually send text messages.
+	if !sms.Enabled(cfg) {
+		return util.JSONResponse{
+			Code: 400,
+			JSON: gomatrix.RespError{
+				ErrCode: "M_UNRECOGNIZED",
+				Err:     "This server doesn't support validating phone numbers",
+			},
+		}
+	}
+
+	msisdn, err := sms.NormalisePhoneNumber(req.Country, req.PhoneNumber)
+	if err != nil {
+		return util.JSONResponse{
+			Code: 400,
+			JSON: gomatrix.RespError{
+				ErrCode: "M_INVALID_PHONE_NUMBER",
+				Err:     err.Error(),
+			},
+		}
+	}
+
+	session, send, err := getOrCreateSession(
+		db, req.ClientSecret, constants.MediumMSISDN, msisdn, req.SendAttempt, req.NextLink,
+		func() (string, error) { return crypto.RandDigits(msisdnTokenLength) },
+	)
+	if err != nil {
+		return common.InternalServerError(err)
+	}
+
+	// Send the validation text message if needed.
+	if send {
+		data := smsTemplateData{
+			MSISDN: session.Address,
+			Token:  session.Token,
+		}
+
+		if err = sms.SendSMS(cfg, session.Address, templates.ValidationSMS, &data); err != nil {
+			logrus.WithError(err).Error("Couldn't send validation text message")
+			return common.InternalServerError(err)
+		}
+	}
+
+	return util.JSONResponse{
+		Code: 200,
+		JSON: RequestMSISDNTokenResp{
+			RequestTokenResp: RequestTokenResp{SID: session.ID},
+			MSISDN:           msisdn,
+			IntlFmt:          "+" + msisdn,
+		},
+	}
+}
+
+func checkRequestMSISDNTokenReq(req *RequestMSISDNTokenReq) *util.JSONResponse {
+	var resp util.JSONResponse
+
+	if len(req.ClientSecret) == 0 {
+		resp = common.MissingParamsError("client_secret")
+		return &resp
+	}
+
+	if len(req.PhoneNumber) == 0 {
+		resp = common.MissingParamsError("phone_number")
+		return &resp
+	}
+
+	if !isClientSecretValid(req.ClientSecret) {
+		resp = common.InvalidParamError("Invalid client secret")
+		return &resp
+	}
+
+	return nil
+}
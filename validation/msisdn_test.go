@@ -0,0 +1,30 @@
+package validation
+
+import (
+	"testing"
+
+	"github.com/matrix-org/gomatrix"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckRequestMSISDNTokenReq(t *testing.T) {
+	req := &RequestMSISDNTokenReq{
+		ClientSecret: "somesecret",
+		Country:      "GB",
+		PhoneNumber:  "07700900123",
+		SendAttempt:  1,
+	}
+
+	require.Nil(t, checkRequestMSISDNTokenReq(req))
+
+	req.ClientSecret = "some secret"
+	resp := checkRequestMSISDNTokenReq(req)
+	require.NotNil(t, resp)
+	require.Equal(t, "M_INVALID_PARAM", resp.JSON.(gomatrix.RespError).ErrCode)
+
+	req.PhoneNumber = ""
+	resp = checkRequestMSISDNTokenReq(req)
+	require.NotNil(t, resp)
+	require.Equal(t, "M_MISSING_PARAMS", resp.JSON.(gomatrix.RespError).ErrCode)
+	require.Equal(t, "Missing params: phone_number", resp.JSON.(gomatrix.RespError).Err)
+}
@@ -0,0 +1,68 @@
+package validation
+
+import (
+	"net/http"
+
+	"github.com/babolivier/ident/common"
+	"github.com/babolivier/ident/common/config"
+	"github.com/babolivier/ident/common/database"
+
+	"github.com/gorilla/mux"
+	"github.com/matrix-org/util"
+)
+
+func SetupRouting(router *mux.Router, cfg *config.Config, db database.Database) {
+	router.Handle("/validate/email/requestToken", common.MakeAPI(func(r *http.Request) util.JSONResponse {
+		return RequestEmailToken(r, cfg, db)
+	})).Methods(http.MethodOptions, http.MethodPost)
+
+	router.Handle("/validate/email/submitToken", common.MakeAPI(func(r *http.Request) util.JSONResponse {
+		return SubmitToken(r, db)
+	})).Methods(http.MethodOptions, http.MethodPost)
+
+	// This is the route the link included in the validation email points to.
+	router.Handle("/validate/email/submitToken", common.MakeAPI(func(r *http.Request) util.JSONResponse {
+		return SubmitTokenFromLink(r, db)
+	})).Methods(http.MethodGet)
+
+	router.Handle("/validate/msisdn/requestToken", common.MakeAPI(func(r *http.Request) util.JSONResponse {
+		return RequestMSISDNToken(r, cfg, db)
+	})).Methods(http.MethodOptions, http.MethodPost)
+
+	router.Handle("/validate/msisdn/submitToken", common.MakeAPI(func(r *http.Request) util.JSONResponse {
+		return SubmitToken(r, db)
+	})).Methods(http.MethodOptions, http.MethodPost)
+
+	router.Handle("/3pid/getValidated3pid", common.MakeAPI(func(r *http.Request) util.JSONResponse {
+		return GetValidated3PID(r, db)
+	})).Methods(http.MethodGet)
+}
+
+// SetupRoutingV2 registers the same routes as SetupRouting, but requires the requests to be authenticated as per the
+// v2 API. The route the link in the validation email points to stays unauthenticated, since it's meant to be opened
+// in a web browser.
+func SetupRoutingV2(router *mux.Router, cfg *config.Config, db database.Database) {
+	router.Handle("/validate/email/requestToken", common.MakeAuthAPI(cfg, db, func(r *http.Request, userID string) util.JSONResponse {
+		return RequestEmailToken(r, cfg, db)
+	})).Methods(http.MethodOptions, http.MethodPost)
+
+	router.Handle("/validate/email/submitToken", common.MakeAuthAPI(cfg, db, func(r *http.Request, userID string) util.JSONResponse {
+		return SubmitToken(r, db)
+	})).Methods(http.MethodOptions, http.MethodPost)
+
+	router.Handle("/validate/email/submitToken", common.MakeAPI(func(r *http.Request) util.JSONResponse {
+		return SubmitTokenFromLink(r, db)
+	})).Methods(http.MethodGet)
+
+	router.Handle("/validate/msisdn/requestToken", common.MakeAuthAPI(cfg, db, func(r *http.Request, userID string) util.JSONResponse {
+		return RequestMSISDNToken(r, cfg, db)
+	})).Methods(http.MethodOptions, http.MethodPost)
+
+	router.Handle("/validate/msisdn/submitToken", common.MakeAuthAPI(cfg, db, func(r *http.Request, userID string) util.JSONResponse {
+		return SubmitToken(r, db)
+	})).Methods(http.MethodOptions, http.MethodPost)
+
+	router.Handle("/3pid/getValidated3pid", common.MakeAuthAPI(cfg, db, func(r *http.Request, userID string) util.JSONResponse {
+		return GetValidated3PID(r, db)
+	})).Methods(http.MethodGet)
+}
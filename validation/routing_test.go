@@ -0,0 +1,417 @@
+package validation
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/babolivier/ident/common"
+	"github.com/babolivier/ident/common/config"
+	"github.com/babolivier/ident/common/constants"
+	"github.com/babolivier/ident/common/crypto"
+	"github.com/babolivier/ident/common/database"
+	"github.com/babolivier/ident/common/testutils"
+	"github.com/babolivier/ident/common/types"
+
+	"github.com/matrix-org/gomatrix"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRequestEmailToken(t *testing.T) {
+	cfg := testutils.NewTestConfig(t)
+
+	validationTXT, err := ioutil.ReadFile("../templates/text/validation.txt")
+	require.Nil(t, err, err)
+
+	files := map[string]string{cfg.Ident.Validation.Email.EmailTemplate.Text: string(validationTXT)}
+
+	testutils.TestWithTemplates(t, func(t *testing.T) {
+		smtpServer := testutils.NewTestSMTPServer(t, nil)
+		defer smtpServer.Close()
+
+		// Work on a copy of the configuration, so other tests keep using the file transport.
+		smtpCfg := *cfg
+		smtpServer.Configure(&smtpCfg)
+
+		db := testutils.NewTestDB(t)
+		s := testutils.NewTestServer(&smtpCfg, db, SetupRouting)
+		defer s.Close()
+
+		testRequestEmailToken(t, s, smtpServer)
+	}, files)
+}
+
+func testRequestEmailToken(t *testing.T, s *httptest.Server, smtpServer *testutils.TestSMTPServer) {
+	requestTokenURL := s.URL + path.Join(constants.APIPrefix, "validate/email/requestToken")
+	contentType := "application/json"
+
+	req := RequestEmailTokenReq{
+		ClientSecret: "somesecret",
+		Email:        "alice@example.com",
+		SendAttempt:  1,
+	}
+
+	resp, err := http.Post(requestTokenURL, contentType, structToIOReader(t, &req))
+	require.Nil(t, err, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var requestTokenResp RequestTokenResp
+	httpRespToStruct(t, resp, &requestTokenResp)
+	require.NotEmpty(t, requestTokenResp.SID)
+
+	received := smtpServer.LastEmailTo(t, req.Email)
+	require.Equal(t, "ident@example.com", received.From)
+	require.Len(t, smtpServer.Emails(), 1)
+
+	// Test that requesting a token again with the same attempt doesn't send another email.
+	resp, err = http.Post(requestTokenURL, contentType, structToIOReader(t, &req))
+	require.Nil(t, err, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Len(t, smtpServer.Emails(), 1)
+
+	// Test that the link from the email validates the session.
+	link := received.Link(t, "submitToken")
+	linkURL, err := url.Parse(link)
+	require.Nil(t, err, err)
+	require.Equal(t, requestTokenResp.SID, linkURL.Query().Get("sid"))
+	require.Equal(t, req.ClientSecret, linkURL.Query().Get("client_secret"))
+
+	resp, err = http.Get(s.URL + linkURL.RequestURI())
+	require.Nil(t, err, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var submitTokenResp SubmitTokenResp
+	httpRespToStruct(t, resp, &submitTokenResp)
+	require.True(t, submitTokenResp.Success)
+}
+
+func TestRequestEmailTokenDisabled(t *testing.T) {
+	testutils.TestWithTestServer(t, testRequestEmailTokenDisabled, SetupRouting)
+}
+
+func testRequestEmailTokenDisabled(t *testing.T, cfg *config.Config, db database.Database, s *httptest.Server) {
+	requestTokenURL := s.URL + path.Join(constants.APIPrefix, "validate/email/requestToken")
+	contentType := "application/json"
+
+	cfg.Email.Disabled = true
+	defer func() { cfg.Email.Disabled = false }()
+
+	// Test that email addresses can't be validated if sending emails is disabled.
+	req := RequestEmailTokenReq{
+		ClientSecret: "somesecret",
+		Email:        "alice@example.com",
+		SendAttempt:  1,
+	}
+
+	resp, err := http.Post(requestTokenURL, contentType, structToIOReader(t, &req))
+	require.Nil(t, err, err)
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	var respError gomatrix.RespError
+	httpRespToStruct(t, resp, &respError)
+	require.Equal(t, "M_UNRECOGNIZED", respError.ErrCode)
+}
+
+func TestSubmitToken(t *testing.T) {
+	testutils.TestWithTestServer(t, testSubmitToken, SetupRouting)
+}
+
+func testSubmitToken(t *testing.T, cfg *config.Config, db database.Database, s *httptest.Server) {
+	submitTokenURL := s.URL + path.Join(constants.APIPrefix, "validate/email/submitToken")
+	getValidatedURL := s.URL + path.Join(constants.APIPrefix, "3pid/getValidated3pid")
+	contentType := "application/json"
+
+	session := saveTestSession(t, db, "")
+
+	var respError gomatrix.RespError
+
+	// Test that the session isn't considered as validated before the token has been submitted.
+	resp, err := http.Get(getValidatedURL + "?" + sessionQuery(session).Encode())
+	require.Nil(t, err, err)
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	httpRespToStruct(t, resp, &respError)
+	require.Equal(t, "M_SESSION_NOT_VALIDATED", respError.ErrCode)
+
+	// Test that submitting the wrong token results in an error.
+	req := SubmitTokenReq{
+		SID:          session.ID,
+		ClientSecret: session.ClientSecret,
+		Token:        "wrongtoken",
+	}
+
+	resp, err = http.Post(submitTokenURL, contentType, structToIOReader(t, &req))
+	require.Nil(t, err, err)
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	httpRespToStruct(t, resp, &respError)
+	require.Equal(t, "M_INVALID_PARAM", respError.ErrCode)
+
+	// Test that submitting a token for an unknown session results in an error.
+	req.SID = "unknownsid"
+	req.Token = session.Token
+
+	resp, err = http.Post(submitTokenURL, contentType, structToIOReader(t, &req))
+	require.Nil(t, err, err)
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	httpRespToStruct(t, resp, &respError)
+	require.Equal(t, "M_NO_VALID_SESSION", respError.ErrCode)
+
+	// Test that submitting the right token validates the session.
+	req.SID = session.ID
+
+	var submitTokenResp SubmitTokenResp
+	resp, err = http.Post(submitTokenURL, contentType, structToIOReader(t, &req))
+	require.Nil(t, err, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	httpRespToStruct(t, resp, &submitTokenResp)
+	require.True(t, submitTokenResp.Success)
+
+	var getValidatedResp GetValidated3PIDResp
+	resp, err = http.Get(getValidatedURL + "?" + sessionQuery(session).Encode())
+	require.Nil(t, err, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	httpRespToStruct(t, resp, &getValidatedResp)
+	require.Equal(t, session.Medium, getValidatedResp.Medium)
+	require.Equal(t, session.Address, getValidatedResp.Address)
+	require.NotZero(t, getValidatedResp.ValidatedAt)
+}
+
+func TestSubmitTokenFromLink(t *testing.T) {
+	testutils.TestWithTestServer(t, testSubmitTokenFromLink, SetupRouting)
+}
+
+func testSubmitTokenFromLink(t *testing.T, cfg *config.Config, db database.Database, s *httptest.Server) {
+	submitTokenURL := s.URL + path.Join(constants.APIPrefix, "validate/email/submitToken")
+
+	// Test that clicking the link validates the session.
+	session := saveTestSession(t, db, "")
+
+	query := sessionQuery(session)
+	query.Set("token", session.Token)
+
+	var submitTokenResp SubmitTokenResp
+	resp, err := http.Get(submitTokenURL + "?" + query.Encode())
+	require.Nil(t, err, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	httpRespToStruct(t, resp, &submitTokenResp)
+	require.True(t, submitTokenResp.Success)
+
+	// Test that clicking the link redirects to the next link if the client provided one.
+	nextLink := "https://example.com/validated"
+	session = saveTestSession(t, db, nextLink)
+
+	query = sessionQuery(session)
+	query.Set("token", session.Token)
+
+	client := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	resp, err = client.Get(submitTokenURL + "?" + query.Encode())
+	require.Nil(t, err, err)
+	require.Equal(t, http.StatusFound, resp.StatusCode)
+	require.Equal(t, nextLink, resp.Header.Get("Location"))
+}
+
+func TestMSISDNValidation(t *testing.T) {
+	testutils.TestWithTestServer(t, testMSISDNValidation, SetupRouting)
+}
+
+func testMSISDNValidation(t *testing.T, cfg *config.Config, db database.Database, s *httptest.Server) {
+	requestTokenURL := s.URL + path.Join(constants.APIPrefix, "validate/msisdn/requestToken")
+	submitTokenURL := s.URL + path.Join(constants.APIPrefix, "validate/msisdn/submitToken")
+	getValidatedURL := s.URL + path.Join(constants.APIPrefix, "3pid/getValidated3pid")
+	contentType := "application/json"
+
+	var respError gomatrix.RespError
+
+	// Test that an invalid phone number results in an error.
+	req := RequestMSISDNTokenReq{
+		ClientSecret: "somesecret",
+		Country:      "GB",
+		PhoneNumber:  "not a number",
+		SendAttempt:  1,
+	}
+
+	resp, err := http.Post(requestTokenURL, contentType, structToIOReader(t, &req))
+	require.Nil(t, err, err)
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	httpRespToStruct(t, resp, &respError)
+	require.Equal(t, "M_INVALID_PHONE_NUMBER", respError.ErrCode)
+
+	// Test that requesting a token sends it by SMS to the normalised phone number.
+	req.PhoneNumber = "07700 900 001"
+
+	var requestTokenResp RequestMSISDNTokenResp
+	resp, err = http.Post(requestTokenURL, contentType, structToIOReader(t, &req))
+	require.Nil(t, err, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	httpRespToStruct(t, resp, &requestTokenResp)
+	require.NotEmpty(t, requestTokenResp.SID)
+	require.Equal(t, "447700900001", requestTokenResp.MSISDN)
+	require.Equal(t, "+447700900001", requestTokenResp.IntlFmt)
+
+	body := testutils.LastTestSMS(t, cfg, requestTokenResp.MSISDN)
+	prefix := "Your Matrix validation code is "
+	require.True(t, strings.HasPrefix(body, prefix), body)
+
+	token := strings.TrimPrefix(body, prefix)
+	require.Len(t, token, msisdnTokenLength)
+
+	// Test that submitting the token validates the session.
+	submitReq := SubmitTokenReq{
+		SID:          requestTokenResp.SID,
+		ClientSecret: req.ClientSecret,
+		Token:        token,
+	}
+
+	resp, err = http.Post(submitTokenURL, contentType, structToIOReader(t, &submitReq))
+	require.Nil(t, err, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	query := url.Values{}
+	query.Set("sid", requestTokenResp.SID)
+	query.Set("client_secret", req.ClientSecret)
+
+	var getValidatedResp GetValidated3PIDResp
+	resp, err = http.Get(getValidatedURL + "?" + query.Encode())
+	require.Nil(t, err, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	httpRespToStruct(t, resp, &getValidatedResp)
+	require.Equal(t, constants.MediumMSISDN, getValidatedResp.Medium)
+	require.Equal(t, "447700900001", getValidatedResp.Address)
+}
+
+func TestMSISDNValidationTooManyAttempts(t *testing.T) {
+	testutils.TestWithTestServer(t, testMSISDNValidationTooManyAttempts, SetupRouting)
+}
+
+func testMSISDNValidationTooManyAttempts(
+	t *testing.T, cfg *config.Config, db database.Database, s *httptest.Server,
+) {
+	requestTokenURL := s.URL + path.Join(constants.APIPrefix, "validate/msisdn/requestToken")
+	submitTokenURL := s.URL + path.Join(constants.APIPrefix, "validate/msisdn/submitToken")
+	contentType := "application/json"
+
+	req := RequestMSISDNTokenReq{
+		ClientSecret: "somesecret",
+		Country:      "GB",
+		PhoneNumber:  "07700 900 002",
+		SendAttempt:  1,
+	}
+
+	// requestToken requests a token and returns the session ID and the token sent by SMS.
+	requestToken := func() (string, string) {
+		resp, err := http.Post(requestTokenURL, contentType, structToIOReader(t, &req))
+		require.Nil(t, err, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+
+		var requestTokenResp RequestMSISDNTokenResp
+		httpRespToStruct(t, resp, &requestTokenResp)
+
+		body := testutils.LastTestSMS(t, cfg, requestTokenResp.MSISDN)
+		return requestTokenResp.SID, strings.TrimPrefix(body, "Your Matrix validation code is ")
+	}
+
+	// submitToken submits the given token and returns the error code of the response, if any.
+	submitToken := func(sid, token string) string {
+		submitReq := SubmitTokenReq{SID: sid, ClientSecret: req.ClientSecret, Token: token}
+
+		resp, err := http.Post(submitTokenURL, contentType, structToIOReader(t, &submitReq))
+		require.Nil(t, err, err)
+		if resp.StatusCode == http.StatusOK {
+			return ""
+		}
+
+		var respError gomatrix.RespError
+		httpRespToStruct(t, resp, &respError)
+		return respError.ErrCode
+	}
+
+	sid, token := requestToken()
+
+	// Build a wrong token by changing the last digit of the right one.
+	wrongToken := token[:len(token)-1] + string('0'+(token[len(token)-1]-'0'+1)%10)
+
+	for i := 0; i < MaxTokenAttempts; i++ {
+		require.Equal(t, "M_INVALID_PARAM", submitToken(sid, wrongToken))
+	}
+
+	// Test that the right token is rejected once the limit is reached, and that the session isn't validated.
+	require.Equal(t, "M_SESSION_EXPIRED", submitToken(sid, token))
+
+	session, err := db.GetValidationSession(sid, req.ClientSecret)
+	require.Nil(t, err, err)
+	require.False(t, session.Validated())
+
+	// Test that requesting a token again starts a new session with a new token.
+	req.SendAttempt++
+	newSID, newToken := requestToken()
+	require.NotEqual(t, sid, newSID)
+	require.Equal(t, "", submitToken(newSID, newToken))
+}
+
+func saveTestSession(t *testing.T, db database.Database, nextLink string) *types.ValidationSession {
+	sid, err := crypto.RandString(32)
+	require.Nil(t, err, err)
+
+	session := &types.ValidationSession{
+		ID:           sid,
+		Medium:       constants.MediumEmail,
+		Address:      "alice@example.com",
+		ClientSecret: "somesecret",
+		Token:        "sometoken",
+		SendAttempt:  1,
+		NextLink:     nextLink,
+		CreatedAt:    common.NowMS(),
+	}
+
+	err = db.SaveValidationSession(session)
+	require.Nil(t, err, err)
+
+	return session
+}
+
+func sessionQuery(session *types.ValidationSession) url.Values {
+	query := url.Values{}
+	query.Set("sid", session.ID)
+	query.Set("client_secret", session.ClientSecret)
+	return query
+}
+
+func structToIOReader(t *testing.T, req interface{}) io.Reader {
+	jsonBytes, err := json.Marshal(req)
+	require.Nil(t, err, err)
+
+	return bytes.NewReader(jsonBytes)
+}
+
+func httpRespToStruct(t *testing.T, resp *http.Response, instance interface{}) []byte {
+	require.NotNil(t, resp.Body)
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(resp.Body)
+	require.Nil(t, err, err)
+
+	err = json.Unmarshal(b, instance)
+	require.Nil(t, err, err)
+
+	return b
+}
@@ -0,0 +1,320 @@
+package validation
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/babolivier/ident/common"
+	"github.com/babolivier/ident/common/crypto"
+	"github.com/babolivier/ident/common/database"
+	"github.com/babolivier/ident/common/types"
+
+	"github.com/matrix-org/gomatrix"
+	"github.com/matrix-org/util"
+)
+
+// SessionValidationTimeout is the amount of time after its creation during which the token of a session can be
+// submitted.
+const SessionValidationTimeout = 24 * time.Hour
+
+// SessionValidLifetime is the amount of time after its validation during which a session can be used, e.g. to
+// create an association.
+const SessionValidLifetime = 24 * time.Hour
+
+// MaxTokenAttempts is the number of times a token can be submitted for a session. Once it's reached, the session is
+// invalidated, so short tokens (e.g. the codes sent by SMS) can't be guessed.
+const MaxTokenAttempts = 5
+
+// The format of client secrets is defined by the specification.
+// c.f. https://matrix.org/docs/spec/identity_service/r0.2.1#post-matrix-identity-api-v1-validate-email-requesttoken
+var clientSecretRegexp = regexp.MustCompile("^[0-9a-zA-Z.=_-]{1,255}$")
+
+type SubmitTokenReq struct {
+	SID          string `json:"sid"`
+	ClientSecret string `json:"client_secret"`
+	Token        string `json:"token"`
+}
+
+type SubmitTokenResp struct {
+	Success bool `json:"success"`
+}
+
+type GetValidated3PIDResp struct {
+	Medium      string `json:"medium"`
+	Address     string `json:"address"`
+	ValidatedAt int64  `json:"validated_at"`
+}
+
+func SubmitToken(r *http.Request, db database.Database) util.JSONResponse {
+	// Check if we have a request body.
+	if r.Body == nil {
+		return util.JSONResponse{
+			Code: 400,
+			JSON: gomatrix.RespError{
+				ErrCode: "M_MISSING_PARAMS",
+				Err:     "Missing request body",
+			},
+		}
+	}
+
+	defer r.Body.Close()
+
+	// Load the body's JSON into an instance of SubmitTokenReq.
+	var req SubmitTokenReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return common.InternalServerError(err)
+	}
+
+	_, resp := submitToken(&req, db)
+	return resp
+}
+
+func SubmitTokenFromLink(r *http.Request, db database.Database) util.JSONResponse {
+	query := r.URL.Query()
+	req := SubmitTokenReq{
+		SID:          query.Get("sid"),
+		ClientSecret: query.Get("client_secret"),
+		Token:        query.Get("token"),
+	}
+
+	session, resp := submitToken(&req, db)
+
+	// If the client provided a link to redirect the user to once the session is validated, do so.
+	if session != nil && len(session.NextLink) > 0 {
+		return util.RedirectResponse(session.NextLink)
+	}
+
+	return resp
+}
+
+func submitToken(req *SubmitTokenReq, db database.Database) (*types.ValidationSession, util.JSONResponse) {
+	if resp := checkSubmitTokenReq(req); resp != nil {
+		return nil, *resp
+	}
+
+	session, err := db.GetValidationSession(req.SID, req.ClientSecret)
+	if err != nil {
+		return nil, common.InternalServerError(err)
+	}
+
+	if session == nil {
+		return nil, noValidSessionError()
+	}
+
+	// Submitting the token again for a session that's already been validated is a no-op.
+	if session.Validated() {
+		return session, util.JSONResponse{
+			Code: 200,
+			JSON: SubmitTokenResp{Success: true},
+		}
+	}
+
+	if isExpired(session.CreatedAt, SessionValidationTimeout) {
+		return nil, sessionExpiredError()
+	}
+
+	// Count the attempt before checking the token, so concurrent attempts can't get past the limit.
+	ok, err := db.AddValidationSessionTokenAttempt(session.ID, MaxTokenAttempts)
+	if err != nil {
+		return nil, common.InternalServerError(err)
+	}
+
+	if !ok {
+		return nil, tooManyAttemptsError()
+	}
+
+	// Compare the tokens in constant time, so how long the comparison takes doesn't tell how much of the token matches.
+	if subtle.ConstantTimeCompare([]byte(req.Token), []byte(session.Token)) != 1 {
+		return nil, util.JSONResponse{
+			Code: 400,
+			JSON: gomatrix.RespError{
+				ErrCode: "M_INVALID_PARAM",
+				Err:     "Invalid token",
+			},
+		}
+	}
+
+	if err = db.MarkValidationSessionValidated(session.ID, common.NowMS()); err != nil {
+		return nil, common.InternalServerError(err)
+	}
+
+	return session, util.JSONResponse{
+		Code: 200,
+		JSON: SubmitTokenResp{Success: true},
+	}
+}
+
+func checkSubmitTokenReq(req *SubmitTokenReq) *util.JSONResponse {
+	var resp util.JSONResponse
+
+	if len(req.SID) == 0 {
+		resp = common.MissingParamsError("sid")
+		return &resp
+	}
+
+	if len(req.ClientSecret) == 0 {
+		resp = common.MissingParamsError("client_secret")
+		return &resp
+	}
+
+	if len(req.Token) == 0 {
+		resp = common.MissingParamsError("token")
+		return &resp
+	}
+
+	return nil
+}
+
+func GetValidated3PID(r *http.Request, db database.Database) util.JSONResponse {
+	query := r.URL.Query()
+
+	session, resp := GetValidatedSession(query.Get("sid"), query.Get("client_secret"), db)
+	if resp != nil {
+		return *resp
+	}
+
+	return util.JSONResponse{
+		Code: 200,
+		JSON: GetValidated3PIDResp{
+			Medium:      session.Medium,
+			Address:     session.Address,
+			ValidatedAt: session.ValidatedAt,
+		},
+	}
+}
+
+// GetValidatedSession retrieves the session matching the provided session ID and client secret, and checks that it
+// has been validated and that its validation hasn't expired. If one of these checks fails, or if there was an error
+// retrieving the session, returns with a non-nil response to send back to the client.
+func GetValidatedSession(sid, clientSecret string, db database.Database) (*types.ValidationSession, *util.JSONResponse) {
+	var resp util.JSONResponse
+
+	if len(sid) == 0 {
+		resp = common.MissingParamsError("sid")
+		return nil, &resp
+	}
+
+	if len(clientSecret) == 0 {
+		resp = common.MissingParamsError("client_secret")
+		return nil, &resp
+	}
+
+	session, err := db.GetValidationSession(sid, clientSecret)
+	if err != nil {
+		resp = common.InternalServerError(err)
+		return nil, &resp
+	}
+
+	if session == nil {
+		resp = noValidSessionError()
+		return nil, &resp
+	}
+
+	if !session.Validated() {
+		resp = util.JSONResponse{
+			Code: 400,
+			JSON: gomatrix.RespError{
+				ErrCode: "M_SESSION_NOT_VALIDATED",
+				Err:     "This validation session has not yet been completed",
+			},
+		}
+		return nil, &resp
+	}
+
+	if isExpired(session.ValidatedAt, SessionValidLifetime) {
+		resp = sessionExpiredError()
+		return nil, &resp
+	}
+
+	return session, nil
+}
+
+// getOrCreateSession looks for an ongoing session for the given client secret and 3PID and creates a new one if
+// none could be found. Also returns whether a message containing the session's token needs to be sent to the 3PID,
+// i.e. if the session is new or if the client incremented the send attempt.
+func getOrCreateSession(
+	db database.Database, clientSecret, medium, address string, sendAttempt int, nextLink string,
+	newToken func() (string, error),
+) (session *types.ValidationSession, send bool, err error) {
+	session, err = db.GetValidationSessionForThreepid(clientSecret, medium, address)
+	if err != nil {
+		return
+	}
+
+	// Reuse the existing session if it can still be validated.
+	if session != nil && !session.Validated() && !isExpired(session.CreatedAt, SessionValidationTimeout) &&
+		session.TokenAttempts < MaxTokenAttempts {
+		if sendAttempt <= session.SendAttempt {
+			return session, false, nil
+		}
+
+		session.SendAttempt = sendAttempt
+		err = db.UpdateValidationSessionSendAttempt(session.ID, sendAttempt)
+		return session, true, err
+	}
+
+	sid, err := crypto.RandString(32)
+	if err != nil {
+		return
+	}
+
+	token, err := newToken()
+	if err != nil {
+		return
+	}
+
+	session = &types.ValidationSession{
+		ID:           sid,
+		Medium:       medium,
+		Address:      address,
+		ClientSecret: clientSecret,
+		Token:        token,
+		SendAttempt:  sendAttempt,
+		NextLink:     nextLink,
+		CreatedAt:    common.NowMS(),
+	}
+
+	err = db.SaveValidationSession(session)
+	return session, true, err
+}
+
+func isClientSecretValid(clientSecret string) bool {
+	return clientSecretRegexp.MatchString(clientSecret)
+}
+
+func isExpired(ts int64, lifetime time.Duration) bool {
+	return common.NowMS() > ts+int64(lifetime/time.Millisecond)
+}
+
+func noValidSessionError() util.JSONResponse {
+	return util.JSONResponse{
+		Code: 404,
+		JSON: gomatrix.RespError{
+			ErrCode: "M_NO_VALID_SESSION",
+			Err:     "No valid session was found matching that sid and client secret",
+		},
+	}
+}
+
+func sessionExpiredError() util.JSONResponse {
+	return util.JSONResponse{
+		Code: 400,
+		JSON: gomatrix.RespError{
+			ErrCode: "M_SESSION_EXPIRED",
+			Err:     "This validation session has expired: call requestToken again",
+		},
+	}
+}
+
+func tooManyAttemptsError() util.JSONResponse {
+	return util.JSONResponse{
+		Code: 400,
+		JSON: gomatrix.RespError{
+			ErrCode: "M_SESSION_EXPIRED",
+			Err:     "Too many invalid tokens were submitted for this validation session: call requestToken again",
+		},
+	}
+}
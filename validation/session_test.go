@@ -0,0 +1,66 @@
+package validation
+
+import (
+	"testing"
+	"time"
+
+	"github.com/babolivier/ident/common"
+	"github.com/babolivier/ident/common/constants"
+	"github.com/babolivier/ident/common/crypto"
+	"github.com/babolivier/ident/common/testutils"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestIsClientSecretValid(t *testing.T) {
+	require.True(t, isClientSecretValid("monkeys_are_GREAT.=-"))
+	require.False(t, isClientSecretValid(""))
+	require.False(t, isClientSecretValid("monkeys are great"))
+	require.False(t, isClientSecretValid("monkeys/are/great"))
+}
+
+func TestIsExpired(t *testing.T) {
+	require.False(t, isExpired(common.NowMS(), time.Hour))
+	require.True(t, isExpired(common.NowMS()-int64(2*time.Hour/time.Millisecond), time.Hour))
+}
+
+func TestGetOrCreateSession(t *testing.T) {
+	db := testutils.NewTestDB(t)
+
+	clientSecret := "somesecret"
+	address := "alice@example.com"
+
+	// Test that a new session is created if there's none for this 3PID.
+	session, send, err := getOrCreateSession(db, clientSecret, constants.MediumEmail, address, 1, "", newTestToken)
+	require.Nil(t, err, err)
+	require.True(t, send)
+	require.Len(t, session.Token, 32)
+	require.Equal(t, 1, session.SendAttempt)
+
+	// Test that the existing session is reused and no message is sent if the send attempt didn't change.
+	sameSession, send, err := getOrCreateSession(db, clientSecret, constants.MediumEmail, address, 1, "", newTestToken)
+	require.Nil(t, err, err)
+	require.False(t, send)
+	require.Equal(t, session.ID, sameSession.ID)
+	require.Equal(t, session.Token, sameSession.Token)
+
+	// Test that the existing session is reused and a message is sent if the send attempt was incremented.
+	sameSession, send, err = getOrCreateSession(db, clientSecret, constants.MediumEmail, address, 2, "", newTestToken)
+	require.Nil(t, err, err)
+	require.True(t, send)
+	require.Equal(t, session.ID, sameSession.ID)
+	require.Equal(t, 2, sameSession.SendAttempt)
+
+	// Test that a new session is created once the existing one has been validated.
+	err = db.MarkValidationSessionValidated(session.ID, common.NowMS())
+	require.Nil(t, err, err)
+
+	otherSession, send, err := getOrCreateSession(db, clientSecret, constants.MediumEmail, address, 2, "", newTestToken)
+	require.Nil(t, err, err)
+	require.True(t, send)
+	require.NotEqual(t, session.ID, otherSession.ID)
+}
+
+func newTestToken() (string, error) {
+	return crypto.RandString(32)
+}